@@ -0,0 +1,350 @@
+package main
+
+import (
+	"backend/password"
+	"backend/profanity"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]{3,24}$`)
+
+// Hashed when logging in to an account that does not exist, so that the response time does not reveal
+// which usernames are registered
+var dummyPasswordHash, _ = password.Hash("not a real password")
+
+type Account struct {
+	Username     string
+	PasswordHash string
+	// Ratings, history and the profile are all stored against the player, so they follow the account
+	PlayerId  string
+	CreatedAt time.Time
+}
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// AccountStore keeps accounts, which are looked up by their username regardless of case
+type AccountStore interface {
+	// CreateAccount saves the account, returning false if its username is already taken
+	CreateAccount(ctx context.Context, account Account) (bool, error)
+	// GetAccount returns the account with the username, or nil if there isn't one
+	GetAccount(ctx context.Context, username string) (*Account, error)
+	DeleteAccount(ctx context.Context, username string) error
+}
+
+func accountKey(username string) string {
+	return "account:" + strings.ToLower(username)
+}
+
+func (store *RedisStore) CreateAccount(ctx context.Context, account Account) (bool, error) {
+	err := store.rdb.JSONSetMode(ctx, accountKey(account.Username), "$", account, "NX").Err()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (store *RedisStore) GetAccount(ctx context.Context, username string) (*Account, error) {
+	return getRedisJson[Account](ctx, store.rdb, accountKey(username))
+}
+
+func (store *RedisStore) DeleteAccount(ctx context.Context, username string) error {
+	return store.rdb.Del(ctx, accountKey(username)).Err()
+}
+
+func (store *MemoryStore) CreateAccount(ctx context.Context, account Account) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, exists := store.accounts[strings.ToLower(account.Username)]; exists {
+		return false, nil
+	}
+
+	accountJson, err := json.Marshal(account)
+	if err != nil {
+		return false, err
+	}
+
+	store.accounts[strings.ToLower(account.Username)] = accountJson
+	return true, nil
+}
+
+func (store *MemoryStore) GetAccount(ctx context.Context, username string) (*Account, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return getMemoryJson[Account](store.accounts, strings.ToLower(username))
+}
+
+func (store *MemoryStore) DeleteAccount(ctx context.Context, username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.accounts, strings.ToLower(username))
+	return nil
+}
+
+func readCredentials(w http.ResponseWriter, r *http.Request) (Credentials, error) {
+	var credentials Credentials
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&credentials)
+	if err != nil {
+		return credentials, errors.New("Invalid credentials, must be a JSON object with a username and password")
+	}
+
+	credentials.Username = strings.TrimSpace(credentials.Username)
+
+	return credentials, nil
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	credentials, err := readCredentials(w, r)
+	if err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	if !usernamePattern.MatchString(credentials.Username) || profanity.Contains(credentials.Username) {
+		WriteError(w, InvalidUsername, "Invalid username, must be between 3 and 24 letters, numbers or underscores")
+		return
+	}
+
+	if len(credentials.Password) < minPasswordLength || len(credentials.Password) > maxPasswordLength {
+		WriteError(w, InvalidPassword, "Invalid password, must be between 8 and 128 characters")
+		return
+	}
+
+	passwordHash, err := password.Hash(credentials.Password)
+	if err != nil {
+		logger.Warn("There was an error hashing password: " + err.Error())
+		WriteError(w, InternalError, "There was an error registering the account")
+		return
+	}
+
+	logger = logger.With(slog.String("username", credentials.Username))
+
+	// The guest's player becomes the account's player, so everything they have done so far is kept
+	account := Account{
+		Username:     credentials.Username,
+		PasswordHash: passwordHash,
+		PlayerId:     id,
+		CreatedAt:    time.Now(),
+	}
+
+	player, err := store.GetPlayer(r.Context(), id)
+	if err != nil {
+		logger.Warn("There was an error registering the account: " + err.Error())
+		WriteError(w, InternalError, "There was an error registering the account")
+		return
+	}
+
+	var validationError ErrorCode
+	if player != nil && player.Username != nil {
+		validationError = AlreadyRegistered
+	}
+
+	// Accounts are kept separately from the player, so the username is claimed first and then given up again if the
+	// player can't take it
+	if len(validationError) == 0 {
+		created, err := store.CreateAccount(r.Context(), account)
+		if err == nil && !created {
+			validationError = UsernameTaken
+		} else if err != nil {
+			logger.Warn("There was an error registering the account: " + err.Error())
+			WriteError(w, InternalError, "There was an error registering the account")
+			return
+		}
+	}
+
+	// The database keeps accounts that the store may since have lost, so it has the final say on whether the username is
+	// taken. It is written before the player takes the username, and both claims are given up if the player can't
+	database := GetDatabaseFromContext(r.Context())
+	if len(validationError) == 0 && database != nil {
+		accountPlayer := NewPlayer(id)
+		if player != nil {
+			accountPlayer = player
+		}
+		accountPlayer.Username = &account.Username
+
+		err = database.SaveAccount(r.Context(), account, *accountPlayer)
+		if errors.Is(err, errAccountExists) {
+			validationError = UsernameTaken
+			store.DeleteAccount(r.Context(), account.Username)
+		} else if err != nil {
+			store.DeleteAccount(r.Context(), account.Username)
+			logger.Warn("There was an error registering the account: " + err.Error())
+			WriteError(w, InternalError, "There was an error registering the account")
+			return
+		}
+	}
+
+	if len(validationError) == 0 {
+		err = store.UpdatePlayer(r.Context(), id, func(tx PlayerTx) error {
+			validationError = ""
+
+			player, err := tx.GetPlayer(r.Context())
+			if err != nil {
+				return err
+			}
+
+			if player == nil {
+				player = NewPlayer(id)
+			}
+
+			if player.Username != nil {
+				validationError = AlreadyRegistered
+				return nil
+			}
+
+			player.Username = &account.Username
+			tx.SetPlayer(*player)
+
+			return nil
+		})
+
+		if err != nil || len(validationError) > 0 {
+			store.DeleteAccount(r.Context(), account.Username)
+			if database != nil {
+				database.DeleteAccount(r.Context(), account.Username)
+			}
+		}
+
+		if err != nil {
+			logger.Warn("There was an error registering the account: " + err.Error())
+			WriteError(w, InternalError, "There was an error registering the account")
+			return
+		}
+	}
+
+	if validationError == AlreadyRegistered {
+		WriteError(w, AlreadyRegistered, "Unable to register, you already have an account")
+		return
+	}
+
+	if validationError == UsernameTaken {
+		WriteError(w, UsernameTaken, "Unable to register, the username "+account.Username+" is taken")
+		return
+	}
+
+	logger.Info("Registered account")
+	WriteJson(w, struct {
+		Username string
+		PlayerId string
+	}{
+		Username: account.Username,
+		PlayerId: account.PlayerId,
+	})
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	credentials, err := readCredentials(w, r)
+	if err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	stored, err := store.GetAccount(r.Context(), credentials.Username)
+	if err != nil {
+		logger.Warn("There was an error fetching account: " + err.Error())
+		WriteError(w, InternalError, "There was an error logging in")
+		return
+	}
+
+	var account Account
+	passwordHash := dummyPasswordHash
+	if stored != nil {
+		account = *stored
+		passwordHash = account.PasswordHash
+	} else if database := GetDatabaseFromContext(r.Context()); database != nil {
+		stored, err := database.GetAccount(r.Context(), credentials.Username)
+		if err != nil {
+			logger.Warn("There was an error fetching account: " + err.Error())
+			WriteError(w, InternalError, "There was an error logging in")
+			return
+		}
+
+		if stored != nil {
+			account = *stored
+			passwordHash = account.PasswordHash
+		}
+	}
+
+	matches, err := password.Verify(credentials.Password, passwordHash)
+	if err != nil {
+		logger.Warn("There was an error verifying password: " + err.Error())
+		WriteError(w, InternalError, "There was an error logging in")
+		return
+	}
+
+	if len(account.PasswordHash) == 0 || !matches {
+		logger.Debug("Failed login attempt for " + credentials.Username)
+		WriteError(w, InvalidCredentials, "Invalid username or password")
+		return
+	}
+
+	sessions := GetSessionsFromContext(r.Context())
+	currentSession := GetSessionFromContext(r.Context())
+
+	_, err = sessions.StartSession(w, r, account.PlayerId)
+	if err != nil {
+		logger.Warn("There was an error starting session: " + err.Error())
+		WriteError(w, InternalError, "There was an error logging in")
+		return
+	}
+
+	err = sessions.Revoke(r.Context(), currentSession.PlayerId, currentSession.SessionId)
+	if err != nil {
+		logger.Warn("There was an error revoking guest session: " + err.Error())
+	}
+
+	logger.Info("Logged in as " + account.Username)
+
+	// The client reconnects to the WebSocket server to receive updates as the account's player
+	WriteJson(w, struct {
+		Username string
+		PlayerId string
+	}{
+		Username: account.Username,
+		PlayerId: account.PlayerId,
+	})
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	sessions := GetSessionsFromContext(r.Context())
+	session := GetSessionFromContext(r.Context())
+
+	err := sessions.Revoke(r.Context(), session.PlayerId, session.SessionId)
+	if err != nil {
+		logger.Warn("There was an error revoking session: " + err.Error())
+		WriteError(w, InternalError, "There was an error logging out")
+		return
+	}
+
+	// The client continues as a new guest once it reconnects to the WebSocket server
+	logger.Info("Logged out")
+	sessions.ClearCookie(w)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const apiV2BasePath = "/api/v2"
+
+var apiV2Routes = []ApiRoute{
+	{
+		Method:      http.MethodPost,
+		Path:        "/lobbies",
+		OperationId: "createLobby",
+		Summary:     "Create a lobby with the current player in it",
+		Handler:     createLobbyV2Handler,
+		Response:    Lobby{},
+		Status:      http.StatusCreated,
+		ETag:        true,
+		Errors:      []ErrorCode{ServerRestarting},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/lobbies/{lobbyId}",
+		OperationId: "getLobby",
+		Summary:     "Get a lobby and the game being played in it",
+		Handler:     getLobbyV2Handler,
+		Response:    Lobby{},
+		Status:      http.StatusOK,
+		ETag:        true,
+		Errors:      []ErrorCode{LobbyNotFound},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/lobbies/{lobbyId}/players",
+		OperationId: "joinLobby",
+		Summary:     "Join a lobby as its second player, which starts the game",
+		Handler:     joinLobbyV2Handler,
+		Response:    Lobby{},
+		Status:      http.StatusOK,
+		ETag:        true,
+		Errors:      []ErrorCode{LobbyNotFound, LobbyNotJoinable, LobbyFull, ServerRestarting},
+	},
+	{
+		Method:      http.MethodDelete,
+		Path:        "/lobbies/{lobbyId}/players/{playerId}",
+		OperationId: "leaveLobby",
+		Summary:     "Leave a lobby, forfeiting the game if it is a tournament or arena game",
+		Handler:     leaveLobbyV2Handler,
+		Status:      http.StatusNoContent,
+		Errors:      []ErrorCode{Forbidden, NotInLobby},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/lobbies/{lobbyId}/moves",
+		OperationId: "listMoves",
+		Summary:     "List the moves made in the lobby's game so far",
+		Handler:     listMovesV2Handler,
+		Response:    []MoveRecord{},
+		Status:      http.StatusOK,
+		ETag:        true,
+		Errors:      []ErrorCode{LobbyNotFound},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/lobbies/{lobbyId}/moves",
+		OperationId: "makeMove",
+		Summary:     "Make a move in the lobby's game. Send an Idempotency-Key header to make retries safe",
+		Handler:     makeMoveV2Handler,
+		RequestBody: MoveRequest{},
+		Response:    Lobby{},
+		Status:      http.StatusCreated,
+		ETag:        true,
+		IfMatch:     true,
+		Idempotent:  true,
+		Errors: []ErrorCode{
+			NotInLobby,
+			ConcurrentEdit,
+			WaitingForPlayer,
+			PreconditionFailed,
+			VersionConflict,
+			IdempotencyKeyReused,
+			ErrorCode(WrongPlayer),
+			ErrorCode(GameIsOver),
+			ErrorCode(TargetOutOfBounds),
+			ErrorCode(TargetIsNotEmpty),
+			ErrorCode(SourceMissing),
+			ErrorCode(SourceOutOfBounds),
+			ErrorCode(SourceDoesNotBelongToPlayer),
+			ErrorCode(InvalidTarget),
+		},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/lobbies/{lobbyId}/resignation",
+		OperationId: "resign",
+		Summary:     "Resign the lobby's game, making the opponent the winner",
+		Handler:     resignV2Handler,
+		Response:    Lobby{},
+		Status:      http.StatusOK,
+		ETag:        true,
+		Errors:      []ErrorCode{NotInLobby, ConcurrentEdit, WaitingForPlayer, ErrorCode(GameIsOver)},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/lobbies/{lobbyId}/chat",
+		OperationId: "sendChatMessage",
+		Summary:     "Send a chat message to everyone in the lobby",
+		Handler:     sendChatMessageV2Handler,
+		RequestBody: ChatRequest{},
+		Response:    ChatMessage{},
+		Status:      http.StatusCreated,
+		Errors:      []ErrorCode{NotInLobby, ChatMessageLength, Profanity},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/lobbies/{lobbyId}/events",
+		OperationId: "listLobbyEvents",
+		Summary:     "List everything that has happened in the lobby. Reading the whole log also rebuilds the lobby from it",
+		Handler:     listLobbyEventsV2Handler,
+		Query: map[string]string{
+			"after": "Only list the entries after the entry with this ID",
+		},
+		Response: LobbyLog{},
+		Status:   http.StatusOK,
+		ETag:     true,
+		Errors:   []ErrorCode{LobbyNotFound, Forbidden},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/players/{playerId}",
+		OperationId: "getPlayer",
+		Summary:     "Get a player's public profile and ratings",
+		Handler:     getPlayerV2Handler,
+		Response:    PlayerResource{},
+		Status:      http.StatusOK,
+		ETag:        true,
+		Errors:      []ErrorCode{PlayerNotFound},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/games/{gameId}",
+		OperationId: "getGame",
+		Summary:     "Get a finished game from the archive",
+		Handler:     getGameV2Handler,
+		Response:    ArchivedGame{},
+		Status:      http.StatusOK,
+		ETag:        true,
+		Errors:      []ErrorCode{GameNotFound},
+	},
+}
+
+type MoveRequest struct {
+	// The position of the piece to move, which is left out while pieces are still being placed
+	From *int `json:",omitempty"`
+	To   int
+	// If set, the move is only made if the game is still at this version
+	ExpectedVersion *int `json:",omitempty"`
+}
+
+// staleVersion is never the version of a game, so a move expecting it is only ever made if it is a replay
+var staleVersion = -1
+
+type ChatRequest struct {
+	Message string
+}
+
+// PlayerResource is everything about a player that other players can see
+type PlayerResource struct {
+	PublicProfile
+	Username *string
+	Ratings  map[string]PlayerRating
+}
+
+// ETag returns a strong ETag for the JSON representation of the value
+func ETag(value any) string {
+	body, _ := json.Marshal(value)
+	sum := sha256.Sum256(body)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// matchesETag returns whether an If-Match or If-None-Match header includes the ETag
+func matchesETag(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteJsonWithETag sends the value along with its ETag, or 304 Not Modified if the client already has it
+func WriteJsonWithETag(w http.ResponseWriter, r *http.Request, status int, value any) {
+	etag := ETag(value)
+	w.Header().Set("ETag", etag)
+
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if r.Method == http.MethodGet && len(ifNoneMatch) > 0 && matchesETag(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// ReadJson decodes the request body into value, rejecting unknown fields so that typos aren't silently ignored
+func ReadJson(w http.ResponseWriter, r *http.Request, value any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(value)
+	if errors.Is(err, io.EOF) {
+		return errors.New("Missing request body, must be a JSON object")
+	}
+
+	if err != nil {
+		return errors.New("Invalid request body: " + err.Error())
+	}
+
+	return nil
+}
+
+func createLobbyV2Handler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	id := GetIdFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	// Lobbies are created on another server, since players in this one would soon have to reconnect
+	if GetDrainFromContext(r.Context()).IsDraining() {
+		writeServerRestarting(w)
+		return
+	}
+
+	lobby, err := CreateLobby(r.Context(), store, logger, id)
+	if err != nil {
+		logger.Warn("There was an error creating the lobby: " + err.Error())
+		WriteError(w, InternalError, "There was an error creating the lobby")
+		return
+	}
+
+	w.Header().Set("Location", apiV2BasePath+"/lobbies/"+lobby.LobbyId)
+	WriteJsonWithETag(w, r, http.StatusCreated, lobby)
+}
+
+func getLobbyV2Handler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	lobbyId := r.PathValue("lobbyId")
+	lobby, err := store.GetLobby(r.Context(), lobbyId)
+	if err != nil {
+		logger.Warn("Unable to fetch lobby: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching the lobby")
+		return
+	}
+
+	if lobby == nil {
+		WriteError(w, LobbyNotFound, "No lobby with ID "+lobbyId+" found")
+		return
+	}
+
+	WriteJsonWithETag(w, r, http.StatusOK, lobby)
+}
+
+func joinLobbyV2Handler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	// Games are started on another server, since players in this one would soon have to reconnect
+	if GetDrainFromContext(r.Context()).IsDraining() {
+		writeServerRestarting(w)
+		return
+	}
+
+	lobby, err := JoinLobby(r.Context(), store, logger, id, r.PathValue("lobbyId"))
+	if err != nil {
+		writeLobbyError(w, logger, err, nil)
+		return
+	}
+
+	WriteJsonWithETag(w, r, http.StatusOK, lobby)
+}
+
+func leaveLobbyV2Handler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	if r.PathValue("playerId") != id {
+		WriteError(w, Forbidden, "Players can only remove themselves from a lobby")
+		return
+	}
+
+	player, err := store.GetPlayer(r.Context(), id)
+	if err != nil {
+		logger.Warn("Unable to fetch player: " + err.Error())
+		WriteError(w, InternalError, "There was an error leaving the lobby")
+		return
+	}
+
+	if player == nil || player.CurrentLobby == nil || *player.CurrentLobby != r.PathValue("lobbyId") {
+		WriteError(w, NotInLobby, "The player is not in lobby "+r.PathValue("lobbyId"))
+		return
+	}
+
+	err = LeaveLobby(r.Context(), store, logger, id)
+	if err != nil {
+		logger.Warn("There was an error leaving player lobby: " + err.Error())
+		WriteError(w, InternalError, "There was an error leaving the lobby")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listMovesV2Handler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	lobbyId := r.PathValue("lobbyId")
+	lobby, err := store.GetLobby(r.Context(), lobbyId)
+	if err != nil {
+		logger.Warn("Unable to fetch lobby: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching the moves")
+		return
+	}
+
+	if lobby == nil {
+		WriteError(w, LobbyNotFound, "No lobby with ID "+lobbyId+" found")
+		return
+	}
+
+	moves := []MoveRecord{}
+	if lobby.Game != nil {
+		moves = lobby.Game.Moves
+	}
+
+	WriteJsonWithETag(w, r, http.StatusOK, moves)
+}
+
+func makeMoveV2Handler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	lobbyId := r.PathValue("lobbyId")
+
+	var move MoveRequest
+	if err := ReadJson(w, r, &move); err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	details := map[string]any{
+		"From": move.From,
+		"To":   move.To,
+	}
+
+	lobby, err := store.GetLobby(r.Context(), lobbyId)
+	if err != nil {
+		logger.Warn("Unable to fetch lobby: " + err.Error())
+		WriteError(w, InternalError, "There was an error making the move")
+		return
+	}
+
+	if lobby == nil || (lobby.Player1 != id && (lobby.Player2 == nil || *lobby.Player2 != id)) {
+		WriteErrorDetails(w, NotInLobby, "The player is not in lobby "+lobbyId, details)
+		return
+	}
+
+	options := MoveOptions{
+		ExpectedVersion: move.ExpectedVersion,
+		IdempotencyKey:  r.Header.Get(IdempotencyKeyHeader),
+		Strategy:        GetMoveStrategyFromContext(r.Context()),
+	}
+
+	// If-Match is turned into the version of the game it matched, which is checked again as the move is saved, so
+	// that the lobby can't change in between. A lobby that no longer matches only fails the request once it is known
+	// not to be a retry of a move that was already made, which would have changed the lobby itself
+	ifMatch := r.Header.Get("If-Match")
+	expectingIfMatch := false
+	if len(ifMatch) > 0 && lobby.Game != nil {
+		if matchesETag(ifMatch, ETag(lobby)) {
+			if options.ExpectedVersion == nil {
+				options.ExpectedVersion = &lobby.Game.Version
+				expectingIfMatch = true
+			}
+		} else if len(options.IdempotencyKey) == 0 {
+			WriteErrorDetails(w, PreconditionFailed, "The lobby has changed since it was last fetched", details)
+			return
+		} else {
+			options.ExpectedVersion = &staleVersion
+			expectingIfMatch = true
+		}
+	}
+
+	if len(options.IdempotencyKey) > maxIdempotencyKeyLength {
+		WriteErrorDetails(w, InvalidRequest, "Invalid "+IdempotencyKeyHeader+" header, must be at most "+strconv.Itoa(maxIdempotencyKeyLength)+" characters", details)
+		return
+	}
+
+	updatedLobby, replayed, err := MakeMove(r.Context(), store, logger, id, lobbyId, PlayerMove{from: move.From, to: move.To}, options)
+	if replayed {
+		w.Header().Set(IdempotentReplayedHeader, "true")
+	}
+
+	var versionConflictError VersionConflictError
+	if expectingIfMatch && errors.As(err, &versionConflictError) {
+		WriteErrorDetails(w, PreconditionFailed, "The lobby has changed since it was last fetched", details)
+		return
+	}
+
+	if err != nil {
+		writeLobbyError(w, logger, err, details)
+		return
+	}
+
+	w.Header().Set("Location", apiV2BasePath+"/lobbies/"+lobbyId+"/moves")
+	w.Header().Set("Content-Location", apiV2BasePath+"/lobbies/"+lobbyId)
+	WriteJsonWithETag(w, r, http.StatusCreated, updatedLobby)
+}
+
+func resignV2Handler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	lobby, err := Resign(r.Context(), store, logger, id, r.PathValue("lobbyId"))
+	if err != nil {
+		writeLobbyError(w, logger, err, nil)
+		return
+	}
+
+	WriteJsonWithETag(w, r, http.StatusOK, lobby)
+}
+
+func sendChatMessageV2Handler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	var request ChatRequest
+	if err := ReadJson(w, r, &request); err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	message, err := SendChatMessage(r.Context(), store, logger, id, r.PathValue("lobbyId"), request.Message)
+	if err != nil {
+		writeLobbyError(w, logger, err, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(message)
+}
+
+func listLobbyEventsV2Handler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	lobbyId := r.PathValue("lobbyId")
+	after := r.URL.Query().Get("after")
+	if len(after) > 0 && !IsValidStreamId(after) {
+		WriteError(w, InvalidRequest, "Invalid 'after' parameter, must be the ID of a lobby event")
+		return
+	}
+
+	lobby, err := store.GetLobby(r.Context(), lobbyId)
+	if err != nil {
+		logger.Warn("Unable to fetch lobby: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching the lobby's events")
+		return
+	}
+
+	if lobby == nil {
+		WriteError(w, LobbyNotFound, "No lobby with ID "+lobbyId+" found")
+		return
+	}
+
+	// Chat messages are only for the players in the lobby
+	if lobby.Player1 != id && (lobby.Player2 == nil || *lobby.Player2 != id) {
+		WriteError(w, Forbidden, "Only players in the lobby can see its events")
+		return
+	}
+
+	entries, err := store.GetLobbyEvents(r.Context(), lobbyId, after)
+	if err != nil {
+		logger.Warn("There was an error fetching lobby events: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching the lobby's events")
+		return
+	}
+
+	lobbyLog := LobbyLog{Events: entries}
+	if len(after) == 0 {
+		lobbyLog.Lobby, err = ReplayLobby(entries)
+		if err != nil {
+			logger.Warn("Lobby could not be rebuilt from its events: " + err.Error())
+		}
+	}
+
+	WriteJsonWithETag(w, r, http.StatusOK, lobbyLog)
+}
+
+func getPlayerV2Handler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	playerId := r.PathValue("playerId")
+	player, err := store.GetPlayer(r.Context(), playerId)
+	if err != nil {
+		logger.Warn("Unable to fetch player: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching the player")
+		return
+	}
+
+	if player == nil {
+		WriteError(w, PlayerNotFound, "No player with ID "+playerId+" found")
+		return
+	}
+
+	ratings, err := store.GetPlayerRatings(r.Context(), playerId)
+	if err != nil {
+		logger.Warn("There was an error fetching ratings: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching the player")
+		return
+	}
+
+	profiles, err := GetPublicProfiles(r.Context(), store, playerId)
+	if err != nil {
+		logger.Warn("There was an error fetching profile: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching the player")
+		return
+	}
+
+	WriteJsonWithETag(w, r, http.StatusOK, PlayerResource{
+		PublicProfile: profiles[0],
+		Username:      player.Username,
+		Ratings:       ratings.Pools,
+	})
+}
+
+func getGameV2Handler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+
+	gameId := r.PathValue("gameId")
+	game, err := GetArchivedGame(r.Context(), gameId)
+	if err != nil {
+		logger.Warn("There was an error fetching archived game: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching the game")
+		return
+	}
+
+	if game == nil {
+		WriteError(w, GameNotFound, "No archived game with ID "+gameId+" found")
+		return
+	}
+
+	// Archived games never change
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(24*60*60))
+	WriteJsonWithETag(w, r, http.StatusOK, game)
+}
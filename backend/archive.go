@@ -0,0 +1,225 @@
+package main
+
+import (
+	"backend/turn"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"time"
+)
+
+type ArchivedGame struct {
+	GameId      string
+	LobbyId     string
+	Player1     string
+	Player2     string
+	Variant     Variant
+	TimeControl TimeControl
+	StartedAt   time.Time
+	EndedAt     time.Time
+	Moves       []MoveRecord
+	Winner      turn.Turn
+	WinnerId    string
+}
+
+type ArchivedGamePage struct {
+	Games  []ArchivedGame
+	Offset int
+	Limit  int
+	Total  int
+}
+
+// GameArchive stores finished games so that they outlive the lobby they were played in
+type GameArchive interface {
+	SaveGame(ctx context.Context, game ArchivedGame) error
+	GetGame(ctx context.Context, gameId string) (*ArchivedGame, error)
+	ListPlayerGames(ctx context.Context, playerId string, offset int, limit int) (ArchivedGamePage, error)
+}
+
+// NewArchivedGame builds the archive record for a lobby whose game has finished
+func NewArchivedGame(lobby Lobby) ArchivedGame {
+	game := lobby.Game
+
+	endedAt := time.Now()
+	if game.EndedAt != nil {
+		endedAt = *game.EndedAt
+	}
+
+	return ArchivedGame{
+		GameId:      game.Id,
+		LobbyId:     lobby.LobbyId,
+		Player1:     lobby.Player1,
+		Player2:     *lobby.Player2,
+		Variant:     game.Variant,
+		TimeControl: game.TimeControl,
+		StartedAt:   game.StartedAt,
+		EndedAt:     endedAt,
+		Moves:       game.Moves,
+		Winner:      game.Turn,
+		WinnerId:    *lobby.WinnerId(),
+	}
+}
+
+type RedisGameArchive struct {
+	rdb redis.UniversalClient
+}
+
+func NewRedisGameArchive(rdb redis.UniversalClient) *RedisGameArchive {
+	return &RedisGameArchive{
+		rdb: rdb,
+	}
+}
+
+func archivedGameKey(gameId string) string {
+	return "archive:" + gameId
+}
+
+func playerArchiveKey(playerId string) string {
+	return "player:" + playerId + ":archive"
+}
+
+func (archive *RedisGameArchive) SaveGame(ctx context.Context, game ArchivedGame) error {
+	// Under Cluster the game and each player's archive can be in different slots, so they are written one after the
+	// other. The game is saved first, so that players' archives never list a game that doesn't exist
+	err := archive.rdb.JSONSet(ctx, archivedGameKey(game.GameId), "$", game).Err()
+	if err != nil {
+		return err
+	}
+
+	member := redis.Z{Score: float64(game.EndedAt.UnixMilli()), Member: game.GameId}
+	_, err = archive.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, playerArchiveKey(game.Player1), member)
+		pipe.ZAdd(ctx, playerArchiveKey(game.Player2), member)
+		return nil
+	})
+
+	return err
+}
+
+func (archive *RedisGameArchive) GetGame(ctx context.Context, gameId string) (*ArchivedGame, error) {
+	gameJson, err := archive.rdb.JSONGet(ctx, archivedGameKey(gameId)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	if len(gameJson) == 0 {
+		return nil, nil
+	}
+
+	var game ArchivedGame
+	err = json.Unmarshal([]byte(gameJson), &game)
+	if err != nil {
+		return nil, err
+	}
+
+	return &game, nil
+}
+
+func (archive *RedisGameArchive) ListPlayerGames(ctx context.Context, playerId string, offset int, limit int) (ArchivedGamePage, error) {
+	page := ArchivedGamePage{
+		Games:  []ArchivedGame{},
+		Offset: offset,
+		Limit:  limit,
+	}
+
+	total, err := archive.rdb.ZCard(ctx, playerArchiveKey(playerId)).Result()
+	if err != nil {
+		return page, err
+	}
+	page.Total = int(total)
+
+	gameIds, err := archive.rdb.ZRevRange(ctx, playerArchiveKey(playerId), int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return page, err
+	}
+
+	if len(gameIds) == 0 {
+		return page, nil
+	}
+
+	keys := make([]string, len(gameIds))
+	for i, gameId := range gameIds {
+		keys[i] = archivedGameKey(gameId)
+	}
+
+	gamesJson, err := jsonMGet(ctx, archive.rdb, keys...)
+	if err != nil {
+		return page, err
+	}
+
+	for _, gameJson := range gamesJson {
+		rawGame, ok := gameJson.(string)
+		if !ok {
+			continue
+		}
+
+		// JSON.MGET with a JSONPath wraps every document in an array
+		var games []ArchivedGame
+		if err := json.Unmarshal([]byte(rawGame), &games); err == nil && len(games) > 0 {
+			page.Games = append(page.Games, games[0])
+		}
+	}
+
+	return page, nil
+}
+
+// GetArchivedGame returns the finished game from the store, or from the database if the store no longer has it
+func GetArchivedGame(ctx context.Context, gameId string) (*ArchivedGame, error) {
+	game, err := GetStoreFromContext(ctx).GetGame(ctx, gameId)
+	if err != nil || game != nil {
+		return game, err
+	}
+
+	database := GetDatabaseFromContext(ctx)
+	if database == nil {
+		return nil, nil
+	}
+
+	return database.GetGame(ctx, gameId)
+}
+
+func listGamesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	playerId := GetIdFromContext(r.Context())
+	if r.URL.Query().Has("playerId") {
+		playerId = r.URL.Query().Get("playerId")
+	}
+
+	offset, limit, err := ParsePagination(r)
+	if err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	page, err := store.ListPlayerGames(r.Context(), playerId, offset, limit)
+	if err != nil {
+		logger.Warn("There was an error fetching archived games: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching archived games")
+		return
+	}
+
+	WriteJson(w, page)
+}
+
+func getGameHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+
+	gameId := r.PathValue("gameId")
+	game, err := GetArchivedGame(r.Context(), gameId)
+	if err != nil {
+		logger.Warn("There was an error fetching archived game: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching archived game")
+		return
+	}
+
+	if game == nil {
+		WriteError(w, GameNotFound, "No archived game with ID "+gameId+" found")
+		return
+	}
+
+	WriteJson(w, game)
+}
@@ -0,0 +1,916 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type ArenaState string
+
+const (
+	ArenaScheduled ArenaState = "SCHEDULED"
+	ArenaLive                 = "LIVE"
+	ArenaFinished             = "FINISHED"
+)
+
+const (
+	arenaWinPoints = 2
+	// Players who have won their previous two games score double for each win until they lose
+	arenaStreakThreshold = 2
+	arenaMaxDuration     = 24 * time.Hour
+	arenaPairingInterval = 2 * time.Second
+)
+
+type ArenaPlayer struct {
+	PlayerId     string
+	Score        int
+	Games        int
+	Wins         int
+	Streak       int
+	LastOpponent *string
+	// The last game recorded for the player, so that the same game is never scored twice
+	LastGameId string `json:",omitempty"`
+	// Paused players are not paired until they rejoin the arena
+	Paused bool
+}
+
+func (player *ArenaPlayer) IsOnFire() bool {
+	return player.Streak >= arenaStreakThreshold
+}
+
+type Arena struct {
+	ArenaId     string
+	Name        string
+	OrganizerId string
+	State       ArenaState
+	StartsAt    time.Time
+	EndsAt      time.Time
+	Players     map[string]*ArenaPlayer
+}
+
+// Ranking returns the arena's players ordered by score
+func (arena *Arena) Ranking() []ArenaPlayer {
+	ranking := make([]ArenaPlayer, 0, len(arena.Players))
+	for _, player := range arena.Players {
+		ranking = append(ranking, *player)
+	}
+
+	sort.SliceStable(ranking, func(i, j int) bool {
+		if ranking[i].Score != ranking[j].Score {
+			return ranking[i].Score > ranking[j].Score
+		}
+
+		return ranking[i].PlayerId < ranking[j].PlayerId
+	})
+
+	return ranking
+}
+
+func (arena *Arena) playerIds() []string {
+	playerIds := make([]string, 0, len(arena.Players))
+	for playerId := range arena.Players {
+		playerIds = append(playerIds, playerId)
+	}
+
+	return playerIds
+}
+
+type ArenaPage struct {
+	Arenas []Arena
+	Offset int
+	Limit  int
+	Total  int
+}
+
+type ArenaValidationError struct {
+	cause   ErrorCode
+	message string
+}
+
+func (e ArenaValidationError) Error() string {
+	return string(e.cause)
+}
+
+func arenaKey(arenaId string) string {
+	return withHashTag("arena:"+arenaId, "arena:"+arenaId)
+}
+
+// arenaPoolKey is the sorted set of players waiting for a game, scored by when they started waiting
+func arenaPoolKey(arenaId string) string {
+	return withHashTag("arena:"+arenaId, "arena:"+arenaId+":pool")
+}
+
+// ArenaPoolEntry is a player waiting in an arena's pool to be paired
+type ArenaPoolEntry struct {
+	PlayerId     string
+	WaitingSince time.Time
+}
+
+// ArenaStore keeps arenas, the pool of players waiting for a game in each, and lists of every arena and those that
+// haven't finished
+type ArenaStore interface {
+	// GetArena returns the arena with the given ID, or nil if it doesn't exist
+	GetArena(ctx context.Context, arenaId string) (*Arena, error)
+	// CreateArena saves a new arena and adds it to the lists
+	CreateArena(ctx context.Context, arena Arena) error
+	// ModifyArena runs the function on the arena in a transaction, returning it as it was saved, or nil if it doesn't
+	// exist. While the arena is live, the players the function returns join its pool if they aren't already in it, and
+	// once it has finished its pool is emptied. If the arena changes before it is saved, the function is run again, up
+	// to a few times before giving up with ErrTxConflict
+	ModifyArena(ctx context.Context, arenaId string, modify func(arena *Arena) ([]string, error)) (*Arena, error)
+	// ListArenas returns a page of the list of arenas, latest to start first
+	ListArenas(ctx context.Context, offset int, limit int) (ArenaPage, error)
+	// ActiveArenas returns the IDs of the arenas that haven't finished, or that have only just finished
+	ActiveArenas(ctx context.Context) ([]string, error)
+	RemoveActiveArena(ctx context.Context, arenaId string) error
+	// GetArenaPool returns the players waiting in the arena's pool, longest waiting first
+	GetArenaPool(ctx context.Context, arenaId string) ([]ArenaPoolEntry, error)
+	// TakeFromArenaPool removes the players from the arena's pool, returning those of them who were in it
+	TakeFromArenaPool(ctx context.Context, arenaId string, playerIds ...string) ([]string, error)
+	// ReturnToArenaPool puts the players back in the arena's pool as having waited since the given times, unless they
+	// are already in it
+	ReturnToArenaPool(ctx context.Context, arenaId string, entries ...ArenaPoolEntry) error
+}
+
+func getRedisArena(ctx context.Context, rdb redis.Cmdable, arenaId string) (*Arena, error) {
+	arena, err := getRedisJson[Arena](ctx, rdb, arenaKey(arenaId))
+	if arena != nil && arena.Players == nil {
+		arena.Players = map[string]*ArenaPlayer{}
+	}
+
+	return arena, err
+}
+
+func (store *RedisStore) GetArena(ctx context.Context, arenaId string) (*Arena, error) {
+	return getRedisArena(ctx, store.rdb, arenaId)
+}
+
+func (store *RedisStore) CreateArena(ctx context.Context, arena Arena) error {
+	// Under Cluster the arena and the lists of arenas can be in different slots. The arena is saved first, so that the
+	// lists never hold an arena that doesn't exist
+	err := store.rdb.JSONSet(ctx, arenaKey(arena.ArenaId), "$", arena).Err()
+	if err != nil {
+		return err
+	}
+
+	_, err = store.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, "arenas:active", arena.ArenaId)
+		pipe.ZAdd(ctx, "arenas", redis.Z{Score: float64(arena.StartsAt.UnixMilli()), Member: arena.ArenaId})
+		return nil
+	})
+
+	return err
+}
+
+func (store *RedisStore) ModifyArena(ctx context.Context, arenaId string, modify func(arena *Arena) ([]string, error)) (*Arena, error) {
+	var modified *Arena
+
+	tx := func(tx *redis.Tx) error {
+		modified = nil
+
+		arena, err := getRedisArena(ctx, tx, arenaId)
+		if err != nil || arena == nil {
+			return err
+		}
+
+		queue, err := modify(arena)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			err := pipe.JSONSet(ctx, arenaKey(arenaId), "$", arena).Err()
+			if err != nil {
+				return err
+			}
+
+			if arena.State == ArenaFinished {
+				pipe.Del(ctx, arenaPoolKey(arenaId))
+				return nil
+			}
+
+			if arena.State == ArenaLive {
+				now := float64(time.Now().UnixMilli())
+				for _, playerId := range queue {
+					pipe.ZAddNX(ctx, arenaPoolKey(arenaId), redis.Z{Score: now, Member: playerId})
+				}
+			}
+
+			return nil
+		})
+
+		if err == nil {
+			modified = arena
+		}
+
+		return err
+	}
+
+	err := WatchWithRetries(ctx, func() error {
+		return store.rdb.Watch(ctx, tx, arenaKey(arenaId))
+	}, storeTxAttempts)
+
+	if errors.Is(err, redis.TxFailedErr) {
+		return nil, ErrTxConflict
+	}
+
+	return modified, err
+}
+
+func (store *RedisStore) ListArenas(ctx context.Context, offset int, limit int) (ArenaPage, error) {
+	page := ArenaPage{
+		Arenas: []Arena{},
+		Offset: offset,
+		Limit:  limit,
+	}
+
+	total, err := store.rdb.ZCard(ctx, "arenas").Result()
+	if err != nil {
+		return page, err
+	}
+	page.Total = int(total)
+
+	arenaIds, err := store.rdb.ZRevRange(ctx, "arenas", int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return page, err
+	}
+
+	for _, arenaId := range arenaIds {
+		arena, err := store.GetArena(ctx, arenaId)
+		if err != nil {
+			return page, err
+		}
+
+		if arena != nil {
+			page.Arenas = append(page.Arenas, *arena)
+		}
+	}
+
+	return page, nil
+}
+
+func (store *RedisStore) ActiveArenas(ctx context.Context) ([]string, error) {
+	return store.rdb.SMembers(ctx, "arenas:active").Result()
+}
+
+func (store *RedisStore) RemoveActiveArena(ctx context.Context, arenaId string) error {
+	return store.rdb.SRem(ctx, "arenas:active", arenaId).Err()
+}
+
+func (store *RedisStore) GetArenaPool(ctx context.Context, arenaId string) ([]ArenaPoolEntry, error) {
+	pool, err := store.rdb.ZRangeWithScores(ctx, arenaPoolKey(arenaId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]ArenaPoolEntry, len(pool))
+	for i, entry := range pool {
+		entries[i] = ArenaPoolEntry{
+			PlayerId:     entry.Member.(string),
+			WaitingSince: time.UnixMilli(int64(entry.Score)),
+		}
+	}
+
+	return entries, nil
+}
+
+func (store *RedisStore) TakeFromArenaPool(ctx context.Context, arenaId string, playerIds ...string) ([]string, error) {
+	// Each player is removed on their own, to find out which of them were in the pool
+	results := make([]*redis.IntCmd, len(playerIds))
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, playerId := range playerIds {
+			results[i] = pipe.ZRem(ctx, arenaPoolKey(arenaId), playerId)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for i, result := range results {
+		if result.Val() == 1 {
+			removed = append(removed, playerIds[i])
+		}
+	}
+
+	return removed, nil
+}
+
+func (store *RedisStore) ReturnToArenaPool(ctx context.Context, arenaId string, entries ...ArenaPoolEntry) error {
+	members := make([]redis.Z, len(entries))
+	for i, entry := range entries {
+		members[i] = redis.Z{Score: float64(entry.WaitingSince.UnixMilli()), Member: entry.PlayerId}
+	}
+
+	return store.rdb.ZAddNX(ctx, arenaPoolKey(arenaId), members...).Err()
+}
+
+// getArena expects the store to already be locked
+func (store *MemoryStore) getArena(arenaId string) (*Arena, error) {
+	arena, err := getMemoryJson[Arena](store.arenas, arenaId)
+	if arena != nil && arena.Players == nil {
+		arena.Players = map[string]*ArenaPlayer{}
+	}
+
+	return arena, err
+}
+
+func (store *MemoryStore) GetArena(ctx context.Context, arenaId string) (*Arena, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.getArena(arenaId)
+}
+
+func (store *MemoryStore) CreateArena(ctx context.Context, arena Arena) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	arenaJson, err := json.Marshal(arena)
+	if err != nil {
+		return err
+	}
+
+	store.arenas[arena.ArenaId] = arenaJson
+	store.activeArenas[arena.ArenaId] = struct{}{}
+	return nil
+}
+
+func (store *MemoryStore) ModifyArena(ctx context.Context, arenaId string, modify func(arena *Arena) ([]string, error)) (*Arena, error) {
+	var queue []string
+	arena, err := modifyMemoryJson(store, store.arenas, arenaId, func(arena *Arena) error {
+		if arena.Players == nil {
+			arena.Players = map[string]*ArenaPlayer{}
+		}
+
+		var err error
+		queue, err = modify(arena)
+		return err
+	}, func(arena *Arena) {
+		if arena.State == ArenaFinished {
+			delete(store.arenaPools, arenaId)
+			return
+		}
+
+		if arena.State == ArenaLive {
+			now := time.Now().Truncate(time.Millisecond)
+			for _, playerId := range queue {
+				store.returnToArenaPool(arenaId, ArenaPoolEntry{PlayerId: playerId, WaitingSince: now})
+			}
+		}
+	})
+
+	return arena, err
+}
+
+func (store *MemoryStore) ListArenas(ctx context.Context, offset int, limit int) (ArenaPage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	page := ArenaPage{
+		Arenas: []Arena{},
+		Offset: offset,
+		Limit:  limit,
+		Total:  len(store.arenas),
+	}
+
+	arenas := make([]Arena, 0, len(store.arenas))
+	for arenaId := range store.arenas {
+		arena, err := store.getArena(arenaId)
+		if err != nil {
+			return page, err
+		}
+
+		arenas = append(arenas, *arena)
+	}
+
+	sort.Slice(arenas, func(i, j int) bool {
+		if !arenas[i].StartsAt.Equal(arenas[j].StartsAt) {
+			return arenas[i].StartsAt.After(arenas[j].StartsAt)
+		}
+
+		return arenas[i].ArenaId > arenas[j].ArenaId
+	})
+
+	if offset < len(arenas) {
+		page.Arenas = arenas[offset:min(offset+limit, len(arenas))]
+	}
+
+	return page, nil
+}
+
+func (store *MemoryStore) ActiveArenas(ctx context.Context) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	arenaIds := make([]string, 0, len(store.activeArenas))
+	for arenaId := range store.activeArenas {
+		arenaIds = append(arenaIds, arenaId)
+	}
+
+	return arenaIds, nil
+}
+
+func (store *MemoryStore) RemoveActiveArena(ctx context.Context, arenaId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.activeArenas, arenaId)
+	return nil
+}
+
+func (store *MemoryStore) GetArenaPool(ctx context.Context, arenaId string) ([]ArenaPoolEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entries := make([]ArenaPoolEntry, 0, len(store.arenaPools[arenaId]))
+	for playerId, waitingSince := range store.arenaPools[arenaId] {
+		entries = append(entries, ArenaPoolEntry{PlayerId: playerId, WaitingSince: waitingSince})
+	}
+
+	// Ties are broken the same as in a Redis sorted set
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].WaitingSince.Equal(entries[j].WaitingSince) {
+			return entries[i].WaitingSince.Before(entries[j].WaitingSince)
+		}
+
+		return entries[i].PlayerId < entries[j].PlayerId
+	})
+
+	return entries, nil
+}
+
+func (store *MemoryStore) TakeFromArenaPool(ctx context.Context, arenaId string, playerIds ...string) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var removed []string
+	for _, playerId := range playerIds {
+		if _, exists := store.arenaPools[arenaId][playerId]; exists {
+			delete(store.arenaPools[arenaId], playerId)
+			removed = append(removed, playerId)
+		}
+	}
+
+	return removed, nil
+}
+
+func (store *MemoryStore) ReturnToArenaPool(ctx context.Context, arenaId string, entries ...ArenaPoolEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.returnToArenaPool(arenaId, entries...)
+	return nil
+}
+
+// returnToArenaPool expects the store to already be locked
+func (store *MemoryStore) returnToArenaPool(arenaId string, entries ...ArenaPoolEntry) {
+	if store.arenaPools[arenaId] == nil {
+		store.arenaPools[arenaId] = map[string]time.Time{}
+	}
+
+	for _, entry := range entries {
+		if _, exists := store.arenaPools[arenaId][entry.PlayerId]; !exists {
+			store.arenaPools[arenaId][entry.PlayerId] = entry.WaitingSince
+		}
+	}
+}
+
+// UpdateArena applies update to the stored arena inside a transaction and sends the updated arena to its players.
+// Players listed by the update in the returned slice are added to the pairing pool
+func UpdateArena(ctx context.Context, store Store, logger *slog.Logger, arenaId string, update func(arena *Arena) ([]string, error)) (*Arena, error) {
+	updated, err := store.ModifyArena(ctx, arenaId, update)
+	if err != nil {
+		return nil, err
+	}
+
+	if updated == nil {
+		return nil, ArenaValidationError{cause: ArenaNotFound, message: "No arena with ID " + arenaId + " found"}
+	}
+
+	// Under Cluster the active arenas can be in another slot to the arena, so they can't be changed in its
+	// transaction. The scheduler removes finished arenas that are still listed if this fails
+	if updated.State == ArenaFinished {
+		if err := store.RemoveActiveArena(ctx, arenaId); err != nil {
+			logger.Warn("Failed to remove finished arena from active arenas: " + err.Error())
+		}
+	}
+
+	PublishLobbyEvent(ctx, store, logger, LobbyEventMessage{
+		Event: ArenaUpdate,
+		Arena: updated,
+	}, updated.playerIds()...)
+
+	return updated, nil
+}
+
+// RecordArenaResult scores a finished arena game and puts both players back into the pairing pool.
+// A player who forfeited by leaving the game is paused instead. Recording the same game again changes nothing
+func RecordArenaResult(ctx context.Context, store Store, logger *slog.Logger, arenaId string, lobbyId string, gameId string, winnerId string, loserId string, forfeit bool) error {
+	logger = logger.With(slog.String("arenaId", arenaId))
+
+	_, err := UpdateArena(ctx, store, logger, arenaId, func(arena *Arena) ([]string, error) {
+		winner, winnerExists := arena.Players[winnerId]
+		loser, loserExists := arena.Players[loserId]
+		if !winnerExists || !loserExists {
+			return nil, nil
+		}
+
+		// Players are only paired again once their last game has been recorded, so it is the only one that can be
+		// recorded twice
+		if winner.LastGameId == gameId && loser.LastGameId == gameId {
+			return nil, nil
+		}
+
+		points := arenaWinPoints
+		if winner.IsOnFire() {
+			points *= 2
+		}
+
+		winner.Score += points
+		winner.Games++
+		winner.Wins++
+		winner.Streak++
+		winner.LastOpponent = &loserId
+		winner.LastGameId = gameId
+
+		loser.Games++
+		loser.Streak = 0
+		loser.LastOpponent = &winnerId
+		loser.LastGameId = gameId
+
+		if forfeit {
+			loser.Paused = true
+		}
+
+		var queue []string
+		for _, player := range []*ArenaPlayer{winner, loser} {
+			if !player.Paused {
+				queue = append(queue, player.PlayerId)
+			}
+		}
+
+		return queue, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The players are moved into a new lobby when they are next paired
+	return store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		tx.DeleteLobby()
+		return nil
+	})
+}
+
+// pairArena starts or finishes the arena depending on the time, and pairs up players waiting in the pool while it is live
+func pairArena(ctx context.Context, store Store, logger *slog.Logger, arenaId string, now time.Time) error {
+	arena, err := store.GetArena(ctx, arenaId)
+	if err != nil || arena == nil {
+		return err
+	}
+
+	if arena.State == ArenaFinished {
+		return store.RemoveActiveArena(ctx, arenaId)
+	}
+
+	if arena.State == ArenaScheduled && !now.Before(arena.StartsAt) {
+		logger.Info("Arena is starting")
+		_, err = UpdateArena(ctx, store, logger, arenaId, func(arena *Arena) ([]string, error) {
+			if arena.State != ArenaScheduled {
+				return nil, nil
+			}
+
+			arena.State = ArenaLive
+
+			var queue []string
+			for _, player := range arena.Players {
+				if !player.Paused {
+					queue = append(queue, player.PlayerId)
+				}
+			}
+
+			return queue, nil
+		})
+
+		return err
+	}
+
+	if arena.State == ArenaLive && !now.Before(arena.EndsAt) {
+		logger.Info("Arena clock has run out, finishing arena")
+		_, err = UpdateArena(ctx, store, logger, arenaId, func(arena *Arena) ([]string, error) {
+			arena.State = ArenaFinished
+			return nil, nil
+		})
+
+		return err
+	}
+
+	if arena.State != ArenaLive {
+		return nil
+	}
+
+	pool, err := store.GetArenaPool(ctx, arenaId)
+	if err != nil {
+		return err
+	}
+
+	waiting := make([]string, len(pool))
+	waitingSince := map[string]time.Time{}
+	for i, entry := range pool {
+		waiting[i] = entry.PlayerId
+		waitingSince[entry.PlayerId] = entry.WaitingSince
+	}
+
+	paired := map[string]bool{}
+	for i, playerId := range waiting {
+		if paired[playerId] {
+			continue
+		}
+
+		player, exists := arena.Players[playerId]
+		if !exists || player.Paused {
+			store.TakeFromArenaPool(ctx, arenaId, playerId)
+			continue
+		}
+
+		// Prefer the longest waiting opponent who was not the player's last opponent
+		var opponentId *string
+		for _, candidateId := range waiting[i+1:] {
+			if paired[candidateId] {
+				continue
+			}
+
+			if opponentId == nil {
+				candidate := candidateId
+				opponentId = &candidate
+			}
+
+			if player.LastOpponent == nil || *player.LastOpponent != candidateId {
+				candidate := candidateId
+				opponentId = &candidate
+				break
+			}
+		}
+
+		if opponentId == nil {
+			break
+		}
+
+		removed, err := store.TakeFromArenaPool(ctx, arenaId, playerId, *opponentId)
+		if err != nil {
+			return err
+		}
+
+		// Another server has already paired one of the players, so the other is put back in the same place, to be
+		// paired first next time
+		if len(removed) != 2 {
+			for _, removedId := range removed {
+				err := store.ReturnToArenaPool(ctx, arenaId, ArenaPoolEntry{PlayerId: removedId, WaitingSince: waitingSince[removedId]})
+				if err != nil {
+					logger.Warn("There was an error putting player " + removedId + " back in the arena pool: " + err.Error())
+				}
+			}
+
+			continue
+		}
+
+		paired[playerId] = true
+		paired[*opponentId] = true
+
+		err = CreateMatchLobby(ctx, store, logger, Lobby{
+			LobbyId: NewLobbyId(),
+			Player1: playerId,
+			Player2: opponentId,
+			ArenaId: &arenaId,
+		})
+
+		if err != nil {
+			logger.Warn("There was an error creating arena lobby, putting players back in the pool: " + err.Error())
+
+			// Back in the same place, so that they are paired first next time
+			err = store.ReturnToArenaPool(ctx, arenaId,
+				ArenaPoolEntry{PlayerId: playerId, WaitingSince: waitingSince[playerId]},
+				ArenaPoolEntry{PlayerId: *opponentId, WaitingSince: waitingSince[*opponentId]},
+			)
+			if err != nil {
+				logger.Warn("There was an error putting players back in the arena pool: " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// RunArenaScheduler keeps pairing players in every active arena until the context is cancelled
+func RunArenaScheduler(ctx context.Context, store Store, logger *slog.Logger) {
+	ticker := time.NewTicker(arenaPairingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			arenaIds, err := store.ActiveArenas(ctx)
+			if err != nil {
+				logger.Warn("There was an error fetching active arenas: " + err.Error())
+				continue
+			}
+
+			for _, arenaId := range arenaIds {
+				// Only one server pairs an arena at a time
+				acquired, err := store.TryLock(ctx, "arena:"+arenaId+":pairing", arenaPairingInterval)
+				if err != nil || !acquired {
+					continue
+				}
+
+				err = pairArena(ctx, store, logger.With(slog.String("arenaId", arenaId)), arenaId, now)
+				if err != nil {
+					logger.Warn("There was an error pairing arena " + arenaId + ": " + err.Error())
+				}
+			}
+		}
+	}
+}
+
+func writeArenaError(w http.ResponseWriter, logger *slog.Logger, err error) {
+	var validationError ArenaValidationError
+	if errors.As(err, &validationError) {
+		WriteError(w, validationError.cause, validationError.message)
+		return
+	}
+
+	logger.Warn("There was an error updating arena: " + err.Error())
+	WriteError(w, InternalError, "There was an error updating arena")
+}
+
+func createArenaHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 || len(name) > 64 {
+		WriteError(w, InvalidRequest, "Missing or invalid 'name' parameter, must be between 1 and 64 characters")
+		return
+	}
+
+	duration, err := strconv.Atoi(r.URL.Query().Get("duration"))
+	if err != nil || duration <= 0 || time.Duration(duration)*time.Minute > arenaMaxDuration {
+		WriteError(w, InvalidRequest, "Missing or invalid 'duration' parameter, must be a number of minutes up to 24 hours")
+		return
+	}
+
+	startsIn := 0
+	rawStartsIn := r.URL.Query().Get("startsIn")
+	if len(rawStartsIn) > 0 {
+		if minutes, err := strconv.Atoi(rawStartsIn); err == nil && minutes >= 0 {
+			startsIn = minutes
+		} else {
+			WriteError(w, InvalidRequest, "Invalid 'startsIn' parameter, must be a non-negative number of minutes")
+			return
+		}
+	}
+
+	startsAt := time.Now().Add(time.Duration(startsIn) * time.Minute)
+	arena := Arena{
+		ArenaId:     NewLobbyId(),
+		Name:        name,
+		OrganizerId: id,
+		State:       ArenaScheduled,
+		StartsAt:    startsAt,
+		EndsAt:      startsAt.Add(time.Duration(duration) * time.Minute),
+		Players:     map[string]*ArenaPlayer{},
+	}
+
+	logger = logger.With(slog.String("arenaId", arena.ArenaId))
+
+	err = store.CreateArena(r.Context(), arena)
+	if err != nil {
+		logger.Warn("There was an error creating the arena: " + err.Error())
+		WriteError(w, InternalError, "There was an error creating the arena")
+		return
+	}
+
+	logger.Info("Created arena")
+	WriteJson(w, arena)
+}
+
+func listArenasHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	offset, limit, err := ParsePagination(r)
+	if err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	page, err := store.ListArenas(r.Context(), offset, limit)
+	if err != nil {
+		logger.Warn("There was an error fetching arenas: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching arenas")
+		return
+	}
+
+	WriteJson(w, page)
+}
+
+func getArenaHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	arenaId := r.PathValue("arenaId")
+	arena, err := store.GetArena(r.Context(), arenaId)
+	if err != nil {
+		logger.Warn("There was an error fetching arena: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching arena")
+		return
+	}
+
+	if arena == nil {
+		WriteError(w, ArenaNotFound, "No arena with ID "+arenaId+" found")
+		return
+	}
+
+	WriteJson(w, struct {
+		Arena
+		Ranking []ArenaPlayer
+	}{
+		Arena:   *arena,
+		Ranking: arena.Ranking(),
+	})
+}
+
+func joinArenaHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	arena, err := UpdateArena(r.Context(), store, logger, r.PathValue("arenaId"), func(arena *Arena) ([]string, error) {
+		if arena.State == ArenaFinished {
+			return nil, ArenaValidationError{cause: ArenaAlreadyFinished, message: "The arena has already finished"}
+		}
+
+		if player, exists := arena.Players[id]; exists {
+			// Players who are not paused are either waiting in the pool or playing a game already
+			if !player.Paused {
+				return nil, nil
+			}
+
+			player.Paused = false
+		} else {
+			arena.Players[id] = &ArenaPlayer{PlayerId: id}
+		}
+
+		return []string{id}, nil
+	})
+
+	if err != nil {
+		writeArenaError(w, logger, err)
+		return
+	}
+
+	WriteJson(w, arena)
+}
+
+func pauseArenaHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	arenaId := r.PathValue("arenaId")
+	arena, err := UpdateArena(r.Context(), store, logger, arenaId, func(arena *Arena) ([]string, error) {
+		player, exists := arena.Players[id]
+		if !exists {
+			return nil, ArenaValidationError{cause: NotInArena, message: "You have not joined the arena"}
+		}
+
+		player.Paused = true
+		return nil, nil
+	})
+
+	if err != nil {
+		writeArenaError(w, logger, err)
+		return
+	}
+
+	_, err = store.TakeFromArenaPool(r.Context(), arenaId, id)
+	if err != nil {
+		logger.Warn("There was an error removing player from arena pool: " + err.Error())
+	}
+
+	WriteJson(w, arena)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// stalePoolStore returns the arena pool as it was before another server took players out of it
+type stalePoolStore struct {
+	*MemoryStore
+	pool []ArenaPoolEntry
+}
+
+func (store stalePoolStore) GetArenaPool(ctx context.Context, arenaId string) ([]ArenaPoolEntry, error) {
+	return store.pool, nil
+}
+
+// When another server pairs one of the two players first, the other goes back into the pool where they were
+func TestPairArenaReturnsUnpairedPlayer(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	ctx := NewBackgroundContext(context.Background(), memoryStore, nil)
+	now := time.Now()
+
+	err := memoryStore.CreateArena(ctx, Arena{
+		ArenaId:  "arena",
+		State:    ArenaLive,
+		StartsAt: now.Add(-time.Minute),
+		EndsAt:   now.Add(time.Hour),
+		Players: map[string]*ArenaPlayer{
+			"alice": {PlayerId: "alice"},
+			"bob":   {PlayerId: "bob"},
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to create arena: " + err.Error())
+	}
+
+	aliceWaiting := ArenaPoolEntry{PlayerId: "alice", WaitingSince: now.Add(-time.Minute).Truncate(time.Millisecond)}
+	bobWaiting := ArenaPoolEntry{PlayerId: "bob", WaitingSince: now.Add(-time.Second).Truncate(time.Millisecond)}
+
+	// Bob has already been taken out of the pool by another server
+	if err := memoryStore.ReturnToArenaPool(ctx, "arena", aliceWaiting); err != nil {
+		t.Fatal("Failed to add to pool: " + err.Error())
+	}
+
+	store := stalePoolStore{MemoryStore: memoryStore, pool: []ArenaPoolEntry{aliceWaiting, bobWaiting}}
+	if err := pairArena(ctx, store, discardLogger(), "arena", now); err != nil {
+		t.Fatal("Failed to pair arena: " + err.Error())
+	}
+
+	pool, err := memoryStore.GetArenaPool(ctx, "arena")
+	if err != nil {
+		t.Fatal("Failed to read pool: " + err.Error())
+	}
+
+	if len(pool) != 1 || pool[0].PlayerId != "alice" || !pool[0].WaitingSince.Equal(aliceWaiting.WaitingSince) {
+		t.Fatalf("Expected alice to be back in the pool since %v, got %+v", aliceWaiting.WaitingSince, pool)
+	}
+
+	if player, err := memoryStore.GetPlayer(ctx, "alice"); err != nil || player != nil {
+		t.Fatalf("Expected alice not to have been put in a lobby, got %+v (%v)", player, err)
+	}
+}
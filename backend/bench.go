@@ -0,0 +1,236 @@
+package main
+
+import (
+	"backend/position"
+	"backend/turn"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+type MoveBenchmarkConfig struct {
+	Lobbies int
+	// How many clients make moves for each player at once, which is what makes moves contend with each other
+	ClientsPerPlayer int
+	// How many moves are made in each lobby's game
+	MovesPerLobby int
+}
+
+type MoveBenchmarkResult struct {
+	Strategy MoveStrategy
+	Duration time.Duration
+	// Moves that were saved
+	Moves int
+	// Moves that were rejected because another client had already moved, such as for being made out of turn
+	Rejected int
+	// Moves that failed because the game kept changing while they were being saved
+	Aborted   int
+	Latencies []time.Duration
+}
+
+func (result MoveBenchmarkResult) Percentile(percentile float64) time.Duration {
+	if len(result.Latencies) == 0 {
+		return 0
+	}
+
+	sorted := slices.Clone(result.Latencies)
+	slices.Sort(sorted)
+	return sorted[int(float64(len(sorted)-1)*percentile)]
+}
+
+// RunMoveBenchmark plays games in new lobbies using the move strategy, with several clients racing to make each
+// player's moves. Only moves that don't end the game are made, so that finished games aren't recorded anywhere
+func RunMoveBenchmark(ctx context.Context, store *RedisStore, strategy MoveStrategy, config MoveBenchmarkConfig) (MoveBenchmarkResult, error) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	result := MoveBenchmarkResult{Strategy: strategy}
+
+	var keys []string
+	defer func() {
+		// Under Cluster the keys are in different slots, so they are deleted one at a time
+		store.rdb.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.Del(context.Background(), key)
+			}
+
+			return nil
+		})
+	}()
+
+	lobbies := make([]Lobby, config.Lobbies)
+	for i := range lobbies {
+		player2 := "bench-" + uuid.NewString()
+		lobbies[i] = Lobby{
+			LobbyId: NewLobbyId(),
+			Player1: "bench-" + uuid.NewString(),
+			Player2: &player2,
+			Game:    NewGame(),
+		}
+
+		keys = append(
+			keys,
+			lobbyKey(lobbies[i].LobbyId),
+			lobbyExpiryKey(lobbies[i].LobbyId),
+			lobbyEventsKey(lobbies[i].LobbyId),
+			playerKey(lobbies[i].Player1),
+			playerKey(player2),
+			inboxKey(lobbies[i].Player1),
+			inboxKey(player2),
+		)
+
+		err := CreateMatchLobby(ctx, store, logger, lobbies[i])
+		if err != nil {
+			return result, err
+		}
+	}
+
+	var mutex sync.Mutex
+	var group sync.WaitGroup
+	var benchmarkErr error
+
+	start := time.Now()
+	for _, lobby := range lobbies {
+		// Cancelled as soon as any of the lobby's clients stop, such as once there are no moves left that wouldn't end
+		// the game
+		lobbyCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		for _, seat := range []turn.Turn{turn.Player1, turn.Player2} {
+			playerId := lobby.Player1
+			if seat == turn.Player2 {
+				playerId = *lobby.Player2
+			}
+
+			for client := 0; client < config.ClientsPerPlayer; client++ {
+				group.Add(1)
+
+				go func() {
+					defer group.Done()
+					defer cancel()
+
+					for lobbyCtx.Err() == nil {
+						current, err := store.GetLobby(lobbyCtx, lobby.LobbyId)
+						if err != nil || current == nil || current.Game.Version >= config.MovesPerLobby {
+							return
+						}
+
+						if current.Game.Turn != seat {
+							time.Sleep(time.Millisecond)
+							continue
+						}
+
+						move, exists := chooseBenchmarkMove(*current.Game, seat)
+						if !exists {
+							return
+						}
+
+						moveStart := time.Now()
+						_, _, err = MakeMove(lobbyCtx, store, logger, playerId, lobby.LobbyId, move, MoveOptions{Strategy: strategy})
+						latency := time.Since(moveStart)
+
+						var invalidMoveError *InvalidMoveError
+						var validationError LobbyValidationError
+
+						mutex.Lock()
+						switch {
+						case err == nil:
+							result.Moves++
+							result.Latencies = append(result.Latencies, latency)
+						case errors.As(err, &invalidMoveError) || errors.As(err, &validationError):
+							result.Rejected++
+						case errors.Is(err, ErrTxConflict):
+							result.Aborted++
+						case lobbyCtx.Err() == nil:
+							benchmarkErr = err
+						}
+						failed := benchmarkErr != nil
+						mutex.Unlock()
+
+						if failed {
+							return
+						}
+					}
+				}()
+			}
+		}
+	}
+
+	group.Wait()
+	result.Duration = time.Since(start)
+
+	return result, benchmarkErr
+}
+
+// chooseBenchmarkMove picks a random valid move for the player that doesn't end the game
+func chooseBenchmarkMove(game Game, seat turn.Turn) (PlayerMove, bool) {
+	var candidates []PlayerMove
+	for to := range game.Board {
+		if game.State == Setup {
+			candidates = append(candidates, PlayerMove{to: to})
+			continue
+		}
+
+		for from := range game.Board {
+			if game.Board[from] == seat.AsPosition() && game.Board[to] == position.Empty {
+				candidates = append(candidates, PlayerMove{from: &from, to: to})
+			}
+		}
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	for _, move := range candidates {
+		newGame, err := game.EvaluateMove(seat, move)
+		if err == nil && newGame.State != GameOver {
+			return move, true
+		}
+	}
+
+	return PlayerMove{}, false
+}
+
+// RunMoveBenchmarkCommand runs the move benchmark for each strategy and prints how they compare
+func RunMoveBenchmarkCommand(rdb redis.UniversalClient, args []string) {
+	flags := flag.NewFlagSet("bench-moves", flag.ExitOnError)
+	lobbies := flags.Int("lobbies", 50, "number of lobbies to play games in at once")
+	clients := flags.Int("clients", 2, "number of clients racing to make each player's moves")
+	moves := flags.Int("moves", 40, "number of moves to make in each game")
+	flags.Parse(args)
+
+	config := MoveBenchmarkConfig{
+		Lobbies:          *lobbies,
+		ClientsPerPlayer: *clients,
+		MovesPerLobby:    *moves,
+	}
+
+	fmt.Printf("%-8s %8s %10s %10s %10s %10s %10s\n", "strategy", "moves", "moves/s", "p50", "p99", "rejected", "aborted")
+
+	for _, strategy := range []MoveStrategy{WatchMoves, ScriptMoves} {
+		result, err := RunMoveBenchmark(context.Background(), NewRedisStore(rdb), strategy, config)
+		if err != nil {
+			log.Fatal("Benchmark of " + string(strategy) + " strategy failed: " + err.Error())
+		}
+
+		fmt.Printf(
+			"%-8s %8d %10.1f %10s %10s %10d %10d\n",
+			strategy,
+			result.Moves,
+			float64(result.Moves)/result.Duration.Seconds(),
+			result.Percentile(0.5).Round(time.Microsecond),
+			result.Percentile(0.99).Round(time.Microsecond),
+			result.Rejected,
+			result.Aborted,
+		)
+	}
+}
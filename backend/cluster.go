@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often each node records that it is still running
+const nodeHeartbeatInterval = 5 * time.Second
+
+// How long a node can go without a heartbeat before the other nodes treat it as dead and clean up after it
+const nodeTimeout = 30 * time.Second
+
+// How long a node has to clean up after a dead node before another node may try
+const nodeCleanupLease = time.Minute
+
+const nodesKey = "nodes"
+
+// nodeConnectionsKey holds the WebSockets connected to the node
+func nodeConnectionsKey(nodeId string) string {
+	return "node:" + nodeId + ":connections"
+}
+
+// playerSocketsKey holds which node each of the player's WebSockets is connected to
+func playerSocketsKey(playerId string) string {
+	return "player:" + playerId + ":sockets"
+}
+
+// LoadNodeId reads the name of this node from the environment, or makes one up if it isn't set. Names have to be
+// unique across every node sharing the same Redis
+func LoadNodeId() string {
+	value := strings.TrimSpace(os.Getenv("NODE_ID"))
+	if len(value) > 0 {
+		return value
+	}
+
+	return uuid.NewString()
+}
+
+// Node is one of the servers sharing the same Redis. WebSockets don't have to stick to a node, since messages reach
+// players through their inboxes whichever node they are connected to, but each node records which WebSockets it holds
+// so that the other nodes can clean up after it if it dies
+type Node struct {
+	Id    string
+	store Store
+	mutex sync.Mutex
+	// The WebSockets the node holds, so that they can be recorded again if Redis loses track of them
+	connections map[string]NodeConnection
+}
+
+func NewNode(id string, store Store) *Node {
+	return &Node{
+		Id:          id,
+		store:       store,
+		connections: map[string]NodeConnection{},
+	}
+}
+
+// NodeConnection is a WebSocket held by a node
+type NodeConnection struct {
+	ConnectionId string
+	NodeId       string
+	PlayerId     string
+	ClientId     string
+	SessionId    string
+	ConnectedAt  time.Time
+}
+
+// NodeStore keeps track of the nodes that are running and the WebSockets each of them holds
+type NodeStore interface {
+	// Heartbeat records that the node is still running, and returns whether it had been forgotten, such as when
+	// another node took it for dead and cleaned up after it
+	Heartbeat(ctx context.Context, nodeId string) (bool, error)
+	// RecordNodeConnection adds the WebSocket to those held by its node and its player
+	RecordNodeConnection(ctx context.Context, connection NodeConnection) error
+	// ForgetPlayerSocket removes the WebSocket from the player's and returns how many they have left
+	ForgetPlayerSocket(ctx context.Context, playerId string, connectionId string) (int, error)
+	// ForgetNodeConnection removes the WebSocket from those held by the node
+	ForgetNodeConnection(ctx context.Context, nodeId string, connectionId string) error
+	// GetNodeConnections returns the WebSockets recorded as held by the node. Those that can't be read are returned
+	// with only their ID
+	GetNodeConnections(ctx context.Context, nodeId string) ([]NodeConnection, error)
+	// DeadNodes returns the nodes whose last heartbeat was before the given time
+	DeadNodes(ctx context.Context, before time.Time) ([]string, error)
+	// RemoveNode forgets the node along with the WebSockets it held
+	RemoveNode(ctx context.Context, nodeId string) error
+	// CountPlayerSockets returns how many WebSockets the player has connected across every node
+	CountPlayerSockets(ctx context.Context, playerId string) (int, error)
+}
+
+func (store *RedisStore) Heartbeat(ctx context.Context, nodeId string) (bool, error) {
+	added, err := store.rdb.ZAdd(ctx, nodesKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: nodeId}).Result()
+	if err != nil {
+		return false, err
+	}
+
+	// The node's connections are deleted before the node itself when cleaning up after it, so they may be gone even
+	// though the node is still listed. A node without any connections has no hash either, which is treated the same
+	recorded, err := store.rdb.Exists(ctx, nodeConnectionsKey(nodeId)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return added > 0 || recorded == 0, nil
+}
+
+func (store *RedisStore) RecordNodeConnection(ctx context.Context, connection NodeConnection) error {
+	connectionJson, err := json.Marshal(connection)
+	if err != nil {
+		return err
+	}
+
+	// Under Cluster the node's and the player's keys can be in different slots, so they are written one after the
+	// other. The node's is written first, so that if the player's can't be, forgetting the WebSocket later still
+	// finds it
+	err = store.rdb.HSet(ctx, nodeConnectionsKey(connection.NodeId), connection.ConnectionId, string(connectionJson)).Err()
+	if err != nil {
+		return err
+	}
+
+	return store.rdb.HSet(ctx, playerSocketsKey(connection.PlayerId), connection.ConnectionId, connection.NodeId).Err()
+}
+
+func (store *RedisStore) ForgetPlayerSocket(ctx context.Context, playerId string, connectionId string) (int, error) {
+	var remaining *redis.IntCmd
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, playerSocketsKey(playerId), connectionId)
+		remaining = pipe.HLen(ctx, playerSocketsKey(playerId))
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(remaining.Val()), nil
+}
+
+func (store *RedisStore) ForgetNodeConnection(ctx context.Context, nodeId string, connectionId string) error {
+	return store.rdb.HDel(ctx, nodeConnectionsKey(nodeId), connectionId).Err()
+}
+
+func (store *RedisStore) GetNodeConnections(ctx context.Context, nodeId string) ([]NodeConnection, error) {
+	recorded, err := store.rdb.HGetAll(ctx, nodeConnectionsKey(nodeId)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	connections := make([]NodeConnection, 0, len(recorded))
+	for connectionId, connectionJson := range recorded {
+		connection := NodeConnection{ConnectionId: connectionId}
+		if err := json.Unmarshal([]byte(connectionJson), &connection); err != nil {
+			connection = NodeConnection{ConnectionId: connectionId}
+		}
+
+		connections = append(connections, connection)
+	}
+
+	return connections, nil
+}
+
+func (store *RedisStore) DeadNodes(ctx context.Context, before time.Time) ([]string, error) {
+	return store.rdb.ZRangeByScore(ctx, nodesKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(before.UnixMilli(), 10),
+	}).Result()
+}
+
+func (store *RedisStore) RemoveNode(ctx context.Context, nodeId string) error {
+	// Under Cluster the node's connections and the list of nodes can be in different slots. The connections go first,
+	// so that if the node can't be removed, whoever cleans up after it once it times out has nothing left to do
+	err := store.rdb.Del(ctx, nodeConnectionsKey(nodeId)).Err()
+	if err != nil {
+		return err
+	}
+
+	return store.rdb.ZRem(ctx, nodesKey, nodeId).Err()
+}
+
+func (store *RedisStore) CountPlayerSockets(ctx context.Context, playerId string) (int, error) {
+	sockets, err := store.rdb.HLen(ctx, playerSocketsKey(playerId)).Result()
+	return int(sockets), err
+}
+
+func (store *MemoryStore) Heartbeat(ctx context.Context, nodeId string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	_, listed := store.nodes[nodeId]
+	store.nodes[nodeId] = time.Now()
+	return !listed || len(store.nodeConnections[nodeId]) == 0, nil
+}
+
+func (store *MemoryStore) RecordNodeConnection(ctx context.Context, connection NodeConnection) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	connectionJson, err := json.Marshal(connection)
+	if err != nil {
+		return err
+	}
+
+	if store.nodeConnections[connection.NodeId] == nil {
+		store.nodeConnections[connection.NodeId] = map[string][]byte{}
+	}
+	store.nodeConnections[connection.NodeId][connection.ConnectionId] = connectionJson
+
+	if store.playerSockets[connection.PlayerId] == nil {
+		store.playerSockets[connection.PlayerId] = map[string]string{}
+	}
+	store.playerSockets[connection.PlayerId][connection.ConnectionId] = connection.NodeId
+
+	return nil
+}
+
+func (store *MemoryStore) ForgetPlayerSocket(ctx context.Context, playerId string, connectionId string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.playerSockets[playerId], connectionId)
+
+	remaining := len(store.playerSockets[playerId])
+	if remaining == 0 {
+		delete(store.playerSockets, playerId)
+	}
+
+	return remaining, nil
+}
+
+func (store *MemoryStore) ForgetNodeConnection(ctx context.Context, nodeId string, connectionId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.nodeConnections[nodeId], connectionId)
+	return nil
+}
+
+func (store *MemoryStore) GetNodeConnections(ctx context.Context, nodeId string) ([]NodeConnection, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	connections := make([]NodeConnection, 0, len(store.nodeConnections[nodeId]))
+	for connectionId := range store.nodeConnections[nodeId] {
+		connection, err := getMemoryJson[NodeConnection](store.nodeConnections[nodeId], connectionId)
+		if err != nil {
+			connection = &NodeConnection{ConnectionId: connectionId}
+		}
+
+		connections = append(connections, *connection)
+	}
+
+	return connections, nil
+}
+
+func (store *MemoryStore) DeadNodes(ctx context.Context, before time.Time) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var deadNodeIds []string
+	for nodeId, lastHeartbeat := range store.nodes {
+		if !lastHeartbeat.After(before) {
+			deadNodeIds = append(deadNodeIds, nodeId)
+		}
+	}
+
+	return deadNodeIds, nil
+}
+
+func (store *MemoryStore) RemoveNode(ctx context.Context, nodeId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.nodeConnections, nodeId)
+	delete(store.nodes, nodeId)
+	return nil
+}
+
+func (store *MemoryStore) CountPlayerSockets(ctx context.Context, playerId string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return len(store.playerSockets[playerId]), nil
+}
+
+// Heartbeat records that the node is still running, and returns whether it had been forgotten
+func (node *Node) Heartbeat(ctx context.Context) (bool, error) {
+	return node.store.Heartbeat(ctx, node.Id)
+}
+
+// Connect records that the player has connected a WebSocket to the node, and stops them forfeiting their game for
+// having disconnected. disconnect must be called once the WebSocket closes
+func (node *Node) Connect(ctx context.Context, connection NodeConnection, logger *slog.Logger) (disconnect func(), err error) {
+	if err := node.record(ctx, connection); err != nil {
+		return nil, err
+	}
+
+	node.mutex.Lock()
+	node.connections[connection.ConnectionId] = connection
+	node.mutex.Unlock()
+
+	if err := node.store.CancelTimer(ctx, disconnectForfeitTimerId(connection.PlayerId)); err != nil {
+		logger.Warn("Failed to cancel disconnect forfeit: " + err.Error())
+	}
+
+	return func() {
+		node.mutex.Lock()
+		delete(node.connections, connection.ConnectionId)
+		node.mutex.Unlock()
+
+		// The request's context has already been cancelled by the time the WebSocket closes
+		if err := node.forget(context.Background(), connection); err != nil {
+			// Forgotten once Redis is back, when the node restores its connections
+			logger.Warn("Failed to remove connection from node: " + err.Error())
+		}
+	}, nil
+}
+
+// record adds the WebSocket to those held by the node and the player
+func (node *Node) record(ctx context.Context, connection NodeConnection) error {
+	return node.store.RecordNodeConnection(ctx, connection)
+}
+
+// forget removes the closed WebSocket from those held by the node and the player, giving the player time to reconnect
+// before they forfeit their game if it was their last one. It is removed from the player's first, which is in a
+// different slot under Cluster, so that the WebSocket is forgotten again if removing it from the node's fails rather
+// than the player being left looking connected
+func (node *Node) forget(ctx context.Context, connection NodeConnection) error {
+	remaining, err := node.store.ForgetPlayerSocket(ctx, connection.PlayerId, connection.ConnectionId)
+	if err != nil {
+		return err
+	}
+
+	err = node.store.ForgetNodeConnection(ctx, node.Id, connection.ConnectionId)
+	if err != nil || remaining > 0 {
+		return err
+	}
+
+	return ScheduleDisconnectForfeit(ctx, node.store, connection.PlayerId)
+}
+
+// restore brings what Redis records about the node's WebSockets back in line with those it holds, once Redis is back
+// after being unavailable or another node has cleaned up after this one. WebSockets that closed in the meantime
+// couldn't be forgotten, and those cleaned up after are no longer recorded
+func (node *Node) restore(ctx context.Context, logger *slog.Logger) error {
+	node.mutex.Lock()
+	held := maps.Clone(node.connections)
+	node.mutex.Unlock()
+
+	recorded, err := node.store.GetNodeConnections(ctx, node.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, connection := range recorded {
+		if _, exists := held[connection.ConnectionId]; exists {
+			continue
+		}
+
+		if len(connection.PlayerId) == 0 {
+			logger.Warn("Dropping connection " + connection.ConnectionId + " that couldn't be read")
+			node.store.ForgetNodeConnection(ctx, node.Id, connection.ConnectionId)
+			continue
+		}
+
+		if err := node.forget(ctx, connection); err != nil {
+			return err
+		}
+
+		// The session couldn't stop counting the WebSocket while Redis was unavailable either
+		node.store.AddSessionSockets(ctx, connection.SessionId, -1)
+	}
+
+	for _, connection := range held {
+		if err := node.record(ctx, connection); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Restored " + strconv.Itoa(len(held)) + " connections")
+	return nil
+}
+
+// Leave removes the node once it has shut down, so that other nodes don't wait for it to time out and then clean up
+// after it
+func (node *Node) Leave(ctx context.Context) error {
+	return node.store.RemoveNode(ctx, node.Id)
+}
+
+// IsPlayerConnected returns whether the player has a WebSocket connected to any node. WebSockets on a node that died
+// still count until another node has cleaned up after it
+func IsPlayerConnected(ctx context.Context, store Store, playerId string) (bool, error) {
+	sockets, err := store.CountPlayerSockets(ctx, playerId)
+	return sockets > 0, err
+}
+
+// RunNode keeps the node's heartbeat going and cleans up after nodes that have died, until the context is done
+func RunNode(ctx context.Context, node *Node, health *RedisHealth, logger *slog.Logger) {
+	ticker := time.NewTicker(nodeHeartbeatInterval)
+	defer ticker.Stop()
+
+	changes, stop := health.Watch()
+	defer stop()
+
+	// Nodes aren't treated as dead before this, such as while they catch up after Redis was unavailable
+	cleanUpFrom := time.Now()
+
+	for {
+		if health.Available() {
+			node.beat(ctx, logger, !time.Now().Before(cleanUpFrom))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case status := <-changes:
+			if status != RedisAvailable {
+				continue
+			}
+
+			// No node could keep its heartbeat going while Redis was unavailable
+			cleanUpFrom = time.Now().Add(nodeTimeout)
+
+			if err := node.restore(ctx, logger); err != nil {
+				logger.Warn("There was an error restoring connections: " + err.Error())
+			}
+		}
+	}
+}
+
+// beat records the node's heartbeat, and cleans up after any nodes that have died if cleanUp is set. If another node
+// took this one for dead and cleaned up after it, such as after a long pause, its WebSockets are recorded again
+func (node *Node) beat(ctx context.Context, logger *slog.Logger, cleanUp bool) {
+	forgotten, err := node.Heartbeat(ctx)
+	if err != nil {
+		logger.Warn("There was an error recording heartbeat: " + err.Error())
+	}
+
+	node.mutex.Lock()
+	holding := len(node.connections) > 0
+	node.mutex.Unlock()
+
+	// A node holding no WebSockets has nothing recorded that could have been cleaned up
+	if forgotten && holding {
+		logger.Warn("Node was cleaned up after while it was still running, restoring its connections")
+		if err := node.restore(ctx, logger); err != nil {
+			logger.Warn("There was an error restoring connections: " + err.Error())
+		}
+	}
+
+	if !cleanUp {
+		return
+	}
+
+	deadNodeIds, err := node.store.DeadNodes(ctx, time.Now().Add(-nodeTimeout))
+	if err != nil {
+		logger.Warn("There was an error fetching dead nodes: " + err.Error())
+	}
+
+	for _, deadNodeId := range deadNodeIds {
+		// This node only looks dead to itself if it couldn't reach Redis for a while
+		if deadNodeId == node.Id {
+			continue
+		}
+
+		err := node.cleanUpAfter(ctx, deadNodeId, logger.With(slog.String("deadNodeId", deadNodeId)))
+		if err != nil {
+			logger.Warn("There was an error cleaning up after node " + deadNodeId + ": " + err.Error())
+		}
+	}
+}
+
+// cleanUpAfter forgets the WebSockets that were connected to a dead node, giving players who aren't connected to any
+// other node time to reconnect before they forfeit their game. Only one node cleans up after each dead node
+func (node *Node) cleanUpAfter(ctx context.Context, deadNodeId string, logger *slog.Logger) error {
+	lock := "node:" + deadNodeId + ":cleanup"
+	acquired, err := node.store.TryLock(ctx, lock, nodeCleanupLease)
+	if err != nil || !acquired {
+		return err
+	}
+
+	connections, err := node.store.GetNodeConnections(ctx, deadNodeId)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Node died, cleaning up " + strconv.Itoa(len(connections)) + " connections")
+
+	for _, connection := range connections {
+		if len(connection.PlayerId) == 0 {
+			logger.Warn("Skipping connection " + connection.ConnectionId + " that couldn't be read")
+			continue
+		}
+
+		// Each connection is forgotten as it is cleaned up, so that none are cleaned up twice if this node dies too
+		remaining, err := node.store.ForgetPlayerSocket(ctx, connection.PlayerId, connection.ConnectionId)
+		if err != nil {
+			return err
+		}
+
+		if err := node.store.ForgetNodeConnection(ctx, deadNodeId, connection.ConnectionId); err != nil {
+			return err
+		}
+
+		// The session may have been revoked since, in which case it has nothing to count
+		node.store.AddSessionSockets(ctx, connection.SessionId, -1)
+
+		if remaining == 0 {
+			if err := ScheduleDisconnectForfeit(ctx, node.store, connection.PlayerId); err != nil {
+				logger.Warn("Failed to schedule disconnect forfeit: " + err.Error())
+			}
+		}
+	}
+
+	// The lock on cleaning up is let go of last, so that no other node starts cleaning up after the dead node while it
+	// is still being removed
+	if err := node.store.RemoveNode(ctx, deadNodeId); err != nil {
+		return err
+	}
+
+	return node.store.Unlock(ctx, lock)
+}
+
+func WithNodeMiddleware(node *Node) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "node", node))
+			next.ServeHTTP(w, modifiedRequest)
+		})
+	}
+}
+
+func GetNodeFromContext(ctx context.Context) *Node {
+	node, ok := ctx.Value("node").(*Node)
+	if !ok {
+		panic("Node in context is not present. Something has gone wrong!")
+	}
+
+	return node
+}
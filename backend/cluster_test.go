@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// A node that another node took for dead, such as after a long pause, records its WebSockets again on its next beat
+func TestBeatRestoresCleanedUpNode(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := NewBackgroundContext(context.Background(), store, nil)
+	node := NewNode("node", store)
+
+	node.beat(ctx, discardLogger(), false)
+
+	connection := NodeConnection{ConnectionId: "connection", NodeId: node.Id, PlayerId: "alice", SessionId: "session"}
+	if _, err := node.Connect(ctx, connection, discardLogger()); err != nil {
+		t.Fatal("Failed to connect: " + err.Error())
+	}
+
+	if err := store.RemoveNode(ctx, node.Id); err != nil {
+		t.Fatal("Failed to remove node: " + err.Error())
+	}
+
+	if _, err := store.ForgetPlayerSocket(ctx, "alice", connection.ConnectionId); err != nil {
+		t.Fatal("Failed to forget socket: " + err.Error())
+	}
+
+	node.beat(ctx, discardLogger(), false)
+
+	recorded, err := store.GetNodeConnections(ctx, node.Id)
+	if err != nil || len(recorded) != 1 || recorded[0].ConnectionId != connection.ConnectionId {
+		t.Fatalf("Expected the connection to be recorded again, got %+v (%v)", recorded, err)
+	}
+
+	if connected, err := IsPlayerConnected(ctx, store, "alice"); err != nil || !connected {
+		t.Fatalf("Expected alice to be connected again, got %v (%v)", connected, err)
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"backend/tournament"
+	"backend/turn"
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"io/fs"
+	_ "modernc.org/sqlite"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Database keeps the records that have to outlive Redis, such as finished games and the players who played them.
+// Live lobbies and games stay in the Store, and are only written through to the database once a game is over. It is
+// also a GameArchive, so games can still be found once Redis no longer has them. Accounts are written through when
+// they are registered and tournaments whenever they change. Arenas are not written through and are only kept in Redis
+type Database struct {
+	db *sql.DB
+}
+
+// LoadDatabasePath reads where the SQLite database is kept from the environment. Nothing is written to a database
+// if it isn't set
+func LoadDatabasePath() (string, bool) {
+	value, exists := os.LookupEnv("SQLITE_PATH")
+	value = strings.TrimSpace(value)
+
+	return value, exists && len(value) > 0
+}
+
+// OpenDatabase opens the SQLite database at the path, creating it if needed, and brings its schema up to date
+func OpenDatabase(ctx context.Context, path string) (*Database, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	database := &Database{db: db}
+	if err := database.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return database, nil
+}
+
+func (database *Database) Close() error {
+	return database.db.Close()
+}
+
+// Migrate applies every embedded migration that hasn't been applied yet, in the order of their file names. Each
+// migration is applied in its own transaction along with the record of it having been applied
+func (database *Database) Migrate(ctx context.Context) error {
+	_, err := database.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version TEXT PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+
+		migration, err := migrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		err = database.inTx(ctx, func(tx *sql.Tx) error {
+			var applied int
+			err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_migrations WHERE version = $1", version).Scan(&applied)
+			if err != nil || applied > 0 {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, string(migration)); err != nil {
+				return errors.New("migration " + version + " failed: " + err.Error())
+			}
+
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)", version, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inTx runs the function in a transaction, which is committed if it returns without an error and rolled back if not
+func (database *Database) inTx(ctx context.Context, run func(tx *sql.Tx) error) error {
+	tx, err := database.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := run(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PlayerRecord is what the database keeps about a player
+type PlayerRecord struct {
+	Player
+	Ratings PlayerRatings
+}
+
+// SaveGameOver writes a finished game through to the database along with the latest records of both of its players
+func (database *Database) SaveGameOver(ctx context.Context, game ArchivedGame, players ...PlayerRecord) error {
+	return database.inTx(ctx, func(tx *sql.Tx) error {
+		for _, player := range players {
+			if err := savePlayerRecord(ctx, tx, player); err != nil {
+				return err
+			}
+		}
+
+		return saveArchivedGame(ctx, tx, game)
+	})
+}
+
+func savePlayerRecord(ctx context.Context, tx *sql.Tx, player PlayerRecord) error {
+	now := time.Now().UTC()
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO players (player_id, username, display_name, avatar, country, bio, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (player_id) DO UPDATE SET
+			username = excluded.username,
+			display_name = excluded.display_name,
+			avatar = excluded.avatar,
+			country = excluded.country,
+			bio = excluded.bio,
+			updated_at = excluded.updated_at
+	`, player.Id, player.Username, player.Profile.DisplayName, string(player.Profile.Avatar), player.Profile.Country, player.Profile.Bio, now)
+	if err != nil {
+		return err
+	}
+
+	for pool, rating := range player.Ratings.Pools {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO player_ratings (player_id, pool, rating, deviation, volatility, games, wins, losses, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (player_id, pool) DO UPDATE SET
+				rating = excluded.rating,
+				deviation = excluded.deviation,
+				volatility = excluded.volatility,
+				games = excluded.games,
+				wins = excluded.wins,
+				losses = excluded.losses,
+				updated_at = excluded.updated_at
+		`, player.Id, pool, rating.Glicko.Rating, rating.Glicko.Deviation, rating.Glicko.Volatility, rating.Games, rating.Wins, rating.Losses, rating.UpdatedAt.UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveArchivedGame saves the game and its moves, unless it has already been saved
+func saveArchivedGame(ctx context.Context, tx *sql.Tx, game ArchivedGame) error {
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO games (game_id, lobby_id, player_1, player_2, variant, time_control, started_at, ended_at, winner, winner_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (game_id) DO NOTHING
+	`, game.GameId, game.LobbyId, game.Player1, game.Player2, string(game.Variant), string(game.TimeControl), game.StartedAt.UTC(), game.EndedAt.UTC(), string(game.Winner), game.WinnerId)
+	if err != nil {
+		return err
+	}
+
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+
+	for i, move := range game.Moves {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO game_moves (game_id, move_number, player, from_position, to_position, made_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, game.GameId, i+1, string(move.Player), move.From, move.To, move.At.UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SaveGame saves a finished game without updating its players, who have to already be in the database
+func (database *Database) SaveGame(ctx context.Context, game ArchivedGame) error {
+	return database.inTx(ctx, func(tx *sql.Tx) error {
+		return saveArchivedGame(ctx, tx, game)
+	})
+}
+
+const selectArchivedGame = `
+	SELECT game_id, lobby_id, player_1, player_2, variant, time_control, started_at, ended_at, winner, winner_id
+	FROM games
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanArchivedGame(row rowScanner) (ArchivedGame, error) {
+	var game ArchivedGame
+	var variant, timeControl, winner string
+
+	err := row.Scan(&game.GameId, &game.LobbyId, &game.Player1, &game.Player2, &variant, &timeControl, &game.StartedAt, &game.EndedAt, &winner, &game.WinnerId)
+	game.Variant = Variant(variant)
+	game.TimeControl = TimeControl(timeControl)
+	game.Winner = turn.Turn(winner)
+	game.Moves = []MoveRecord{}
+
+	return game, err
+}
+
+func (database *Database) getGameMoves(ctx context.Context, game *ArchivedGame) error {
+	rows, err := database.db.QueryContext(ctx, `
+		SELECT player, from_position, to_position, made_at
+		FROM game_moves
+		WHERE game_id = $1
+		ORDER BY move_number
+	`, game.GameId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var move MoveRecord
+		var player string
+		var from sql.NullInt64
+
+		if err := rows.Scan(&player, &from, &move.To, &move.At); err != nil {
+			return err
+		}
+
+		move.Player = turn.Turn(player)
+		if from.Valid {
+			position := int(from.Int64)
+			move.From = &position
+		}
+
+		game.Moves = append(game.Moves, move)
+	}
+
+	return rows.Err()
+}
+
+func (database *Database) GetGame(ctx context.Context, gameId string) (*ArchivedGame, error) {
+	game, err := scanArchivedGame(database.db.QueryRowContext(ctx, selectArchivedGame+" WHERE game_id = $1", gameId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.getGameMoves(ctx, &game); err != nil {
+		return nil, err
+	}
+
+	return &game, nil
+}
+
+func (database *Database) ListPlayerGames(ctx context.Context, playerId string, offset int, limit int) (ArchivedGamePage, error) {
+	page := ArchivedGamePage{
+		Games:  []ArchivedGame{},
+		Offset: offset,
+		Limit:  limit,
+	}
+
+	err := database.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM games WHERE player_1 = $1 OR player_2 = $1", playerId).Scan(&page.Total)
+	if err != nil {
+		return page, err
+	}
+
+	rows, err := database.db.QueryContext(
+		ctx,
+		selectArchivedGame+" WHERE player_1 = $1 OR player_2 = $1 ORDER BY ended_at DESC LIMIT $2 OFFSET $3",
+		playerId,
+		limit,
+		offset,
+	)
+	if err != nil {
+		return page, err
+	}
+
+	for rows.Next() {
+		game, err := scanArchivedGame(rows)
+		if err != nil {
+			rows.Close()
+			return page, err
+		}
+
+		page.Games = append(page.Games, game)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	for i := range page.Games {
+		if err := database.getGameMoves(ctx, &page.Games[i]); err != nil {
+			return page, err
+		}
+	}
+
+	return page, nil
+}
+
+// errAccountExists is returned when saving an account whose username or player already has one
+var errAccountExists = errors.New("an account with the username or player already exists")
+
+// SaveAccount saves a newly registered account along with its player, returning errAccountExists if the username has
+// been taken or the player already has an account
+func (database *Database) SaveAccount(ctx context.Context, account Account, player Player) error {
+	return database.inTx(ctx, func(tx *sql.Tx) error {
+		if err := savePlayerRecord(ctx, tx, PlayerRecord{Player: player}); err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO accounts (username_key, username, password_hash, player_id, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING
+		`, strings.ToLower(account.Username), account.Username, account.PasswordHash, account.PlayerId, account.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+
+		if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+			return errors.Join(err, errAccountExists)
+		}
+
+		return nil
+	})
+}
+
+// DeleteAccount deletes an account that couldn't be registered after all, leaving its player
+func (database *Database) DeleteAccount(ctx context.Context, username string) error {
+	_, err := database.db.ExecContext(ctx, "DELETE FROM accounts WHERE username_key = $1", strings.ToLower(username))
+	return err
+}
+
+func (database *Database) GetAccount(ctx context.Context, username string) (*Account, error) {
+	var account Account
+	err := database.db.QueryRowContext(ctx, `
+		SELECT username, password_hash, player_id, created_at
+		FROM accounts
+		WHERE username_key = $1
+	`, strings.ToLower(username)).Scan(&account.Username, &account.PasswordHash, &account.PlayerId, &account.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// SaveTournament saves the tournament as it is now, replacing its players and rounds. Standings aren't saved, as they
+// are worked out from the rounds
+func (database *Database) SaveTournament(ctx context.Context, tourney Tournament) error {
+	return database.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO tournaments (tournament_id, name, format, organizer_id, state, swiss_rounds, created_at, started_at, finished_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (tournament_id) DO UPDATE SET
+				name = excluded.name,
+				state = excluded.state,
+				swiss_rounds = excluded.swiss_rounds,
+				started_at = excluded.started_at,
+				finished_at = excluded.finished_at
+		`, tourney.TournamentId, tourney.Name, string(tourney.Format), tourney.OrganizerId, string(tourney.State), tourney.SwissRounds, tourney.CreatedAt.UTC(), nullTime(tourney.StartedAt), nullTime(tourney.FinishedAt))
+		if err != nil {
+			return err
+		}
+
+		for _, table := range []string{"tournament_players", "tournament_pairings"} {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE tournament_id = $1", tourney.TournamentId); err != nil {
+				return err
+			}
+		}
+
+		for seed, playerId := range tourney.Players {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO tournament_players (tournament_id, seed, player_id)
+				VALUES ($1, $2, $3)
+			`, tourney.TournamentId, seed+1, playerId)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, round := range tourney.Rounds {
+			for i, pairing := range round.Pairings {
+				_, err := tx.ExecContext(ctx, `
+					INSERT INTO tournament_pairings (tournament_id, round_number, pairing_number, player_1, player_2, lobby_id, winner, forfeited)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				`, tourney.TournamentId, round.Number, i+1, pairing.Player1, pairing.Player2, pairing.LobbyId, pairing.Winner, pairing.Forfeited)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+func (database *Database) GetTournament(ctx context.Context, tournamentId string) (*Tournament, error) {
+	tourney := Tournament{
+		Players:   []string{},
+		Rounds:    []tournament.Round{},
+		Standings: []tournament.Standing{},
+	}
+
+	var format, state string
+	var startedAt, finishedAt sql.NullTime
+	err := database.db.QueryRowContext(ctx, `
+		SELECT tournament_id, name, format, organizer_id, state, swiss_rounds, created_at, started_at, finished_at
+		FROM tournaments
+		WHERE tournament_id = $1
+	`, tournamentId).Scan(&tourney.TournamentId, &tourney.Name, &format, &tourney.OrganizerId, &state, &tourney.SwissRounds, &tourney.CreatedAt, &startedAt, &finishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	tourney.Format = tournament.Format(format)
+	tourney.State = TournamentState(state)
+	if startedAt.Valid {
+		tourney.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		tourney.FinishedAt = &finishedAt.Time
+	}
+
+	rows, err := database.db.QueryContext(ctx, "SELECT player_id FROM tournament_players WHERE tournament_id = $1 ORDER BY seed", tournamentId)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var playerId string
+		if err := rows.Scan(&playerId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		tourney.Players = append(tourney.Players, playerId)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = database.db.QueryContext(ctx, `
+		SELECT round_number, player_1, player_2, lobby_id, winner, forfeited
+		FROM tournament_pairings
+		WHERE tournament_id = $1
+		ORDER BY round_number, pairing_number
+	`, tournamentId)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var number int
+		var pairing tournament.Pairing
+		if err := rows.Scan(&number, &pairing.Player1, &pairing.Player2, &pairing.LobbyId, &pairing.Winner, &pairing.Forfeited); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if len(tourney.Rounds) == 0 || tourney.Rounds[len(tourney.Rounds)-1].Number != number {
+			tourney.Rounds = append(tourney.Rounds, tournament.Round{Number: number})
+		}
+
+		round := &tourney.Rounds[len(tourney.Rounds)-1]
+		round.Pairings = append(round.Pairings, pairing)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tourney.Standings = tournament.Standings(tourney.Players, tourney.Rounds)
+
+	return &tourney, nil
+}
+
+// WithDatabaseMiddleware adds the database to the context. It is nil when no database has been set up
+func WithDatabaseMiddleware(database *Database) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "database", database))
+			next.ServeHTTP(w, modifiedRequest)
+		})
+	}
+}
+
+// GetDatabaseFromContext returns the database, or nil if there isn't one
+func GetDatabaseFromContext(ctx context.Context) *Database {
+	database, ok := ctx.Value("database").(*Database)
+	if !ok {
+		panic("Database in context is not present. Something has gone wrong!")
+	}
+
+	return database
+}
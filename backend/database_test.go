@@ -0,0 +1,228 @@
+package main
+
+import (
+	"backend/glicko"
+	"backend/tournament"
+	"backend/turn"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	database, err := OpenDatabase(context.Background(), filepath.Join(t.TempDir(), "rota.db"))
+	if err != nil {
+		t.Fatal("Failed to open database: " + err.Error())
+	}
+	t.Cleanup(func() { database.Close() })
+
+	return database
+}
+
+func newTestArchivedGame(gameId string, player1 string, player2 string, endedAt time.Time) ArchivedGame {
+	from := 3
+	return ArchivedGame{
+		GameId:      gameId,
+		LobbyId:     "lobby-" + gameId,
+		Player1:     player1,
+		Player2:     player2,
+		Variant:     Classic,
+		TimeControl: Unlimited,
+		StartedAt:   endedAt.Add(-time.Minute),
+		EndedAt:     endedAt,
+		Moves: []MoveRecord{
+			{Player: turn.Player1, To: 3, At: endedAt.Add(-time.Minute)},
+			{Player: turn.Player2, From: &from, To: 4, At: endedAt},
+		},
+		Winner:   turn.Player1,
+		WinnerId: player1,
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	database := newTestDatabase(t)
+	ctx := context.Background()
+
+	// Every migration has already been applied by OpenDatabase, so applying them again does nothing
+	if err := database.Migrate(ctx); err != nil {
+		t.Fatal("Failed to migrate again: " + err.Error())
+	}
+
+	var applied int
+	if err := database.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatal("Failed to count migrations: " + err.Error())
+	}
+
+	if applied != 3 {
+		t.Fatalf("Expected 3 applied migrations, got %d", applied)
+	}
+}
+
+func TestSaveGameOver(t *testing.T) {
+	database := newTestDatabase(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	alice := PlayerRecord{
+		Player: *NewPlayer("alice"),
+		Ratings: PlayerRatings{
+			PlayerId: "alice",
+			Pools: map[string]PlayerRating{
+				RatingPool(Classic, Unlimited): {Glicko: glicko.NewRating(), Games: 1, Wins: 1, UpdatedAt: now},
+			},
+		},
+	}
+	bob := PlayerRecord{Player: *NewPlayer("bob")}
+
+	first := newTestArchivedGame("first", "alice", "bob", now.Add(-time.Hour))
+	second := newTestArchivedGame("second", "bob", "alice", now)
+
+	for _, game := range []ArchivedGame{first, second, first} {
+		if err := database.SaveGameOver(ctx, game, alice, bob); err != nil {
+			t.Fatal("Failed to save game: " + err.Error())
+		}
+	}
+
+	game, err := database.GetGame(ctx, "first")
+	if err != nil {
+		t.Fatal("Failed to get game: " + err.Error())
+	}
+
+	if game == nil || !reflect.DeepEqual(*game, first) {
+		t.Fatalf("Expected %+v, got %+v", first, game)
+	}
+
+	missing, err := database.GetGame(ctx, "missing")
+	if err != nil || missing != nil {
+		t.Fatalf("Expected no game, got %+v, %v", missing, err)
+	}
+
+	page, err := database.ListPlayerGames(ctx, "alice", 0, 10)
+	if err != nil {
+		t.Fatal("Failed to list games: " + err.Error())
+	}
+
+	// Saving the first game again didn't add it twice, and the latest game comes first
+	if page.Total != 2 || len(page.Games) != 2 || page.Games[0].GameId != "second" || page.Games[1].GameId != "first" {
+		t.Fatalf("Expected the second then first game, got %+v", page)
+	}
+
+	if !reflect.DeepEqual(page.Games[1].Moves, first.Moves) {
+		t.Fatalf("Expected moves %+v, got %+v", first.Moves, page.Games[1].Moves)
+	}
+
+	page, err = database.ListPlayerGames(ctx, "bob", 1, 10)
+	if err != nil {
+		t.Fatal("Failed to list games: " + err.Error())
+	}
+
+	if page.Total != 2 || len(page.Games) != 1 || page.Games[0].GameId != "first" {
+		t.Fatalf("Expected only the first game after the offset, got %+v", page)
+	}
+}
+
+func TestSaveAccount(t *testing.T) {
+	database := newTestDatabase(t)
+	ctx := context.Background()
+
+	account := Account{
+		Username:     "Alice",
+		PasswordHash: "hash",
+		PlayerId:     "alice",
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+	}
+
+	player := NewPlayer("alice")
+	player.Username = &account.Username
+	if err := database.SaveAccount(ctx, account, *player); err != nil {
+		t.Fatal("Failed to save account: " + err.Error())
+	}
+
+	// Usernames are unique regardless of case, and each player can only have one account
+	taken := account
+	taken.Username, taken.PlayerId = "ALICE", "bob"
+	if err := database.SaveAccount(ctx, taken, *NewPlayer("bob")); !errors.Is(err, errAccountExists) {
+		t.Fatalf("Expected the username to be taken, got %v", err)
+	}
+
+	second := account
+	second.Username = "alice2"
+	if err := database.SaveAccount(ctx, second, *NewPlayer("alice")); !errors.Is(err, errAccountExists) {
+		t.Fatalf("Expected the player to already have an account, got %v", err)
+	}
+
+	stored, err := database.GetAccount(ctx, "aLiCe")
+	if err != nil {
+		t.Fatal("Failed to get account: " + err.Error())
+	}
+
+	if stored == nil || *stored != account {
+		t.Fatalf("Expected %+v, got %+v", account, stored)
+	}
+
+	if err := database.DeleteAccount(ctx, "alice"); err != nil {
+		t.Fatal("Failed to delete account: " + err.Error())
+	}
+
+	stored, err = database.GetAccount(ctx, "alice")
+	if err != nil || stored != nil {
+		t.Fatalf("Expected no account, got %+v, %v", stored, err)
+	}
+}
+
+func TestSaveTournament(t *testing.T) {
+	database := newTestDatabase(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tourney := Tournament{
+		TournamentId: "cup",
+		Name:         "Cup",
+		Format:       tournament.Knockout,
+		OrganizerId:  "alice",
+		State:        TournamentRegistering,
+		Players:      []string{"alice", "bob", "carol"},
+		Rounds:       []tournament.Round{},
+		Standings:    []tournament.Standing{},
+		CreatedAt:    now,
+	}
+
+	if err := database.SaveTournament(ctx, tourney); err != nil {
+		t.Fatal("Failed to save tournament: " + err.Error())
+	}
+
+	// Saving it again once it has started replaces the players and rounds
+	tourney.State = TournamentInProgress
+	tourney.StartedAt = &now
+	tourney.Players = []string{"carol", "alice", "bob"}
+	tourney.Rounds = append(tourney.Rounds, tournament.NextRound(tourney.Format, tourney.Players, tourney.Rounds))
+	tourney.Rounds[0].Pairings[0].LobbyId = &tourney.TournamentId
+	tourney.Rounds[0].Pairings[0].Winner = &tourney.Players[0]
+	tourney.Rounds = append(tourney.Rounds, tournament.Round{Number: 2, Pairings: []tournament.Pairing{
+		{Player1: "alice", Player2: &tourney.Players[0], Forfeited: true},
+	}})
+	tourney.Standings = tournament.Standings(tourney.Players, tourney.Rounds)
+
+	if err := database.SaveTournament(ctx, tourney); err != nil {
+		t.Fatal("Failed to save tournament: " + err.Error())
+	}
+
+	stored, err := database.GetTournament(ctx, "cup")
+	if err != nil {
+		t.Fatal("Failed to get tournament: " + err.Error())
+	}
+
+	if stored == nil || !reflect.DeepEqual(*stored, tourney) {
+		t.Fatalf("Expected %+v, got %+v", tourney, stored)
+	}
+
+	missing, err := database.GetTournament(ctx, "missing")
+	if err != nil || missing != nil {
+		t.Fatalf("Expected no tournament, got %+v, %v", missing, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorCode identifies why a request failed. Codes are stable, so clients can rely on them to react to specific
+// failures and to show their own, localised messages
+type ErrorCode string
+
+const (
+	InvalidRequest     ErrorCode = "INVALID_REQUEST"
+	Unauthenticated    ErrorCode = "UNAUTHENTICATED"
+	Forbidden          ErrorCode = "FORBIDDEN"
+	PreconditionFailed ErrorCode = "PRECONDITION_FAILED"
+	OriginNotAllowed   ErrorCode = "ORIGIN_NOT_ALLOWED"
+	InvalidCSRFToken   ErrorCode = "INVALID_CSRF_TOKEN"
+	RateLimited        ErrorCode = "RATE_LIMITED"
+	TooManyConnections ErrorCode = "TOO_MANY_CONNECTIONS"
+	InternalError      ErrorCode = "INTERNAL_ERROR"
+	ServiceUnavailable ErrorCode = "SERVICE_UNAVAILABLE"
+	ServerRestarting   ErrorCode = "SERVER_RESTARTING"
+
+	LobbyNotFound    ErrorCode = "LOBBY_NOT_FOUND"
+	LobbyNotJoinable ErrorCode = "LOBBY_NOT_JOINABLE"
+	LobbyFull        ErrorCode = "LOBBY_FULL"
+	NotInLobby       ErrorCode = "NOT_IN_LOBBY"
+	ConcurrentEdit   ErrorCode = "CONCURRENT_EDIT"
+	WaitingForPlayer ErrorCode = "WAITING_FOR_PLAYER_2"
+
+	ChatMessageLength ErrorCode = "CHAT_MESSAGE_LENGTH"
+
+	VersionConflict      ErrorCode = "VERSION_CONFLICT"
+	IdempotencyKeyReused ErrorCode = "IDEMPOTENCY_KEY_REUSED"
+
+	InvalidUsername    ErrorCode = "INVALID_USERNAME"
+	InvalidPassword    ErrorCode = "INVALID_PASSWORD"
+	InvalidCredentials ErrorCode = "INVALID_CREDENTIALS"
+	AlreadyRegistered  ErrorCode = "ALREADY_REGISTERED"
+	UsernameTaken      ErrorCode = "USERNAME_TAKEN"
+	PlayerNotFound     ErrorCode = "PLAYER_NOT_FOUND"
+	SessionNotFound    ErrorCode = "SESSION_NOT_FOUND"
+
+	DisplayNameLength     ErrorCode = "DISPLAY_NAME_LENGTH"
+	DisplayNameCharacters ErrorCode = "DISPLAY_NAME_CHARACTERS"
+	InvalidAvatar         ErrorCode = "INVALID_AVATAR"
+	InvalidCountry        ErrorCode = "INVALID_COUNTRY"
+	BioLength             ErrorCode = "BIO_LENGTH"
+	Profanity             ErrorCode = "PROFANITY"
+
+	GameNotFound   ErrorCode = "GAME_NOT_FOUND"
+	SeasonNotFound ErrorCode = "SEASON_NOT_FOUND"
+
+	TournamentNotFound ErrorCode = "TOURNAMENT_NOT_FOUND"
+	RegistrationClosed ErrorCode = "REGISTRATION_CLOSED"
+	NotOrganizer       ErrorCode = "NOT_ORGANIZER"
+	AlreadyStarted     ErrorCode = "ALREADY_STARTED"
+	NotEnoughPlayers   ErrorCode = "NOT_ENOUGH_PLAYERS"
+
+	ArenaNotFound        ErrorCode = "ARENA_NOT_FOUND"
+	ArenaAlreadyFinished ErrorCode = "ARENA_FINISHED"
+	NotInArena           ErrorCode = "NOT_IN_ARENA"
+)
+
+var errorStatuses = map[ErrorCode]int{
+	InvalidRequest:     http.StatusBadRequest,
+	Unauthenticated:    http.StatusUnauthorized,
+	Forbidden:          http.StatusForbidden,
+	PreconditionFailed: http.StatusPreconditionFailed,
+	OriginNotAllowed:   http.StatusForbidden,
+	InvalidCSRFToken:   http.StatusForbidden,
+	RateLimited:        http.StatusTooManyRequests,
+	TooManyConnections: http.StatusTooManyRequests,
+	InternalError:      http.StatusInternalServerError,
+	ServiceUnavailable: http.StatusServiceUnavailable,
+	ServerRestarting:   http.StatusServiceUnavailable,
+
+	LobbyNotFound:    http.StatusNotFound,
+	LobbyNotJoinable: http.StatusConflict,
+	LobbyFull:        http.StatusConflict,
+	NotInLobby:       http.StatusConflict,
+	ConcurrentEdit:   http.StatusConflict,
+	WaitingForPlayer: http.StatusConflict,
+
+	ChatMessageLength: http.StatusBadRequest,
+
+	VersionConflict:      http.StatusConflict,
+	IdempotencyKeyReused: http.StatusUnprocessableEntity,
+
+	ErrorCode(WrongPlayer):                 http.StatusConflict,
+	ErrorCode(GameIsOver):                  http.StatusConflict,
+	ErrorCode(TargetOutOfBounds):           http.StatusBadRequest,
+	ErrorCode(SourceMissing):               http.StatusBadRequest,
+	ErrorCode(SourceOutOfBounds):           http.StatusBadRequest,
+	ErrorCode(TargetIsNotEmpty):            http.StatusUnprocessableEntity,
+	ErrorCode(SourceDoesNotBelongToPlayer): http.StatusUnprocessableEntity,
+	ErrorCode(InvalidTarget):               http.StatusUnprocessableEntity,
+
+	InvalidUsername:    http.StatusBadRequest,
+	InvalidPassword:    http.StatusBadRequest,
+	InvalidCredentials: http.StatusUnauthorized,
+	AlreadyRegistered:  http.StatusConflict,
+	UsernameTaken:      http.StatusConflict,
+	PlayerNotFound:     http.StatusNotFound,
+	SessionNotFound:    http.StatusNotFound,
+
+	DisplayNameLength:     http.StatusBadRequest,
+	DisplayNameCharacters: http.StatusBadRequest,
+	InvalidAvatar:         http.StatusBadRequest,
+	InvalidCountry:        http.StatusBadRequest,
+	BioLength:             http.StatusBadRequest,
+	Profanity:             http.StatusBadRequest,
+
+	GameNotFound:   http.StatusNotFound,
+	SeasonNotFound: http.StatusNotFound,
+
+	TournamentNotFound: http.StatusNotFound,
+	RegistrationClosed: http.StatusConflict,
+	NotOrganizer:       http.StatusForbidden,
+	AlreadyStarted:     http.StatusConflict,
+	NotEnoughPlayers:   http.StatusConflict,
+
+	ArenaNotFound:        http.StatusNotFound,
+	ArenaAlreadyFinished: http.StatusConflict,
+	NotInArena:           http.StatusConflict,
+}
+
+var invalidMoveMessages = map[InvalidMove]string{
+	WrongPlayer:                 "It is not your turn",
+	GameIsOver:                  "The game is already over",
+	TargetOutOfBounds:           "The target position is not on the board",
+	TargetIsNotEmpty:            "The target position already has a piece on it",
+	SourceMissing:               "A piece to move must be chosen once every piece has been placed",
+	SourceOutOfBounds:           "The piece to move is not on the board",
+	SourceDoesNotBelongToPlayer: "The piece to move belongs to the other player",
+	InvalidTarget:               "The piece can't move to the target position",
+}
+
+// ApiError is the body of every unsuccessful response
+type ApiError struct {
+	Code    ErrorCode
+	Message string
+	Status  int
+	Details map[string]any `json:",omitempty"`
+}
+
+// StatusForCode returns the HTTP status that is sent with the error code
+func StatusForCode(code ErrorCode) int {
+	status, exists := errorStatuses[code]
+	if !exists {
+		return http.StatusInternalServerError
+	}
+
+	return status
+}
+
+// WriteError sends an ApiError for the code, with the status the code maps to
+func WriteError(w http.ResponseWriter, code ErrorCode, message string) {
+	WriteErrorDetails(w, code, message, nil)
+}
+
+// WriteErrorDetails sends an ApiError for the code, along with any details that explain it further
+func WriteErrorDetails(w http.ResponseWriter, code ErrorCode, message string, details map[string]any) {
+	status := StatusForCode(code)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ApiError{
+		Code:    code,
+		Message: message,
+		Status:  status,
+		Details: details,
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"backend/profanity"
+	"backend/turn"
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// LobbyLogKind is what happened in a lobby
+type LobbyLogKind string
+
+const (
+	LobbyCreated   LobbyLogKind = "LOBBY_CREATED"
+	PlayerJoined   LobbyLogKind = "PLAYER_JOINED"
+	PlayerLeft     LobbyLogKind = "PLAYER_LEFT"
+	MoveMade       LobbyLogKind = "MOVE_MADE"
+	PlayerResigned LobbyLogKind = "PLAYER_RESIGNED"
+	ChatSent       LobbyLogKind = "CHAT_SENT"
+)
+
+// LobbyLogEntry records something that happened in a lobby. Every change to a lobby is added to its log in the same
+// transaction that saves the lobby, so the lobby can always be rebuilt by replaying its log from the start
+type LobbyLogEntry struct {
+	// Set once the entry has been saved. IDs only ever increase, so clients can ask for the entries after the last one
+	// they saw
+	Id       string `json:",omitempty"`
+	Kind     LobbyLogKind
+	PlayerId string
+	At       time.Time
+	// The lobby as it was created, which already has both players and a game if it was created by the server
+	Lobby *Lobby `json:",omitempty"`
+	// The game started by the second player joining
+	Game *Game `json:",omitempty"`
+	From *int  `json:",omitempty"`
+	To   *int  `json:",omitempty"`
+	// What was said in a chat message
+	Message string `json:",omitempty"`
+}
+
+// LobbyLog is a lobby's log, along with the lobby rebuilt from it when the whole log was read
+type LobbyLog struct {
+	Events []LobbyLogEntry
+	Lobby  *Lobby `json:",omitempty"`
+}
+
+type ChatMessage struct {
+	PlayerId string
+	Message  string
+	At       time.Time
+}
+
+const maxChatMessageLength = 500
+
+// lobbySeat returns which player in the lobby's game the player is
+func lobbySeat(lobby Lobby, playerId string) turn.Turn {
+	if lobby.Player1 == playerId {
+		return turn.Player1
+	}
+
+	return turn.Player2
+}
+
+// newMoveLogEntry records a move made by the player, at the time the game says it was made
+func newMoveLogEntry(playerId string, move PlayerMove, game Game) *LobbyLogEntry {
+	to := move.to
+
+	return &LobbyLogEntry{
+		Kind:     MoveMade,
+		PlayerId: playerId,
+		At:       game.Moves[len(game.Moves)-1].At,
+		From:     move.from,
+		To:       &to,
+	}
+}
+
+// ReplayLobby rebuilds a lobby from its log, or returns nil if everyone has left it
+func ReplayLobby(entries []LobbyLogEntry) (*Lobby, error) {
+	var lobby *Lobby
+
+	for _, entry := range entries {
+		if entry.Kind == LobbyCreated {
+			if entry.Lobby == nil {
+				return nil, errors.New("entry " + entry.Id + " created a lobby without saving it")
+			}
+
+			// Games are copied, so that replaying the log never changes its entries
+			created := *entry.Lobby
+			if created.Game != nil {
+				game := *created.Game
+				created.Game = &game
+			}
+
+			lobby = &created
+			continue
+		}
+
+		// Chat messages don't change the lobby
+		if entry.Kind == ChatSent {
+			continue
+		}
+
+		if lobby == nil {
+			return nil, errors.New("entry " + entry.Id + " is for a lobby that doesn't exist")
+		}
+
+		switch entry.Kind {
+		case PlayerJoined:
+			playerId := entry.PlayerId
+			lobby.Player2 = &playerId
+			lobby.Game = nil
+			if entry.Game != nil {
+				game := *entry.Game
+				lobby.Game = &game
+			}
+		case PlayerLeft:
+			if lobby.RemovePlayer(entry.PlayerId) == nil {
+				lobby = nil
+			}
+		case MoveMade:
+			if lobby.Game == nil || entry.To == nil {
+				return nil, errors.New("move " + entry.Id + " can't be replayed without a game")
+			}
+
+			game, err := lobby.Game.evaluateMoveAt(lobbySeat(*lobby, entry.PlayerId), PlayerMove{from: entry.From, to: *entry.To}, entry.At)
+			if err != nil {
+				return nil, errors.New("move " + entry.Id + " can't be replayed: " + err.Error())
+			}
+
+			lobby.Game = &game
+		case PlayerResigned:
+			if lobby.Game == nil {
+				return nil, errors.New("resignation " + entry.Id + " can't be replayed without a game")
+			}
+
+			if err := lobby.Game.Resign(lobbySeat(*lobby, entry.PlayerId), entry.At); err != nil {
+				return nil, errors.New("resignation " + entry.Id + " can't be replayed: " + err.Error())
+			}
+		default:
+			return nil, errors.New("entry " + entry.Id + " has unknown kind " + string(entry.Kind))
+		}
+	}
+
+	return lobby, nil
+}
+
+// Resign ends the game in the lobby with the player's opponent as the winner, and sends the result to both players
+func Resign(ctx context.Context, store Store, logger *slog.Logger, playerId string, lobbyId string) (Lobby, error) {
+	logger = logger.With("lobbyId", lobbyId)
+
+	var updatedLobby Lobby
+	var entry *LobbyLogEntry
+
+	err := store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		lobby, err := tx.GetLobby(ctx)
+		if err != nil {
+			return err
+		}
+
+		seat, err := checkMoveLobby(lobby, playerId, MoveOptions{})
+		if err != nil {
+			return err
+		}
+
+		entry = &LobbyLogEntry{Kind: PlayerResigned, PlayerId: playerId, At: time.Now()}
+		if err := lobby.Game.Resign(seat, entry.At); err != nil {
+			return err
+		}
+
+		tx.AppendLobbyEvent(entry)
+		tx.SetLobby(*lobby)
+		tx.SetGameOver(newGameOverTimer(*lobby))
+		updatedLobby = *lobby
+
+		return nil
+	})
+
+	if err != nil {
+		return updatedLobby, err
+	}
+
+	logger.Info("Player resigned, broadcasting updated game")
+	publishGameUpdate(ctx, store, logger, updatedLobby, entry.Id)
+
+	HandleGameOver(ctx, logger, updatedLobby)
+
+	return updatedLobby, nil
+}
+
+// SendChatMessage adds the message to the lobby's log and sends it to everyone in the lobby
+func SendChatMessage(ctx context.Context, store Store, logger *slog.Logger, playerId string, lobbyId string, message string) (ChatMessage, error) {
+	logger = logger.With("lobbyId", lobbyId)
+
+	chatMessage := ChatMessage{
+		PlayerId: playerId,
+		Message:  strings.TrimSpace(message),
+	}
+
+	length := utf8.RuneCountInString(chatMessage.Message)
+	if length == 0 || length > maxChatMessageLength {
+		return chatMessage, LobbyValidationError{cause: ChatMessageLength, message: "Chat messages must be between 1 and " + strconv.Itoa(maxChatMessageLength) + " characters"}
+	}
+
+	if profanity.Contains(chatMessage.Message) {
+		return chatMessage, LobbyValidationError{cause: Profanity, message: "Chat messages can't contain profanity"}
+	}
+
+	var recipients []string
+	var entry *LobbyLogEntry
+
+	err := store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		lobby, err := tx.GetLobby(ctx)
+		if err != nil {
+			return err
+		}
+
+		if lobby == nil || !lobby.HasPlayer(playerId) {
+			return LobbyValidationError{cause: NotInLobby, message: "The player is not in lobby " + lobbyId}
+		}
+
+		recipients = []string{lobby.Player1}
+		if lobby.Player2 != nil {
+			recipients = append(recipients, *lobby.Player2)
+		}
+
+		chatMessage.At = time.Now()
+		entry = &LobbyLogEntry{Kind: ChatSent, PlayerId: playerId, At: chatMessage.At, Message: chatMessage.Message}
+		tx.AppendLobbyEvent(entry)
+
+		return nil
+	})
+
+	if err != nil {
+		return chatMessage, err
+	}
+
+	logger.Debug("Sending chat message to players")
+	PublishLobbyEvent(ctx, store, logger, LobbyEventMessage{
+		Event:   ChatMessageSent,
+		EventId: entry.Id,
+		Chat:    &chatMessage,
+	}, recipients...)
+
+	return chatMessage, nil
+}
+
+// CatchUp returns the message that brings a reconnecting player up to date with everything that has happened in
+// their lobby since the entry they last saw, or nil if nothing has
+func CatchUp(ctx context.Context, store Store, playerId string, lastEventId string) (*LobbyEventMessage, error) {
+	player, err := store.GetPlayer(ctx, playerId)
+	if err != nil || player == nil || player.CurrentLobby == nil {
+		return nil, err
+	}
+
+	entries, err := store.GetLobbyEvents(ctx, *player.CurrentLobby, lastEventId)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	// Read after the log, so that the game is at least as new as the last entry. The player's CurrentLobby is only
+	// trusted once the lobby agrees they are in it
+	lobby, err := store.GetLobby(ctx, *player.CurrentLobby)
+	if err != nil || lobby == nil || !lobby.HasPlayer(playerId) {
+		return nil, err
+	}
+
+	profiles, err := GetLobbyProfiles(ctx, store, *lobby)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LobbyEventMessage{
+		Event:   CaughtUp,
+		EventId: entries[len(entries)-1].Id,
+		Game:    lobby.Game,
+		Players: profiles,
+		Events:  entries,
+	}, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// How long a lobby is kept once nothing has happened in it. Saving the lobby, adding to its log and its players
+// staying connected all keep it alive
+const lobbyLifetime = time.Hour
+
+// How long a lobby and its log are kept after the lobby expires, so that the sweeper can still find out who was in
+// it. Lobbies that are never swept, such as when no server was listening for them expiring, are deleted once this
+// runs out too
+const lobbyExpiryGrace = time.Hour
+
+// How long a guest is kept after they were last active. Players who have registered an account are kept forever
+const guestLifetime = 30 * 24 * time.Hour
+
+// How long to wait before listening for expired lobbies again after failing to
+const lobbySweeperRetryDelay = 5 * time.Second
+
+// lobbyExpiryKey expires when the lobby does. The lobby itself is kept a while longer, so that it can be read once
+// it has expired
+func lobbyExpiryKey(lobbyId string) string {
+	return withHashTag(lobbyHashTag(lobbyId), "lobby:"+lobbyId+":expiry")
+}
+
+// lobbyIdFromExpiryKey returns the ID of the lobby the key is the expiry key of, if it is one
+func lobbyIdFromExpiryKey(key string) (string, bool) {
+	key = withoutHashTag(key)
+	if !strings.HasPrefix(key, "lobby:") || !strings.HasSuffix(key, ":expiry") {
+		return "", false
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(key, "lobby:"), ":expiry"), true
+}
+
+// isGuest returns whether the player is only kept for as long as they stay active
+func isGuest(player Player) bool {
+	return player.Username == nil
+}
+
+// EnableExpiryNotifications turns on the keyspace notifications that tell servers when keys expire, keeping any that
+// are already on. Managed Redis services may not allow this, in which case they have to be turned on some other way
+func EnableExpiryNotifications(ctx context.Context, rdb redis.UniversalClient) error {
+	return forEachPrimary(ctx, rdb, enableExpiryNotifications)
+}
+
+func enableExpiryNotifications(ctx context.Context, rdb *redis.Client) error {
+	config, err := rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+
+	flags := config["notify-keyspace-events"]
+	if !strings.Contains(flags, "E") {
+		flags += "E"
+	}
+
+	// A is an alias for every kind of event, including expiry
+	if !strings.Contains(flags, "x") && !strings.Contains(flags, "A") {
+		flags += "x"
+	}
+
+	if flags == config["notify-keyspace-events"] {
+		return nil
+	}
+
+	return rdb.ConfigSet(ctx, "notify-keyspace-events", flags).Err()
+}
+
+// ExpireLobby closes the lobby if it has expired, taking its players out of it and telling them that it was closed.
+// Every server is told when a lobby expires, but only one of them closes it
+func ExpireLobby(ctx context.Context, store Store, logger *slog.Logger, lobbyId string) error {
+	var seated []string
+	var gameId *string
+	var abandonedLobby *Lobby
+
+	err := store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		seated = nil
+		gameId = nil
+		abandonedLobby = nil
+
+		lobby, err := tx.GetLobby(ctx)
+		if err != nil || lobby == nil {
+			return err
+		}
+
+		expiresAt, err := tx.GetLobbyExpiry(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Something happened in the lobby after it expired
+		if !expiresAt.IsZero() {
+			logger.Debug("Lobby was active again before it could be closed")
+			return nil
+		}
+
+		seated = []string{lobby.Player1}
+		if lobby.Player2 != nil {
+			seated = append(seated, *lobby.Player2)
+		}
+
+		if lobby.Game != nil && lobby.Game.State == GameOver {
+			gameId = &lobby.Game.Id
+		}
+
+		// A tournament or arena game that is still being played is abandoned, the same as if both players had left it
+		if lobby.IsMatchLobby() && lobby.Player2 != nil && lobby.Game != nil && lobby.Game.State != GameOver {
+			abandoned := *lobby
+			abandonedLobby = &abandoned
+		}
+
+		tx.DeleteLobby()
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Hands off the job that records the result of the game, in case the server that ended it died before it could
+	if gameId != nil {
+		if err := store.HandOffGameOver(ctx, lobbyId, *gameId); err != nil {
+			logger.Warn("There was an error scheduling the expired lobby's game result to be recorded: " + err.Error())
+		}
+	}
+
+	if abandonedLobby != nil {
+		recordAbandonedGame(ctx, store, logger, *abandonedLobby)
+	}
+
+	// Only the players who hadn't already moved on to another lobby are told
+	var playerIds []string
+	for _, playerId := range seated {
+		cleared, err := clearCurrentLobby(ctx, store, playerId, lobbyId)
+		if err != nil {
+			logger.Warn("There was an error taking player " + playerId + " out of expired lobby: " + err.Error())
+			continue
+		}
+
+		if cleared {
+			playerIds = append(playerIds, playerId)
+		}
+	}
+
+	if len(playerIds) > 0 {
+		logger.Info("Closed expired lobby, telling its players")
+		PublishLobbyEvent(ctx, store, logger, LobbyEventMessage{Event: LobbyExpired}, playerIds...)
+	}
+
+	return nil
+}
+
+// recordAbandonedGame records a tournament or arena game that expired before it finished. Neither player is more to
+// blame than the other, so both forfeit a tournament game, and both go back to an arena's pool without scoring
+func recordAbandonedGame(ctx context.Context, store Store, logger *slog.Logger, lobby Lobby) {
+	if lobby.TournamentId != nil {
+		logger.Info("Tournament game was abandoned, both players forfeit it")
+		err := RecordTournamentForfeit(ctx, store, logger, *lobby.TournamentId, lobby.LobbyId)
+		if err != nil {
+			logger.Warn("There was an error recording the abandoned tournament game: " + err.Error())
+		}
+	}
+
+	if lobby.ArenaId != nil {
+		arena, err := store.GetArena(ctx, *lobby.ArenaId)
+		if err != nil {
+			logger.Warn("There was an error reading the abandoned game's arena: " + err.Error())
+			return
+		}
+
+		if arena == nil || arena.State != ArenaLive {
+			return
+		}
+
+		var entries []ArenaPoolEntry
+		for _, playerId := range []string{lobby.Player1, *lobby.Player2} {
+			if player, exists := arena.Players[playerId]; exists && !player.Paused {
+				entries = append(entries, ArenaPoolEntry{PlayerId: playerId, WaitingSince: time.Now()})
+			}
+		}
+
+		if len(entries) == 0 {
+			return
+		}
+
+		logger.Info("Arena game was abandoned, putting its players back in the pool")
+		err = store.ReturnToArenaPool(ctx, *lobby.ArenaId, entries...)
+		if err != nil {
+			logger.Warn("There was an error putting the abandoned game's players back in the arena pool: " + err.Error())
+		}
+	}
+}
+
+// KeepExpiryNotificationsEnabled turns expiry notifications on, and again each time Redis comes back after being
+// unavailable, since a replica promoted by a failover or a Redis that restarted may not have them on. Runs until the
+// context is done
+func KeepExpiryNotificationsEnabled(ctx context.Context, rdb redis.UniversalClient, health *RedisHealth, logger *slog.Logger) {
+	for {
+		if err := EnableExpiryNotifications(ctx, rdb); err != nil {
+			logger.Warn("Failed to turn on keyspace notifications, expired lobbies will be deleted without telling their players: " + err.Error())
+		}
+
+		recovered, stopWaiting := health.UntilRecovered(ctx)
+		<-recovered.Done()
+		stopWaiting()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// RunLobbySweeper closes lobbies as they expire, until the context is done. It listens again each time Redis comes
+// back after being unavailable, since notifications sent in the meantime are lost, and may now be sent by another node
+func RunLobbySweeper(ctx context.Context, store Store, health *RedisHealth, logger *slog.Logger) {
+	for {
+		listenCtx, stopListening := health.UntilRecovered(ctx)
+
+		expired, err := store.ExpiredLobbies(listenCtx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logger.Warn("There was an error listening for expired lobbies: " + err.Error())
+		}
+
+		if err == nil {
+			// Only stops once the context is done or Redis has recovered
+			for lobbyId := range expired {
+				err := ExpireLobby(ctx, store, logger.With(slog.String("lobbyId", lobbyId)), lobbyId)
+				if err != nil {
+					logger.Warn("There was an error closing expired lobby " + lobbyId + ": " + err.Error())
+				}
+			}
+		}
+
+		// Listens again straight away once Redis is back
+		recovered := listenCtx.Err() != nil && ctx.Err() == nil
+		stopListening()
+		if recovered {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lobbySweeperRetryDelay):
+		}
+	}
+}
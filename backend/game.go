@@ -3,7 +3,9 @@ package main
 import (
 	"backend/position"
 	"backend/turn"
+	"github.com/google/uuid"
 	"math"
+	"time"
 )
 
 type GameState string
@@ -14,16 +16,50 @@ const (
 	GameOver           = "GAME_OVER"
 )
 
+type Variant string
+
+const (
+	Classic Variant = "CLASSIC"
+)
+
+type TimeControl string
+
+const (
+	Unlimited TimeControl = "UNLIMITED"
+)
+
+type MoveRecord struct {
+	Player turn.Turn
+	From   *int
+	To     int
+	At     time.Time
+}
+
 type Game struct {
-	State GameState
-	Turn  turn.Turn
-	Board []position.Position
+	Id string
+	// Incremented by every move, so clients can say which state of the game they made their move against
+	Version     int
+	State       GameState
+	Turn        turn.Turn
+	Board       []position.Position
+	Variant     Variant
+	TimeControl TimeControl
+	Moves       []MoveRecord
+	StartedAt   time.Time
+	EndedAt     *time.Time
+	// The version of the game's document, separate from the version of the lobby it is kept in
+	SchemaVersion int
 }
 
 func NewGame() *Game {
 	return &Game{
-		State: Setup,
-		Turn:  turn.Player1,
+		Id:          uuid.NewString(),
+		State:       Setup,
+		Turn:        turn.Player1,
+		Variant:     Classic,
+		TimeControl: Unlimited,
+		Moves:       []MoveRecord{},
+		StartedAt:   time.Now(),
 		Board: []position.Position{
 			position.Empty,
 			position.Empty,
@@ -47,13 +83,13 @@ type InvalidMove string
 
 const (
 	WrongPlayer                 InvalidMove = "WRONG_PLAYER"
-	TargetOutOfBounds                       = "TARGET_OUT_OF_BOUNDS"
-	TargetIsNotEmpty                        = "TARGET_IS_NOT_EMPTY"
-	SourceMissing                           = "SOURCE_MISSING"
-	SourceOutOfBounds                       = "SOURCE_OUT_OF_BOUNDS"
-	SourceDoesNotBelongToPlayer             = "SOURCE_DOES_NOT_BELONG_PLAYER"
-	InvalidTarget                           = "INVALID_TARGET"
-	GameIsOver                              = "GAME_IS_OVER"
+	TargetOutOfBounds           InvalidMove = "TARGET_OUT_OF_BOUNDS"
+	TargetIsNotEmpty            InvalidMove = "TARGET_IS_NOT_EMPTY"
+	SourceMissing               InvalidMove = "SOURCE_MISSING"
+	SourceOutOfBounds           InvalidMove = "SOURCE_OUT_OF_BOUNDS"
+	SourceDoesNotBelongToPlayer InvalidMove = "SOURCE_DOES_NOT_BELONG_PLAYER"
+	InvalidTarget               InvalidMove = "INVALID_TARGET"
+	GameIsOver                  InvalidMove = "GAME_IS_OVER"
 )
 
 type InvalidMoveError struct {
@@ -93,12 +129,27 @@ func (game *Game) PlayerHasWon(p turn.Turn) bool {
 }
 
 func (currentGame *Game) EvaluateMove(p turn.Turn, move PlayerMove) (Game, error) {
+	return currentGame.evaluateMoveAt(p, move, time.Now())
+}
+
+// evaluateMoveAt evaluates the move as if it was made at the given time, so that moves can be replayed from a lobby's
+// log exactly as they were first made
+func (currentGame *Game) evaluateMoveAt(p turn.Turn, move PlayerMove, now time.Time) (Game, error) {
 	existingBoard := make([]position.Position, len(currentGame.Board))
 	copy(existingBoard, currentGame.Board)
+	existingMoves := make([]MoveRecord, len(currentGame.Moves), len(currentGame.Moves)+1)
+	copy(existingMoves, currentGame.Moves)
 	game := Game{
-		State: currentGame.State,
-		Turn:  currentGame.Turn,
-		Board: existingBoard,
+		Id:          currentGame.Id,
+		Version:     currentGame.Version,
+		State:       currentGame.State,
+		Turn:        currentGame.Turn,
+		Board:       existingBoard,
+		Variant:     currentGame.Variant,
+		TimeControl: currentGame.TimeControl,
+		Moves:       existingMoves,
+		StartedAt:   currentGame.StartedAt,
+		EndedAt:     currentGame.EndedAt,
 	}
 
 	if game.State == GameOver {
@@ -127,15 +178,18 @@ func (currentGame *Game) EvaluateMove(p turn.Turn, move PlayerMove) (Game, error
 	pos := p.AsPosition()
 	if game.State == Setup {
 		game.Board[move.to] = pos
+		game.Moves = append(game.Moves, MoveRecord{Player: p, To: move.to, At: now})
 
 		// Rare case where players set up into a winning position
 		if game.PlayerHasWon(p) || game.PlayerHasWon(nextPlayer) {
 			game.State = GameOver
+			game.EndedAt = &now
 
 			if game.PlayerHasWon(nextPlayer) {
 				game.Turn = nextPlayer
 			}
 
+			game.Version++
 			return game, nil
 		}
 
@@ -176,13 +230,36 @@ func (currentGame *Game) EvaluateMove(p turn.Turn, move PlayerMove) (Game, error
 
 		game.Board[from] = position.Empty
 		game.Board[move.to] = pos
+		game.Moves = append(game.Moves, MoveRecord{Player: p, From: &from, To: move.to, At: now})
 
 		if game.PlayerHasWon(p) {
 			game.State = GameOver
+			game.EndedAt = &now
 		} else {
 			game.Turn = nextPlayer
 		}
 	}
 
+	game.Version++
+
 	return game, nil
 }
+
+// Resign ends the game with the other player as the winner
+func (game *Game) Resign(p turn.Turn, at time.Time) error {
+	if game.State == GameOver {
+		return &InvalidMoveError{cause: GameIsOver}
+	}
+
+	// The player whose turn it is when the game ends is the winner
+	game.Turn = turn.Player1
+	if p == turn.Player1 {
+		game.Turn = turn.Player2
+	}
+
+	game.State = GameOver
+	game.EndedAt = &at
+	game.Version++
+
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"time"
+)
+
+// How long after a game ends the job that records its result is run again, unless it finished the first time
+const gameOverRetryDelay = time.Minute
+
+func gameOverTimerId(gameId string) string {
+	return "game-over:" + gameId
+}
+
+// gameOverKey holds the job that records the result of one of the lobby's games, and is kept in the lobby's slot so
+// that it can be saved along with the end of the game
+func gameOverKey(lobbyId string, gameId string) string {
+	return withHashTag(lobbyHashTag(lobbyId), "lobby:"+lobbyId+":game-over:"+gameId)
+}
+
+// newGameOverTimer returns the job that records the result of the lobby's game, which has just ended
+func newGameOverTimer(lobby Lobby) Timer {
+	return Timer{
+		Id:      gameOverTimerId(lobby.Game.Id),
+		Kind:    RecordGameOver,
+		LobbyId: lobby.LobbyId,
+		Lobby:   &lobby,
+		DueAt:   time.Now().Add(gameOverRetryDelay),
+	}
+}
+
+func (store *RedisStore) HandOffGameOver(ctx context.Context, lobbyId string, gameId string) error {
+	timerJson, err := store.rdb.Get(ctx, gameOverKey(lobbyId, gameId)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var timer Timer
+	if err := json.Unmarshal([]byte(timerJson), &timer); err != nil {
+		return err
+	}
+
+	// The timers are in a different slot, so the job is scheduled before it is removed from the lobby. Scheduling it
+	// twice only replaces it
+	if err := store.ScheduleTimer(ctx, timer); err != nil {
+		return err
+	}
+
+	return store.rdb.Del(ctx, gameOverKey(lobbyId, gameId)).Err()
+}
+
+func (store *MemoryStore) HandOffGameOver(ctx context.Context, lobbyId string, gameId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := gameOverKey(lobbyId, gameId)
+	timer, err := getMemoryJson[Timer](store.gameOvers, key)
+	if err != nil || timer == nil {
+		return err
+	}
+
+	store.timers[timer.Id] = store.gameOvers[key]
+	store.timersDueAt[timer.Id] = timer.DueAt.Truncate(time.Millisecond)
+	delete(store.gameOvers, key)
+
+	return nil
+}
+
+// HandleGameOver records the result of a lobby's game once it has finished. The job that does it was saved along
+// with the end of the game, and is handed off to the timers before it is run here, so that it runs again if anything
+// fails. Every step is safe to run again for the same game, and none are cut short by the request ending
+func HandleGameOver(ctx context.Context, logger *slog.Logger, lobby Lobby) {
+	if lobby.Game == nil || lobby.Game.State != GameOver || lobby.Player2 == nil {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	store := GetStoreFromContext(ctx)
+
+	logger = logger.With(slog.String("gameId", lobby.Game.Id))
+
+	err := store.HandOffGameOver(ctx, lobby.LobbyId, lobby.Game.Id)
+	if err != nil {
+		logger.Warn("There was an error scheduling the game's result to be recorded: " + err.Error())
+	}
+
+	err = recordGameOver(ctx, store, logger, lobby)
+	if err != nil {
+		logger.Warn("There was an error recording the game's result, it will be tried again: " + err.Error())
+		return
+	}
+
+	err = store.CancelTimer(ctx, gameOverTimerId(lobby.Game.Id))
+	if err != nil {
+		logger.Warn("There was an error cancelling the game's result being recorded again: " + err.Error())
+	}
+}
+
+// RetryGameOver records the result of the timer's game, which didn't finish being recorded when the game ended
+func RetryGameOver(ctx context.Context, store Store, logger *slog.Logger, timer Timer) error {
+	if timer.Lobby == nil || timer.Lobby.Game == nil {
+		return nil
+	}
+
+	logger = logger.With(slog.String("gameId", timer.Lobby.Game.Id))
+	logger.Info("Retrying recording the game's result")
+
+	return recordGameOver(ctx, store, logger, *timer.Lobby)
+}
+
+// recordGameOver archives and rates the finished game, and records it on the leaderboards and in its tournament or
+// arena. Each step only ever counts the game once, so the whole thing can be run again after any of them fails
+func recordGameOver(ctx context.Context, store Store, logger *slog.Logger, lobby Lobby) error {
+	logger.Info("Game is over, archiving game")
+	err := store.SaveGame(ctx, NewArchivedGame(lobby))
+	if err != nil {
+		return errors.New("archiving the game: " + err.Error())
+	}
+
+	logger.Info("Updating player ratings")
+	err = UpdateRatings(ctx, store, logger, lobby)
+	if err != nil {
+		return errors.New("updating player ratings: " + err.Error())
+	}
+
+	if database := GetDatabaseFromContext(ctx); database != nil {
+		logger.Info("Writing game and players through to the database")
+		err = writeGameThroughToDatabase(ctx, store, database, logger, NewArchivedGame(lobby))
+		if err != nil {
+			logger.Warn("There was an error writing the game to the database: " + err.Error())
+		}
+	}
+
+	logger.Info("Updating leaderboards")
+	err = UpdateLeaderboards(ctx, store, lobby)
+	if err != nil {
+		return errors.New("updating leaderboards: " + err.Error())
+	}
+
+	if lobby.TournamentId != nil {
+		logger.Info("Recording tournament result")
+		err = RecordTournamentResult(ctx, store, logger, *lobby.TournamentId, lobby.LobbyId, *lobby.WinnerId())
+		if err != nil {
+			return errors.New("recording tournament result: " + err.Error())
+		}
+	}
+
+	if lobby.ArenaId != nil {
+		winnerId := *lobby.WinnerId()
+		loserId := lobby.Player1
+		if winnerId == lobby.Player1 {
+			loserId = *lobby.Player2
+		}
+
+		logger.Info("Recording arena result")
+		err = RecordArenaResult(ctx, store, logger, *lobby.ArenaId, lobby.LobbyId, lobby.Game.Id, winnerId, loserId, false)
+		if err != nil {
+			return errors.New("recording arena result: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// How long after failing to write a game through to the database it is tried again
+const databaseWriteThroughRetryDelay = time.Minute
+
+// errPlayerGone is returned when a player in a finished game has expired before it could be written through to the
+// database, which no amount of retrying will fix
+var errPlayerGone = errors.New("a player in the game no longer exists")
+
+func databaseWriteThroughTimerId(gameId string) string {
+	return "database-write-through:" + gameId
+}
+
+// writeGameThroughToDatabase saves the finished game to the database. A timer is scheduled before trying, and only
+// cancelled once the game has been saved, so that the game is still saved if saving it fails or the node dies first
+func writeGameThroughToDatabase(ctx context.Context, store Store, database *Database, logger *slog.Logger, game ArchivedGame) error {
+	timerId := databaseWriteThroughTimerId(game.GameId)
+
+	err := store.ScheduleTimer(ctx, Timer{
+		Id:    timerId,
+		Kind:  DatabaseWriteThrough,
+		Game:  &game,
+		DueAt: time.Now().Add(databaseWriteThroughRetryDelay),
+	})
+	if err != nil {
+		logger.Warn("There was an error scheduling the database write to be retried: " + err.Error())
+	}
+
+	err = saveGameOverToDatabase(ctx, store, database, game)
+	if err != nil {
+		return err
+	}
+
+	return store.CancelTimer(ctx, timerId)
+}
+
+// RetryDatabaseWriteThrough saves the timer's game to the database, which failed when the game ended. Saving is
+// idempotent, so it doesn't matter if the game was saved after all
+func RetryDatabaseWriteThrough(ctx context.Context, store Store, database *Database, logger *slog.Logger, timer Timer) error {
+	if timer.Game == nil {
+		return nil
+	}
+
+	logger = logger.With(slog.String("gameId", timer.Game.GameId))
+	logger.Info("Retrying writing game through to the database")
+
+	err := saveGameOverToDatabase(ctx, store, database, *timer.Game)
+	if errors.Is(err, errPlayerGone) {
+		logger.Warn("Giving up writing game through to the database: " + err.Error())
+		return nil
+	}
+
+	return err
+}
+
+// saveGameOverToDatabase saves the finished game along with both players as they are now that it has been rated
+func saveGameOverToDatabase(ctx context.Context, store Store, database *Database, game ArchivedGame) error {
+	players, err := store.GetPlayers(ctx, game.Player1, game.Player2)
+	if err != nil {
+		return err
+	}
+
+	records := make([]PlayerRecord, 0, len(players))
+	for _, player := range players {
+		if player == nil {
+			return errPlayerGone
+		}
+
+		ratings, err := store.GetPlayerRatings(ctx, player.Id)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, PlayerRecord{Player: *player, Ratings: ratings})
+	}
+
+	return database.SaveGameOver(ctx, game, records...)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHandleGameOverTwice(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := NewBackgroundContext(context.Background(), store, nil)
+	lobby := newCasualLobby(t, store, "alice", "bob")
+
+	finished, err := Resign(ctx, store, discardLogger(), "alice", lobby.LobbyId)
+	if err != nil {
+		t.Fatal("Failed to resign: " + err.Error())
+	}
+
+	// The job was handed off to the timers, then cancelled once it finished
+	if len(store.gameOvers) != 0 || len(store.timers) != 0 {
+		t.Fatalf("Expected the game over job to be done with, got %d saved and %d timers", len(store.gameOvers), len(store.timers))
+	}
+
+	// Running the job again, such as after a node died before cancelling it, counts the game once
+	HandleGameOver(ctx, discardLogger(), finished)
+	err = RetryGameOver(ctx, store, discardLogger(), newGameOverTimer(finished))
+	if err != nil {
+		t.Fatal("Failed to record the game again: " + err.Error())
+	}
+
+	pool := RatingPool(finished.Game.Variant, finished.Game.TimeControl)
+	for _, playerId := range []string{"alice", "bob"} {
+		ratings, err := store.GetPlayerRatings(ctx, playerId)
+		if err != nil {
+			t.Fatal("Failed to read ratings: " + err.Error())
+		}
+
+		if games := ratings.Get(pool).Games; games != 1 {
+			t.Fatalf("Expected %s to have played 1 rated game, got %d", playerId, games)
+		}
+
+		history, err := store.GetRatingHistory(ctx, playerId, pool, ratingHistoryLimit)
+		if err != nil || len(history) != 1 {
+			t.Fatalf("Expected 1 rating change for %s, got %+v (%v)", playerId, history, err)
+		}
+	}
+
+	wins, err := store.GetLeaderboard(ctx, CurrentSeason(time.Now()), MostWins, GlobalScope, 0, 10)
+	if err != nil {
+		t.Fatal("Failed to read leaderboard: " + err.Error())
+	}
+
+	if len(wins.Entries) != 1 || wins.Entries[0].PlayerId != "bob" || wins.Entries[0].Score != 1 {
+		t.Fatalf("Expected bob to have won once, got %+v", wins.Entries)
+	}
+}
@@ -0,0 +1,138 @@
+package glicko
+
+import "math"
+
+const (
+	DefaultRating     = 1500.0
+	DefaultDeviation  = 350.0
+	DefaultVolatility = 0.06
+
+	// Constrains the change in volatility over time. Reasonable values are between 0.3 and 1.2
+	tau = 0.5
+
+	// Converts between the Glicko and Glicko-2 scales
+	scale = 173.7178
+
+	convergenceTolerance = 0.000001
+)
+
+type Rating struct {
+	Rating     float64
+	Deviation  float64
+	Volatility float64
+}
+
+func NewRating() Rating {
+	return Rating{
+		Rating:     DefaultRating,
+		Deviation:  DefaultDeviation,
+		Volatility: DefaultVolatility,
+	}
+}
+
+type Score float64
+
+const (
+	Loss Score = 0
+	Draw Score = 0.5
+	Win  Score = 1
+)
+
+type Result struct {
+	Opponent Rating
+	Score    Score
+}
+
+func g(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+func expectedScore(mu float64, opponentMu float64, opponentPhi float64) float64 {
+	return 1 / (1 + math.Exp(-g(opponentPhi)*(mu-opponentMu)))
+}
+
+// Update applies the results of a single rating period to the rating, following the steps
+// described in http://www.glicko.net/glicko/glicko2.pdf
+func (r Rating) Update(results []Result) Rating {
+	mu := (r.Rating - DefaultRating) / scale
+	phi := r.Deviation / scale
+	sigma := r.Volatility
+
+	// A player who did not compete only has their deviation increased
+	if len(results) == 0 {
+		return Rating{
+			Rating:     r.Rating,
+			Deviation:  math.Min(math.Sqrt(phi*phi+sigma*sigma)*scale, DefaultDeviation),
+			Volatility: sigma,
+		}
+	}
+
+	varianceSum := 0.0
+	improvementSum := 0.0
+	for _, result := range results {
+		opponentMu := (result.Opponent.Rating - DefaultRating) / scale
+		opponentPhi := result.Opponent.Deviation / scale
+
+		e := expectedScore(mu, opponentMu, opponentPhi)
+		varianceSum += g(opponentPhi) * g(opponentPhi) * e * (1 - e)
+		improvementSum += g(opponentPhi) * (float64(result.Score) - e)
+	}
+
+	v := 1 / varianceSum
+	delta := v * improvementSum
+
+	newSigma := newVolatility(phi, sigma, v, delta)
+
+	phiStar := math.Sqrt(phi*phi + newSigma*newSigma)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*improvementSum
+
+	return Rating{
+		Rating:     newMu*scale + DefaultRating,
+		Deviation:  newPhi * scale,
+		Volatility: newSigma,
+	}
+}
+
+// newVolatility finds the new volatility using the Illinois algorithm
+func newVolatility(phi float64, sigma float64, v float64, delta float64) float64 {
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		numerator := ex * (delta*delta - phi*phi - v - ex)
+		denominator := 2 * math.Pow(phi*phi+v+ex, 2)
+
+		return numerator/denominator - (x-a)/(tau*tau)
+	}
+
+	boundA := a
+	var boundB float64
+	if delta*delta > phi*phi+v {
+		boundB = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*tau) < 0 {
+			k++
+		}
+		boundB = a - k*tau
+	}
+
+	fBoundA := f(boundA)
+	fBoundB := f(boundB)
+	for math.Abs(boundB-boundA) > convergenceTolerance {
+		c := boundA + (boundA-boundB)*fBoundA/(fBoundB-fBoundA)
+		fC := f(c)
+
+		if fC*fBoundB <= 0 {
+			boundA = boundB
+			fBoundA = fBoundB
+		} else {
+			fBoundA = fBoundA / 2
+		}
+
+		boundB = c
+		fBoundB = fC
+	}
+
+	return math.Exp(boundA / 2)
+}
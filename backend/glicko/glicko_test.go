@@ -0,0 +1,55 @@
+package glicko
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rating   Rating
+		results  []Result
+		expected Rating
+	}{
+		{
+			// The worked example from http://www.glicko.net/glicko/glicko2.pdf
+			name:   "Glickman's example",
+			rating: Rating{Rating: 1500, Deviation: 200, Volatility: 0.06},
+			results: []Result{
+				{Opponent: Rating{Rating: 1400, Deviation: 30, Volatility: DefaultVolatility}, Score: Win},
+				{Opponent: Rating{Rating: 1550, Deviation: 100, Volatility: DefaultVolatility}, Score: Loss},
+				{Opponent: Rating{Rating: 1700, Deviation: 300, Volatility: DefaultVolatility}, Score: Loss},
+			},
+			expected: Rating{Rating: 1464.06, Deviation: 151.52, Volatility: 0.05999},
+		},
+		{
+			name:     "no games",
+			rating:   Rating{Rating: 1500, Deviation: 200, Volatility: 0.06},
+			expected: Rating{Rating: 1500, Deviation: 200.27, Volatility: 0.06},
+		},
+		{
+			name:     "no games never exceeds the default deviation",
+			rating:   NewRating(),
+			expected: NewRating(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := test.rating.Update(test.results)
+
+			if math.Abs(actual.Rating-test.expected.Rating) > 0.01 {
+				t.Errorf("Expected rating %.2f, got %.4f", test.expected.Rating, actual.Rating)
+			}
+
+			if math.Abs(actual.Deviation-test.expected.Deviation) > 0.01 {
+				t.Errorf("Expected deviation %.2f, got %.4f", test.expected.Deviation, actual.Deviation)
+			}
+
+			if math.Abs(actual.Volatility-test.expected.Volatility) > 0.00001 {
+				t.Errorf("Expected volatility %.5f, got %.6f", test.expected.Volatility, actual.Volatility)
+			}
+		})
+	}
+}
@@ -1,17 +1,15 @@
 package main
 
 import (
-	"backend/turn"
 	"context"
 	"encoding/json"
 	"errors"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	gonanoid "github.com/matoous/go-nanoid/v2"
 	"github.com/redis/go-redis/v9"
-	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func WatchWithRetries(ctx context.Context, executeWatch func() error, retryLimit int) error {
@@ -39,300 +37,144 @@ func StrAsJson(str string) string {
 	return "\"" + str + "\""
 }
 
-func createLobbyHandler(w http.ResponseWriter, r *http.Request) {
-	logger := GetLoggerFromContext(r.Context())
-	id := GetIdFromContext(r.Context())
-	rdb := GetRedisFromContext(r.Context())
+func WriteJson(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
 
-	lobbyId, _ := gonanoid.Generate("abcdefghijklmnopqrstuvwxyz0123456789", 8)
+const maxPageSize = 100
 
-	logger = logger.With(slog.String("lobbyId", lobbyId))
+// ParsePagination reads the optional 'offset' and 'limit' query parameters
+func ParsePagination(r *http.Request) (int, int, error) {
+	offset := 0
+	rawOffset := r.URL.Query().Get("offset")
+	if len(rawOffset) > 0 {
+		parsedOffset, err := strconv.Atoi(rawOffset)
+		if err != nil || parsedOffset < 0 {
+			return 0, 0, errors.New("Invalid 'offset' parameter, must be a non-negative integer")
+		}
 
-	tx := func(tx *redis.Tx) error {
-		_, err := tx.TxPipelined(r.Context(), func(pipe redis.Pipeliner) error {
-			logger.Info("Creating lobby...")
-			err := pipe.JSONSet(r.Context(), "lobby:"+lobbyId, "$", Lobby{
-				LobbyId: lobbyId,
-				Player1: id,
-			}).Err()
+		offset = parsedOffset
+	}
 
-			if err != nil {
-				return err
-			}
+	limit := 20
+	rawLimit := r.URL.Query().Get("limit")
+	if len(rawLimit) > 0 {
+		parsedLimit, err := strconv.Atoi(rawLimit)
+		if err != nil || parsedLimit <= 0 || parsedLimit > maxPageSize {
+			return 0, 0, errors.New("Invalid 'limit' parameter, must be an integer between 1 and " + strconv.Itoa(maxPageSize))
+		}
 
-			logger.Info("Adding player to lobby...")
-			err = pipe.JSONSet(r.Context(), "player:"+id, "$.CurrentLobby", StrAsJson(lobbyId)).Err()
+		limit = parsedLimit
+	}
 
-			if err != nil {
-				return err
-			}
+	return offset, limit, nil
+}
 
-			return nil
-		})
+func createLobbyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	id := GetIdFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
 
-		return err
+	// Lobbies are created on another server, since players in this one would soon have to reconnect
+	if GetDrainFromContext(r.Context()).IsDraining() {
+		writeServerRestarting(w)
+		return
 	}
 
-	err := WatchWithRetries(
-		r.Context(),
-		func() error {
-			return rdb.Watch(r.Context(), tx, "player:"+id)
-		},
-		5,
-	)
-
+	lobby, err := CreateLobby(r.Context(), store, logger, id)
 	if err != nil {
 		logger.Warn("There was an error creating the lobby: " + err.Error())
-		http.Error(w, "There was an error creating the lobby", http.StatusInternalServerError)
+		WriteError(w, InternalError, "There was an error creating the lobby")
 		return
 	}
 
-	w.Write([]byte(lobbyId))
+	w.Write([]byte(lobby.LobbyId))
 }
 
 func joinLobbyHandler(w http.ResponseWriter, r *http.Request) {
 	id := GetIdFromContext(r.Context())
 	logger := GetLoggerFromContext(r.Context())
-	rdb := GetRedisFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
 
-	if !r.URL.Query().Has("lobbyId") {
-		logger.Debug("Missing 'lobbyId' query parameter")
-		http.Error(w, "No lobbyId present in request", http.StatusBadRequest)
+	// Games are started on another server, since players in this one would soon have to reconnect
+	if GetDrainFromContext(r.Context()).IsDraining() {
+		writeServerRestarting(w)
 		return
 	}
 
-	lobbyId := r.URL.Query().Get("lobbyId")
-	lobbyJson, err := rdb.JSONGet(r.Context(), "lobby:"+lobbyId).Result()
-
-	if err != nil {
-		logger.Warn("There was an error fetching lobbies: " + err.Error())
-		http.Error(w, "There was an error fetching lobbies", http.StatusInternalServerError)
-		return
-	}
-
-	if len(lobbyJson) == 0 {
-		logger.Debug("No lobby with ID " + lobbyId + " found")
-		http.Error(w, "Invalid lobby ID!", http.StatusBadRequest)
+	if !r.URL.Query().Has("lobbyId") {
+		logger.Debug("Missing 'lobbyId' query parameter")
+		WriteError(w, InvalidRequest, "No lobbyId present in request")
 		return
 	}
 
-	var lobby Lobby
-	json.Unmarshal([]byte(lobbyJson), &lobby)
-
-	logger = logger.With("lobbyId", lobbyId)
-
-	var updatedLobby Lobby
-
-	tx := func(tx *redis.Tx) error {
-		_, err := tx.TxPipelined(r.Context(), func(pipe redis.Pipeliner) error {
-			err = pipe.JSONSet(r.Context(), "player:"+id, "$.CurrentLobby", StrAsJson(lobbyId)).Err()
-
-			if err != nil {
-				return err
-			}
-
-			err = pipe.JSONSet(r.Context(), "lobby:"+lobbyId, "$.Player2", StrAsJson(id)).Err()
-
-			if err != nil {
-				return err
-			}
-
-			err = pipe.JSONSet(r.Context(), "lobby:"+lobbyId, "$.Game", NewGame()).Err()
-
-			if err != nil {
-				return err
-			}
-
-			return nil
-		})
-
-		if err != nil {
-			return err
-		}
-
-		updatedLobbyJson, err := tx.JSONGet(r.Context(), "lobby:"+lobbyId).Result()
-		if err != nil {
-			return err
-		}
-
-		json.Unmarshal([]byte(updatedLobbyJson), &updatedLobby)
-
-		return nil
-	}
-
-	err = WatchWithRetries(r.Context(), func() error {
-		return rdb.Watch(r.Context(), tx, "player:"+id, "lobby:"+lobbyId)
-	}, 5)
-
+	_, err := JoinLobby(r.Context(), store, logger, id, r.URL.Query().Get("lobbyId"))
 	if err != nil {
-		logger.Warn("There was an error joining lobby: " + err.Error())
-		http.Error(w, "There was an error joining lobby", http.StatusInternalServerError)
+		writeLobbyError(w, logger, err, nil)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-
-	logger.Info("Broadcasting lobby update to players")
-	message, _ := json.Marshal(LobbyEventMessage{
-		Event: GameUpdate,
-		Game:  updatedLobby.Game,
-	})
-
-	err = rdb.Publish(r.Context(), "player:"+updatedLobby.Player1, message).Err()
-
-	if err != nil {
-		logger.Warn("There was an error publishing the lobby update: " + err.Error())
-	}
-
-	err = rdb.Publish(r.Context(), "player:"+*updatedLobby.Player2, message).Err()
-
-	if err != nil {
-		logger.Warn("There was an error publishing the lobby update: " + err.Error())
-	}
 }
 
 func leaveLobbyHandler(w http.ResponseWriter, r *http.Request) {
 	id := GetIdFromContext(r.Context())
-	rdb := GetRedisFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
 	logger := GetLoggerFromContext(r.Context())
 
-	hasOpponent := false
-	var sendUpdateToPlayerId *string
-	tx := func(tx *redis.Tx) error {
-		playerJson, err := tx.JSONGet(r.Context(), "player:"+id).Result()
-
-		if err != nil {
-			return err
-		}
-
-		var player Player
-		json.Unmarshal([]byte(playerJson), &player)
-
-		if player.CurrentLobby == nil {
-			return nil
-		}
-
-		lobbyJson, err := tx.JSONGet(r.Context(), "lobby:"+*player.CurrentLobby).Result()
-		if err != nil {
-			return err
-		}
-
-		if len(lobbyJson) == 0 {
-			logger.Warn("Player is in lobby " + *player.CurrentLobby + " that no longer exists. Removing lobby ID from player...")
-			tx.JSONSet(r.Context(), "player:"+id, "$.CurrentLobby", nil)
-
-			return nil
-		}
-
-		var lobby Lobby
-		json.Unmarshal([]byte(lobbyJson), &lobby)
-
-		_, err = tx.TxPipelined(r.Context(), func(pipe redis.Pipeliner) error {
-			hasOpponent = false
-			if lobby.Player1 == id {
-				if lobby.Player2 == nil {
-					logger.Debug("Player was the only user in lobby, deleting lobby...")
-					err = pipe.JSONDel(r.Context(), "lobby:"+lobby.LobbyId, "$").Err()
-					if err != nil {
-						return err
-					}
-
-					err = pipe.JSONSet(r.Context(), "player:"+id, "$.CurrentLobby", nil).Err()
-					if err != nil {
-						return err
-					}
-				} else {
-					logger.Debug("Second player exists, making them the lobby owner and leaving the lobby...")
-					err = pipe.JSONSet(r.Context(), "lobby:"+lobby.LobbyId, "$.Player1", StrAsJson(*lobby.Player2)).Err()
-					if err != nil {
-						return err
-					}
-
-					err = pipe.JSONSet(r.Context(), "lobby:"+lobby.LobbyId, "$.Player2", nil).Err()
-					if err != nil {
-						return err
-					}
-
-					hasOpponent = true
-					sendUpdateToPlayerId = lobby.Player2
-				}
-			} else {
-				logger.Debug("Identified as player 2 in lobby, leaving...")
-				err = pipe.JSONSet(r.Context(), "lobby:"+lobby.LobbyId, "$.Player2", nil).Err()
-				if err != nil {
-					return err
-				}
-
-				err = pipe.JSONSet(r.Context(), "player:"+id, "$.CurrentLobby", nil).Err()
-				if err != nil {
-					return err
-				}
-
-				hasOpponent = true
-				sendUpdateToPlayerId = &lobby.Player1
-			}
-
-			return nil
-		})
-
-		return err
-	}
-
-	err := WatchWithRetries(r.Context(), func() error {
-		return rdb.Watch(r.Context(), tx, "player:"+id)
-	}, 5)
-
+	err := LeaveLobby(r.Context(), store, logger, id)
 	if err != nil {
 		logger.Warn("There was an error leaving player lobby: " + err.Error())
-		http.Error(w, "There was an error leaving player lobby", http.StatusInternalServerError)
+		WriteError(w, InternalError, "There was an error leaving player lobby")
 		return
 	}
 
-	logger.Debug("User has left lobby")
-
-	if hasOpponent && sendUpdateToPlayerId != nil {
-		logger.Info("Sending update to user " + *sendUpdateToPlayerId)
-		message, _ := json.Marshal(LobbyEventMessage{
-			Event: OpponentLeft,
-			Game:  nil,
-		})
+	w.WriteHeader(http.StatusOK)
+}
 
-		err = rdb.Publish(r.Context(), "player:"+*sendUpdateToPlayerId, message).Err()
+func getLobbyHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
 
-		if err != nil {
-			logger.Warn("There was an error publishing \"opponent left\" message: " + err.Error())
-		}
+	lobby, err := GetPlayerLobby(r.Context(), store, id)
+	if err != nil {
+		logger.Warn("Unable to fetch lobby: " + err.Error())
+		WriteError(w, InternalError, "Unable to fetch lobby")
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-}
+	if lobby == nil {
+		WriteError(w, NotInLobby, "The player is not in a lobby!")
+		return
+	}
 
-type MakeMoveValidationError struct {
-	cause string
-}
+	profiles, err := GetLobbyProfiles(r.Context(), store, *lobby)
+	if err != nil {
+		logger.Warn("There was an error fetching player profiles: " + err.Error())
+	}
 
-func (e MakeMoveValidationError) Error() string {
-	return e.cause
+	WriteJson(w, LobbySnapshot{
+		Lobby:   *lobby,
+		Players: profiles,
+	})
 }
 
 func makeMoveHandler(w http.ResponseWriter, r *http.Request) {
 	id := GetIdFromContext(r.Context())
 	logger := GetLoggerFromContext(r.Context())
-	rdb := GetRedisFromContext(r.Context())
-
-	existingPlayerJson, err := rdb.JSONGet(r.Context(), "player:"+id).Result()
+	store := GetStoreFromContext(r.Context())
 
+	existingPlayer, err := store.GetPlayer(r.Context(), id)
 	if err != nil {
-		logger.Warn("Unable to fetch player from redis: " + err.Error())
-		http.Error(w, "Unable to fetch player from redis", http.StatusInternalServerError)
+		logger.Warn("Unable to fetch player: " + err.Error())
+		WriteError(w, InternalError, "Unable to fetch player")
 		return
 	}
 
-	var existingPlayer Player
-	json.Unmarshal([]byte(existingPlayerJson), &existingPlayer)
-
-	if existingPlayer.CurrentLobby == nil {
-		http.Error(w, "The player is not in a lobby!", http.StatusBadRequest)
+	if existingPlayer == nil || existingPlayer.CurrentLobby == nil {
+		WriteError(w, NotInLobby, "The player is not in a lobby!")
 		return
 	}
 
@@ -342,7 +184,7 @@ func makeMoveHandler(w http.ResponseWriter, r *http.Request) {
 		if initialPosition, err := strconv.Atoi(rawFrom); err == nil {
 			from = &initialPosition
 		} else {
-			http.Error(w, "Invalid 'from' parameter, must be an integer", http.StatusBadRequest)
+			WriteError(w, InvalidRequest, "Invalid 'from' parameter, must be an integer")
 			return
 		}
 	}
@@ -353,170 +195,409 @@ func makeMoveHandler(w http.ResponseWriter, r *http.Request) {
 		if targetPosition, err := strconv.Atoi(rawTo); err == nil {
 			to = targetPosition
 		} else {
-			http.Error(w, "Invalid 'to' parameter, must be an integer", http.StatusBadRequest)
+			WriteError(w, InvalidRequest, "Invalid 'to' parameter, must be an integer")
 			return
 		}
 	} else {
-		http.Error(w, "Missing required 'to' parameter, must be an integer", http.StatusBadRequest)
+		WriteError(w, InvalidRequest, "Missing required 'to' parameter, must be an integer")
 		return
 	}
 
-	tx := func(tx *redis.Tx) error {
-		playerJson, err := tx.JSONGet(r.Context(), "player:"+id).Result()
-
-		if err != nil {
-			return err
+	options := MoveOptions{
+		IdempotencyKey: r.Header.Get(IdempotencyKeyHeader),
+		Strategy:       GetMoveStrategyFromContext(r.Context()),
+	}
+	rawExpectedVersion := r.URL.Query().Get("expectedVersion")
+	if len(rawExpectedVersion) > 0 {
+		if expectedVersion, err := strconv.Atoi(rawExpectedVersion); err == nil {
+			options.ExpectedVersion = &expectedVersion
+		} else {
+			WriteError(w, InvalidRequest, "Invalid 'expectedVersion' parameter, must be an integer")
+			return
 		}
+	}
 
-		var player Player
-		json.Unmarshal([]byte(playerJson), &player)
+	if len(options.IdempotencyKey) > maxIdempotencyKeyLength {
+		WriteError(w, InvalidRequest, "Invalid "+IdempotencyKeyHeader+" header, must be at most "+strconv.Itoa(maxIdempotencyKeyLength)+" characters")
+		return
+	}
 
-		if player.CurrentLobby == nil {
-			return MakeMoveValidationError{cause: "NOT_IN_LOBBY"}
-		}
+	_, replayed, err := MakeMove(r.Context(), store, logger, id, *existingPlayer.CurrentLobby, PlayerMove{from: from, to: to}, options)
+	if replayed {
+		w.Header().Set(IdempotentReplayedHeader, "true")
+	}
 
-		if *player.CurrentLobby != *existingPlayer.CurrentLobby {
-			return MakeMoveValidationError{cause: "CONCURRENT_EDIT"}
-		}
+	if err != nil {
+		writeLobbyError(w, logger, err, map[string]any{
+			"From": from,
+			"To":   to,
+		})
+		return
+	}
 
-		lobbyJson, err := tx.JSONGet(r.Context(), "lobby:"+*player.CurrentLobby).Result()
-		if err != nil {
-			return err
-		}
+	w.WriteHeader(http.StatusOK)
+}
 
-		if len(lobbyJson) == 0 {
-			tx.JSONSet(r.Context(), "player:"+id, "$.CurrentLobby", nil)
-			return MakeMoveValidationError{cause: "NOT_IN_LOBBY"}
-		}
+func resignHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
 
-		var lobby Lobby
-		json.Unmarshal([]byte(lobbyJson), &lobby)
+	player, err := store.GetPlayer(r.Context(), id)
+	if err != nil {
+		logger.Warn("Unable to fetch player: " + err.Error())
+		WriteError(w, InternalError, "Unable to fetch player")
+		return
+	}
 
-		logger = logger.With("lobbyId", lobby.LobbyId)
+	if player == nil || player.CurrentLobby == nil {
+		WriteError(w, NotInLobby, "The player is not in a lobby!")
+		return
+	}
 
-		if lobby.Player2 == nil {
-			return MakeMoveValidationError{cause: "WAITING_FOR_PLAYER_2"}
-		}
+	_, err = Resign(r.Context(), store, logger, id, *player.CurrentLobby)
+	if err != nil {
+		writeLobbyError(w, logger, err, nil)
+		return
+	}
 
-		var playerMakingRequest turn.Turn
-		if lobby.Player1 == id {
-			playerMakingRequest = turn.Player1
-		} else {
-			playerMakingRequest = turn.Player2
-		}
+	w.WriteHeader(http.StatusOK)
+}
 
-		game := lobby.Game
+func sendChatMessageHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
 
-		newGame, err := game.EvaluateMove(playerMakingRequest, PlayerMove{from: from, to: to})
+	var request ChatRequest
+	if err := ReadJson(w, r, &request); err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	player, err := store.GetPlayer(r.Context(), id)
+	if err != nil {
+		logger.Warn("Unable to fetch player: " + err.Error())
+		WriteError(w, InternalError, "Unable to fetch player")
+		return
+	}
+
+	if player == nil || player.CurrentLobby == nil {
+		WriteError(w, NotInLobby, "The player is not in a lobby!")
+		return
+	}
+
+	_, err = SendChatMessage(r.Context(), store, logger, id, *player.CurrentLobby, request.Message)
+	if err != nil {
+		writeLobbyError(w, logger, err, nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	sessions := GetSessionsFromContext(r.Context())
+
+	session, err := sessions.Authenticate(w, r)
+	if err != nil && !IsSessionError(err) {
+		logger.Warn("There was an error authenticating session: " + err.Error())
+		WriteError(w, InternalError, "There was an error authenticating session")
+		return
+	}
+
+	if err != nil {
+		logger.Debug("No valid session, starting a new guest session")
+		session, err = sessions.StartSession(w, r, uuid.NewString())
 		if err != nil {
-			return err
+			logger.Warn("Failed to start session: " + err.Error())
+			WriteError(w, InternalError, "Failed to start session")
+			return
 		}
+	}
 
-		tx.JSONSet(r.Context(), "lobby:"+lobby.LobbyId, "$.Game", newGame)
+	id := session.PlayerId
 
-		return nil
+	// Reconnecting players send the ID of the last lobby event they saw, so they can be sent whatever they missed
+	lastEventId := r.URL.Query().Get("lastEventId")
+	if len(lastEventId) > 0 && !IsValidStreamId(lastEventId) {
+		WriteError(w, InvalidRequest, "Invalid 'lastEventId' parameter, must be the ID of a lobby event")
+		return
 	}
 
-	err = WatchWithRetries(r.Context(), func() error {
-		return rdb.Watch(r.Context(), tx, "player:"+id, "lobby:"+*existingPlayer.CurrentLobby)
-	}, 5)
+	// Clients send the same ID every time they reconnect, so they resume from the last message they acknowledged
+	clientId := r.URL.Query().Get("clientId")
+	if len(clientId) == 0 {
+		clientId = uuid.NewString()
+	} else if !IsValidClientId(clientId) {
+		WriteError(w, InvalidRequest, "Invalid 'clientId' parameter, must be at most 64 letters, numbers and dashes")
+		return
+	}
 
-	if err != nil {
-		if errors.Is(err, MakeMoveValidationError{}) {
-			http.Error(w, "Unable to make move: "+err.Error(), http.StatusBadRequest)
+	// Players moved off a server that shut down carry on from where they were on it
+	if resumeToken := r.URL.Query().Get("resumeToken"); len(resumeToken) > 0 {
+		token, ok := DecodeResumeToken(resumeToken)
+		if ok && token.PlayerId == id {
+			clientId = token.ClientId
+			if len(token.LastEventId) > 0 {
+				lastEventId = token.LastEventId
+			}
 		} else {
-			logger.Warn("Error making move caused by: " + err.Error())
-			http.Error(w, "Error making move: "+err.Error(), http.StatusInternalServerError)
+			logger.Debug("Ignoring invalid resume token")
 		}
+	}
+
+	if _, err := r.Cookie(CSRFCookieName); err != nil {
+		sessions.SetCSRFCookie(w, *session)
+	}
 
+	drain := GetDrainFromContext(r.Context())
+	doneDraining, ok := drain.Track()
+	if !ok {
+		writeServerRestarting(w)
 		return
 	}
+	defer doneDraining()
 
-	w.WriteHeader(http.StatusOK)
-	logger.Info("Broadcasting updated game")
+	acquired, refreshConnection, releaseConnection, err := AcquireConnection(r.Context(), store, id)
+	if err != nil {
+		logger.Warn("There was an error registering connection: " + err.Error())
+		WriteError(w, InternalError, "There was an error connecting")
+		return
+	}
+
+	if !acquired {
+		logger.Info("Rejected connection, player has too many open")
+		writeTooManyRequests(w, connectionLeaseDuration, TooManyConnections, "Too many open connections, close another tab and try again")
+		return
+	}
 
-	lobbyJson, err := rdb.JSONGet(r.Context(), "lobby:"+*existingPlayer.CurrentLobby).Result()
+	defer releaseConnection()
 
+	conn, err := upgrader.Upgrade(w, r, w.Header())
 	if err != nil {
-		logger.Warn("Unable to fetch lobby from redis: " + err.Error())
+		logger.Info("Failed to upgrade connection: " + err.Error())
 		return
 	}
+	defer conn.Close()
 
-	var lobby Lobby
-	json.Unmarshal([]byte(lobbyJson), &lobby)
+	logger.Info("New player connected!")
+	// Returning players keep their existing document, so their profile and lobby survive reconnects
+	err = store.UpdatePlayer(r.Context(), id, func(tx PlayerTx) error {
+		player, err := tx.GetPlayer(r.Context())
+		if err != nil || player != nil {
+			return err
+		}
 
-	message, _ := json.Marshal(LobbyEventMessage{
-		Event: GameUpdate,
-		Game:  lobby.Game,
+		tx.SetPlayer(*NewPlayer(id))
+		return nil
 	})
 
-	err = rdb.Publish(r.Context(), "player:"+lobby.Player1, message).Err()
 	if err != nil {
-		logger.Warn("There was an error publishing lobby update: " + err.Error())
+		logger.Warn("Failed to set player: " + err.Error())
 	}
 
-	err = rdb.Publish(r.Context(), "player:"+*lobby.Player2, message).Err()
-	if err != nil {
-		logger.Warn("There was an error publishing lobby update: " + err.Error())
+	// Players and their lobbies are kept alive for as long as they stay connected
+	if err := store.KeepAlive(r.Context(), id); err != nil {
+		logger.Warn("Failed to keep player alive: " + err.Error())
 	}
-}
-
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	logger := GetLoggerFromContext(r.Context())
-	redis := GetRedisFromContext(r.Context())
 
-	var id string
-	idCookie, err := r.Cookie("id")
+	node := GetNodeFromContext(r.Context())
+	disconnectFromNode, err := node.Connect(r.Context(), NodeConnection{
+		ConnectionId: uuid.NewString(),
+		NodeId:       node.Id,
+		PlayerId:     id,
+		ClientId:     clientId,
+		SessionId:    session.SessionId,
+		ConnectedAt:  time.Now(),
+	}, logger)
 	if err != nil {
-		id = uuid.NewString()
-		http.SetCookie(w, &http.Cookie{
-			Name:     "id",
-			Value:    id,
-			HttpOnly: true,
-		})
+		logger.Warn("Failed to register connection with node: " + err.Error())
 	} else {
-		id = idCookie.Value
+		defer disconnectFromNode()
 	}
 
-	conn, err := upgrader.Upgrade(w, r, w.Header())
+	inbox, err := store.OpenInbox(r.Context(), id, clientId)
 	if err != nil {
-		logger.Info("Failed to upgrade connection: " + err.Error())
+		logger.Warn("Failed to open inbox: " + err.Error())
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Failed to open inbox"),
+			time.Now().Add(time.Second),
+		)
 		return
 	}
+	defer inbox.Close()
+	messages := inbox.Messages()
 
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
 		for {
-			if _, _, err := conn.ReadMessage(); err != nil {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
 				return
 			}
+
+			var message ClientMessage
+			if err := json.Unmarshal(data, &message); err != nil || !IsValidStreamId(message.Ack) {
+				logger.Debug("Ignoring invalid message from client")
+				continue
+			}
+
+			if err := inbox.Ack(message.Ack); err != nil {
+				logger.Warn("Failed to acknowledge message: " + err.Error())
+			}
 		}
 	}()
 
-	logger.Info("New player connected!")
-	err = redis.JSONSet(r.Context(), "player:"+id, "$", &Player{
-		Id:           id,
-		CurrentLobby: nil,
-	}).Err()
+	// Sends the player everything that has happened in their lobby since the last event they were sent
+	catchUp := func() error {
+		if len(lastEventId) == 0 {
+			return nil
+		}
 
-	if err != nil {
-		logger.Warn("Failed to set player: " + err.Error())
+		message, err := CatchUp(r.Context(), store, id, lastEventId)
+		if err != nil {
+			logger.Warn("There was an error catching the player up: " + err.Error())
+		}
+
+		if message == nil {
+			return nil
+		}
+
+		lastEventId = message.EventId
+		payload, _ := json.Marshal(message)
+		return conn.WriteMessage(websocket.TextMessage, payload)
+	}
+
+	// Only caught up once the inbox is open, so that nothing is missed in between. Anything sent in both is told apart
+	// by its event ID
+	if err := catchUp(); err != nil {
+		logger.Warn("Failed to send player: " + err.Error())
+		return
 	}
 
-	pubsub := redis.Subscribe(r.Context(), "player:"+id)
-	defer pubsub.Close()
-	ch := pubsub.Channel()
+	disconnect := sessions.Connect(r.Context(), session.SessionId)
+	defer disconnect()
+	revoked, stopWatchingSession := sessions.Revocations(r.Context(), session.SessionId)
+	defer func() {
+		stopWatchingSession()
+	}()
+
+	closeRevoked := func() {
+		logger.Info("Session was revoked, closing connection")
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Session revoked"),
+			time.Now().Add(time.Second),
+		)
+	}
+
+	keepAlive := func() {
+		if err := refreshConnection(); err != nil {
+			logger.Warn("Failed to refresh connection: " + err.Error())
+		}
+
+		if err := store.KeepAlive(r.Context(), id); err != nil {
+			logger.Warn("Failed to keep player alive: " + err.Error())
+		}
+	}
+
+	// Redis going down is sent straight to the player, since nothing can reach their inbox until it is back
+	health := GetRedisHealthFromContext(r.Context())
+	healthChanges, stopWatchingHealth := health.Watch()
+	defer stopWatchingHealth()
+
+	refreshTicker := time.NewTicker(connectionLeaseDuration / 3)
+	defer refreshTicker.Stop()
 
 	for {
 		select {
 		case <-done:
 			return
-		case msg, ok := <-ch:
+		case <-refreshTicker.C:
+			keepAlive()
+		case <-revoked:
+			closeRevoked()
+			return
+		case <-drain.Draining():
+			logger.Info("Server is shutting down, telling player to reconnect")
+			payload, _ := json.Marshal(LobbyEventMessage{
+				Event: ServerRestartingEvent,
+				ResumeToken: EncodeResumeToken(ResumeToken{
+					PlayerId:    id,
+					ClientId:    clientId,
+					LastEventId: lastEventId,
+					ExpiresAt:   time.Now().Add(resumeTokenLifetime),
+				}),
+			})
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				logger.Warn("Failed to send player: " + err.Error())
+			}
+
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, "Server restarting, reconnect"),
+				time.Now().Add(time.Second),
+			)
+			return
+		case status := <-healthChanges:
+			if status != RedisAvailable {
+				logger.Info("Redis is unavailable, telling player")
+				payload, _ := json.Marshal(LobbyEventMessage{Event: MaintenanceStarted})
+				if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+					logger.Warn("Failed to send player: " + err.Error())
+					return
+				}
+
+				continue
+			}
+
+			// Revocations published while Redis was unavailable are lost, so the session is checked once the player
+			// is listening for them again
+			stopWatchingSession()
+			revoked, stopWatchingSession = sessions.Revocations(r.Context(), session.SessionId)
+
+			active, err := sessions.IsActive(r.Context(), session.SessionId)
+			if err != nil {
+				logger.Warn("There was an error checking session: " + err.Error())
+			} else if !active {
+				closeRevoked()
+				return
+			}
+
+			keepAlive()
+
+			// Messages sent to the player while Redis was unavailable are lost, so they are caught up on their lobby
+			payload, _ := json.Marshal(LobbyEventMessage{Event: MaintenanceEnded})
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				logger.Warn("Failed to send player: " + err.Error())
+				return
+			}
+
+			if err := catchUp(); err != nil {
+				logger.Warn("Failed to send player: " + err.Error())
+				return
+			}
+		case message, ok := <-messages:
 			if !ok {
 				return
 			}
-			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg.Payload)); err != nil {
+			payload, err := withDeliveryId(message)
+			if err != nil {
+				logger.Warn("Failed to read message " + message.Id + " from inbox: " + err.Error())
+				continue
+			}
+
+			if eventId := messageEventId(payload); len(eventId) > 0 {
+				lastEventId = eventId
+			}
+
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
 				logger.Warn("Failed to send player: " + err.Error())
 				return
 			}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many commands in a row have to fail before Redis is treated as unavailable
+const redisFailureThreshold = 3
+
+// How often Redis is pinged while it is available, so that an outage is noticed even when nothing else is using it
+const redisHealthInterval = 2 * time.Second
+
+// How long a health check may take before it counts as a failure
+const redisHealthTimeout = time.Second
+
+// How long to wait before first checking whether Redis has come back. The wait doubles after every failed check, up to
+// redisMaxBackoff
+const redisMinBackoff = 500 * time.Millisecond
+const redisMaxBackoff = 30 * time.Second
+
+// How long clients are told to wait before retrying requests that were turned away while Redis is unavailable
+const redisUnavailableRetryAfter = 5 * time.Second
+
+// ErrRedisUnavailable is returned by commands that weren't sent because Redis is unavailable
+var ErrRedisUnavailable = errors.New("redis is unavailable")
+
+type RedisStatus string
+
+const (
+	RedisAvailable   RedisStatus = "AVAILABLE"
+	RedisUnavailable RedisStatus = "UNAVAILABLE"
+)
+
+// RedisHealthReport is whether Redis is available, and since when
+type RedisHealthReport struct {
+	Status RedisStatus
+	Since  time.Time
+}
+
+// RedisHealth tracks whether Redis can be reached, and acts as a circuit breaker for every command sent to it. Once
+// enough commands in a row have failed, commands fail straight away with ErrRedisUnavailable rather than each waiting
+// to time out, until a health check finds that Redis has come back
+type RedisHealth struct {
+	rdb      redis.UniversalClient
+	logger   *slog.Logger
+	mutex    sync.Mutex
+	status   RedisStatus
+	since    time.Time
+	failures int
+	watchers map[chan RedisStatus]struct{}
+}
+
+// NewRedisHealth starts tracking the health of the client's commands. Run has to be called for it to notice that
+// Redis has come back. Without a client, such as when everything is kept in memory, Redis is always available
+func NewRedisHealth(rdb redis.UniversalClient, logger *slog.Logger) *RedisHealth {
+	health := &RedisHealth{
+		rdb:      rdb,
+		logger:   logger,
+		status:   RedisAvailable,
+		since:    time.Now(),
+		watchers: map[chan RedisStatus]struct{}{},
+	}
+
+	if rdb != nil {
+		rdb.AddHook(health)
+	}
+
+	return health
+}
+
+// Available returns whether commands are being sent to Redis
+func (health *RedisHealth) Available() bool {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	return health.status == RedisAvailable
+}
+
+func (health *RedisHealth) Report() RedisHealthReport {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	return RedisHealthReport{Status: health.status, Since: health.since}
+}
+
+// Watch returns a channel that receives Redis' status each time it changes. Watchers that fall behind are only sent
+// the latest status. stop must be called once the changes are no longer needed
+func (health *RedisHealth) Watch() (changes <-chan RedisStatus, stop func()) {
+	watcher := make(chan RedisStatus, 1)
+
+	health.mutex.Lock()
+	health.watchers[watcher] = struct{}{}
+	health.mutex.Unlock()
+
+	return watcher, func() {
+		health.mutex.Lock()
+		delete(health.watchers, watcher)
+		health.mutex.Unlock()
+	}
+}
+
+// UntilRecovered returns a context that is cancelled once Redis next comes back after being unavailable, so that
+// subscriptions made with it can be made again against the recovered Redis
+func (health *RedisHealth) UntilRecovered(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	changes, stop := health.Watch()
+
+	go func() {
+		defer stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case status := <-changes:
+				if status == RedisAvailable {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// setStatus expects the health to already be locked
+func (health *RedisHealth) setStatus(status RedisStatus) {
+	if health.status == status {
+		return
+	}
+
+	health.status = status
+	health.since = time.Now()
+
+	for watcher := range health.watchers {
+		// Only the latest status matters to watchers that haven't caught up yet
+		select {
+		case <-watcher:
+		default:
+		}
+
+		select {
+		case watcher <- status:
+		default:
+		}
+	}
+}
+
+// record counts the outcome of a command towards whether Redis is unavailable
+func (health *RedisHealth) record(err error) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if !isRedisUnavailableError(err) {
+		health.failures = 0
+		return
+	}
+
+	health.failures++
+	if health.failures >= redisFailureThreshold && health.status == RedisAvailable {
+		health.logger.Warn("Redis is unavailable, turning requests away until it comes back: " + err.Error())
+		health.setStatus(RedisUnavailable)
+	}
+}
+
+func (health *RedisHealth) recovered() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.failures = 0
+	if health.status != RedisAvailable {
+		health.logger.Info("Redis is available again after " + time.Since(health.since).Round(time.Second).String())
+		health.setStatus(RedisAvailable)
+	}
+}
+
+// isRedisUnavailableError returns whether the error means Redis couldn't be reached, rather than that the command
+// itself failed
+func isRedisUnavailableError(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) || errors.Is(err, redis.TxFailedErr) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	// Redis replied, so could be reached, unless it replied that it is starting up or failing over
+	var redisError redis.Error
+	if errors.As(err, &redisError) {
+		for _, prefix := range []string{"LOADING", "READONLY", "MASTERDOWN", "CLUSTERDOWN", "TRYAGAIN"} {
+			if redis.HasErrorPrefix(err, prefix) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// Health checks are sent even while Redis is unavailable, and don't count towards whether it is
+func isHealthCheck(ctx context.Context) bool {
+	healthCheck, _ := ctx.Value("redisHealthCheck").(bool)
+	return healthCheck
+}
+
+func (health *RedisHealth) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (health *RedisHealth) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if isHealthCheck(ctx) {
+			return next(ctx, cmd)
+		}
+
+		if !health.Available() {
+			cmd.SetErr(ErrRedisUnavailable)
+			return ErrRedisUnavailable
+		}
+
+		err := next(ctx, cmd)
+		health.record(err)
+		return err
+	}
+}
+
+func (health *RedisHealth) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if isHealthCheck(ctx) {
+			return next(ctx, cmds)
+		}
+
+		if !health.Available() {
+			for _, cmd := range cmds {
+				cmd.SetErr(ErrRedisUnavailable)
+			}
+
+			return ErrRedisUnavailable
+		}
+
+		err := next(ctx, cmds)
+		health.record(err)
+		return err
+	}
+}
+
+// check pings every primary, since under Cluster Redis is only available if every slot is
+func (health *RedisHealth) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, "redisHealthCheck", true), redisHealthTimeout)
+	defer cancel()
+
+	return forEachPrimary(ctx, health.rdb, func(ctx context.Context, client *redis.Client) error {
+		return client.Ping(ctx).Err()
+	})
+}
+
+// Run checks on Redis until the context is done, regularly while it is available and backing off while it is not
+func (health *RedisHealth) Run(ctx context.Context) {
+	if health.rdb == nil {
+		return
+	}
+
+	backoff := redisMinBackoff
+
+	for {
+		available := health.Available()
+
+		delay := redisHealthInterval
+		if !available {
+			delay = backoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		err := health.check(ctx)
+		if err == nil {
+			backoff = redisMinBackoff
+			health.recovered()
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if available {
+			health.record(err)
+		} else {
+			backoff = min(backoff*2, redisMaxBackoff)
+		}
+	}
+}
+
+func WithRedisHealthMiddleware(health *RedisHealth) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "redisHealth", health))
+			next.ServeHTTP(w, modifiedRequest)
+		})
+	}
+}
+
+func GetRedisHealthFromContext(ctx context.Context) *RedisHealth {
+	health, ok := ctx.Value("redisHealth").(*RedisHealth)
+	if !ok {
+		panic("Redis health in context is not present. Something has gone wrong!")
+	}
+
+	return health
+}
+
+// RequireRedisMiddleware turns requests away while Redis is unavailable. Nearly every request needs Redis, and would
+// otherwise fail with an internal error
+func RequireRedisMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetRedisHealthFromContext(r.Context()).Available() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		retryAfterSeconds := int(math.Ceil(redisUnavailableRetryAfter.Seconds()))
+
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+		WriteErrorDetails(w, ServiceUnavailable, "The server is under maintenance, try again shortly", map[string]any{
+			"RetryAfter": retryAfterSeconds,
+		})
+	})
+}
+
+// HealthReport is the body of the health check
+type HealthReport struct {
+	Redis RedisHealthReport
+	// Whether the server is shutting down
+	Draining bool
+}
+
+// healthHandler reports whether the server can take requests, which it can't while Redis is unavailable or once it
+// has started shutting down
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := HealthReport{
+		Redis:    GetRedisHealthFromContext(r.Context()).Report(),
+		Draining: GetDrainFromContext(r.Context()).IsDraining(),
+	}
+
+	status := http.StatusOK
+	if report.Redis.Status != RedisAvailable || report.Draining {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
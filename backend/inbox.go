@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// How long messages are kept in a player's inbox. Older messages are trimmed as new ones are added, and the inbox of
+// a player who hasn't been sent anything for this long is deleted
+const inboxRetention = 24 * time.Hour
+
+// How many messages are held for a client that is slow to read them before it is disconnected. It is sent them again
+// once it reconnects
+const inboxBuffer = 64
+
+// InboxMessage is a message in a player's inbox
+type InboxMessage struct {
+	Id      string
+	Payload string
+}
+
+// Inbox delivers the messages in a player's inbox to one of their clients. Messages are delivered at least once:
+// each client's position is only moved on by acknowledging messages, and a client that reconnects is sent everything
+// after the last message it acknowledged, even if it was sent some of it before
+type Inbox interface {
+	Messages() <-chan InboxMessage
+	// Ack acknowledges every message up to and including the one with the ID
+	Ack(id string) error
+	Close() error
+}
+
+// ClientMessage is sent by clients over their WebSocket
+type ClientMessage struct {
+	// The DeliveryId of the last message the client received
+	Ack string
+}
+
+var clientIdPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// IsValidClientId returns whether the ID can be used to track a client's position in an inbox
+func IsValidClientId(clientId string) bool {
+	return clientIdPattern.MatchString(clientId)
+}
+
+// inboxHashTag puts the player's inbox in a shard with other players' inboxes, so that a server can wait for new
+// messages in every inbox open on it with one blocking read per shard
+func inboxHashTag(playerId string) string {
+	return "inboxes:" + strconv.Itoa(shardOf(playerId))
+}
+
+func inboxKey(playerId string) string {
+	return withHashTag(inboxHashTag(playerId), "player:"+playerId+":inbox")
+}
+
+// inboxAcksKey holds the ID of the last message each of the player's clients acknowledged
+func inboxAcksKey(playerId string) string {
+	return withHashTag(inboxHashTag(playerId), "player:"+playerId+":inbox:acks")
+}
+
+// inboxMinId returns the ID of the oldest message that is still kept in inboxes
+func inboxMinId() string {
+	return strconv.FormatInt(time.Now().Add(-inboxRetention).UnixMilli(), 10) + "-0"
+}
+
+// withDeliveryId adds the message's ID to its payload as DeliveryId, which the client sends back to acknowledge it
+func withDeliveryId(message InboxMessage) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message.Payload), &fields); err != nil {
+		return nil, err
+	}
+
+	fields["DeliveryId"], _ = json.Marshal(message.Id)
+	return json.Marshal(fields)
+}
+
+// messageEventId returns the ID of the lobby log entry the message is about, if it is about one
+func messageEventId(payload []byte) string {
+	var message struct{ EventId string }
+	json.Unmarshal(payload, &message)
+	return message.EventId
+}
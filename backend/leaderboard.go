@@ -0,0 +1,654 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LeaderboardKind string
+
+const (
+	TopRating        LeaderboardKind = "rating"
+	MostWins                         = "wins"
+	LongestWinStreak                 = "streak"
+)
+
+var leaderboardKinds = []LeaderboardKind{TopRating, MostWins, LongestWinStreak}
+
+// GlobalScope is the leaderboard scope covering every variant
+const GlobalScope = "global"
+
+// The number of entries kept per leaderboard when a season is archived
+const seasonStandingsLimit = 1000
+
+type LeaderboardEntry struct {
+	Rank     int
+	PlayerId string
+	Score    float64
+}
+
+type LeaderboardPage struct {
+	Season  string
+	Kind    LeaderboardKind
+	Scope   string
+	Entries []LeaderboardEntry
+	Offset  int
+	Limit   int
+	Total   int
+}
+
+type SeasonStandings struct {
+	Season     string
+	ArchivedAt time.Time
+	// Keyed by "<kind>:<scope>"
+	Boards map[string][]LeaderboardEntry
+}
+
+// CurrentSeason returns the season for the given time. Seasons run for a calendar month
+func CurrentSeason(now time.Time) string {
+	return now.UTC().Format("2006-01")
+}
+
+// leaderboardHashTag puts every board for the scope in the same slot, so that a game is recorded on all of them at once
+func leaderboardHashTag(season string, scope string) string {
+	return "leaderboard:" + season + ":" + scope
+}
+
+func leaderboardKey(season string, kind LeaderboardKind, scope string) string {
+	return withHashTag(leaderboardHashTag(season, scope), "leaderboard:"+season+":"+string(kind)+":"+scope)
+}
+
+func currentStreaksKey(season string, scope string) string {
+	return withHashTag(leaderboardHashTag(season, scope), "leaderboard:"+season+":current-streak:"+scope)
+}
+
+// recordedGamesKey holds the IDs of the games already recorded on the scope's boards, so that none is counted twice
+func recordedGamesKey(season string, scope string) string {
+	return withHashTag(leaderboardHashTag(season, scope), "leaderboard:"+season+":recorded-games:"+scope)
+}
+
+func seasonStandingsKey(season string) string {
+	return "season:" + season + ":standings"
+}
+
+func isValidLeaderboardKind(kind LeaderboardKind) bool {
+	for _, validKind := range leaderboardKinds {
+		if kind == validKind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LeaderboardStore keeps each season's leaderboards while it is running, and their final standings once it has ended
+type LeaderboardStore interface {
+	// RecordLeaderboardResult records a finished game on the scope's boards for the season, along with each player's
+	// rating after it. A game that has already been recorded on them isn't recorded again
+	RecordLeaderboardResult(ctx context.Context, season string, scope string, gameId string, winnerId string, winnerRating float64, loserId string, loserRating float64) error
+	// GetLeaderboard returns a page of one of the season's boards, highest score first
+	GetLeaderboard(ctx context.Context, season string, kind LeaderboardKind, scope string, offset int, limit int) (LeaderboardPage, error)
+	// ListLeaderboards returns each of the season's boards as "<kind>:<scope>"
+	ListLeaderboards(ctx context.Context, season string) ([]string, error)
+	// DeleteLeaderboards deletes every one of the season's boards, along with the players' current streaks
+	DeleteLeaderboards(ctx context.Context, season string) error
+	// SaveSeasonStandings saves the final standings of a season that has ended, and lists it as archived
+	SaveSeasonStandings(ctx context.Context, standings SeasonStandings) error
+	// GetSeasonStandings returns the final standings of the season, or nil if it hasn't been archived
+	GetSeasonStandings(ctx context.Context, season string) (*SeasonStandings, error)
+	// ListSeasons returns every season that has been archived, in no particular order
+	ListSeasons(ctx context.Context) ([]string, error)
+	// GetCurrentSeason returns the season the boards are being kept for, or an empty string before the first one
+	GetCurrentSeason(ctx context.Context) (string, error)
+	SetCurrentSeason(ctx context.Context, season string) error
+}
+
+// Records a finished game on every one of a scope's boards, unless it already has been. KEYS are the recorded games,
+// the top rating, most wins, current streak and longest streak boards, and ARGV holds the game ID, the winner and their
+// rating, and the loser and their rating. ZADD GT only ever raises the longest streak
+var recordLeaderboardResultScript = redis.NewScript(`
+if redis.call('SADD', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2], ARGV[5], ARGV[4])
+redis.call('ZINCRBY', KEYS[3], 1, ARGV[2])
+local streak = redis.call('HINCRBY', KEYS[4], ARGV[2], 1)
+redis.call('HSET', KEYS[4], ARGV[4], 0)
+redis.call('ZADD', KEYS[5], 'GT', streak, ARGV[2])
+return 1
+`)
+
+func (store *RedisStore) RecordLeaderboardResult(ctx context.Context, season string, scope string, gameId string, winnerId string, winnerRating float64, loserId string, loserRating float64) error {
+	keys := []string{
+		recordedGamesKey(season, scope),
+		leaderboardKey(season, TopRating, scope),
+		leaderboardKey(season, MostWins, scope),
+		currentStreaksKey(season, scope),
+		leaderboardKey(season, LongestWinStreak, scope),
+	}
+
+	return recordLeaderboardResultScript.Run(ctx, store.rdb, keys, gameId, winnerId, winnerRating, loserId, loserRating).Err()
+}
+
+func (store *RedisStore) GetLeaderboard(ctx context.Context, season string, kind LeaderboardKind, scope string, offset int, limit int) (LeaderboardPage, error) {
+	page := LeaderboardPage{
+		Season:  season,
+		Kind:    kind,
+		Scope:   scope,
+		Entries: []LeaderboardEntry{},
+		Offset:  offset,
+		Limit:   limit,
+	}
+
+	key := leaderboardKey(season, kind, scope)
+
+	total, err := store.rdb.ZCard(ctx, key).Result()
+	if err != nil {
+		return page, err
+	}
+	page.Total = int(total)
+
+	scores, err := store.rdb.ZRevRangeWithScores(ctx, key, int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return page, err
+	}
+
+	for i, score := range scores {
+		page.Entries = append(page.Entries, LeaderboardEntry{
+			Rank:     offset + i + 1,
+			PlayerId: score.Member.(string),
+			Score:    score.Score,
+		})
+	}
+
+	return page, nil
+}
+
+// seasonKeys returns every key the season's boards are kept in. Under Cluster they are spread across every primary,
+// each of which only scans its own keys
+func (store *RedisStore) seasonKeys(ctx context.Context, season string) ([]string, error) {
+	var keys []string
+	var mutex sync.Mutex
+	pattern := withHashTag("leaderboard:"+season+":*", "leaderboard:"+season+":*")
+	err := forEachPrimary(ctx, store.rdb, func(ctx context.Context, client *redis.Client) error {
+		iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			mutex.Lock()
+			keys = append(keys, iter.Val())
+			mutex.Unlock()
+		}
+
+		return iter.Err()
+	})
+
+	return keys, err
+}
+
+func (store *RedisStore) ListLeaderboards(ctx context.Context, season string) ([]string, error) {
+	keys, err := store.seasonKeys(ctx, season)
+	if err != nil {
+		return nil, err
+	}
+
+	var boards []string
+	for _, key := range keys {
+		board := strings.TrimPrefix(withoutHashTag(key), "leaderboard:"+season+":")
+		kind, _, _ := strings.Cut(board, ":")
+		if isValidLeaderboardKind(LeaderboardKind(kind)) {
+			boards = append(boards, board)
+		}
+	}
+
+	return boards, nil
+}
+
+func (store *RedisStore) DeleteLeaderboards(ctx context.Context, season string) error {
+	keys, err := store.seasonKeys(ctx, season)
+	if err != nil {
+		return err
+	}
+
+	// Deleted one at a time, since under Cluster they can be in different slots
+	_, err = store.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, key)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (store *RedisStore) SaveSeasonStandings(ctx context.Context, standings SeasonStandings) error {
+	// Under Cluster these keys can be in different slots, so they are written one after the other
+	err := store.rdb.JSONSet(ctx, seasonStandingsKey(standings.Season), "$", standings).Err()
+	if err != nil {
+		return err
+	}
+
+	return store.rdb.SAdd(ctx, "seasons", standings.Season).Err()
+}
+
+func (store *RedisStore) GetSeasonStandings(ctx context.Context, season string) (*SeasonStandings, error) {
+	return getRedisJson[SeasonStandings](ctx, store.rdb, seasonStandingsKey(season))
+}
+
+func (store *RedisStore) ListSeasons(ctx context.Context) ([]string, error) {
+	return store.rdb.SMembers(ctx, "seasons").Result()
+}
+
+func (store *RedisStore) GetCurrentSeason(ctx context.Context) (string, error) {
+	season, err := store.rdb.Get(ctx, "season:current").Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+
+	return season, err
+}
+
+func (store *RedisStore) SetCurrentSeason(ctx context.Context, season string) error {
+	return store.rdb.Set(ctx, "season:current", season, 0).Err()
+}
+
+func (store *MemoryStore) RecordLeaderboardResult(ctx context.Context, season string, scope string, gameId string, winnerId string, winnerRating float64, loserId string, loserRating float64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	recorded := recordedGamesKey(season, scope)
+	if _, exists := store.recordedGames[recorded][gameId]; exists {
+		return nil
+	}
+
+	if store.recordedGames[recorded] == nil {
+		store.recordedGames[recorded] = map[string]struct{}{}
+	}
+	store.recordedGames[recorded][gameId] = struct{}{}
+
+	board := func(kind LeaderboardKind) map[string]float64 {
+		key := leaderboardKey(season, kind, scope)
+		if store.leaderboards[key] == nil {
+			store.leaderboards[key] = map[string]float64{}
+		}
+
+		return store.leaderboards[key]
+	}
+
+	board(TopRating)[winnerId] = winnerRating
+	board(TopRating)[loserId] = loserRating
+	board(MostWins)[winnerId]++
+
+	streaks := currentStreaksKey(season, scope)
+	if store.currentStreaks[streaks] == nil {
+		store.currentStreaks[streaks] = map[string]int{}
+	}
+
+	store.currentStreaks[streaks][winnerId]++
+	store.currentStreaks[streaks][loserId] = 0
+
+	streak := float64(store.currentStreaks[streaks][winnerId])
+	if longest, exists := board(LongestWinStreak)[winnerId]; !exists || streak > longest {
+		board(LongestWinStreak)[winnerId] = streak
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) GetLeaderboard(ctx context.Context, season string, kind LeaderboardKind, scope string, offset int, limit int) (LeaderboardPage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	page := LeaderboardPage{
+		Season:  season,
+		Kind:    kind,
+		Scope:   scope,
+		Entries: []LeaderboardEntry{},
+		Offset:  offset,
+		Limit:   limit,
+	}
+
+	board := store.leaderboards[leaderboardKey(season, kind, scope)]
+	page.Total = len(board)
+
+	// Ties are broken the same as in a Redis sorted set read highest first
+	entries := make([]LeaderboardEntry, 0, len(board))
+	for playerId, score := range board {
+		entries = append(entries, LeaderboardEntry{PlayerId: playerId, Score: score})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+
+		return entries[i].PlayerId > entries[j].PlayerId
+	})
+
+	for i := offset; i < min(offset+limit, len(entries)); i++ {
+		entries[i].Rank = i + 1
+		page.Entries = append(page.Entries, entries[i])
+	}
+
+	return page, nil
+}
+
+func (store *MemoryStore) ListLeaderboards(ctx context.Context, season string) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var boards []string
+	for key := range store.leaderboards {
+		if board, found := strings.CutPrefix(key, "leaderboard:"+season+":"); found {
+			boards = append(boards, board)
+		}
+	}
+
+	return boards, nil
+}
+
+func (store *MemoryStore) DeleteLeaderboards(ctx context.Context, season string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for key := range store.leaderboards {
+		if strings.HasPrefix(key, "leaderboard:"+season+":") {
+			delete(store.leaderboards, key)
+		}
+	}
+
+	for key := range store.currentStreaks {
+		if strings.HasPrefix(key, "leaderboard:"+season+":") {
+			delete(store.currentStreaks, key)
+		}
+	}
+
+	for key := range store.recordedGames {
+		if strings.HasPrefix(key, "leaderboard:"+season+":") {
+			delete(store.recordedGames, key)
+		}
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) SaveSeasonStandings(ctx context.Context, standings SeasonStandings) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	standingsJson, err := json.Marshal(standings)
+	if err != nil {
+		return err
+	}
+
+	store.seasonStandings[standings.Season] = standingsJson
+	return nil
+}
+
+func (store *MemoryStore) GetSeasonStandings(ctx context.Context, season string) (*SeasonStandings, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return getMemoryJson[SeasonStandings](store.seasonStandings, season)
+}
+
+func (store *MemoryStore) ListSeasons(ctx context.Context) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	seasons := make([]string, 0, len(store.seasonStandings))
+	for season := range store.seasonStandings {
+		seasons = append(seasons, season)
+	}
+
+	return seasons, nil
+}
+
+func (store *MemoryStore) GetCurrentSeason(ctx context.Context) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.currentSeason, nil
+}
+
+func (store *MemoryStore) SetCurrentSeason(ctx context.Context, season string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.currentSeason = season
+	return nil
+}
+
+// UpdateLeaderboards records a finished game on the global and variant leaderboards of the current season. Recording
+// the same game again changes nothing
+func UpdateLeaderboards(ctx context.Context, store Store, lobby Lobby) error {
+	if lobby.Game == nil || lobby.Game.State != GameOver || lobby.Player2 == nil {
+		return nil
+	}
+
+	game := lobby.Game
+	season := CurrentSeason(time.Now())
+	pool := RatingPool(game.Variant, game.TimeControl)
+
+	winnerId, loserId := *lobby.WinnerId(), lobby.Player1
+	if winnerId == lobby.Player1 {
+		loserId = *lobby.Player2
+	}
+
+	winnerRatings, err := store.GetPlayerRatings(ctx, winnerId)
+	if err != nil {
+		return err
+	}
+
+	loserRatings, err := store.GetPlayerRatings(ctx, loserId)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range []string{GlobalScope, string(game.Variant)} {
+		err := store.RecordLeaderboardResult(ctx, season, scope, game.Id, winnerId, winnerRatings.Get(pool).Glicko.Rating, loserId, loserRatings.Get(pool).Glicko.Rating)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RolloverSeason archives the final standings of the previous season once a new season has started.
+// It is safe to call from several servers at once, only one of them will archive the standings
+func RolloverSeason(ctx context.Context, store Store, logger *slog.Logger, now time.Time) error {
+	current := CurrentSeason(now)
+
+	previous, err := store.GetCurrentSeason(ctx)
+	if err != nil {
+		return err
+	}
+
+	if previous == current {
+		return nil
+	}
+
+	if len(previous) == 0 {
+		return store.SetCurrentSeason(ctx, current)
+	}
+
+	acquired, err := store.TryLock(ctx, "season:"+previous+":archiving", time.Minute)
+	if err != nil || !acquired {
+		return err
+	}
+
+	logger = logger.With(slog.String("season", previous))
+	logger.Info("Season has ended, archiving final standings...")
+
+	standings := SeasonStandings{
+		Season:     previous,
+		ArchivedAt: now,
+		Boards:     map[string][]LeaderboardEntry{},
+	}
+
+	boards, err := store.ListLeaderboards(ctx, previous)
+	if err != nil {
+		return err
+	}
+
+	for _, board := range boards {
+		kind, scope, _ := strings.Cut(board, ":")
+		page, err := store.GetLeaderboard(ctx, previous, LeaderboardKind(kind), scope, 0, seasonStandingsLimit)
+		if err != nil {
+			return err
+		}
+
+		standings.Boards[board] = page.Entries
+	}
+
+	// The live boards are only deleted once the new season has started, so that if anything before then fails, the
+	// standings are archived again from the same boards
+	err = store.SaveSeasonStandings(ctx, standings)
+	if err != nil {
+		return err
+	}
+
+	err = store.SetCurrentSeason(ctx, current)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Archived final standings, season " + current + " has started")
+
+	return store.DeleteLeaderboards(ctx, previous)
+}
+
+// RunSeasonScheduler periodically checks whether the season has changed until the context is cancelled
+func RunSeasonScheduler(ctx context.Context, store Store, logger *slog.Logger) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if err := RolloverSeason(ctx, store, logger, time.Now()); err != nil {
+			logger.Warn("There was an error rolling over the season: " + err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func getLeaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	kind := LeaderboardKind(r.PathValue("kind"))
+	if !isValidLeaderboardKind(kind) {
+		WriteError(w, InvalidRequest, "Invalid leaderboard, must be one of 'rating', 'wins' or 'streak'")
+		return
+	}
+
+	scope := GlobalScope
+	if r.URL.Query().Has("variant") {
+		scope = r.URL.Query().Get("variant")
+	}
+
+	offset, limit, err := ParsePagination(r)
+	if err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	season := CurrentSeason(time.Now())
+	if r.URL.Query().Has("season") && r.URL.Query().Get("season") != season {
+		season = r.URL.Query().Get("season")
+
+		standings, err := store.GetSeasonStandings(r.Context(), season)
+		if err != nil {
+			logger.Warn("There was an error fetching season standings: " + err.Error())
+			WriteError(w, InternalError, "There was an error fetching season standings")
+			return
+		}
+
+		if standings == nil {
+			WriteError(w, SeasonNotFound, "No standings for season "+season+" found")
+			return
+		}
+
+		entries := standings.Boards[string(kind)+":"+scope]
+		page := LeaderboardPage{
+			Season:  season,
+			Kind:    kind,
+			Scope:   scope,
+			Entries: []LeaderboardEntry{},
+			Offset:  offset,
+			Limit:   limit,
+			Total:   len(entries),
+		}
+
+		if offset < len(entries) {
+			page.Entries = entries[offset:min(offset+limit, len(entries))]
+		}
+
+		WriteJson(w, page)
+		return
+	}
+
+	page, err := store.GetLeaderboard(r.Context(), season, kind, scope, offset, limit)
+	if err != nil {
+		logger.Warn("There was an error fetching leaderboard: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching leaderboard")
+		return
+	}
+
+	WriteJson(w, page)
+}
+
+func listSeasonsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	seasons, err := store.ListSeasons(r.Context())
+	if err != nil {
+		logger.Warn("There was an error fetching seasons: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching seasons")
+		return
+	}
+
+	sort.Strings(seasons)
+
+	WriteJson(w, struct {
+		Current  string
+		Archived []string
+	}{
+		Current:  CurrentSeason(time.Now()),
+		Archived: seasons,
+	})
+}
+
+func getSeasonStandingsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	season := r.PathValue("season")
+	standings, err := store.GetSeasonStandings(r.Context(), season)
+	if err != nil {
+		logger.Warn("There was an error fetching season standings: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching season standings")
+		return
+	}
+
+	if standings == nil {
+		WriteError(w, SeasonNotFound, "No standings for season "+season+" found")
+		return
+	}
+
+	WriteJson(w, standings)
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"backend/turn"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// LobbyValidationError is returned when a lobby operation is not allowed, as opposed to failing
+type LobbyValidationError struct {
+	cause   ErrorCode
+	message string
+}
+
+func (e LobbyValidationError) Error() string {
+	return string(e.cause)
+}
+
+// VersionConflictError is returned when a move was made against a different version of the game than the current one
+type VersionConflictError struct {
+	expected int
+	current  int
+}
+
+func (e VersionConflictError) Error() string {
+	return string(VersionConflict)
+}
+
+// writeLobbyError sends the reason a lobby operation or move was rejected, or an internal error if it failed
+func writeLobbyError(w http.ResponseWriter, logger *slog.Logger, err error, details map[string]any) {
+	var invalidMoveError *InvalidMoveError
+	if errors.As(err, &invalidMoveError) {
+		WriteErrorDetails(w, ErrorCode(invalidMoveError.cause), invalidMoveMessages[invalidMoveError.cause], details)
+		return
+	}
+
+	var validationError LobbyValidationError
+	if errors.As(err, &validationError) {
+		WriteErrorDetails(w, validationError.cause, validationError.message, details)
+		return
+	}
+
+	var versionConflictError VersionConflictError
+	if errors.As(err, &versionConflictError) {
+		if details == nil {
+			details = map[string]any{}
+		}
+
+		details["ExpectedVersion"] = versionConflictError.expected
+		details["CurrentVersion"] = versionConflictError.current
+		WriteErrorDetails(w, VersionConflict, "The game has changed since the expected version", details)
+		return
+	}
+
+	logger.Warn("There was an error updating lobby: " + err.Error())
+	WriteError(w, InternalError, "There was an error updating lobby")
+}
+
+// CreateLobby creates a new lobby with the player in it
+func CreateLobby(ctx context.Context, store Store, logger *slog.Logger, playerId string) (Lobby, error) {
+	lobby := Lobby{
+		LobbyId: NewLobbyId(),
+		Player1: playerId,
+	}
+
+	logger = logger.With(slog.String("lobbyId", lobby.LobbyId))
+
+	logger.Info("Creating lobby...")
+	err := store.UpdateLobby(ctx, lobby.LobbyId, func(tx LobbyTx) error {
+		tx.AppendLobbyEvent(&LobbyLogEntry{Kind: LobbyCreated, PlayerId: playerId, At: time.Now(), Lobby: &lobby})
+		tx.SetLobby(lobby)
+		return nil
+	})
+
+	if err != nil {
+		return lobby, err
+	}
+
+	logger.Info("Adding player to lobby...")
+	return lobby, setCurrentLobby(ctx, store, playerId, lobby.LobbyId)
+}
+
+// JoinLobby adds the player to the lobby as its second player, starts the game and sends it to both players
+func JoinLobby(ctx context.Context, store Store, logger *slog.Logger, playerId string, lobbyId string) (Lobby, error) {
+	logger = logger.With("lobbyId", lobbyId)
+
+	var updatedLobby Lobby
+	var entry *LobbyLogEntry
+
+	err := store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		lobby, err := tx.GetLobby(ctx)
+		if err != nil {
+			return err
+		}
+
+		if lobby == nil {
+			logger.Debug("No lobby with ID " + lobbyId + " found")
+			return LobbyValidationError{cause: LobbyNotFound, message: "No lobby with ID " + lobbyId + " found"}
+		}
+
+		if lobby.IsMatchLobby() {
+			logger.Debug("Lobby was created by a tournament or arena")
+			return LobbyValidationError{cause: LobbyNotJoinable, message: "Tournament and arena lobbies can't be joined"}
+		}
+
+		if lobby.Player1 == playerId || (lobby.Player2 != nil && *lobby.Player2 != playerId) {
+			logger.Debug("Lobby is full")
+			return LobbyValidationError{cause: LobbyFull, message: "The lobby already has two players"}
+		}
+
+		lobby.Player2 = &playerId
+		lobby.Game = NewGame()
+		entry = &LobbyLogEntry{Kind: PlayerJoined, PlayerId: playerId, At: lobby.Game.StartedAt, Game: lobby.Game}
+		tx.AppendLobbyEvent(entry)
+		tx.SetLobby(*lobby)
+
+		updatedLobby = *lobby
+
+		return nil
+	})
+
+	if err != nil {
+		return updatedLobby, err
+	}
+
+	if err := setCurrentLobby(ctx, store, playerId, lobbyId); err != nil {
+		return updatedLobby, err
+	}
+
+	logger.Info("Broadcasting lobby update to players")
+	publishGameUpdate(ctx, store, logger, updatedLobby, entry.Id)
+
+	return updatedLobby, nil
+}
+
+// LeaveLobby removes the player from their current lobby, telling their opponent and forfeiting any tournament or
+// arena game that is still being played
+func LeaveLobby(ctx context.Context, store Store, logger *slog.Logger, playerId string) error {
+	player, err := store.GetPlayer(ctx, playerId)
+	if err != nil || player == nil || player.CurrentLobby == nil {
+		return err
+	}
+
+	lobbyId := *player.CurrentLobby
+
+	var sendUpdateToPlayerId *string
+	var forfeitedLobby *Lobby
+	var entry *LobbyLogEntry
+
+	err = store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		sendUpdateToPlayerId = nil
+		forfeitedLobby = nil
+		entry = nil
+
+		lobby, err := tx.GetLobby(ctx)
+		if err != nil {
+			return err
+		}
+
+		if lobby == nil || !lobby.HasPlayer(playerId) {
+			logger.Warn("Player was in a lobby that no longer exists or no longer has them in it. Removing lobby ID from player...")
+			return nil
+		}
+
+		// Leaving a tournament or arena game that is still being played forfeits it
+		if lobby.IsMatchLobby() && lobby.Player2 != nil && lobby.Game != nil && lobby.Game.State != GameOver {
+			forfeited := *lobby
+			forfeitedLobby = &forfeited
+		}
+
+		sendUpdateToPlayerId, entry = removeFromLobby(tx, logger, lobby, playerId)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := clearCurrentLobby(ctx, store, playerId, lobbyId); err != nil {
+		return err
+	}
+
+	logger.Debug("User has left lobby")
+
+	if sendUpdateToPlayerId != nil {
+		logger.Info("Sending update to user " + *sendUpdateToPlayerId)
+		PublishLobbyEvent(ctx, store, logger, LobbyEventMessage{
+			Event:   OpponentLeft,
+			EventId: entry.Id,
+			Game:    nil,
+		}, *sendUpdateToPlayerId)
+	}
+
+	if forfeitedLobby != nil {
+		winnerId := forfeitedLobby.Player1
+		if winnerId == playerId {
+			winnerId = *forfeitedLobby.Player2
+		}
+
+		if forfeitedLobby.TournamentId != nil {
+			logger.Info("Player forfeited their tournament game")
+			err = RecordTournamentResult(ctx, store, logger, *forfeitedLobby.TournamentId, forfeitedLobby.LobbyId, winnerId)
+			if err != nil {
+				logger.Warn("There was an error recording the tournament forfeit: " + err.Error())
+			}
+		}
+
+		if forfeitedLobby.ArenaId != nil {
+			logger.Info("Player forfeited their arena game")
+			err = RecordArenaResult(ctx, store, logger, *forfeitedLobby.ArenaId, forfeitedLobby.LobbyId, forfeitedLobby.Game.Id, winnerId, playerId, true)
+			if err != nil {
+				logger.Warn("There was an error recording the arena forfeit: " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// leaveLobby takes the player out of the lobby, if they are still in it. It returns the player left in the lobby
+// along with the log entry that tells them, or nil if there isn't one
+func leaveLobby(ctx context.Context, store Store, logger *slog.Logger, lobbyId string, playerId string) (*string, *LobbyLogEntry, error) {
+	var remainingPlayerId *string
+	var entry *LobbyLogEntry
+
+	err := store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		remainingPlayerId = nil
+		entry = nil
+
+		lobby, err := tx.GetLobby(ctx)
+		if err != nil || lobby == nil || !lobby.HasPlayer(playerId) {
+			return err
+		}
+
+		remainingPlayerId, entry = removeFromLobby(tx, logger, lobby, playerId)
+		return nil
+	})
+
+	return remainingPlayerId, entry, err
+}
+
+// removeFromLobby takes the player out of the lobby as part of the transaction, deleting the lobby if nobody is left
+// in it. It returns the player left in the lobby along with the log entry that tells them, or nil if there isn't one
+func removeFromLobby(tx LobbyTx, logger *slog.Logger, lobby *Lobby, playerId string) (*string, *LobbyLogEntry) {
+	remainingPlayerId := lobby.RemovePlayer(playerId)
+	if remainingPlayerId == nil {
+		logger.Debug("Player was the only user in lobby, deleting lobby...")
+		tx.DeleteLobby()
+		return nil, nil
+	}
+
+	logger.Debug("Leaving lobby, " + *remainingPlayerId + " is now its owner...")
+	entry := &LobbyLogEntry{Kind: PlayerLeft, PlayerId: playerId, At: time.Now()}
+	tx.AppendLobbyEvent(entry)
+	tx.SetLobby(*lobby)
+
+	return remainingPlayerId, entry
+}
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// Set on responses to moves that had already been made with the same idempotency key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	// How long the result of a move is kept for retries with the same idempotency key
+	idempotencyKeyLifetime = 24 * time.Hour
+)
+
+type MoveOptions struct {
+	// If set, the move is only made if the game is still at this version
+	ExpectedVersion *int
+	// If set, retrying the move with the same key returns the result of the first attempt instead of moving again
+	IdempotencyKey string
+	// How the move is saved, which defaults to WatchMoves
+	Strategy MoveStrategy
+}
+
+// idempotentMove is the result of a successful move, stored against its idempotency key
+type idempotentMove struct {
+	LobbyId string
+	From    *int
+	To      int
+	Lobby   Lobby
+}
+
+// idempotencyKey is kept in the lobby's slot, so that it can be saved along with the move
+func idempotencyKey(lobbyId string, playerId string, key string) string {
+	return withHashTag(lobbyHashTag(lobbyId), "idempotency:"+lobbyId+":"+playerId+":"+key)
+}
+
+// checkIdempotentMove returns the lobby stored with a previous move, as long as it was the same move
+func checkIdempotentMove(previous idempotentMove, lobbyId string, move PlayerMove) (*Lobby, error) {
+	if previous.LobbyId != lobbyId || previous.To != move.to || !slices.Equal(intSlice(previous.From), intSlice(move.from)) {
+		return nil, LobbyValidationError{cause: IdempotencyKeyReused, message: "The idempotency key was already used for a different move"}
+	}
+
+	return &previous.Lobby, nil
+}
+
+// getIdempotentMove returns the lobby as it was straight after the move was first made with the idempotency key, or
+// nil if the key hasn't been used
+func getIdempotentMove(ctx context.Context, tx LobbyTx, playerId string, lobbyId string, move PlayerMove, key string) (*Lobby, error) {
+	previous, err := tx.GetIdempotentMove(ctx, playerId, key)
+	if err != nil || previous == nil {
+		return nil, err
+	}
+
+	return checkIdempotentMove(*previous, lobbyId, move)
+}
+
+// checkMoveLobby returns which player the player is in the lobby's game, as long as they are in it and the game can be
+// moved in. The lobby is what says who is in it, rather than the player's CurrentLobby, which is saved separately
+func checkMoveLobby(lobby *Lobby, playerId string, options MoveOptions) (turn.Turn, error) {
+	if lobby == nil || !lobby.HasPlayer(playerId) {
+		return "", LobbyValidationError{cause: NotInLobby, message: "The player is not in a lobby!"}
+	}
+
+	if lobby.Player2 == nil {
+		return "", LobbyValidationError{cause: WaitingForPlayer, message: "Waiting for a second player to join the lobby"}
+	}
+
+	if options.ExpectedVersion != nil && *options.ExpectedVersion != lobby.Game.Version {
+		return "", VersionConflictError{expected: *options.ExpectedVersion, current: lobby.Game.Version}
+	}
+
+	return lobbySeat(*lobby, playerId), nil
+}
+
+// MakeMove plays the move in the game in the given lobby, which the player must currently be in, and sends the
+// updated game to both players. replayed is true if the move was already made with the same idempotency key, in which
+// case the lobby is returned as it was straight after that move
+func MakeMove(ctx context.Context, store Store, logger *slog.Logger, playerId string, lobbyId string, move PlayerMove, options MoveOptions) (Lobby, bool, error) {
+	logger = logger.With("lobbyId", lobbyId)
+
+	var updatedLobby Lobby
+	var replayed bool
+	var err error
+	if redisStore, isRedis := store.(*RedisStore); isRedis && options.Strategy == ScriptMoves {
+		updatedLobby, replayed, err = makeMoveWithScript(ctx, redisStore, logger, playerId, lobbyId, move, options)
+	} else {
+		updatedLobby, replayed, err = makeMoveWithTx(ctx, store, logger, playerId, lobbyId, move, options)
+	}
+
+	if err != nil {
+		return updatedLobby, replayed, err
+	}
+
+	// The players were already sent the game when the move was first made, but a retried move that ended the game
+	// records its result again, in case that was cut short the first time
+	if updatedLobby.Game.State == GameOver {
+		HandleGameOver(ctx, logger, updatedLobby)
+	}
+
+	return updatedLobby, replayed, nil
+}
+
+// makeMoveWithTx makes the move in a transaction that is retried whenever the lobby changes underneath it
+func makeMoveWithTx(ctx context.Context, store Store, logger *slog.Logger, playerId string, lobbyId string, move PlayerMove, options MoveOptions) (Lobby, bool, error) {
+	replayed := false
+	var updatedLobby Lobby
+	var entry *LobbyLogEntry
+
+	err := store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		replayed = false
+
+		if len(options.IdempotencyKey) > 0 {
+			previous, err := getIdempotentMove(ctx, tx, playerId, lobbyId, move, options.IdempotencyKey)
+			if err != nil {
+				return err
+			}
+
+			if previous != nil {
+				logger.Debug("Move was already made with idempotency key " + options.IdempotencyKey)
+				updatedLobby = *previous
+				replayed = true
+				return nil
+			}
+		}
+
+		lobby, err := tx.GetLobby(ctx)
+		if err != nil {
+			return err
+		}
+
+		playerMakingRequest, err := checkMoveLobby(lobby, playerId, options)
+		if err != nil {
+			return err
+		}
+
+		newGame, err := lobby.Game.EvaluateMove(playerMakingRequest, move)
+		if err != nil {
+			return err
+		}
+
+		lobby.Game = &newGame
+		updatedLobby = *lobby
+
+		entry = newMoveLogEntry(playerId, move, newGame)
+		tx.AppendLobbyEvent(entry)
+		tx.SetLobby(updatedLobby)
+		if newGame.State == GameOver {
+			tx.SetGameOver(newGameOverTimer(updatedLobby))
+		}
+		if len(options.IdempotencyKey) > 0 {
+			tx.SetIdempotentMove(playerId, options.IdempotencyKey, idempotentMove{
+				LobbyId: lobbyId,
+				From:    move.from,
+				To:      move.to,
+				Lobby:   updatedLobby,
+			}, idempotencyKeyLifetime)
+		}
+
+		return nil
+	})
+
+	if err != nil || replayed {
+		return updatedLobby, replayed, err
+	}
+
+	logger.Info("Broadcasting updated game")
+	publishGameUpdate(ctx, store, logger, updatedLobby, entry.Id)
+
+	return updatedLobby, false, nil
+}
+
+// intSlice turns an optional int into a slice, so that two of them can be compared by value
+func intSlice(value *int) []int {
+	if value == nil {
+		return nil
+	}
+
+	return []int{*value}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"backend/tournament"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newCasualLobby creates a lobby for the first player and has the second join it, if there is one
+func newCasualLobby(t *testing.T, store Store, player1 string, player2 string) Lobby {
+	t.Helper()
+
+	ctx := context.Background()
+	lobby, err := CreateLobby(ctx, store, discardLogger(), player1)
+	if err != nil {
+		t.Fatal("Failed to create lobby: " + err.Error())
+	}
+
+	if len(player2) == 0 {
+		return lobby
+	}
+
+	lobby, err = JoinLobby(ctx, store, discardLogger(), player2, lobby.LobbyId)
+	if err != nil {
+		t.Fatal("Failed to join lobby: " + err.Error())
+	}
+
+	return lobby
+}
+
+func currentLobby(t *testing.T, store Store, playerId string) *string {
+	t.Helper()
+
+	player, err := store.GetPlayer(context.Background(), playerId)
+	if err != nil || player == nil {
+		t.Fatalf("Failed to read player %s: %v", playerId, err)
+	}
+
+	return player.CurrentLobby
+}
+
+func TestLeaveLobby(t *testing.T) {
+	tests := []struct {
+		name     string
+		player2  string
+		leaving  string
+		expected *Lobby
+	}{
+		{name: "only player", leaving: "alice", expected: nil},
+		{name: "owner", player2: "bob", leaving: "alice", expected: &Lobby{Player1: "bob"}},
+		{name: "second player", player2: "bob", leaving: "bob", expected: &Lobby{Player1: "alice"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			ctx := context.Background()
+			lobby := newCasualLobby(t, store, "alice", test.player2)
+
+			if err := LeaveLobby(ctx, store, discardLogger(), test.leaving); err != nil {
+				t.Fatal("Failed to leave lobby: " + err.Error())
+			}
+
+			if current := currentLobby(t, store, test.leaving); current != nil {
+				t.Fatalf("Player is still in lobby %s", *current)
+			}
+
+			remaining, err := store.GetLobby(ctx, lobby.LobbyId)
+			if err != nil {
+				t.Fatal("Failed to read lobby: " + err.Error())
+			}
+
+			if test.expected == nil {
+				if remaining != nil {
+					t.Fatalf("Expected the empty lobby to be deleted, got %+v", remaining)
+				}
+
+				return
+			}
+
+			if remaining == nil || remaining.Player1 != test.expected.Player1 || remaining.Player2 != nil {
+				t.Fatalf("Expected %s to be left in the lobby, got %+v", test.expected.Player1, remaining)
+			}
+		})
+	}
+}
+
+// Match lobbies take their players out of the lobbies they were in, so that no lobby is left with a player who
+// has moved on
+func TestCreateMatchLobbyLeavesPreviousLobbies(t *testing.T) {
+	tests := []struct {
+		name string
+		// Sets up the lobbies the players are in beforehand, returning the IDs of the lobbies that should be deleted,
+		// and the lobbies that should be kept along with the player who should be left in each
+		setUp      func(t *testing.T, store Store) (deleted []string, leftBehind map[string]string)
+		matchedIds [2]string
+	}{
+		{
+			name: "not in a lobby",
+			setUp: func(t *testing.T, store Store) ([]string, map[string]string) {
+				return nil, nil
+			},
+			matchedIds: [2]string{"alice", "bob"},
+		},
+		{
+			name: "both in the same lobby",
+			setUp: func(t *testing.T, store Store) ([]string, map[string]string) {
+				lobby := newCasualLobby(t, store, "alice", "bob")
+				return []string{lobby.LobbyId}, nil
+			},
+			matchedIds: [2]string{"alice", "bob"},
+		},
+		{
+			name: "each alone in a lobby",
+			setUp: func(t *testing.T, store Store) ([]string, map[string]string) {
+				first := newCasualLobby(t, store, "alice", "")
+				second := newCasualLobby(t, store, "bob", "")
+				return []string{first.LobbyId, second.LobbyId}, nil
+			},
+			matchedIds: [2]string{"alice", "bob"},
+		},
+		{
+			name: "in a lobby with someone else",
+			setUp: func(t *testing.T, store Store) ([]string, map[string]string) {
+				lobby := newCasualLobby(t, store, "alice", "carol")
+				return nil, map[string]string{lobby.LobbyId: "carol"}
+			},
+			matchedIds: [2]string{"alice", "bob"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			ctx := context.Background()
+			deleted, leftBehind := test.setUp(t, store)
+
+			player2 := test.matchedIds[1]
+			match := Lobby{LobbyId: NewLobbyId(), Player1: test.matchedIds[0], Player2: &player2}
+			if err := CreateMatchLobby(ctx, store, discardLogger(), match); err != nil {
+				t.Fatal("Failed to create match lobby: " + err.Error())
+			}
+
+			for _, playerId := range test.matchedIds {
+				if current := currentLobby(t, store, playerId); current == nil || *current != match.LobbyId {
+					t.Fatalf("Expected %s to be in the match lobby, got %v", playerId, current)
+				}
+			}
+
+			for _, lobbyId := range deleted {
+				if lobby, err := store.GetLobby(ctx, lobbyId); err != nil || lobby != nil {
+					t.Fatalf("Expected lobby %s to be deleted, got %+v (%v)", lobbyId, lobby, err)
+				}
+			}
+
+			for lobbyId, playerId := range leftBehind {
+				lobby, err := store.GetLobby(ctx, lobbyId)
+				if err != nil || lobby == nil || lobby.Player1 != playerId || lobby.Player2 != nil {
+					t.Fatalf("Expected only %s to be left in lobby %s, got %+v (%v)", playerId, lobbyId, lobby, err)
+				}
+
+				if current := currentLobby(t, store, playerId); current == nil || *current != lobbyId {
+					t.Fatalf("Expected %s to still be in lobby %s, got %v", playerId, lobbyId, current)
+				}
+			}
+		})
+	}
+}
+
+// A player's CurrentLobby is saved separately from the lobby, so it can point at a lobby that no longer has them in it,
+// which must never let them act in that lobby
+func TestStaleCurrentLobby(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	lobby := newCasualLobby(t, store, "alice", "bob")
+
+	err := store.UpdatePlayer(ctx, "carol", func(tx PlayerTx) error {
+		carol := NewPlayer("carol")
+		carol.CurrentLobby = &lobby.LobbyId
+		tx.SetPlayer(*carol)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Failed to save player: " + err.Error())
+	}
+
+	if playerLobby, err := GetPlayerLobby(ctx, store, "carol"); err != nil || playerLobby != nil {
+		t.Fatalf("Expected carol not to be in a lobby, got %+v (%v)", playerLobby, err)
+	}
+
+	_, _, err = MakeMove(ctx, store, discardLogger(), "carol", lobby.LobbyId, PlayerMove{to: 4}, MoveOptions{})
+	var validationError LobbyValidationError
+	if !errors.As(err, &validationError) || validationError.cause != NotInLobby {
+		t.Fatalf("Expected carol's move to be rejected, got %v", err)
+	}
+
+	if err := LeaveLobby(ctx, store, discardLogger(), "carol"); err != nil {
+		t.Fatal("Failed to leave lobby: " + err.Error())
+	}
+
+	if current := currentLobby(t, store, "carol"); current != nil {
+		t.Fatalf("Expected carol's lobby to be cleared, got %s", *current)
+	}
+
+	remaining, err := store.GetLobby(ctx, lobby.LobbyId)
+	if err != nil || remaining == nil || remaining.Player1 != "alice" || remaining.Player2 == nil || *remaining.Player2 != "bob" {
+		t.Fatalf("Expected alice and bob to still be in the lobby, got %+v (%v)", remaining, err)
+	}
+}
+
+// A tournament game that expires before it finishes is forfeited by both players, so that the round can still finish
+func TestExpireAbandonedTournamentLobby(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := NewBackgroundContext(context.Background(), store, nil)
+
+	lobbyId := NewLobbyId()
+	bob := "bob"
+	err := store.CreateTournament(ctx, Tournament{
+		TournamentId: "cup",
+		Format:       tournament.Knockout,
+		State:        TournamentInProgress,
+		Players:      []string{"alice", "bob"},
+		Rounds: []tournament.Round{
+			{Number: 1, Pairings: []tournament.Pairing{{Player1: "alice", Player2: &bob, LobbyId: &lobbyId}}},
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to create tournament: " + err.Error())
+	}
+
+	tournamentId := "cup"
+	err = CreateMatchLobby(ctx, store, discardLogger(), Lobby{LobbyId: lobbyId, Player1: "alice", Player2: &bob, TournamentId: &tournamentId})
+	if err != nil {
+		t.Fatal("Failed to create match lobby: " + err.Error())
+	}
+
+	store.lobbyExpiries[lobbyId] = time.Now().Add(-time.Second)
+	if err := ExpireLobby(ctx, store, discardLogger(), lobbyId); err != nil {
+		t.Fatal("Failed to expire lobby: " + err.Error())
+	}
+
+	if lobby, err := store.GetLobby(ctx, lobbyId); err != nil || lobby != nil {
+		t.Fatalf("Expected the lobby to be deleted, got %+v (%v)", lobby, err)
+	}
+
+	tourney, err := store.GetTournament(ctx, tournamentId)
+	if err != nil || tourney == nil {
+		t.Fatalf("Failed to read tournament: %v", err)
+	}
+
+	if !tourney.Rounds[0].Pairings[0].Forfeited || tourney.State != TournamentFinished {
+		t.Fatalf("Expected both players to forfeit and the tournament to finish, got %+v", tourney)
+	}
+}
+
+// A tournament game whose lobby couldn't be created gets one when the timer fires, and firing it again after the game
+// has started doesn't start it over
+func TestRetryTournamentLobby(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := NewBackgroundContext(context.Background(), store, nil)
+
+	lobbyId := NewLobbyId()
+	bob := "bob"
+	err := store.CreateTournament(ctx, Tournament{
+		TournamentId: "cup",
+		Format:       tournament.Knockout,
+		State:        TournamentInProgress,
+		Players:      []string{"alice", "bob"},
+		Rounds: []tournament.Round{
+			{Number: 1, Pairings: []tournament.Pairing{{Player1: "alice", Player2: &bob, LobbyId: &lobbyId}}},
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to create tournament: " + err.Error())
+	}
+
+	timer := Timer{Id: tournamentLobbyTimerId(lobbyId), Kind: TournamentLobby, TournamentId: "cup", LobbyId: lobbyId}
+	if err := RetryTournamentLobby(ctx, store, discardLogger(), timer); err != nil {
+		t.Fatal("Failed to create tournament lobby: " + err.Error())
+	}
+
+	for _, playerId := range []string{"alice", "bob"} {
+		if current := currentLobby(t, store, playerId); current == nil || *current != lobbyId {
+			t.Fatalf("Expected %s to be in the tournament lobby, got %v", playerId, current)
+		}
+	}
+
+	moved, _, err := MakeMove(ctx, store, discardLogger(), "alice", lobbyId, PlayerMove{to: 4}, MoveOptions{})
+	if err != nil {
+		t.Fatal("Failed to make move: " + err.Error())
+	}
+
+	if err := RetryTournamentLobby(ctx, store, discardLogger(), timer); err != nil {
+		t.Fatal("Failed to create tournament lobby again: " + err.Error())
+	}
+
+	lobby, err := store.GetLobby(ctx, lobbyId)
+	if err != nil || lobby == nil || lobby.Game.Version != moved.Game.Version {
+		t.Fatalf("Expected the game to carry on at version %d, got %+v (%v)", moved.Game.Version, lobby, err)
+	}
+}
@@ -1,20 +1,262 @@
 package main
 
+import (
+	"backend/turn"
+	"context"
+	"encoding/json"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"log/slog"
+	"time"
+)
+
 type Lobby struct {
-	LobbyId string
-	Player1 string
-	Player2 *string
-	Game    *Game
+	LobbyId      string
+	Player1      string
+	Player2      *string
+	Game         *Game
+	TournamentId *string
+	ArenaId      *string
+	// The version of the stored document, which is migrated when it is read if it is older than the current one
+	SchemaVersion int
+}
+
+// IsMatchLobby returns whether the lobby was created by the server to pair players, rather than by a player
+func (lobby *Lobby) IsMatchLobby() bool {
+	return lobby.TournamentId != nil || lobby.ArenaId != nil
+}
+
+// WinnerId returns the ID of the player who won the lobby's game, or nil if the game is not over
+func (lobby *Lobby) WinnerId() *string {
+	if lobby.Game == nil || lobby.Game.State != GameOver || lobby.Player2 == nil {
+		return nil
+	}
+
+	// The player whose turn it is when the game ends is the winner
+	if lobby.Game.Turn == turn.Player2 {
+		return lobby.Player2
+	}
+
+	return &lobby.Player1
+}
+
+func (lobby *Lobby) HasPlayer(playerId string) bool {
+	return lobby.Player1 == playerId || (lobby.Player2 != nil && *lobby.Player2 == playerId)
+}
+
+// RemovePlayer takes the player out of the lobby, making the second player its owner if the first one left. It
+// returns the player left in the lobby, or nil if it is now empty and should be deleted
+func (lobby *Lobby) RemovePlayer(playerId string) *string {
+	if lobby.Player1 == playerId {
+		if lobby.Player2 == nil {
+			return nil
+		}
+
+		lobby.Player1 = *lobby.Player2
+	}
+
+	lobby.Player2 = nil
+
+	remainingPlayerId := lobby.Player1
+	return &remainingPlayerId
 }
 
 type LobbyEvent string
 
 const (
-	GameUpdate   LobbyEvent = "GAME_UPDATE"
-	OpponentLeft            = "OPPONENT_LEFT"
+	GameUpdate       LobbyEvent = "GAME_UPDATE"
+	OpponentLeft                = "OPPONENT_LEFT"
+	TournamentUpdate            = "TOURNAMENT_UPDATE"
+	ArenaUpdate                 = "ARENA_UPDATE"
+	ChatMessageSent             = "CHAT_MESSAGE"
+	// Sent to a reconnecting player with everything they missed in their lobby
+	CaughtUp = "CATCH_UP"
+	// Sent to the players in a lobby that was closed because nothing happened in it for too long
+	LobbyExpired = "LOBBY_EXPIRED"
+	// Sent straight to connected players when Redis becomes unavailable, during which nothing can be saved, and again
+	// once it is back
+	MaintenanceStarted = "MAINTENANCE_STARTED"
+	MaintenanceEnded   = "MAINTENANCE_ENDED"
+	// Sent straight to connected players when the server is shutting down, just before their WebSocket is closed
+	ServerRestartingEvent = "SERVER_RESTARTING"
 )
 
 type LobbyEventMessage struct {
 	Event LobbyEvent
-	Game  *Game
+	// The ID of the lobby log entry the message is about, which reconnecting players send back to catch up from
+	EventId    string `json:",omitempty"`
+	Game       *Game
+	Tournament *Tournament     `json:",omitempty"`
+	Arena      *Arena          `json:",omitempty"`
+	Players    []PublicProfile `json:",omitempty"`
+	Chat       *ChatMessage    `json:",omitempty"`
+	Events     []LobbyLogEntry `json:",omitempty"`
+	// Sent with ServerRestartingEvent, for the player to send back when they reconnect
+	ResumeToken string `json:",omitempty"`
+}
+
+// LobbySnapshot is the full state of a lobby as seen by the players in it
+type LobbySnapshot struct {
+	Lobby   Lobby
+	Players []PublicProfile
+}
+
+func NewLobbyId() string {
+	lobbyId, _ := gonanoid.Generate("abcdefghijklmnopqrstuvwxyz0123456789", 8)
+	return lobbyId
+}
+
+// PublishLobbyEvent adds the message to the inbox of each of the given players
+func PublishLobbyEvent(ctx context.Context, store Store, logger *slog.Logger, message LobbyEventMessage, playerIds ...string) {
+	payload, _ := json.Marshal(message)
+
+	for _, playerId := range playerIds {
+		err := store.Notify(ctx, playerId, payload)
+		if err != nil {
+			logger.Warn("There was an error sending " + string(message.Event) + " message to player " + playerId + ": " + err.Error())
+		}
+	}
+}
+
+// publishGameUpdate sends the lobby's game to both of its players, along with the log entry that changed it
+func publishGameUpdate(ctx context.Context, store Store, logger *slog.Logger, lobby Lobby, eventId string) {
+	profiles, err := GetLobbyProfiles(ctx, store, lobby)
+	if err != nil {
+		logger.Warn("There was an error fetching player profiles: " + err.Error())
+	}
+
+	PublishLobbyEvent(ctx, store, logger, LobbyEventMessage{
+		Event:   GameUpdate,
+		EventId: eventId,
+		Game:    lobby.Game,
+		Players: profiles,
+	}, lobby.Player1, *lobby.Player2)
+}
+
+// GetPlayerLobby returns the lobby the player is in, or nil if they aren't in one. A player's CurrentLobby can be left
+// pointing at a lobby they are no longer in, such as when a server stopped between saving the lobby and the player,
+// so it is only trusted once the lobby agrees
+func GetPlayerLobby(ctx context.Context, store StoreReader, playerId string) (*Lobby, error) {
+	player, err := store.GetPlayer(ctx, playerId)
+	if err != nil || player == nil || player.CurrentLobby == nil {
+		return nil, err
+	}
+
+	lobby, err := store.GetLobby(ctx, *player.CurrentLobby)
+	if err != nil || lobby == nil || !lobby.HasPlayer(playerId) {
+		return nil, err
+	}
+
+	return lobby, nil
+}
+
+// setCurrentLobby points the player at the lobby they have been added to, creating them if they haven't connected yet
+func setCurrentLobby(ctx context.Context, store Store, playerId string, lobbyId string) error {
+	return store.UpdatePlayer(ctx, playerId, func(tx PlayerTx) error {
+		player, err := tx.GetPlayer(ctx)
+		if err != nil {
+			return err
+		}
+
+		if player == nil {
+			player = NewPlayer(playerId)
+		}
+
+		player.CurrentLobby = &lobbyId
+		tx.SetPlayer(*player)
+		return nil
+	})
+}
+
+// clearCurrentLobby stops pointing the player at the lobby they have been taken out of, unless they have already moved
+// on to another one. Returns whether they were still pointed at it
+func clearCurrentLobby(ctx context.Context, store Store, playerId string, lobbyId string) (bool, error) {
+	cleared := false
+
+	err := store.UpdatePlayer(ctx, playerId, func(tx PlayerTx) error {
+		cleared = false
+
+		player, err := tx.GetPlayer(ctx)
+		if err != nil {
+			return err
+		}
+
+		// The player may have expired, or already be in another lobby
+		if player == nil || player.CurrentLobby == nil || *player.CurrentLobby != lobbyId {
+			return nil
+		}
+
+		player.CurrentLobby = nil
+		tx.SetPlayer(*player)
+		cleared = true
+		return nil
+	})
+
+	return cleared, err
+}
+
+// CreateMatchLobby creates a lobby for two players chosen by the server rather than by the players themselves,
+// moves both players into it and starts the game. If the lobby already exists, such as when creating it is tried again
+// after failing part way, its players are only moved into it, so that its game isn't started again
+func CreateMatchLobby(ctx context.Context, store Store, logger *slog.Logger, lobby Lobby) error {
+	if lobby.Player2 == nil {
+		return nil
+	}
+
+	if lobby.Game == nil {
+		lobby.Game = NewGame()
+	}
+
+	logger = logger.With(slog.String("lobbyId", lobby.LobbyId))
+
+	entry := &LobbyLogEntry{Kind: LobbyCreated, PlayerId: lobby.Player1, At: time.Now(), Lobby: &lobby}
+	err := store.UpdateLobby(ctx, lobby.LobbyId, func(tx LobbyTx) error {
+		existing, err := tx.GetLobby(ctx)
+		if err != nil || existing != nil {
+			return err
+		}
+
+		tx.AppendLobbyEvent(entry)
+		tx.SetLobby(lobby)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The players left behind in the lobbies the matched players were in, and the log entries that tell them
+	leftBehind := map[string]*LobbyLogEntry{}
+
+	for _, playerId := range []string{lobby.Player1, *lobby.Player2} {
+		player, err := store.GetPlayer(ctx, playerId)
+		if err != nil {
+			return err
+		}
+
+		// Players can only be in one lobby, so leave the one they were in, which is usually their last match's. Both
+		// players may be leaving the same lobby, in which case the second leaves it as the first left it
+		if player != nil && player.CurrentLobby != nil && *player.CurrentLobby != lobby.LobbyId {
+			remainingPlayerId, leftEntry, err := leaveLobby(ctx, store, logger, *player.CurrentLobby, playerId)
+			if err != nil {
+				return err
+			}
+
+			if remainingPlayerId != nil && *remainingPlayerId != lobby.Player1 && *remainingPlayerId != *lobby.Player2 {
+				leftBehind[*remainingPlayerId] = leftEntry
+			}
+		}
+
+		if err := setCurrentLobby(ctx, store, playerId, lobby.LobbyId); err != nil {
+			return err
+		}
+	}
+
+	for playerId, leftEntry := range leftBehind {
+		PublishLobbyEvent(ctx, store, logger, LobbyEventMessage{Event: OpponentLeft, EventId: leftEntry.Id}, playerId)
+	}
+
+	logger.Info("Created match lobby, broadcasting game to players")
+	publishGameUpdate(ctx, store, logger, lobby, entry.Id)
+
+	return nil
 }
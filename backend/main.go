@@ -2,66 +2,221 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		return GetSecurityFromContext(r.Context()).IsOriginAllowed(r)
 	},
 }
 
 func main() {
-	var redisConnectionString *string
-	if connectionString, exists := os.LookupEnv("REDIS_URL"); exists == true {
-		redisConnectionString = &connectionString
+	// Printing the OpenAPI document doesn't need any of the server's dependencies
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		document, _ := json.MarshalIndent(GenerateOpenApi("Rota API", "2.0.0", apiV2BasePath, apiV2Routes), "", "  ")
+		fmt.Println(string(document))
+		return
 	}
 
-	var redisClientOpts *redis.Options
-	if redisConnectionString == nil {
-		redisClientOpts = &redis.Options{
-			Addr: "localhost:6379",
-		}
+	production := false
+	if productionValue, exists := os.LookupEnv("production"); exists == true {
+		production = strings.ToLower(productionValue) == "true"
+	}
+
+	sessionConfig, err := LoadSessionConfig(production)
+	if err != nil {
+		log.Fatal("Invalid session configuration: " + err.Error())
+	}
+
+	securityConfig, err := LoadSecurityConfig(production)
+	if err != nil {
+		log.Fatal("Invalid security configuration: " + err.Error())
+	}
+
+	moveStrategy, err := LoadMoveStrategy()
+	if err != nil {
+		log.Fatal("Invalid move strategy: " + err.Error())
+	}
+
+	storageBackend, err := LoadStorageBackend()
+	if err != nil {
+		log.Fatal("Invalid storage backend: " + err.Error())
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	var rdb redis.UniversalClient
+	var store Store
+	if storageBackend == MemoryStorage {
+		logger.Info("Keeping everything in memory, it will be lost when the server stops")
+		store = NewMemoryStore()
 	} else {
-		opts, err := redis.ParseURL(*redisConnectionString)
+		redisMode, err := LoadRedisMode()
+		if err != nil {
+			log.Fatal("Invalid redis mode: " + err.Error())
+		}
+
+		rdb, err = NewRedisClient(redisMode)
 		if err != nil {
 			log.Fatal("Invalid redis connection string: " + err.Error())
 		}
 
-		redisClientOpts = opts
+		// Has to be set before any keys are named
+		useHashTags = redisMode == ClusterRedis
+
+		redisError := rdb.Ping(context.Background()).Err()
+		if redisError != nil {
+			log.Fatal("Failed to connect to redis: " + redisError.Error())
+		}
+
+		fmt.Println("Connected to redis!")
+
+		store = NewRedisStore(rdb)
+	}
+
+	var database *Database
+	if databasePath, exists := LoadDatabasePath(); exists {
+		database, err = OpenDatabase(context.Background(), databasePath)
+		if err != nil {
+			log.Fatal("Failed to open database: " + err.Error())
+		}
+		defer database.Close()
+
+		logger.Info("Writing finished games, accounts and tournaments through to " + databasePath)
+	}
+
+	if len(os.Args) > 1 && (os.Args[1] == "bench-moves" || os.Args[1] == "migrate-documents") && rdb == nil {
+		log.Fatal(os.Args[1] + " only runs against Redis, STORAGE must be " + string(RedisStorage))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "bench-moves" {
+		RunMoveBenchmarkCommand(rdb, os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate-documents" {
+		RunMigrateDocumentsCommand(rdb, os.Args[2:])
+		return
 	}
 
-	rdb := redis.NewClient(redisClientOpts)
+	node := NewNode(LoadNodeId(), store)
+	logger = logger.With(slog.String("nodeId", node.Id))
 
-	redisError := rdb.Ping(context.Background()).Err()
-	if redisError != nil {
-		log.Fatal("Failed to connect to redis: " + redisError.Error())
+	background := NewBackgroundTasks(context.Background())
+
+	health := NewRedisHealth(rdb, logger.With(slog.String("scheduler", "redis-health")))
+	background.Go(health.Run)
+
+	background.Go(func(ctx context.Context) {
+		RunSeasonScheduler(ctx, store, logger.With(slog.String("scheduler", "season")))
+	})
+	background.Go(func(ctx context.Context) {
+		RunArenaScheduler(ctx, store, logger.With(slog.String("scheduler", "arena")))
+	})
+
+	// The memory store tells the sweeper about lobbies expiring itself
+	if rdb != nil {
+		background.Go(func(ctx context.Context) {
+			KeepExpiryNotificationsEnabled(ctx, rdb, health, logger.With(slog.String("scheduler", "lobby-sweeper")))
+		})
 	}
+	background.Go(func(ctx context.Context) {
+		RunLobbySweeper(ctx, store, health, logger.With(slog.String("scheduler", "lobby-sweeper")))
+	})
 
-	fmt.Println("Connected to redis!")
+	background.Go(func(ctx context.Context) {
+		RunNode(ctx, node, health, logger.With(slog.String("scheduler", "node")))
+	})
+
+	timerLogger := logger.With(slog.String("scheduler", "timers"))
+	timerHandlers := map[TimerKind]TimerHandler{
+		DisconnectForfeit: func(ctx context.Context, timer Timer) error {
+			return ForfeitDisconnectedPlayer(ctx, store, timerLogger, timer)
+		},
+		RecordGameOver: func(ctx context.Context, timer Timer) error {
+			return RetryGameOver(ctx, store, timerLogger, timer)
+		},
+		TournamentLobby: func(ctx context.Context, timer Timer) error {
+			return RetryTournamentLobby(ctx, store, timerLogger, timer)
+		},
+	}
+	if database != nil {
+		timerHandlers[DatabaseWriteThrough] = func(ctx context.Context, timer Timer) error {
+			return RetryDatabaseWriteThrough(ctx, store, database, timerLogger, timer)
+		}
+		timerHandlers[TournamentWriteThrough] = func(ctx context.Context, timer Timer) error {
+			return RetryTournamentWriteThrough(ctx, store, database, timerLogger, timer)
+		}
+	}
+
+	background.Go(func(ctx context.Context) {
+		RunTimers(NewBackgroundContext(ctx, store, database), store, timerLogger, timerHandlers)
+	})
+
+	drain := NewDrain()
 
 	authenticatedMux := http.NewServeMux()
 	authenticatedMux.HandleFunc("POST /api/create-lobby", createLobbyHandler)
 	authenticatedMux.HandleFunc("POST /api/join-lobby", joinLobbyHandler)
 	authenticatedMux.HandleFunc("POST /api/leave-lobby", leaveLobbyHandler)
 	authenticatedMux.HandleFunc("POST /api/make-move", makeMoveHandler)
+	authenticatedMux.HandleFunc("POST /api/resign", resignHandler)
+	authenticatedMux.HandleFunc("POST /api/chat", sendChatMessageHandler)
+	authenticatedMux.HandleFunc("GET /api/lobby", getLobbyHandler)
+	authenticatedMux.HandleFunc("GET /api/profile", getProfileHandler)
+	authenticatedMux.HandleFunc("POST /api/profile", setProfileHandler)
+	authenticatedMux.HandleFunc("POST /api/register", registerHandler)
+	authenticatedMux.HandleFunc("POST /api/login", loginHandler)
+	authenticatedMux.HandleFunc("POST /api/logout", logoutHandler)
+	authenticatedMux.HandleFunc("GET /api/sessions", listSessionsHandler)
+	authenticatedMux.HandleFunc("DELETE /api/sessions", revokeAllSessionsHandler)
+	authenticatedMux.HandleFunc("DELETE /api/sessions/{sessionId}", revokeSessionHandler)
+	authenticatedMux.HandleFunc("GET /api/ratings", getRatingsHandler)
+	authenticatedMux.HandleFunc("GET /api/rating-history", getRatingHistoryHandler)
+	authenticatedMux.HandleFunc("GET /api/games", listGamesHandler)
+	authenticatedMux.HandleFunc("GET /api/games/{gameId}", getGameHandler)
+	authenticatedMux.HandleFunc("GET /api/leaderboards/{kind}", getLeaderboardHandler)
+	authenticatedMux.HandleFunc("GET /api/seasons", listSeasonsHandler)
+	authenticatedMux.HandleFunc("GET /api/seasons/{season}/standings", getSeasonStandingsHandler)
+	authenticatedMux.HandleFunc("POST /api/tournaments", createTournamentHandler)
+	authenticatedMux.HandleFunc("GET /api/tournaments", listTournamentsHandler)
+	authenticatedMux.HandleFunc("GET /api/tournaments/{tournamentId}", getTournamentHandler)
+	authenticatedMux.HandleFunc("POST /api/tournaments/{tournamentId}/register", registerTournamentHandler)
+	authenticatedMux.HandleFunc("POST /api/tournaments/{tournamentId}/withdraw", withdrawTournamentHandler)
+	authenticatedMux.HandleFunc("POST /api/tournaments/{tournamentId}/start", startTournamentHandler)
+	authenticatedMux.HandleFunc("POST /api/arenas", createArenaHandler)
+	authenticatedMux.HandleFunc("GET /api/arenas", listArenasHandler)
+	authenticatedMux.HandleFunc("GET /api/arenas/{arenaId}", getArenaHandler)
+	authenticatedMux.HandleFunc("POST /api/arenas/{arenaId}/join", joinArenaHandler)
+	authenticatedMux.HandleFunc("POST /api/arenas/{arenaId}/pause", pauseArenaHandler)
+	RegisterApiRoutes(authenticatedMux, apiV2BasePath, apiV2Routes)
 
 	mainMux := http.NewServeMux()
-	mainMux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-	mainMux.HandleFunc("/ws", wsHandler)
+	mainMux.HandleFunc("/health", healthHandler)
+	mainMux.HandleFunc("GET "+apiV2BasePath+"/openapi.json", openApiHandler("Rota API", "2.0.0", apiV2BasePath, apiV2Routes))
+	mainMux.Handle("/ws", CreateStack(RequireRedisMiddleware, WithRateLimitMiddleware)(http.HandlerFunc(wsHandler)))
 	mainMux.Handle(
 		"/",
 		CreateStack(
 			WithIdMiddleware,
 			AddIdToLoggerMiddleware,
+			RequireRedisMiddleware,
+			WithRateLimitMiddleware,
+			WithCSRFMiddleware,
 		)(authenticatedMux),
 	)
 
@@ -70,7 +225,15 @@ func main() {
 		"/",
 		CreateStack(
 			WithLoggerMiddleware,
-			WithRedisMiddleware(rdb),
+			WithSecurityMiddleware(securityConfig),
+			WithCORSMiddleware(securityConfig),
+			WithRedisHealthMiddleware(health),
+			WithStoreMiddleware(store),
+			WithDatabaseMiddleware(database),
+			WithNodeMiddleware(node),
+			WithDrainMiddleware(drain),
+			WithMoveStrategyMiddleware(moveStrategy),
+			WithSessionsMiddleware(NewSessionManager(sessionConfig, store)),
 		)(mainMux),
 	)
 
@@ -79,22 +242,43 @@ func main() {
 		port = portNum
 	}
 
-	production := false
-	if productionValue, exists := os.LookupEnv("production"); exists == true {
-		production = strings.ToLower(productionValue) == "true"
-	}
-
+	server := &http.Server{Addr: "localhost:8080", Handler: app}
 	if production {
+		server.Addr = "0.0.0.0:" + port
 		fmt.Println("Production server listening on 0.0.0.0:" + port)
-		log.Fatal(http.ListenAndServe(
-			"0.0.0.0:"+port,
-			app,
-		))
 	} else {
 		fmt.Println("Development server listening on localhost:8080")
-		log.Fatal(http.ListenAndServe(
-			"localhost:8080",
-			app,
-		))
+	}
+
+	// Deploys send SIGTERM, after which the server drains rather than cutting off every player
+	stopping, stopListening := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopListening()
+
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErrors:
+		log.Fatal(err)
+	case <-stopping.Done():
+	}
+
+	ShutDown(server, drain, background, logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := node.Leave(ctx); err != nil {
+		logger.Warn("Failed to remove node: " + err.Error())
+	}
+
+	if rdb == nil {
+		return
+	}
+
+	if err := rdb.Close(); err != nil {
+		logger.Warn("Failed to close Redis: " + err.Error())
 	}
 }
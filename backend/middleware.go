@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"github.com/google/uuid"
-	"github.com/redis/go-redis/v9"
 	"log/slog"
 	"net/http"
 	"os"
@@ -24,17 +23,26 @@ func CreateStack(xs ...Middleware) Middleware {
 
 func WithIdMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		idCookie, err := r.Cookie("id")
+		sessions := GetSessionsFromContext(r.Context())
+		logger := GetLoggerFromContext(r.Context())
+
+		session, err := sessions.Authenticate(w, r)
+
+		if err != nil && !IsSessionError(err) {
+			logger.Warn("There was an error authenticating session: " + err.Error())
+			WriteError(w, InternalError, "There was an error authenticating session")
+			return
+		}
 
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Header().Set("Content-Type", "text/plain")
-			w.Write([]byte("ID cookie is not present. Connect to the WebSocket server first!"))
+			logger.Debug("Rejected session: " + err.Error())
+			WriteError(w, Unauthenticated, "Session is missing or invalid. Connect to the WebSocket server first!")
 			return
 		}
 
-		modifiedRequest := r.WithContext(context.WithValue(r.Context(), "id", idCookie.Value))
-		next.ServeHTTP(w, modifiedRequest)
+		ctx := context.WithValue(r.Context(), "id", session.PlayerId)
+		ctx = context.WithValue(ctx, "session", session)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
@@ -47,6 +55,15 @@ func GetIdFromContext(ctx context.Context) string {
 	return id
 }
 
+func GetSessionFromContext(ctx context.Context) *Session {
+	session, ok := ctx.Value("session").(*Session)
+	if !ok {
+		panic("Session in context is not present. Something has gone wrong!")
+	}
+
+	return session
+}
+
 func AddIdToLoggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id := GetIdFromContext(r.Context())
@@ -81,20 +98,27 @@ func GetLoggerFromContext(ctx context.Context) *slog.Logger {
 	return logger
 }
 
-func WithRedisMiddleware(redis *redis.Client) Middleware {
+// NewBackgroundContext adds what the middleware adds to requests to a context for work that isn't done in a request,
+// such as firing timers, so that it can share code with request handlers
+func NewBackgroundContext(ctx context.Context, store Store, database *Database) context.Context {
+	ctx = context.WithValue(ctx, "store", store)
+	return context.WithValue(ctx, "database", database)
+}
+
+func WithSessionsMiddleware(sessions *SessionManager) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "redis", redis))
+			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "sessions", sessions))
 			next.ServeHTTP(w, modifiedRequest)
 		})
 	}
 }
 
-func GetRedisFromContext(ctx context.Context) *redis.Client {
-	rdb, ok := ctx.Value("redis").(*redis.Client)
+func GetSessionsFromContext(ctx context.Context) *SessionManager {
+	sessions, ok := ctx.Value("sessions").(*SessionManager)
 	if !ok {
-		panic("Redis in context is not present. Something has gone wrong!")
+		panic("Session manager in context is not present. Something has gone wrong!")
 	}
 
-	return rdb
+	return sessions
 }
@@ -0,0 +1,50 @@
+-- Kept to SQL that both SQLite and Postgres understand. Times are stored in UTC
+
+CREATE TABLE players (
+	player_id TEXT PRIMARY KEY,
+	username TEXT UNIQUE,
+	display_name TEXT NOT NULL,
+	avatar TEXT NOT NULL,
+	country TEXT NOT NULL,
+	bio TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE player_ratings (
+	player_id TEXT NOT NULL REFERENCES players (player_id),
+	pool TEXT NOT NULL,
+	rating DOUBLE PRECISION NOT NULL,
+	deviation DOUBLE PRECISION NOT NULL,
+	volatility DOUBLE PRECISION NOT NULL,
+	games INTEGER NOT NULL,
+	wins INTEGER NOT NULL,
+	losses INTEGER NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (player_id, pool)
+);
+
+CREATE TABLE games (
+	game_id TEXT PRIMARY KEY,
+	lobby_id TEXT NOT NULL,
+	player_1 TEXT NOT NULL REFERENCES players (player_id),
+	player_2 TEXT NOT NULL REFERENCES players (player_id),
+	variant TEXT NOT NULL,
+	time_control TEXT NOT NULL,
+	started_at TIMESTAMP NOT NULL,
+	ended_at TIMESTAMP NOT NULL,
+	winner TEXT NOT NULL,
+	winner_id TEXT NOT NULL
+);
+
+CREATE INDEX games_player_1 ON games (player_1, ended_at);
+CREATE INDEX games_player_2 ON games (player_2, ended_at);
+
+CREATE TABLE game_moves (
+	game_id TEXT NOT NULL REFERENCES games (game_id),
+	move_number INTEGER NOT NULL,
+	player TEXT NOT NULL,
+	from_position INTEGER,
+	to_position INTEGER NOT NULL,
+	made_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (game_id, move_number)
+);
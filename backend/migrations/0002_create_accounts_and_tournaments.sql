@@ -0,0 +1,43 @@
+-- Accounts are looked up by their lowercased username, which is also what makes usernames unique regardless of case
+
+CREATE TABLE accounts (
+	username_key TEXT PRIMARY KEY,
+	username TEXT NOT NULL,
+	password_hash TEXT NOT NULL,
+	player_id TEXT NOT NULL UNIQUE REFERENCES players (player_id),
+	created_at TIMESTAMP NOT NULL
+);
+
+-- Tournament players aren't necessarily in players, which only holds those who have finished a game or registered
+CREATE TABLE tournaments (
+	tournament_id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	format TEXT NOT NULL,
+	organizer_id TEXT NOT NULL,
+	state TEXT NOT NULL,
+	swiss_rounds INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	started_at TIMESTAMP,
+	finished_at TIMESTAMP
+);
+
+CREATE INDEX tournaments_created_at ON tournaments (created_at);
+
+-- Players are kept in seed order once the tournament has started, and in the order they registered before then
+CREATE TABLE tournament_players (
+	tournament_id TEXT NOT NULL REFERENCES tournaments (tournament_id),
+	seed INTEGER NOT NULL,
+	player_id TEXT NOT NULL,
+	PRIMARY KEY (tournament_id, seed)
+);
+
+CREATE TABLE tournament_pairings (
+	tournament_id TEXT NOT NULL REFERENCES tournaments (tournament_id),
+	round_number INTEGER NOT NULL,
+	pairing_number INTEGER NOT NULL,
+	player_1 TEXT NOT NULL,
+	player_2 TEXT,
+	lobby_id TEXT,
+	winner TEXT,
+	PRIMARY KEY (tournament_id, round_number, pairing_number)
+);
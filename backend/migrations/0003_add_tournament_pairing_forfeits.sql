@@ -0,0 +1,2 @@
+-- Pairings whose game was abandoned are finished with neither player winning
+ALTER TABLE tournament_pairings ADD COLUMN forfeited BOOLEAN NOT NULL DEFAULT FALSE;
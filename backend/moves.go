@@ -0,0 +1,339 @@
+package main
+
+import (
+	"backend/turn"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// MoveStrategy is how moves are saved to Redis
+type MoveStrategy string
+
+const (
+	// Moves are made in a store transaction, which is retried if the lobby changes. In Redis, the transaction watches
+	// its keys
+	WatchMoves MoveStrategy = "watch"
+	// Moves are checked and saved by a Lua script, which Redis runs atomically, so they never have to be retried
+	// because of unrelated changes to the lobby. Only used with Redis storage
+	ScriptMoves MoveStrategy = "script"
+)
+
+// How many times a move is evaluated again when the game changed between reading it and running the script
+const scriptMoveAttempts = 5
+
+// LoadMoveStrategy reads the move strategy from the environment
+func LoadMoveStrategy() (MoveStrategy, error) {
+	value, exists := os.LookupEnv("MOVE_STRATEGY")
+	if !exists {
+		return WatchMoves, nil
+	}
+
+	strategy := MoveStrategy(strings.ToLower(strings.TrimSpace(value)))
+	if strategy != WatchMoves && strategy != ScriptMoves {
+		return WatchMoves, errors.New("MOVE_STRATEGY must be either " + string(WatchMoves) + " or " + string(ScriptMoves))
+	}
+
+	return strategy, nil
+}
+
+// Saves a move that was evaluated against a given version of the game, as long as the player still holds the seat
+// it was evaluated for and the game is still at that version. Every key is in the lobby's slot: KEYS are the lobby,
+// the lobby's log, the lobby's expiry key, the game's game over job and optionally the idempotency key. ARGV holds the
+// lobby ID, the player ID, the seat, the version the move was evaluated against, the new version, state, turn, board
+// and end time of the game as JSON, the move record as JSON, the idempotent move as JSON with its lifetime in
+// milliseconds, the log entry as JSON, the IDs of both players, how long until the lobby expires and is deleted in
+// milliseconds, the current schema versions of lobbies and games, and the game over job as JSON if the move ends the
+// game.
+//
+// Returns {"OK", log entry ID} once saved, {"REPLAYED", move} if the idempotency key was already used, or
+// {"CONFLICT", reason} if the move needs to be evaluated again. Lobbies stored at an older schema version conflict
+// too, since the script only updates the fields a move changes, and would leave the rest of the lobby unmigrated
+var makeMoveScript = redis.NewScript(`
+if KEYS[5] then
+	local previous = redis.call('JSON.GET', KEYS[5])
+	if previous then
+		return {'REPLAYED', previous}
+	end
+end
+
+local lobby = redis.call('JSON.GET', KEYS[1], '$.Player1', '$.Player2', '$.Game.Turn', '$.Game.Version', '$.SchemaVersion', '$.Game.SchemaVersion')
+if not lobby then
+	return {'CONFLICT', 'lobby'}
+end
+
+lobby = cjson.decode(lobby)
+
+if (lobby['$.SchemaVersion'][1] or 0) ~= tonumber(ARGV[18]) or (lobby['$.Game.SchemaVersion'][1] or 0) ~= tonumber(ARGV[19]) then
+	return {'CONFLICT', 'schema'}
+end
+
+local seat = lobby['$.Player1'][1]
+if ARGV[3] == 'PLAYER_2' then
+	seat = lobby['$.Player2'][1]
+end
+
+if seat ~= ARGV[2] then
+	return {'CONFLICT', 'seat'}
+end
+
+-- The update is sent to the players the move was evaluated with
+if lobby['$.Player1'][1] ~= ARGV[14] or lobby['$.Player2'][1] ~= ARGV[15] then
+	return {'CONFLICT', 'players'}
+end
+
+if lobby['$.Game.Turn'][1] ~= ARGV[3] then
+	return {'CONFLICT', 'turn'}
+end
+
+-- Games created before versions were added don't have one until their first move
+if (lobby['$.Game.Version'][1] or 0) ~= tonumber(ARGV[4]) then
+	return {'CONFLICT', 'version'}
+end
+
+redis.call('JSON.SET', KEYS[1], '$.Game.Version', ARGV[5])
+redis.call('JSON.SET', KEYS[1], '$.Game.State', ARGV[6])
+redis.call('JSON.SET', KEYS[1], '$.Game.Turn', ARGV[7])
+redis.call('JSON.SET', KEYS[1], '$.Game.Board', ARGV[8])
+redis.call('JSON.SET', KEYS[1], '$.Game.EndedAt', ARGV[9])
+redis.call('JSON.ARRAPPEND', KEYS[1], '$.Game.Moves', ARGV[10])
+
+local eventId = redis.call('XADD', KEYS[2], '*', 'entry', ARGV[13])
+
+-- Moves keep the lobby alive, the same as saving it does
+redis.call('SET', KEYS[3], '1', 'PX', ARGV[16])
+redis.call('PEXPIRE', KEYS[1], ARGV[17])
+redis.call('PEXPIRE', KEYS[2], ARGV[17])
+
+if KEYS[5] then
+	redis.call('JSON.SET', KEYS[5], '$', ARGV[11])
+	redis.call('PEXPIRE', KEYS[5], ARGV[12])
+end
+
+if ARGV[20] ~= '' then
+	redis.call('SET', KEYS[4], ARGV[20])
+end
+
+return {'OK', eventId}
+`)
+
+// makeMoveWithScript evaluates the move against the current game, then saves it with a script and sends it to both
+// players. The move is only evaluated again if the game itself changed in between
+func makeMoveWithScript(ctx context.Context, store *RedisStore, logger *slog.Logger, playerId string, lobbyId string, move PlayerMove, options MoveOptions) (Lobby, bool, error) {
+	for attempt := 0; attempt < scriptMoveAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return Lobby{}, false, ctx.Err()
+		}
+
+		replayedLobby, err := getReplayedMove(ctx, store, logger, playerId, lobbyId, move, options)
+		if err != nil {
+			return Lobby{}, false, err
+		}
+
+		if replayedLobby != nil {
+			return *replayedLobby, true, nil
+		}
+
+		lobby, err := store.GetLobby(ctx, lobbyId)
+		if err != nil {
+			return Lobby{}, false, err
+		}
+
+		playerMakingRequest, err := checkMoveLobby(lobby, playerId, options)
+		if err != nil {
+			// The same move may have been made with the idempotency key since it was looked up, which is what changed
+			// the version, so it is only a conflict if it wasn't
+			var versionConflictError VersionConflictError
+			if errors.As(err, &versionConflictError) {
+				replayedLobby, replayErr := getReplayedMove(ctx, store, logger, playerId, lobbyId, move, options)
+				if replayErr != nil {
+					return Lobby{}, false, replayErr
+				}
+
+				if replayedLobby != nil {
+					return *replayedLobby, true, nil
+				}
+			}
+
+			return Lobby{}, false, err
+		}
+
+		newGame, err := lobby.Game.EvaluateMove(playerMakingRequest, move)
+		if err != nil {
+			return Lobby{}, false, err
+		}
+
+		evaluatedVersion := lobby.Game.Version
+		lobby.Game = &newGame
+
+		args, err := makeMoveScriptArgs(*lobby, playerId, playerMakingRequest, evaluatedVersion, move, options)
+		if err != nil {
+			return Lobby{}, false, err
+		}
+
+		keys := []string{
+			lobbyKey(lobbyId),
+			lobbyEventsKey(lobbyId),
+			lobbyExpiryKey(lobbyId),
+			gameOverKey(lobbyId, newGame.Id),
+		}
+		if len(options.IdempotencyKey) > 0 {
+			keys = append(keys, idempotencyKey(lobbyId, playerId, options.IdempotencyKey))
+		}
+
+		result, err := makeMoveScript.Run(ctx, store.rdb, keys, args...).StringSlice()
+		if err != nil {
+			return Lobby{}, false, err
+		}
+
+		switch result[0] {
+		case "OK":
+			logger.Info("Saved move, broadcasting updated game")
+			publishGameUpdate(ctx, store, logger, *lobby, result[1])
+			return *lobby, false, nil
+		case "REPLAYED":
+			var stored idempotentMove
+			if err := json.Unmarshal([]byte(result[1]), &stored); err != nil {
+				return Lobby{}, false, err
+			}
+
+			previous, err := checkIdempotentMove(stored, lobbyId, move)
+			if err != nil {
+				return Lobby{}, false, err
+			}
+
+			logger.Debug("Move was already made with idempotency key " + options.IdempotencyKey)
+			return *previous, true, nil
+		default:
+			if result[1] == "schema" {
+				logger.Debug("Lobby is stored at an older schema version, saving it migrated before making the move")
+				if err := saveMigratedLobby(ctx, store, lobbyId); err != nil {
+					return Lobby{}, false, err
+				}
+
+				continue
+			}
+
+			logger.Debug("The " + result[1] + " changed while making the move, evaluating it again")
+		}
+	}
+
+	return Lobby{}, false, ErrTxConflict
+}
+
+// getReplayedMove returns the lobby as it was straight after the move was first made with the idempotency key, or nil
+// if there is no key or it hasn't been used
+func getReplayedMove(ctx context.Context, store *RedisStore, logger *slog.Logger, playerId string, lobbyId string, move PlayerMove, options MoveOptions) (*Lobby, error) {
+	if len(options.IdempotencyKey) == 0 {
+		return nil, nil
+	}
+
+	previous, err := store.GetIdempotentMove(ctx, lobbyId, playerId, options.IdempotencyKey)
+	if err != nil || previous == nil {
+		return nil, err
+	}
+
+	replayedLobby, err := checkIdempotentMove(*previous, lobbyId, move)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("Move was already made with idempotency key " + options.IdempotencyKey)
+	return replayedLobby, nil
+}
+
+// saveMigratedLobby writes the lobby back at the current schema version, which it is migrated to as it is read
+func saveMigratedLobby(ctx context.Context, store Store, lobbyId string) error {
+	return store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+		lobby, err := tx.GetLobby(ctx)
+		if err != nil || lobby == nil {
+			return err
+		}
+
+		tx.SetLobby(*lobby)
+		return nil
+	})
+}
+
+func makeMoveScriptArgs(lobby Lobby, playerId string, seat turn.Turn, evaluatedVersion int, move PlayerMove, options MoveOptions) ([]any, error) {
+	game := lobby.Game
+
+	values := []any{game.Version, game.State, game.Turn, game.Board, game.EndedAt, game.Moves[len(game.Moves)-1]}
+	encoded := make([]any, 0, len(values))
+	for _, value := range values {
+		valueJson, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = append(encoded, string(valueJson))
+	}
+
+	// The move is only stored if it has an idempotency key
+	var idempotentMoveJson []byte
+	if len(options.IdempotencyKey) > 0 {
+		var err error
+		idempotentMoveJson, err = json.Marshal(idempotentMove{
+			LobbyId: lobby.LobbyId,
+			From:    move.from,
+			To:      move.to,
+			Lobby:   lobby,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entryJson, err := json.Marshal(newMoveLogEntry(playerId, move, *game))
+	if err != nil {
+		return nil, err
+	}
+
+	// The job that records the result is saved along with the move that ends the game
+	var gameOverJson []byte
+	if game.State == GameOver {
+		gameOverJson, err = json.Marshal(newGameOverTimer(lobby))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	args := []any{lobby.LobbyId, playerId, string(seat), evaluatedVersion}
+	args = append(args, encoded...)
+	return append(
+		args,
+		string(idempotentMoveJson),
+		idempotencyKeyLifetime.Milliseconds(),
+		string(entryJson),
+		lobby.Player1,
+		*lobby.Player2,
+		lobbyLifetime.Milliseconds(),
+		(lobbyLifetime + lobbyExpiryGrace).Milliseconds(),
+		CurrentSchemaVersion(LobbyDocument),
+		CurrentSchemaVersion(GameDocument),
+		string(gameOverJson),
+	), nil
+}
+
+func WithMoveStrategyMiddleware(strategy MoveStrategy) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "moveStrategy", strategy))
+			next.ServeHTTP(w, modifiedRequest)
+		})
+	}
+}
+
+func GetMoveStrategyFromContext(ctx context.Context) MoveStrategy {
+	strategy, ok := ctx.Value("moveStrategy").(MoveStrategy)
+	if !ok {
+		panic("Move strategy in context is not present. Something has gone wrong!")
+	}
+
+	return strategy
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"testing"
+)
+
+var moveStrategies = []MoveStrategy{WatchMoves, ScriptMoves}
+
+// newTestRedisStore connects to the Redis Stack server at REDIS_URL, skipping the test if it isn't set. Every key the
+// test adds is deleted once it finishes
+func newTestRedisStore(t *testing.T) (*RedisStore, *[]string) {
+	t.Helper()
+
+	url, exists := os.LookupEnv("REDIS_URL")
+	if !exists {
+		t.Skip("Set REDIS_URL to a Redis Stack server to run the Redis integration tests")
+	}
+
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal("Invalid REDIS_URL: " + err.Error())
+	}
+
+	rdb := redis.NewClient(options)
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Fatal("Failed to connect to Redis: " + err.Error())
+	}
+
+	var keys []string
+	t.Cleanup(func() {
+		if len(keys) > 0 {
+			rdb.Del(context.Background(), keys...)
+		}
+
+		rdb.Close()
+	})
+
+	return NewRedisStore(rdb), &keys
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestLobby creates a match lobby for two new players, adding its keys to those deleted after the test
+func newTestLobby(t *testing.T, store *RedisStore, keys *[]string) Lobby {
+	t.Helper()
+
+	player2 := "test-" + uuid.NewString()
+	lobby := Lobby{LobbyId: NewLobbyId(), Player1: "test-" + uuid.NewString(), Player2: &player2}
+	*keys = append(*keys, lobbyTestKeys(lobby)...)
+
+	if err := CreateMatchLobby(context.Background(), store, discardLogger(), lobby); err != nil {
+		t.Fatal("Failed to create lobby: " + err.Error())
+	}
+
+	return lobby
+}
+
+func lobbyTestKeys(lobby Lobby) []string {
+	return []string{
+		lobbyKey(lobby.LobbyId),
+		lobbyExpiryKey(lobby.LobbyId),
+		lobbyEventsKey(lobby.LobbyId),
+		playerKey(lobby.Player1),
+		playerKey(*lobby.Player2),
+		inboxKey(lobby.Player1),
+		inboxKey(*lobby.Player2),
+		gameOverKey(lobby.LobbyId, lobby.Game.Id),
+	}
+}
+
+func TestMakeMove(t *testing.T) {
+	for _, strategy := range moveStrategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			store, keys := newTestRedisStore(t)
+			ctx := context.Background()
+			lobby := newTestLobby(t, store, keys)
+
+			updated, replayed, err := MakeMove(ctx, store, discardLogger(), lobby.Player1, lobby.LobbyId, PlayerMove{to: 4}, MoveOptions{Strategy: strategy})
+			if err != nil {
+				t.Fatal("Move failed: " + err.Error())
+			}
+
+			if replayed || updated.Game.Version != 1 {
+				t.Fatalf("Expected a new move at version 1, got version %d with replayed %v", updated.Game.Version, replayed)
+			}
+
+			stored, err := store.GetLobby(ctx, lobby.LobbyId)
+			if err != nil || stored == nil {
+				t.Fatalf("Failed to read lobby back: %v", err)
+			}
+
+			if stored.Game.Version != 1 || len(stored.Game.Moves) != 1 || stored.Game.Moves[0].To != 4 {
+				t.Fatalf("Stored game doesn't have the move: %+v", stored.Game)
+			}
+
+			if stored.Game.EndedAt != nil || stored.Game.Board[4] != updated.Game.Board[4] {
+				t.Fatalf("Stored game doesn't match the returned one: %+v", stored.Game)
+			}
+
+			entries, err := store.GetLobbyEvents(ctx, lobby.LobbyId, "")
+			if err != nil || len(entries) != 2 || entries[1].Kind != MoveMade {
+				t.Fatalf("Expected the lobby's log to end with the move, got %+v (%v)", entries, err)
+			}
+
+			// The same player can't move twice in a row
+			_, _, err = MakeMove(ctx, store, discardLogger(), lobby.Player1, lobby.LobbyId, PlayerMove{to: 0}, MoveOptions{Strategy: strategy})
+			var invalidMoveError *InvalidMoveError
+			if !errors.As(err, &invalidMoveError) {
+				t.Fatalf("Expected a move out of turn to be invalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMakeMoveIdempotency(t *testing.T) {
+	for _, strategy := range moveStrategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			store, keys := newTestRedisStore(t)
+			ctx := context.Background()
+			lobby := newTestLobby(t, store, keys)
+
+			options := MoveOptions{Strategy: strategy, IdempotencyKey: uuid.NewString()}
+			*keys = append(*keys, idempotencyKey(lobby.LobbyId, lobby.Player1, options.IdempotencyKey))
+
+			first, replayed, err := MakeMove(ctx, store, discardLogger(), lobby.Player1, lobby.LobbyId, PlayerMove{to: 4}, options)
+			if err != nil || replayed {
+				t.Fatalf("Expected the first move to be made, got replayed %v and %v", replayed, err)
+			}
+
+			again, replayed, err := MakeMove(ctx, store, discardLogger(), lobby.Player1, lobby.LobbyId, PlayerMove{to: 4}, options)
+			if err != nil || !replayed {
+				t.Fatalf("Expected the retried move to be replayed, got replayed %v and %v", replayed, err)
+			}
+
+			if again.Game.Version != first.Game.Version || again.Game.Board[4] != first.Game.Board[4] {
+				t.Fatalf("Replayed lobby doesn't match the first move's: %+v", again.Game)
+			}
+
+			// A retry expecting a version the game was never at, as a stale If-Match is, is still replayed
+			staleOptions := options
+			staleOptions.ExpectedVersion = &staleVersion
+			if _, replayed, err := MakeMove(ctx, store, discardLogger(), lobby.Player1, lobby.LobbyId, PlayerMove{to: 4}, staleOptions); err != nil || !replayed {
+				t.Fatalf("Expected the retried move to be replayed despite its version, got replayed %v and %v", replayed, err)
+			}
+
+			staleOptions.IdempotencyKey = uuid.NewString()
+			_, _, err = MakeMove(ctx, store, discardLogger(), *lobby.Player2, lobby.LobbyId, PlayerMove{to: 0}, staleOptions)
+			var versionConflictError VersionConflictError
+			if !errors.As(err, &versionConflictError) {
+				t.Fatalf("Expected a new move at a stale version to conflict, got %v", err)
+			}
+
+			_, _, err = MakeMove(ctx, store, discardLogger(), lobby.Player1, lobby.LobbyId, PlayerMove{to: 5}, options)
+			var validationError LobbyValidationError
+			if !errors.As(err, &validationError) || validationError.cause != IdempotencyKeyReused {
+				t.Fatalf("Expected a different move with the same key to be rejected, got %v", err)
+			}
+
+			stored, err := store.GetLobby(ctx, lobby.LobbyId)
+			if err != nil || stored.Game.Version != 1 {
+				t.Fatalf("Expected only one move to be saved, got %+v (%v)", stored, err)
+			}
+		})
+	}
+}
+
+// The script only saves moves evaluated against the game as it still is, and reports what changed otherwise
+func TestMakeMoveScriptConflicts(t *testing.T) {
+	store, keys := newTestRedisStore(t)
+	ctx := context.Background()
+	lobby := newTestLobby(t, store, keys)
+
+	stored, err := store.GetLobby(ctx, lobby.LobbyId)
+	if err != nil || stored == nil {
+		t.Fatalf("Failed to read lobby: %v", err)
+	}
+
+	move := PlayerMove{to: 4}
+	newGame, err := stored.Game.EvaluateMove(lobbySeat(*stored, lobby.Player1), move)
+	if err != nil {
+		t.Fatal("Failed to evaluate move: " + err.Error())
+	}
+
+	tests := []struct {
+		name             string
+		playerId         string
+		evaluatedVersion int
+		reason           string
+	}{
+		{name: "stale version", playerId: lobby.Player1, evaluatedVersion: 3, reason: "version"},
+		{name: "player not in lobby", playerId: "test-" + uuid.NewString(), evaluatedVersion: 0, reason: "seat"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			moved := *stored
+			moved.Game = &newGame
+
+			args, err := makeMoveScriptArgs(moved, test.playerId, lobbySeat(*stored, lobby.Player1), test.evaluatedVersion, move, MoveOptions{})
+			if err != nil {
+				t.Fatal("Failed to encode script arguments: " + err.Error())
+			}
+
+			keys := []string{
+				lobbyKey(lobby.LobbyId),
+				lobbyEventsKey(lobby.LobbyId),
+				lobbyExpiryKey(lobby.LobbyId),
+				gameOverKey(lobby.LobbyId, newGame.Id),
+			}
+
+			result, err := makeMoveScript.Run(ctx, store.rdb, keys, args...).StringSlice()
+			if err != nil {
+				t.Fatal("Script failed: " + err.Error())
+			}
+
+			if len(result) != 2 || result[0] != "CONFLICT" || result[1] != test.reason {
+				t.Fatalf("Expected a %s conflict, got %v", test.reason, result)
+			}
+		})
+	}
+
+	unchanged, err := store.GetLobby(ctx, lobby.LobbyId)
+	if err != nil || unchanged.Game.Version != 0 || len(unchanged.Game.Moves) != 0 {
+		t.Fatalf("Conflicting moves were saved: %+v (%v)", unchanged, err)
+	}
+}
+
+// Lobbies saved before schema versions were added don't have a game ID, version or moves until they are migrated,
+// which both strategies have to save along with the move
+func TestMakeMoveOnUnmigratedLobby(t *testing.T) {
+	for _, strategy := range moveStrategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			store, keys := newTestRedisStore(t)
+			ctx := context.Background()
+
+			player1, player2 := "test-"+uuid.NewString(), "test-"+uuid.NewString()
+			lobby := Lobby{LobbyId: NewLobbyId(), Player1: player1, Player2: &player2}
+			*keys = append(*keys, lobbyTestKeys(lobby)...)
+
+			legacyLobby := `{"LobbyId":"` + lobby.LobbyId + `","Player1":"` + player1 + `","Player2":"` + player2 + `",` +
+				`"Game":{"State":"SETUP","Turn":"PLAYER_1","Board":["EMPTY","EMPTY","EMPTY","EMPTY","EMPTY","EMPTY","EMPTY","EMPTY","EMPTY"]}}`
+
+			_, err := store.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.JSONSet(ctx, lobbyKey(lobby.LobbyId), "$", legacyLobby)
+				pipe.JSONSet(ctx, playerKey(player1), "$", `{"Id":"`+player1+`","CurrentLobby":"`+lobby.LobbyId+`"}`)
+				pipe.JSONSet(ctx, playerKey(player2), "$", `{"Id":"`+player2+`","CurrentLobby":"`+lobby.LobbyId+`"}`)
+				return nil
+			})
+			if err != nil {
+				t.Fatal("Failed to save legacy lobby: " + err.Error())
+			}
+
+			before, err := store.GetLobby(ctx, lobby.LobbyId)
+			if err != nil || before == nil || before.Game.Id != legacyGameId(lobby.LobbyId) {
+				t.Fatalf("Expected the legacy game to be given an ID from its lobby, got %+v (%v)", before, err)
+			}
+
+			_, _, err = MakeMove(ctx, store, discardLogger(), player1, lobby.LobbyId, PlayerMove{to: 4}, MoveOptions{Strategy: strategy})
+			if err != nil {
+				t.Fatal("Move failed: " + err.Error())
+			}
+
+			schemaVersionsJson, err := store.rdb.JSONGet(ctx, lobbyKey(lobby.LobbyId), "$.SchemaVersion", "$.Game.SchemaVersion").Result()
+			if err != nil {
+				t.Fatal("Failed to read schema versions: " + err.Error())
+			}
+
+			var schemaVersions map[string][]int
+			if err := json.Unmarshal([]byte(schemaVersionsJson), &schemaVersions); err != nil {
+				t.Fatal("Failed to decode schema versions: " + err.Error())
+			}
+
+			if !slices.Equal(schemaVersions["$.SchemaVersion"], []int{CurrentSchemaVersion(LobbyDocument)}) ||
+				!slices.Equal(schemaVersions["$.Game.SchemaVersion"], []int{CurrentSchemaVersion(GameDocument)}) {
+				t.Fatalf("Expected the lobby to be saved migrated, got %s", schemaVersionsJson)
+			}
+
+			after, err := store.GetLobby(ctx, lobby.LobbyId)
+			if err != nil || after == nil {
+				t.Fatalf("Failed to read lobby back: %v", err)
+			}
+
+			if len(after.Game.Moves) != 1 || after.Game.Version != 1 {
+				t.Fatalf("Expected the move to be saved, got %+v", after.Game)
+			}
+
+			if after.Game.Id != before.Game.Id {
+				t.Fatalf("Expected the game to keep its ID, got %s then %s", before.Game.Id, after.Game.Id)
+			}
+		})
+	}
+}
+
+func TestMoveBenchmark(t *testing.T) {
+	for _, strategy := range moveStrategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			store, _ := newTestRedisStore(t)
+
+			result, err := RunMoveBenchmark(context.Background(), store, strategy, MoveBenchmarkConfig{
+				Lobbies:          5,
+				ClientsPerPlayer: 2,
+				MovesPerLobby:    10,
+			})
+			if err != nil {
+				t.Fatal("Benchmark failed: " + err.Error())
+			}
+
+			if result.Moves == 0 {
+				t.Fatal("Benchmark didn't make any moves")
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"backend/position"
+	"backend/turn"
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ApiRoute describes a route of a versioned API. Routes are both registered and documented from their description, so
+// the OpenAPI document can't drift from what the server actually does
+type ApiRoute struct {
+	Method      string
+	Path        string
+	OperationId string
+	Summary     string
+	Handler     http.HandlerFunc
+	// Optional string query parameters, and what each of them does
+	Query map[string]string
+	// A zero value of the JSON request body, or nil if the route doesn't take one
+	RequestBody any
+	// A zero value of the JSON response body, or nil if the route doesn't respond with one
+	Response any
+	Status   int
+	// Whether the response has an ETag, which GET requests can send back in If-None-Match
+	ETag bool
+	// Whether the change is only made if the resource's ETag matches If-Match
+	IfMatch bool
+	// Whether retries with the same Idempotency-Key header return the original result rather than repeating the change
+	Idempotent bool
+	// Error codes the route can respond with, in addition to those every route can respond with
+	Errors []ErrorCode
+}
+
+// Errors that any authenticated route can respond with
+var commonErrors = []ErrorCode{InvalidRequest, Unauthenticated, InvalidCSRFToken, RateLimited, InternalError, ServiceUnavailable}
+
+// Values of string types that only have a fixed set of values
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeFor[GameState]():         {string(Setup), Playing, GameOver},
+	reflect.TypeFor[Variant]():           {string(Classic)},
+	reflect.TypeFor[TimeControl]():       {string(Unlimited)},
+	reflect.TypeFor[turn.Turn]():         {string(turn.Player1), turn.Player2},
+	reflect.TypeFor[position.Position](): {string(position.Player1), position.Player2, position.Empty},
+	reflect.TypeFor[Avatar]():            avatarNames(),
+	reflect.TypeFor[ErrorCode]():         errorCodeNames(),
+	reflect.TypeFor[LobbyLogKind](): {
+		string(LobbyCreated),
+		string(PlayerJoined),
+		string(PlayerLeft),
+		string(MoveMade),
+		string(PlayerResigned),
+		string(ChatSent),
+	},
+}
+
+func avatarNames() []string {
+	names := make([]string, len(avatars))
+	for i, avatar := range avatars {
+		names[i] = string(avatar)
+	}
+
+	return names
+}
+
+func errorCodeNames() []string {
+	names := make([]string, 0, len(errorStatuses))
+	for code := range errorStatuses {
+		names = append(names, string(code))
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+var pathParameterPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// schemaGenerator builds JSON schemas from Go types, the same way encoding/json would serialise them
+type schemaGenerator struct {
+	components map[string]any
+}
+
+func (generator *schemaGenerator) schema(t reflect.Type) map[string]any {
+	if t == reflect.TypeFor[time.Time]() {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	if values, exists := schemaEnums[t]; exists {
+		return map[string]any{"type": "string", "enum": values}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return map[string]any{"anyOf": []any{generator.schema(t.Elem()), map[string]any{"type": "null"}}}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return generator.structSchema(t)
+		}
+
+		if _, exists := generator.components[t.Name()]; !exists {
+			// Reserve the name first, so that types referring to themselves don't recurse forever
+			generator.components[t.Name()] = nil
+			generator.components[t.Name()] = generator.structSchema(t)
+		}
+
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": generator.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": generator.schema(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (generator *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+
+	generator.addFields(t, properties, &required)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+func (generator *schemaGenerator) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		// Fields of embedded structs are serialised as if they belonged to the outer struct
+		if field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct {
+			generator.addFields(field.Type, properties, required)
+			continue
+		}
+
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		properties[name] = generator.schema(field.Type)
+
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// GenerateOpenApi builds an OpenAPI 3.1 document describing the routes, which are served under basePath
+func GenerateOpenApi(title string, version string, basePath string, routes []ApiRoute) map[string]any {
+	generator := &schemaGenerator{components: map[string]any{}}
+	errorSchema := generator.schema(reflect.TypeFor[ApiError]())
+	paths := map[string]any{}
+
+	for _, route := range routes {
+		operation := map[string]any{
+			"operationId": route.OperationId,
+			"summary":     route.Summary,
+		}
+
+		var parameters []any
+		for _, match := range pathParameterPattern.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(route.Query)) {
+			parameters = append(parameters, map[string]any{
+				"name":        name,
+				"in":          "query",
+				"description": route.Query[name],
+				"schema":      map[string]any{"type": "string"},
+			})
+		}
+
+		if route.ETag && route.Method == http.MethodGet {
+			parameters = append(parameters, map[string]any{
+				"name":        "If-None-Match",
+				"in":          "header",
+				"description": "Responds with 304 Not Modified if the resource still has one of these ETags",
+				"schema":      map[string]any{"type": "string"},
+			})
+		}
+
+		if route.IfMatch {
+			parameters = append(parameters, map[string]any{
+				"name":        "If-Match",
+				"in":          "header",
+				"description": "Only makes the change if the resource still has one of these ETags",
+				"schema":      map[string]any{"type": "string"},
+			})
+		}
+
+		if route.Idempotent {
+			parameters = append(parameters, map[string]any{
+				"name":        IdempotencyKeyHeader,
+				"in":          "header",
+				"description": "A unique key for the change. Retrying with the same key returns the original result",
+				"schema":      map[string]any{"type": "string", "maxLength": maxIdempotencyKeyLength},
+			})
+		}
+
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if route.RequestBody != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": generator.schema(reflect.TypeOf(route.RequestBody))},
+				},
+			}
+		}
+
+		success := map[string]any{"description": http.StatusText(route.Status)}
+		if route.Response != nil {
+			success["content"] = map[string]any{
+				"application/json": map[string]any{"schema": generator.schema(reflect.TypeOf(route.Response))},
+			}
+		}
+
+		if route.ETag {
+			success["headers"] = map[string]any{
+				"ETag": map[string]any{"schema": map[string]any{"type": "string"}},
+			}
+		}
+
+		responses := map[string]any{strconv.Itoa(route.Status): success}
+		if route.ETag && route.Method == http.MethodGet {
+			responses[strconv.Itoa(http.StatusNotModified)] = map[string]any{"description": http.StatusText(http.StatusNotModified)}
+		}
+
+		// Several error codes can share a status, so each status lists the codes it is sent with
+		codesByStatus := map[int][]string{}
+		for _, code := range append(slices.Clone(commonErrors), route.Errors...) {
+			status := StatusForCode(code)
+			codesByStatus[status] = append(codesByStatus[status], string(code))
+		}
+
+		for status, codes := range codesByStatus {
+			responses[strconv.Itoa(status)] = map[string]any{
+				"description": http.StatusText(status) + ": " + strings.Join(codes, ", "),
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": errorSchema},
+				},
+			}
+		}
+
+		operation["responses"] = responses
+
+		path, exists := paths[route.Path].(map[string]any)
+		if !exists {
+			path = map[string]any{}
+			paths[route.Path] = path
+		}
+
+		path[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   title,
+			"version": version,
+		},
+		"servers": []any{map[string]any{"url": basePath}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": generator.components,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{"type": "apiKey", "in": "cookie", "name": "session"},
+				"csrf":    map[string]any{"type": "apiKey", "in": "header", "name": CSRFHeaderName},
+			},
+		},
+		"security": []any{map[string]any{"session": []any{}, "csrf": []any{}}},
+	}
+}
+
+// RegisterApiRoutes registers each of the routes under basePath
+func RegisterApiRoutes(mux *http.ServeMux, basePath string, routes []ApiRoute) {
+	for _, route := range routes {
+		mux.HandleFunc(route.Method+" "+basePath+route.Path, route.Handler)
+	}
+}
+
+// openApiHandler serves the OpenAPI document for the routes, which is only generated once
+func openApiHandler(title string, version string, basePath string, routes []ApiRoute) http.HandlerFunc {
+	document := sync.OnceValue(func() map[string]any {
+		return GenerateOpenApi(title, version, basePath, routes)
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJson(w, document())
+	}
+}
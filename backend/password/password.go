@@ -0,0 +1,77 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+)
+
+// Parameters follow the second recommended option in RFC 9106
+const (
+	iterations = 3
+	memory     = 64 * 1024
+	threads    = 4
+	keyLength  = 32
+	saltSize   = 16
+)
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Hash hashes the password with argon2id, returning it in the PHC string format so the parameters
+// can be changed later without invalidating existing hashes
+func Hash(password string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, keyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		memory,
+		iterations,
+		threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify returns whether the password matches the hash
+func Verify(password string, hash string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrInvalidHash
+	}
+
+	var hashMemory uint32
+	var hashTime uint32
+	var hashThreads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hashMemory, &hashTime, &hashThreads); err != nil {
+		return false, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+
+	expectedKey, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+
+	key := argon2.IDKey([]byte(password), salt, hashTime, hashMemory, hashThreads, uint32(len(expectedKey)))
+
+	return subtle.ConstantTimeCompare(key, expectedKey) == 1, nil
+}
@@ -3,4 +3,17 @@ package main
 type Player struct {
 	Id           string
 	CurrentLobby *string
+	Profile      PlayerProfile
+	// Set once a guest has registered an account
+	Username *string
+	// The version of the stored document, which is migrated when it is read if it is older than the current one
+	SchemaVersion int
+}
+
+// NewPlayer returns a player who has only just connected
+func NewPlayer(playerId string) *Player {
+	return &Player{
+		Id:      playerId,
+		Profile: PlayerProfile{Avatar: DefaultAvatar},
+	}
 }
@@ -0,0 +1,115 @@
+package profanity
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Words that are blocked along with anything made by adding to their start or end, such as "fucking" or "bullshit".
+// They aren't looked for in the middle of words, as that catches innocent ones like "Scunthorpe". Matching is done on
+// normalised text, so common substitutions such as "sh1t" or "f.u.c.k" are caught as well
+var blockedStems = []string{
+	"asshole",
+	"bitch",
+	"cunt",
+	"fuck",
+	"nigga",
+	"nigger",
+	"shit",
+	"whore",
+}
+
+// Words that are only blocked on their own, as they appear inside plenty of innocent words ("peacock", "therapist").
+// Those that are also common names, such as "Dick", aren't blocked at all
+var blockedWords = map[string]bool{
+	"arse":     true,
+	"bastard":  true,
+	"bollocks": true,
+	"cock":     true,
+	"fag":      true,
+	"penis":    true,
+	"piss":     true,
+	"porn":     true,
+	"pussy":    true,
+	"retard":   true,
+	"slut":     true,
+	"twat":     true,
+	"wank":     true,
+}
+
+var substitutions = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'@': 'a',
+	'$': 's',
+	'!': 'i',
+	'|': 'i',
+}
+
+// words lowercases the text, undoes common character substitutions and splits it on anything that isn't a letter
+func words(text string) []string {
+	var builder strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if substitute, exists := substitutions[r]; exists {
+			r = substitute
+		}
+
+		if unicode.IsLetter(r) {
+			builder.WriteRune(r)
+		} else {
+			builder.WriteRune(' ')
+		}
+	}
+
+	return strings.Fields(builder.String())
+}
+
+// tokens returns the words in the text, along with each run of single letters joined into one word, which catches
+// blocked words that have been split up, such as "f u c k". Only single letters are joined, as joining whole words
+// finds blocked words across innocent ones, such as "was hit"
+func tokens(text string) []string {
+	textWords := words(text)
+
+	var joined []string
+	var run strings.Builder
+	endRun := func() {
+		if run.Len() > 1 {
+			joined = append(joined, run.String())
+		}
+
+		run.Reset()
+	}
+
+	for _, word := range textWords {
+		if len([]rune(word)) == 1 {
+			run.WriteString(word)
+		} else {
+			endRun()
+		}
+	}
+	endRun()
+
+	return append(textWords, joined...)
+}
+
+// Contains returns whether the text contains a blocked word
+func Contains(text string) bool {
+	for _, token := range tokens(text) {
+		if blockedWords[token] {
+			return true
+		}
+
+		for _, blocked := range blockedStems {
+			if strings.HasPrefix(token, blocked) || strings.HasSuffix(token, blocked) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
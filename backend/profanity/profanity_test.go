@@ -0,0 +1,52 @@
+package profanity
+
+import "testing"
+
+func TestContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected bool
+	}{
+		{name: "empty", text: "", expected: false},
+		{name: "clean", text: "Rota player from Leeds", expected: false},
+
+		// Stems match with anything added to their start or end
+		{name: "stem on its own", text: "shit", expected: true},
+		{name: "stem with a suffix", text: "fucking", expected: true},
+		{name: "stem with a prefix", text: "bullshit", expected: true},
+		{name: "stem with a suffix and no space", text: "fuckwit", expected: true},
+		{name: "stem in a sentence", text: "what the fuck", expected: true},
+		{name: "stem in capitals", text: "SHIT", expected: true},
+		{name: "stem with substitutions", text: "sh1t", expected: true},
+		{name: "stem with symbol substitutions", text: "$h!t", expected: true},
+		{name: "stem split by punctuation", text: "f.u.c.k", expected: true},
+		{name: "stem split by spaces", text: "f u c k", expected: true},
+		{name: "stem joined to a name", text: "bitchface_99", expected: true},
+
+		// Stems aren't looked for in the middle of words
+		{name: "stem inside a place name", text: "Scunthorpe", expected: false},
+		{name: "stem inside a word", text: "mishitting", expected: false},
+		{name: "words across a space", text: "was hit", expected: false},
+		{name: "single letters next to words", text: "a shirt", expected: false},
+
+		// Blocked words only match on their own
+		{name: "word on its own", text: "cock", expected: true},
+		{name: "word with substitutions", text: "p0rn", expected: true},
+		{name: "word split by spaces", text: "w a n k", expected: true},
+		{name: "word inside a bird", text: "peacock", expected: false},
+		{name: "word inside a job", text: "therapist", expected: false},
+		{name: "word inside a place name", text: "Penistone", expected: false},
+		{name: "word inside a football club", text: "Arsenal", expected: false},
+		{name: "word with a suffix", text: "cocktail", expected: false},
+		{name: "common name", text: "Dick", expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := Contains(test.text); actual != test.expected {
+				t.Fatalf("Expected Contains(%q) to be %v, got %v", test.text, test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"backend/profanity"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	minDisplayNameLength = 3
+	maxDisplayNameLength = 24
+	maxBioLength         = 280
+)
+
+var displayNamePattern = regexp.MustCompile(`^[\p{L}\p{N}_\- ]+$`)
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+type Avatar string
+
+const (
+	DefaultAvatar  Avatar = "PEBBLE"
+	OwlAvatar             = "OWL"
+	FoxAvatar             = "FOX"
+	LionAvatar            = "LION"
+	EagleAvatar           = "EAGLE"
+	WolfAvatar            = "WOLF"
+	TortoiseAvatar        = "TORTOISE"
+)
+
+var avatars = []Avatar{DefaultAvatar, OwlAvatar, FoxAvatar, LionAvatar, EagleAvatar, WolfAvatar, TortoiseAvatar}
+
+type PlayerProfile struct {
+	DisplayName string
+	Avatar      Avatar
+	// ISO 3166-1 alpha-2 country code, used to show a flag
+	Country string
+	Bio     string
+}
+
+// PublicProfile is what other players are able to see about a player
+type PublicProfile struct {
+	PlayerId string
+	PlayerProfile
+}
+
+type ProfileValidationError struct {
+	cause   ErrorCode
+	message string
+}
+
+func (e ProfileValidationError) Error() string {
+	return string(e.cause)
+}
+
+func (profile *PlayerProfile) Validate() error {
+	if utf8.RuneCountInString(profile.DisplayName) < minDisplayNameLength || utf8.RuneCountInString(profile.DisplayName) > maxDisplayNameLength {
+		return ProfileValidationError{cause: DisplayNameLength, message: "Display name must be between 3 and 24 characters"}
+	}
+
+	if !displayNamePattern.MatchString(profile.DisplayName) {
+		return ProfileValidationError{cause: DisplayNameCharacters, message: "Display name can only contain letters, numbers, spaces, underscores and hyphens"}
+	}
+
+	isValidAvatar := false
+	for _, avatar := range avatars {
+		if profile.Avatar == avatar {
+			isValidAvatar = true
+		}
+	}
+
+	if !isValidAvatar {
+		return ProfileValidationError{cause: InvalidAvatar, message: "Avatar must be one of the available avatars"}
+	}
+
+	if len(profile.Country) > 0 && !countryPattern.MatchString(profile.Country) {
+		return ProfileValidationError{cause: InvalidCountry, message: "Country must be a two letter ISO 3166 country code"}
+	}
+
+	if utf8.RuneCountInString(profile.Bio) > maxBioLength {
+		return ProfileValidationError{cause: BioLength, message: "Bio can be at most 280 characters"}
+	}
+
+	if profanity.Contains(profile.DisplayName) || profanity.Contains(profile.Bio) {
+		return ProfileValidationError{cause: Profanity, message: "Display name and bio can't contain offensive language"}
+	}
+
+	return nil
+}
+
+// GetPublicProfiles fetches the public profiles of the given players, in the same order
+func GetPublicProfiles(ctx context.Context, store Store, playerIds ...string) ([]PublicProfile, error) {
+	profiles := make([]PublicProfile, len(playerIds))
+	for i, playerId := range playerIds {
+		profiles[i] = PublicProfile{
+			PlayerId:      playerId,
+			PlayerProfile: PlayerProfile{Avatar: DefaultAvatar},
+		}
+	}
+
+	players, err := store.GetPlayers(ctx, playerIds...)
+	if err != nil {
+		return profiles, err
+	}
+
+	for i, player := range players {
+		if player == nil {
+			continue
+		}
+
+		profiles[i].PlayerProfile = player.Profile
+		if len(profiles[i].Avatar) == 0 {
+			profiles[i].Avatar = DefaultAvatar
+		}
+	}
+
+	return profiles, nil
+}
+
+// GetLobbyProfiles fetches the public profiles of everyone in the lobby
+func GetLobbyProfiles(ctx context.Context, store Store, lobby Lobby) ([]PublicProfile, error) {
+	if lobby.Player2 == nil {
+		return GetPublicProfiles(ctx, store, lobby.Player1)
+	}
+
+	return GetPublicProfiles(ctx, store, lobby.Player1, *lobby.Player2)
+}
+
+func getProfileHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	playerId := GetIdFromContext(r.Context())
+	if r.URL.Query().Has("playerId") {
+		playerId = r.URL.Query().Get("playerId")
+	}
+
+	profiles, err := GetPublicProfiles(r.Context(), store, playerId)
+	if err != nil {
+		logger.Warn("There was an error fetching profile: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching profile")
+		return
+	}
+
+	WriteJson(w, profiles[0])
+}
+
+func setProfileHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	var profile PlayerProfile
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&profile)
+	if err != nil {
+		WriteError(w, InvalidRequest, "Invalid profile, must be a JSON object")
+		return
+	}
+
+	profile.DisplayName = strings.TrimSpace(profile.DisplayName)
+	profile.Bio = strings.TrimSpace(profile.Bio)
+	profile.Country = strings.ToUpper(profile.Country)
+	if len(profile.Avatar) == 0 {
+		profile.Avatar = DefaultAvatar
+	}
+
+	var validationError ProfileValidationError
+	if errors.As(profile.Validate(), &validationError) {
+		WriteError(w, validationError.cause, validationError.message)
+		return
+	}
+
+	err = store.UpdatePlayer(r.Context(), id, func(tx PlayerTx) error {
+		player, err := tx.GetPlayer(r.Context())
+		if err != nil {
+			return err
+		}
+
+		if player == nil {
+			player = NewPlayer(id)
+		}
+
+		player.Profile = profile
+		tx.SetPlayer(*player)
+
+		return nil
+	})
+	if err != nil {
+		logger.Warn("There was an error saving profile: " + err.Error())
+		WriteError(w, InternalError, "There was an error saving profile")
+		return
+	}
+
+	logger.Info("Updated profile")
+	WriteJson(w, PublicProfile{
+		PlayerId:      id,
+		PlayerProfile: profile,
+	})
+}
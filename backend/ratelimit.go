@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimit allows bursts of up to Burst requests, refilling at a rate of Burst requests every Per
+type RateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// Several players can share an IP address, so the IP address bucket is bigger than the session one
+const ipLimitMultiplier = 5
+
+var defaultRateLimit = RateLimit{Burst: 30, Per: 10 * time.Second}
+
+// Limits for routes that are expensive or easy to abuse, keyed by the same patterns the routes are registered with
+var routeRateLimits = map[string]RateLimit{
+	"GET /ws":                                {Burst: 10, Per: time.Minute},
+	"POST /api/create-lobby":                 {Burst: 5, Per: time.Minute},
+	"POST /api/join-lobby":                   {Burst: 20, Per: time.Minute},
+	"POST /api/make-move":                    {Burst: 10, Per: 5 * time.Second},
+	"POST /api/v2/lobbies":                   {Burst: 5, Per: time.Minute},
+	"POST /api/v2/lobbies/{lobbyId}/players": {Burst: 20, Per: time.Minute},
+	"POST /api/v2/lobbies/{lobbyId}/moves":   {Burst: 10, Per: 5 * time.Second},
+	"POST /api/profile":                      {Burst: 10, Per: time.Minute},
+	"POST /api/register":                     {Burst: 5, Per: time.Hour},
+	"POST /api/login":                        {Burst: 10, Per: 15 * time.Minute},
+	"POST /api/tournaments":                  {Burst: 5, Per: time.Hour},
+	"POST /api/arenas":                       {Burst: 5, Per: time.Hour},
+	"DELETE /api/sessions":                   {Burst: 5, Per: time.Minute},
+	"GET /api/games":                         {Burst: 20, Per: 10 * time.Second},
+	"GET /api/leaderboards/{kind}":           {Burst: 20, Per: 10 * time.Second},
+}
+
+// The most WebSockets a player may have open at once
+const maxConnectionsPerPlayer = 5
+
+// How long a WebSocket counts towards the limit without being refreshed, so that connections on a server that
+// crashed are eventually forgotten
+const connectionLeaseDuration = time.Minute
+
+// RateLimitStore keeps the buckets that requests are rate limited with, along with the WebSockets each player has open
+type RateLimitStore interface {
+	// TakeTokens takes a token from each of the named buckets, which hold up to each limit's Burst, or from none of them
+	// if any is empty. Returns whether the tokens were taken and, if not, how long until they could be
+	TakeTokens(ctx context.Context, buckets []string, limits []RateLimit) (bool, time.Duration, error)
+	// AcquireConnection registers the WebSocket for the player for connectionLeaseDuration, unless they already have
+	// maxConnectionsPerPlayer open
+	AcquireConnection(ctx context.Context, playerId string, connectionId string) (bool, error)
+	// RefreshConnection extends the WebSocket's registration by connectionLeaseDuration
+	RefreshConnection(ctx context.Context, playerId string, connectionId string) error
+	// ReleaseConnection forgets the WebSocket, so that it no longer counts towards the player's limit
+	ReleaseConnection(ctx context.Context, playerId string, connectionId string) error
+}
+
+// Takes a token from the bucket if it has one, or gives one back to it. Buckets are taken from one at a time, since
+// under Cluster each is in its own slot. KEYS[1] is the bucket, and ARGV holds its capacity, its refill rate in tokens
+// per millisecond and 1 to take a token or -1 to give one back. Returns whether the token was taken and, if not, how
+// many milliseconds until it could be
+var takeTokenScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updatedAt')
+local tokens = tonumber(bucket[1]) or capacity
+local updatedAt = tonumber(bucket[2]) or now
+
+tokens = math.min(capacity, tokens + math.max(0, now - updatedAt) * rate)
+
+local retryAfter = 0
+if tonumber(ARGV[3]) < 0 then
+	tokens = math.min(capacity, tokens + 1)
+elseif tokens < 1 then
+	retryAfter = math.ceil((1 - tokens) / rate)
+else
+	tokens = tokens - 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updatedAt', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate))
+
+if retryAfter > 0 then
+	return {0, retryAfter}
+end
+
+return {1, 0}
+`)
+
+// Registers a connection if the player has fewer than the maximum. KEYS[1] is the player's connections, ARGV holds
+// the connection ID, the maximum and the lease duration in milliseconds
+var acquireConnectionScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+func rateLimitKey(bucket string) string {
+	return "ratelimit:" + bucket
+}
+
+func (store *RedisStore) TakeTokens(ctx context.Context, buckets []string, limits []RateLimit) (bool, time.Duration, error) {
+	takeToken := func(pipe redis.Pipeliner, i int, change int) *redis.Cmd {
+		// Queued scripts can't fall back to sending the script when Redis doesn't have it yet, so it is always sent
+		rate := float64(limits[i].Burst) / float64(limits[i].Per.Milliseconds())
+		return takeTokenScript.Eval(ctx, pipe, []string{rateLimitKey(buckets[i])}, limits[i].Burst, rate, change)
+	}
+
+	results := make([]*redis.Cmd, len(buckets))
+	_, err := store.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range buckets {
+			results[i] = takeToken(pipe, i, 1)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	var taken []int
+	var retryAfter time.Duration
+	for i, result := range results {
+		values, err := result.Int64Slice()
+		if err != nil {
+			return false, 0, err
+		}
+
+		if values[0] == 1 {
+			taken = append(taken, i)
+		} else {
+			retryAfter = max(retryAfter, time.Duration(values[1])*time.Millisecond)
+		}
+	}
+
+	if retryAfter == 0 {
+		return true, 0, nil
+	}
+
+	// The buckets can't all be taken from at once, so the tokens taken from those that weren't empty are given back
+	_, err = store.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, i := range taken {
+			takeToken(pipe, i, -1)
+		}
+
+		return nil
+	})
+
+	return false, retryAfter, err
+}
+
+func playerConnectionsKey(playerId string) string {
+	return "player:" + playerId + ":connections"
+}
+
+func (store *RedisStore) AcquireConnection(ctx context.Context, playerId string, connectionId string) (bool, error) {
+	result, err := acquireConnectionScript.Run(ctx, store.rdb, []string{playerConnectionsKey(playerId)}, connectionId, maxConnectionsPerPlayer, connectionLeaseDuration.Milliseconds()).Int()
+	return result == 1, err
+}
+
+func (store *RedisStore) RefreshConnection(ctx context.Context, playerId string, connectionId string) error {
+	key := playerConnectionsKey(playerId)
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{
+			Score:  float64(time.Now().Add(connectionLeaseDuration).UnixMilli()),
+			Member: connectionId,
+		})
+		return pipe.PExpire(ctx, key, connectionLeaseDuration).Err()
+	})
+
+	return err
+}
+
+func (store *RedisStore) ReleaseConnection(ctx context.Context, playerId string, connectionId string) error {
+	return store.rdb.ZRem(ctx, playerConnectionsKey(playerId), connectionId).Err()
+}
+
+type memoryTokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	// When the bucket would be full again, after which it is no different to one that was never taken from
+	expiresAt time.Time
+}
+
+func (store *MemoryStore) TakeTokens(ctx context.Context, buckets []string, limits []RateLimit) (bool, time.Duration, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	tokens := make([]float64, len(buckets))
+	var retryAfter time.Duration
+
+	for i, name := range buckets {
+		capacity := float64(limits[i].Burst)
+		perToken := limits[i].Per / time.Duration(limits[i].Burst)
+
+		tokens[i] = capacity
+		if bucket, exists := store.rateLimitBuckets[name]; exists && now.Before(bucket.expiresAt) {
+			tokens[i] = min(capacity, bucket.tokens+float64(now.Sub(bucket.updatedAt))/float64(perToken))
+		}
+
+		if tokens[i] < 1 {
+			retryAfter = max(retryAfter, time.Duration((1-tokens[i])*float64(perToken)))
+		}
+	}
+
+	for i, name := range buckets {
+		if retryAfter == 0 {
+			tokens[i]--
+		}
+
+		store.rateLimitBuckets[name] = memoryTokenBucket{
+			tokens:    tokens[i],
+			updatedAt: now,
+			expiresAt: now.Add(limits[i].Per),
+		}
+	}
+
+	return retryAfter == 0, retryAfter, nil
+}
+
+// liveConnections returns the player's connections whose leases haven't run out, forgetting the rest. It expects the
+// store to already be locked
+func (store *MemoryStore) liveConnections(playerId string) map[string]time.Time {
+	connections := store.playerConnections[playerId]
+	for connectionId, leaseUntil := range connections {
+		if !time.Now().Before(leaseUntil) {
+			delete(connections, connectionId)
+		}
+	}
+
+	return connections
+}
+
+func (store *MemoryStore) AcquireConnection(ctx context.Context, playerId string, connectionId string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	connections := store.liveConnections(playerId)
+	if len(connections) >= maxConnectionsPerPlayer {
+		return false, nil
+	}
+
+	if connections == nil {
+		connections = map[string]time.Time{}
+		store.playerConnections[playerId] = connections
+	}
+
+	connections[connectionId] = time.Now().Add(connectionLeaseDuration)
+	return true, nil
+}
+
+func (store *MemoryStore) RefreshConnection(ctx context.Context, playerId string, connectionId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.playerConnections[playerId] == nil {
+		store.playerConnections[playerId] = map[string]time.Time{}
+	}
+
+	store.playerConnections[playerId][connectionId] = time.Now().Add(connectionLeaseDuration)
+	return nil
+}
+
+func (store *MemoryStore) ReleaseConnection(ctx context.Context, playerId string, connectionId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.playerConnections[playerId], connectionId)
+	if len(store.playerConnections[playerId]) == 0 {
+		delete(store.playerConnections, playerId)
+	}
+
+	return nil
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, code ErrorCode, message string) {
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	WriteErrorDetails(w, code, message, map[string]any{
+		"RetryAfter": retryAfterSeconds,
+	})
+}
+
+// WithRateLimitMiddleware limits how often each session and IP address can call each route. Requests made without a
+// session are only limited by IP address
+func WithRateLimitMiddleware(next http.Handler) http.Handler {
+	// Matching against a mux finds the limit for routes with path parameters in the same way the route itself is found
+	routes := http.NewServeMux()
+	for pattern := range routeRateLimits {
+		routes.Handle(pattern, http.NotFoundHandler())
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store := GetStoreFromContext(r.Context())
+		logger := GetLoggerFromContext(r.Context())
+
+		_, pattern := routes.Handler(r)
+		limit, exists := routeRateLimits[pattern]
+		if !exists {
+			pattern = "default"
+			limit = defaultRateLimit
+		}
+
+		buckets := []string{"ip:" + ClientIP(r) + ":" + pattern}
+		limits := []RateLimit{{Burst: limit.Burst * ipLimitMultiplier, Per: limit.Per}}
+
+		if session, ok := r.Context().Value("session").(*Session); ok {
+			buckets = append(buckets, "session:"+session.SessionId+":"+pattern)
+			limits = append(limits, limit)
+		}
+
+		allowed, retryAfter, err := store.TakeTokens(r.Context(), buckets, limits)
+		if err != nil {
+			// Players shouldn't be locked out because the rate limiter is broken
+			logger.Warn("There was an error checking rate limit: " + err.Error())
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !allowed {
+			logger.Info("Rate limited request to " + pattern)
+			writeTooManyRequests(w, retryAfter, RateLimited, "Too many requests, try again later")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AcquireConnection registers a new WebSocket for the player, returning false if they already have too many open.
+// The returned refresh function must be called more often than connectionLeaseDuration while the WebSocket is open,
+// and release once it has closed
+func AcquireConnection(ctx context.Context, store RateLimitStore, playerId string) (acquired bool, refresh func() error, release func(), err error) {
+	connectionId := uuid.NewString()
+
+	acquired, err = store.AcquireConnection(ctx, playerId, connectionId)
+	if err != nil || !acquired {
+		return false, nil, nil, err
+	}
+
+	refresh = func() error {
+		return store.RefreshConnection(context.Background(), playerId, connectionId)
+	}
+
+	release = func() {
+		store.ReleaseConnection(context.Background(), playerId, connectionId)
+	}
+
+	return true, refresh, release, nil
+}
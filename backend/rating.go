@@ -0,0 +1,401 @@
+package main
+
+import (
+	"backend/glicko"
+	"backend/turn"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const ratingHistoryLimit = 500
+
+type PlayerRating struct {
+	Glicko    glicko.Rating
+	Games     int
+	Wins      int
+	Losses    int
+	UpdatedAt time.Time
+}
+
+type PlayerRatings struct {
+	PlayerId string
+	Pools    map[string]PlayerRating
+}
+
+type RatingHistoryEntry struct {
+	GameId     string
+	OpponentId string
+	Score      glicko.Score
+	Before     glicko.Rating
+	After      glicko.Rating
+	At         time.Time
+}
+
+// RatingPool returns the pool a game is rated in. Each variant and time control combination
+// is rated separately
+func RatingPool(variant Variant, timeControl TimeControl) string {
+	return string(variant) + ":" + string(timeControl)
+}
+
+func ratingsKey(playerId string) string {
+	return withHashTag(playerHashTag(playerId), "player:"+playerId+":ratings")
+}
+
+func ratingHistoryKey(playerId string, pool string) string {
+	return withHashTag(playerHashTag(playerId), "player:"+playerId+":rating-history:"+pool)
+}
+
+func (ratings *PlayerRatings) Get(pool string) PlayerRating {
+	if rating, exists := ratings.Pools[pool]; exists {
+		return rating
+	}
+
+	return PlayerRating{Glicko: glicko.NewRating()}
+}
+
+// RatingStore keeps each player's ratings, along with the history of how they changed in each pool
+type RatingStore interface {
+	// GetPlayerRatings returns the player's ratings, which have no pools if they have never played a rated game
+	GetPlayerRatings(ctx context.Context, playerId string) (PlayerRatings, error)
+	// UpdatePlayerRatings runs the function on the player's ratings in a transaction, saving them along with the entry
+	// it returns in the pool's history. Nothing is saved if it returns no entry, or an entry for a game already in the
+	// history, so that each game is only ever rated once
+	UpdatePlayerRatings(ctx context.Context, playerId string, pool string, update func(ratings *PlayerRatings) (*RatingHistoryEntry, error)) error
+	// GetRatingHistory returns up to limit of the player's latest changes in the pool, most recent first
+	GetRatingHistory(ctx context.Context, playerId string, pool string, limit int) ([]RatingHistoryEntry, error)
+}
+
+func getRedisRatings(ctx context.Context, rdb redis.Cmdable, playerId string) (PlayerRatings, error) {
+	ratings := PlayerRatings{
+		PlayerId: playerId,
+		Pools:    map[string]PlayerRating{},
+	}
+
+	ratingsJson, err := rdb.JSONGet(ctx, ratingsKey(playerId)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return ratings, err
+	}
+
+	if len(ratingsJson) == 0 {
+		return ratings, nil
+	}
+
+	err = json.Unmarshal([]byte(ratingsJson), &ratings)
+	if ratings.Pools == nil {
+		ratings.Pools = map[string]PlayerRating{}
+	}
+
+	return ratings, err
+}
+
+func (store *RedisStore) GetPlayerRatings(ctx context.Context, playerId string) (PlayerRatings, error) {
+	return getRedisRatings(ctx, store.rdb, playerId)
+}
+
+func (store *RedisStore) UpdatePlayerRatings(ctx context.Context, playerId string, pool string, update func(ratings *PlayerRatings) (*RatingHistoryEntry, error)) error {
+	tx := func(tx *redis.Tx) error {
+		ratings, err := getRedisRatings(ctx, tx, playerId)
+		if err != nil {
+			return err
+		}
+
+		entry, err := update(&ratings)
+		if err != nil || entry == nil {
+			return err
+		}
+
+		// The history is always saved along with the ratings, so watching the ratings covers it too
+		history, err := getRedisRatingHistory(ctx, tx, playerId, pool, ratingHistoryLimit)
+		if err != nil || hasRatedGame(history, entry.GameId) {
+			return err
+		}
+
+		entryJson, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, ratingsKey(playerId), "$", ratings)
+			pipe.LPush(ctx, ratingHistoryKey(playerId, pool), entryJson)
+			pipe.LTrim(ctx, ratingHistoryKey(playerId, pool), 0, ratingHistoryLimit-1)
+			return nil
+		})
+
+		return err
+	}
+
+	err := WatchWithRetries(ctx, func() error {
+		return store.rdb.Watch(ctx, tx, ratingsKey(playerId))
+	}, storeTxAttempts)
+
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrTxConflict
+	}
+
+	return err
+}
+
+func (store *RedisStore) GetRatingHistory(ctx context.Context, playerId string, pool string, limit int) ([]RatingHistoryEntry, error) {
+	return getRedisRatingHistory(ctx, store.rdb, playerId, pool, limit)
+}
+
+func getRedisRatingHistory(ctx context.Context, rdb redis.Cmdable, playerId string, pool string, limit int) ([]RatingHistoryEntry, error) {
+	rawEntries, err := rdb.LRange(ctx, ratingHistoryKey(playerId, pool), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]RatingHistoryEntry, 0, len(rawEntries))
+	for _, rawEntry := range rawEntries {
+		var entry RatingHistoryEntry
+		if err := json.Unmarshal([]byte(rawEntry), &entry); err == nil {
+			history = append(history, entry)
+		}
+	}
+
+	return history, nil
+}
+
+func (store *MemoryStore) GetPlayerRatings(ctx context.Context, playerId string) (PlayerRatings, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.getRatings(playerId)
+}
+
+// getRatings expects the store to already be locked
+func (store *MemoryStore) getRatings(playerId string) (PlayerRatings, error) {
+	ratings := PlayerRatings{
+		PlayerId: playerId,
+		Pools:    map[string]PlayerRating{},
+	}
+
+	stored, err := getMemoryJson[PlayerRatings](store.ratings, playerId)
+	if err != nil || stored == nil {
+		return ratings, err
+	}
+
+	if stored.Pools == nil {
+		stored.Pools = map[string]PlayerRating{}
+	}
+
+	return *stored, nil
+}
+
+func (store *MemoryStore) UpdatePlayerRatings(ctx context.Context, playerId string, pool string, update func(ratings *PlayerRatings) (*RatingHistoryEntry, error)) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ratings, err := store.getRatings(playerId)
+	if err != nil {
+		return err
+	}
+
+	entry, err := update(&ratings)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	historyKey := playerId + ":" + pool
+	if hasRatedGame(store.ratingHistories[historyKey], entry.GameId) {
+		return nil
+	}
+
+	ratingsJson, err := json.Marshal(ratings)
+	if err != nil {
+		return err
+	}
+
+	store.ratings[playerId] = ratingsJson
+
+	history := append([]RatingHistoryEntry{*entry}, store.ratingHistories[historyKey]...)
+	store.ratingHistories[historyKey] = history[:min(len(history), ratingHistoryLimit)]
+
+	return nil
+}
+
+func (store *MemoryStore) GetRatingHistory(ctx context.Context, playerId string, pool string, limit int) ([]RatingHistoryEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	history := store.ratingHistories[playerId+":"+pool]
+	return slices.Clone(history[:min(len(history), limit)]), nil
+}
+
+// hasRatedGame returns whether the game is in the rating history
+func hasRatedGame(history []RatingHistoryEntry, gameId string) bool {
+	return slices.ContainsFunc(history, func(entry RatingHistoryEntry) bool {
+		return entry.GameId == gameId
+	})
+}
+
+// ratingBeforeGame returns the player's rating in the pool from before the game, which is their current rating unless
+// the game has already been rated for them
+func ratingBeforeGame(ctx context.Context, store Store, playerId string, pool string, gameId string) (glicko.Rating, error) {
+	history, err := store.GetRatingHistory(ctx, playerId, pool, ratingHistoryLimit)
+	if err != nil {
+		return glicko.Rating{}, err
+	}
+
+	for _, entry := range history {
+		if entry.GameId == gameId {
+			return entry.Before, nil
+		}
+	}
+
+	ratings, err := store.GetPlayerRatings(ctx, playerId)
+	if err != nil {
+		return glicko.Rating{}, err
+	}
+
+	return ratings.Get(pool).Glicko, nil
+}
+
+// UpdateRatings rates a finished game for both players in the lobby. Each player's ratings are updated on their own,
+// against their opponent's rating from before the game. Rating the same game again changes nothing
+func UpdateRatings(ctx context.Context, store Store, logger *slog.Logger, lobby Lobby) error {
+	if lobby.Game == nil || lobby.Game.State != GameOver || lobby.Player2 == nil {
+		return nil
+	}
+
+	game := lobby.Game
+	pool := RatingPool(game.Variant, game.TimeControl)
+	player1 := lobby.Player1
+	player2 := *lobby.Player2
+
+	// The player whose turn it is when the game ends is the winner
+	player1Score := glicko.Loss
+	if game.Turn == turn.Player1 {
+		player1Score = glicko.Win
+	}
+	player2Score := glicko.Win - player1Score
+
+	logger = logger.With(slog.String("pool", pool))
+
+	player1Rating, err := ratingBeforeGame(ctx, store, player1, pool, game.Id)
+	if err != nil {
+		return err
+	}
+
+	player2Rating, err := ratingBeforeGame(ctx, store, player2, pool, game.Id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	results := []struct {
+		playerId   string
+		opponentId string
+		opponent   glicko.Rating
+		score      glicko.Score
+		after      glicko.Rating
+	}{
+		{playerId: player1, opponentId: player2, opponent: player2Rating, score: player1Score},
+		{playerId: player2, opponentId: player1, opponent: player1Rating, score: player2Score},
+	}
+
+	for i, result := range results {
+		err := store.UpdatePlayerRatings(ctx, result.playerId, pool, func(ratings *PlayerRatings) (*RatingHistoryEntry, error) {
+			before := ratings.Get(pool)
+			after := applyResult(before, result.opponent, result.score, now)
+			ratings.Pools[pool] = after
+			results[i].after = after.Glicko
+
+			return &RatingHistoryEntry{
+				GameId:     game.Id,
+				OpponentId: result.opponentId,
+				Score:      result.score,
+				Before:     before.Glicko,
+				After:      after.Glicko,
+				At:         now,
+			}, nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Updated ratings",
+		slog.Float64("player1", results[0].after.Rating),
+		slog.Float64("player2", results[1].after.Rating),
+	)
+
+	return nil
+}
+
+func applyResult(rating PlayerRating, opponent glicko.Rating, score glicko.Score, now time.Time) PlayerRating {
+	rating.Glicko = rating.Glicko.Update([]glicko.Result{{Opponent: opponent, Score: score}})
+	rating.Games++
+	rating.UpdatedAt = now
+
+	if score == glicko.Win {
+		rating.Wins++
+	} else if score == glicko.Loss {
+		rating.Losses++
+	}
+
+	return rating
+}
+
+func getRatingsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	playerId := GetIdFromContext(r.Context())
+	if r.URL.Query().Has("playerId") {
+		playerId = r.URL.Query().Get("playerId")
+	}
+
+	ratings, err := store.GetPlayerRatings(r.Context(), playerId)
+	if err != nil {
+		logger.Warn("There was an error fetching ratings: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching ratings")
+		return
+	}
+
+	WriteJson(w, ratings)
+}
+
+func getRatingHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	playerId := GetIdFromContext(r.Context())
+	if r.URL.Query().Has("playerId") {
+		playerId = r.URL.Query().Get("playerId")
+	}
+
+	pool := RatingPool(Classic, Unlimited)
+	if r.URL.Query().Has("pool") {
+		pool = r.URL.Query().Get("pool")
+	}
+
+	limit := 50
+	rawLimit := r.URL.Query().Get("limit")
+	if len(rawLimit) > 0 {
+		if parsedLimit, err := strconv.Atoi(rawLimit); err == nil && parsedLimit > 0 && parsedLimit <= ratingHistoryLimit {
+			limit = parsedLimit
+		} else {
+			WriteError(w, InvalidRequest, "Invalid 'limit' parameter, must be an integer between 1 and "+strconv.Itoa(ratingHistoryLimit))
+			return
+		}
+	}
+
+	history, err := store.GetRatingHistory(r.Context(), playerId, pool, limit)
+	if err != nil {
+		logger.Warn("There was an error fetching rating history: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching rating history")
+		return
+	}
+
+	WriteJson(w, history)
+}
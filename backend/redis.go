@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"hash/fnv"
+	"os"
+	"strings"
+)
+
+// RedisMode is how the server connects to Redis
+type RedisMode string
+
+const (
+	// A single Redis server
+	StandaloneRedis RedisMode = "standalone"
+	// A primary and its replicas, watched by Sentinel, which points the client at the new primary after a failover
+	SentinelRedis RedisMode = "sentinel"
+	// Redis Cluster, which splits keys between primaries by hash slot. Each player and each lobby has its own slot, so
+	// game state is spread across every primary
+	ClusterRedis RedisMode = "cluster"
+)
+
+// LoadRedisMode reads how to connect to Redis from the environment
+func LoadRedisMode() (RedisMode, error) {
+	value, exists := os.LookupEnv("REDIS_MODE")
+	if !exists {
+		return StandaloneRedis, nil
+	}
+
+	mode := RedisMode(strings.ToLower(strings.TrimSpace(value)))
+	if mode != StandaloneRedis && mode != SentinelRedis && mode != ClusterRedis {
+		return StandaloneRedis, errors.New("REDIS_MODE must be one of " + string(StandaloneRedis) + ", " + string(SentinelRedis) + " or " + string(ClusterRedis))
+	}
+
+	return mode, nil
+}
+
+// NewRedisClient connects to Redis in the given mode using REDIS_URL, which is a redis:// or rediss:// URL. Extra
+// Sentinels or cluster nodes are added as addr query parameters, and Sentinel's primary is named with master_name.
+// The URL's credentials are for the Sentinels in Sentinel mode, so those for the primary are set with REDIS_USERNAME
+// and REDIS_PASSWORD instead
+func NewRedisClient(mode RedisMode) (redis.UniversalClient, error) {
+	url, exists := os.LookupEnv("REDIS_URL")
+
+	switch mode {
+	case SentinelRedis:
+		if !exists {
+			return nil, errors.New("REDIS_URL must list the Sentinels to connect to")
+		}
+
+		options, err := redis.ParseFailoverURL(url)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(options.MasterName) == 0 {
+			return nil, errors.New("REDIS_URL must name the primary with master_name")
+		}
+
+		options.Username = os.Getenv("REDIS_USERNAME")
+		options.Password = os.Getenv("REDIS_PASSWORD")
+
+		return redis.NewFailoverClient(options), nil
+	case ClusterRedis:
+		if !exists {
+			return nil, errors.New("REDIS_URL must list the cluster nodes to connect to")
+		}
+
+		options, err := redis.ParseClusterURL(url)
+		if err != nil {
+			return nil, err
+		}
+
+		return redis.NewClusterClient(options), nil
+	default:
+		if !exists {
+			return redis.NewClient(&redis.Options{Addr: "localhost:6379"}), nil
+		}
+
+		options, err := redis.ParseURL(url)
+		if err != nil {
+			return nil, err
+		}
+
+		return redis.NewClient(options), nil
+	}
+}
+
+// Whether keys that are used together in a transaction or script are given hash tags. Redis Cluster only runs those
+// on keys in the same hash slot, so it is set when connecting to a cluster. Keys keep the names they had before
+// clusters were supported otherwise
+var useHashTags = false
+
+// withHashTag puts the key in the tag's hash slot when running against Redis Cluster
+func withHashTag(tag string, key string) string {
+	if !useHashTags {
+		return key
+	}
+
+	return "{" + tag + "}" + key
+}
+
+// withoutHashTag returns the key as it would be named without a hash tag
+func withoutHashTag(key string) string {
+	if !strings.HasPrefix(key, "{") {
+		return key
+	}
+
+	_, untagged, found := strings.Cut(key, "}")
+	if !found {
+		return key
+	}
+
+	return untagged
+}
+
+// How many shards keys that are read together in bulk, such as inboxes and timers, are split into under Redis
+// Cluster. Each shard has its own slot, so they are spread across primaries but can still be read a shard at a time
+const clusterShards = 16
+
+// shardCount returns how many shards keys read together in bulk are split into, which is only one unless running
+// against Redis Cluster
+func shardCount() int {
+	if !useHashTags {
+		return 1
+	}
+
+	return clusterShards
+}
+
+// shardOf returns which shard the ID's keys are kept in
+func shardOf(id string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return int(hash.Sum32() % uint32(shardCount()))
+}
+
+// jsonMGet reads the documents at the keys the same way JSON.MGET does with the $ path, returning nil for those that
+// don't exist. The keys are read one at a time in a pipeline, since under Cluster they can be in different slots
+func jsonMGet(ctx context.Context, rdb redis.UniversalClient, keys ...string) ([]any, error) {
+	commands := make([]*redis.JSONCmd, len(keys))
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			commands[i] = pipe.JSONGet(ctx, key, "$")
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	results := make([]any, len(keys))
+	for i, command := range commands {
+		value, err := command.Result()
+		if errors.Is(err, redis.Nil) || len(value) == 0 {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		results[i] = value
+	}
+
+	return results, nil
+}
+
+// forEachPrimary runs the function against every primary, which for anything but a cluster is just the one it is
+// connected to. Commands such as SCAN and CONFIG only apply to the node they are sent to
+func forEachPrimary(ctx context.Context, rdb redis.UniversalClient, fn func(ctx context.Context, client *redis.Client) error) error {
+	switch client := rdb.(type) {
+	case *redis.ClusterClient:
+		return client.ForEachMaster(ctx, fn)
+	case *redis.Client:
+		return fn(ctx, client)
+	default:
+		return errors.New("unsupported Redis client")
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DocumentKind is a kind of JSON document kept in the store
+type DocumentKind string
+
+const (
+	PlayerDocument DocumentKind = "player"
+	LobbyDocument  DocumentKind = "lobby"
+	// Games are kept inside the lobby they are played in, but have their own version
+	GameDocument DocumentKind = "game"
+)
+
+// Migration upgrades a document from the version before it. Documents are migrated as generic JSON, since they may
+// not fit the current struct
+type Migration func(document map[string]any) error
+
+// documentMigrations holds the migrations for each kind of document, in order. The first one upgrades documents from
+// before versions were added, which are version 0, to version 1. Migrations are only ever added to the end, and a
+// document's current version is the number of migrations for it
+var documentMigrations = map[DocumentKind][]Migration{
+	PlayerDocument: {migratePlayerV1},
+	LobbyDocument:  {migrateLobbyV1},
+	GameDocument:   {migrateGameV1},
+}
+
+// nestedDocuments are the fields of a document that hold documents with their own version
+var nestedDocuments = map[DocumentKind]map[string]DocumentKind{
+	LobbyDocument: {"Game": GameDocument},
+}
+
+// CurrentSchemaVersion returns the version documents of the kind are written at
+func CurrentSchemaVersion(kind DocumentKind) int {
+	return len(documentMigrations[kind])
+}
+
+// Players from before profiles were added don't have one, and are given the default avatar
+func migratePlayerV1(document map[string]any) error {
+	profile, _ := document["Profile"].(map[string]any)
+	if profile == nil {
+		profile = map[string]any{}
+		document["Profile"] = profile
+	}
+
+	if avatar, _ := profile["Avatar"].(string); len(avatar) == 0 {
+		profile["Avatar"] = string(DefaultAvatar)
+	}
+
+	return nil
+}
+
+// legacyGameIdNamespace is the namespace the IDs of games from before games had IDs are made in
+var legacyGameIdNamespace = uuid.MustParse("1fdab239-e2c3-4e87-9571-eda3a13c93c0")
+
+// legacyGameId returns the ID given to the game in the lobby if it was from before games had IDs. Lobbies only ever
+// had the one game then, so the ID is the same each time the lobby is read until it is next saved
+func legacyGameId(lobbyId string) string {
+	return uuid.NewSHA1(legacyGameIdNamespace, []byte(lobbyId)).String()
+}
+
+// Lobbies from before versions were added have everything version 1 has, except that their game may not have an ID.
+// The game is given one here rather than when it is migrated, since it needs the lobby's ID
+func migrateLobbyV1(document map[string]any) error {
+	game, _ := document["Game"].(map[string]any)
+	if game == nil {
+		return nil
+	}
+
+	lobbyId, _ := document["LobbyId"].(string)
+	if id, _ := game["Id"].(string); len(id) == 0 && len(lobbyId) > 0 {
+		game["Id"] = legacyGameId(lobbyId)
+	}
+
+	return nil
+}
+
+// Games from before versions were added may not have an ID, a version, their moves, a variant or a time control.
+// Games are only ever kept in lobbies, which give them an ID first, so a new one is only made for a game that somehow
+// isn't in one
+func migrateGameV1(document map[string]any) error {
+	if id, _ := document["Id"].(string); len(id) == 0 {
+		document["Id"] = uuid.NewString()
+	}
+
+	if _, exists := document["Version"]; !exists {
+		document["Version"] = 0
+	}
+
+	if moves, _ := document["Moves"].([]any); moves == nil {
+		document["Moves"] = []any{}
+	}
+
+	if variant, _ := document["Variant"].(string); len(variant) == 0 {
+		document["Variant"] = string(Classic)
+	}
+
+	if timeControl, _ := document["TimeControl"].(string); len(timeControl) == 0 {
+		document["TimeControl"] = string(Unlimited)
+	}
+
+	return nil
+}
+
+// MigrateDocument upgrades the document to the current version, returning whether anything had to be migrated.
+// Documents from a newer version than this server knows about can't be read, rather than losing what it doesn't
+// know about when they are written back
+func MigrateDocument(kind DocumentKind, documentJson []byte) ([]byte, bool, error) {
+	// Numbers are kept as they were written, rather than going through a float
+	decoder := json.NewDecoder(bytes.NewReader(documentJson))
+	decoder.UseNumber()
+
+	var document map[string]any
+	if err := decoder.Decode(&document); err != nil {
+		return documentJson, false, err
+	}
+
+	migrated, err := migrateDocument(kind, document)
+	if err != nil || !migrated {
+		return documentJson, false, err
+	}
+
+	migratedJson, err := json.Marshal(document)
+	return migratedJson, err == nil, err
+}
+
+func migrateDocument(kind DocumentKind, document map[string]any) (bool, error) {
+	version, err := schemaVersion(document)
+	if err != nil {
+		return false, err
+	}
+
+	migrations := documentMigrations[kind]
+	if version > len(migrations) {
+		return false, errors.New(string(kind) + " is version " + strconv.Itoa(version) + ", which is newer than version " + strconv.Itoa(len(migrations)))
+	}
+
+	migrated := false
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](document); err != nil {
+			return false, errors.New("migrating " + string(kind) + " to version " + strconv.Itoa(version+1) + " failed: " + err.Error())
+		}
+
+		document["SchemaVersion"] = version + 1
+		migrated = true
+	}
+
+	for field, nestedKind := range nestedDocuments[kind] {
+		nested, ok := document[field].(map[string]any)
+		if !ok {
+			continue
+		}
+
+		nestedMigrated, err := migrateDocument(nestedKind, nested)
+		if err != nil {
+			return false, err
+		}
+
+		migrated = migrated || nestedMigrated
+	}
+
+	return migrated, nil
+}
+
+// schemaVersion returns the document's version, which is 0 for documents from before versions were added
+func schemaVersion(document map[string]any) (int, error) {
+	value, exists := document["SchemaVersion"]
+	if !exists {
+		return 0, nil
+	}
+
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, errors.New("schema version is not a number")
+	}
+
+	version, err := strconv.Atoi(number.String())
+	if err != nil || version < 0 {
+		return 0, errors.New("schema version " + number.String() + " is not valid")
+	}
+
+	return version, nil
+}
+
+// versionedDocument is implemented by the structs that are stored with a schema version
+type versionedDocument interface {
+	documentKind() DocumentKind
+}
+
+func (player Player) documentKind() DocumentKind {
+	return PlayerDocument
+}
+
+func (lobby Lobby) documentKind() DocumentKind {
+	return LobbyDocument
+}
+
+// upgradeDocument migrates the JSON if T is stored with a schema version, so that documents are upgraded lazily as
+// they are read. They are only saved at the current version once they are next written
+func upgradeDocument[T any](valueJson []byte) ([]byte, error) {
+	var value T
+	versioned, ok := any(value).(versionedDocument)
+	if !ok {
+		return valueJson, nil
+	}
+
+	migratedJson, _, err := MigrateDocument(versioned.documentKind(), valueJson)
+	return migratedJson, err
+}
+
+// playerAtSchemaVersion marks the player as being the current version, which every player written by this server is
+func playerAtSchemaVersion(player Player) Player {
+	player.SchemaVersion = CurrentSchemaVersion(PlayerDocument)
+	return player
+}
+
+// lobbyAtSchemaVersion marks the lobby and its game as being the current version. The game is copied, so that the
+// caller's game isn't changed
+func lobbyAtSchemaVersion(lobby Lobby) Lobby {
+	lobby.SchemaVersion = CurrentSchemaVersion(LobbyDocument)
+
+	if lobby.Game != nil {
+		game := *lobby.Game
+		game.SchemaVersion = CurrentSchemaVersion(GameDocument)
+		lobby.Game = &game
+	}
+
+	return lobby
+}
+
+// How many keys are asked for at a time while looking for documents to migrate
+const migrationScanCount = 500
+
+// MigrationResult counts the documents of a kind that were looked at by a bulk migration
+type MigrationResult struct {
+	Scanned  int
+	Migrated int
+	Failed   int
+}
+
+// MigrateRedisDocuments upgrades every document of the kind stored in Redis to the current version. Each document is
+// migrated in its own transaction, so documents that change while being migrated are migrated again rather than
+// overwritten. Nothing is written back when dryRun is set
+func MigrateRedisDocuments(ctx context.Context, rdb redis.UniversalClient, kind DocumentKind, dryRun bool, onError func(key string, err error)) (MigrationResult, error) {
+	var result MigrationResult
+
+	// Under Cluster every primary only scans its own keys, and each player and lobby is in its own slot, so every
+	// primary is scanned
+	var mutex sync.Mutex
+	pattern := withHashTag(string(kind)+":*", string(kind)+":*")
+	err := forEachPrimary(ctx, rdb, func(ctx context.Context, client *redis.Client) error {
+		iterator := client.ScanType(ctx, 0, pattern, migrationScanCount, "ReJSON-RL").Iterator()
+		for iterator.Next(ctx) {
+			key := iterator.Val()
+
+			// Keys such as player:<id>:ratings belong to the document, but aren't it
+			if strings.Count(withoutHashTag(key), ":") != 1 {
+				continue
+			}
+
+			migrated, err := migrateRedisDocument(ctx, rdb, kind, key, dryRun)
+
+			mutex.Lock()
+			result.Scanned++
+			if err != nil {
+				result.Failed++
+				onError(key, err)
+			} else if migrated {
+				result.Migrated++
+			}
+			mutex.Unlock()
+		}
+
+		return iterator.Err()
+	})
+
+	return result, err
+}
+
+func migrateRedisDocument(ctx context.Context, rdb redis.UniversalClient, kind DocumentKind, key string, dryRun bool) (bool, error) {
+	var migrated bool
+
+	err := WatchWithRetries(ctx, func() error {
+		return rdb.Watch(ctx, func(tx *redis.Tx) error {
+			documentJson, err := tx.JSONGet(ctx, key).Result()
+			if errors.Is(err, redis.Nil) || len(documentJson) == 0 {
+				// The document was deleted since it was found
+				migrated = false
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			migratedJson, changed, err := MigrateDocument(kind, []byte(documentJson))
+			migrated = changed
+			if err != nil || !changed || dryRun {
+				return err
+			}
+
+			// Guests and lobbies keep the time they have left
+			ttl, err := tx.PTTL(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.JSONSet(ctx, key, "$", string(migratedJson))
+				if ttl > 0 {
+					pipe.PExpire(ctx, key, ttl)
+				}
+
+				return nil
+			})
+
+			return err
+		}, key)
+	}, storeTxAttempts)
+
+	return migrated, err
+}
+
+// RunMigrateDocumentsCommand upgrades every player and lobby in Redis to the current version and prints how many
+// were migrated. Documents are also upgraded as they are read, so this only has to be run before a migration that
+// can't be done lazily, such as one that changes how documents are found
+func RunMigrateDocumentsCommand(rdb redis.UniversalClient, args []string) {
+	flags := flag.NewFlagSet("migrate-documents", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "count the documents that would be migrated without writing them")
+	flags.Parse(args)
+
+	fmt.Printf("%-8s %8s %8s %8s %8s\n", "kind", "version", "scanned", "migrated", "failed")
+
+	for _, kind := range []DocumentKind{PlayerDocument, LobbyDocument} {
+		result, err := MigrateRedisDocuments(context.Background(), rdb, kind, *dryRun, func(key string, err error) {
+			fmt.Println("Failed to migrate " + key + ": " + err.Error())
+		})
+		if err != nil {
+			log.Fatal("Migrating " + string(kind) + " documents failed: " + err.Error())
+		}
+
+		fmt.Printf("%-8s %8d %8d %8d %8d\n", kind, CurrentSchemaVersion(kind), result.Scanned, result.Migrated, result.Failed)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMigratePlayerV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		document map[string]any
+		expected map[string]any
+	}{
+		{
+			name:     "no profile",
+			document: map[string]any{"Id": "alice"},
+			expected: map[string]any{"Id": "alice", "Profile": map[string]any{"Avatar": string(DefaultAvatar)}},
+		},
+		{
+			name:     "profile without an avatar",
+			document: map[string]any{"Id": "alice", "Profile": map[string]any{"DisplayName": "Alice"}},
+			expected: map[string]any{"Id": "alice", "Profile": map[string]any{"DisplayName": "Alice", "Avatar": string(DefaultAvatar)}},
+		},
+		{
+			name:     "profile with an avatar",
+			document: map[string]any{"Id": "alice", "Profile": map[string]any{"Avatar": OwlAvatar}},
+			expected: map[string]any{"Id": "alice", "Profile": map[string]any{"Avatar": OwlAvatar}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := migratePlayerV1(test.document); err != nil {
+				t.Fatal("Migration failed: " + err.Error())
+			}
+
+			if !reflect.DeepEqual(test.document, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, test.document)
+			}
+		})
+	}
+}
+
+func TestMigrateLobbyV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		document map[string]any
+		expected map[string]any
+	}{
+		{
+			name:     "no game",
+			document: map[string]any{"LobbyId": "abc"},
+			expected: map[string]any{"LobbyId": "abc"},
+		},
+		{
+			name:     "game without an ID",
+			document: map[string]any{"LobbyId": "abc", "Game": map[string]any{"State": "SETUP"}},
+			expected: map[string]any{"LobbyId": "abc", "Game": map[string]any{"State": "SETUP", "Id": legacyGameId("abc")}},
+		},
+		{
+			name:     "game with an ID",
+			document: map[string]any{"LobbyId": "abc", "Game": map[string]any{"Id": "game"}},
+			expected: map[string]any{"LobbyId": "abc", "Game": map[string]any{"Id": "game"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := migrateLobbyV1(test.document); err != nil {
+				t.Fatal("Migration failed: " + err.Error())
+			}
+
+			if !reflect.DeepEqual(test.document, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, test.document)
+			}
+		})
+	}
+}
+
+func TestMigrateGameV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		document map[string]any
+		expected map[string]any
+	}{
+		{
+			name:     "nothing set",
+			document: map[string]any{"Id": "game"},
+			expected: map[string]any{"Id": "game", "Version": 0, "Moves": []any{}, "Variant": string(Classic), "TimeControl": string(Unlimited)},
+		},
+		{
+			name: "everything set",
+			document: map[string]any{"Id": "game", "Version": json.Number("3"), "Moves": []any{map[string]any{"To": json.Number("4")}},
+				"Variant": string(Classic), "TimeControl": string(Unlimited)},
+			expected: map[string]any{"Id": "game", "Version": json.Number("3"), "Moves": []any{map[string]any{"To": json.Number("4")}},
+				"Variant": string(Classic), "TimeControl": string(Unlimited)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := migrateGameV1(test.document); err != nil {
+				t.Fatal("Migration failed: " + err.Error())
+			}
+
+			if !reflect.DeepEqual(test.document, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, test.document)
+			}
+		})
+	}
+
+	t.Run("no ID", func(t *testing.T) {
+		document := map[string]any{}
+		if err := migrateGameV1(document); err != nil {
+			t.Fatal("Migration failed: " + err.Error())
+		}
+
+		if id, _ := document["Id"].(string); len(id) == 0 {
+			t.Fatalf("Expected the game to be given an ID, got %v", document)
+		}
+	})
+}
+
+func TestMigrateDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     DocumentKind
+		document string
+		// The document once migrated, or empty if it should be left as it is
+		expected string
+		failed   bool
+	}{
+		{
+			name:     "player from before versions",
+			kind:     PlayerDocument,
+			document: `{"Id":"alice"}`,
+			expected: `{"Id":"alice","Profile":{"Avatar":"` + string(DefaultAvatar) + `"},"SchemaVersion":1}`,
+		},
+		{
+			name:     "current player",
+			kind:     PlayerDocument,
+			document: `{"Id":"alice","Profile":{},"SchemaVersion":1}`,
+		},
+		{
+			name:     "player from a newer version",
+			kind:     PlayerDocument,
+			document: `{"Id":"alice","SchemaVersion":2}`,
+			failed:   true,
+		},
+		{
+			name:     "invalid version",
+			kind:     PlayerDocument,
+			document: `{"Id":"alice","SchemaVersion":"one"}`,
+			failed:   true,
+		},
+		{
+			name:     "lobby from before versions",
+			kind:     LobbyDocument,
+			document: `{"LobbyId":"abc","Game":{"State":"SETUP"}}`,
+			expected: `{"LobbyId":"abc","SchemaVersion":1,"Game":{"Id":"` + legacyGameId("abc") + `","State":"SETUP","Version":0,` +
+				`"Moves":[],"Variant":"` + string(Classic) + `","TimeControl":"` + string(Unlimited) + `","SchemaVersion":1}}`,
+		},
+		{
+			name:     "current lobby with a game from before versions",
+			kind:     LobbyDocument,
+			document: `{"LobbyId":"abc","SchemaVersion":1,"Game":{"Id":"game","Version":2,"Moves":[],"Variant":"CLASSIC","TimeControl":"UNLIMITED"}}`,
+			expected: `{"LobbyId":"abc","SchemaVersion":1,"Game":{"Id":"game","Version":2,"Moves":[],"Variant":"CLASSIC","TimeControl":"UNLIMITED","SchemaVersion":1}}`,
+		},
+		{
+			name:     "current lobby and game",
+			kind:     LobbyDocument,
+			document: `{"LobbyId":"abc","SchemaVersion":1,"Game":{"Id":"game","SchemaVersion":1}}`,
+		},
+		{
+			name:     "lobby with a game from a newer version",
+			kind:     LobbyDocument,
+			document: `{"LobbyId":"abc","SchemaVersion":1,"Game":{"Id":"game","SchemaVersion":2}}`,
+			failed:   true,
+		},
+		{
+			name:     "numbers kept as they were written",
+			kind:     LobbyDocument,
+			document: `{"LobbyId":"abc","Game":{"Id":"game","Version":9007199254740993,"Clock":0.10000000000000001}}`,
+			expected: `{"LobbyId":"abc","SchemaVersion":1,"Game":{"Id":"game","Version":9007199254740993,"Clock":0.10000000000000001,` +
+				`"Moves":[],"Variant":"` + string(Classic) + `","TimeControl":"` + string(Unlimited) + `","SchemaVersion":1}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migratedJson, migrated, err := MigrateDocument(test.kind, []byte(test.document))
+			if test.failed {
+				if err == nil {
+					t.Fatalf("Expected migrating to fail, got %s", migratedJson)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal("Migration failed: " + err.Error())
+			}
+
+			if len(test.expected) == 0 {
+				if migrated || string(migratedJson) != test.document {
+					t.Fatalf("Expected the document to be left as it is, got %s", migratedJson)
+				}
+
+				return
+			}
+
+			if !migrated {
+				t.Fatal("Expected the document to be migrated")
+			}
+
+			assertSameJson(t, test.expected, string(migratedJson))
+		})
+	}
+}
+
+// assertSameJson fails the test unless both documents hold the same values, keeping numbers as they were written
+func assertSameJson(t *testing.T, expected string, actual string) {
+	t.Helper()
+
+	decode := func(document string) any {
+		decoder := json.NewDecoder(strings.NewReader(document))
+		decoder.UseNumber()
+
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			t.Fatal("Failed to decode " + document + ": " + err.Error())
+		}
+
+		return value
+	}
+
+	if !reflect.DeepEqual(decode(expected), decode(actual)) {
+		t.Fatalf("Expected %s, got %s", expected, actual)
+	}
+}
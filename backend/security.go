@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Readable by the frontend, which sends it back in the CSRF header to prove the request came from a page on an
+	// allowed origin
+	CSRFCookieName = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+type SecurityConfig struct {
+	// Origins, such as "https://rota.example.com", that may use the API and connect to the WebSocket server in
+	// addition to the server's own origin. "*" allows every origin
+	AllowedOrigins []string
+	// How long browsers may cache the result of a CORS preflight request
+	PreflightMaxAge time.Duration
+	// The reverse proxies in front of the server, such as the frontend's Caddy server, whose X-Forwarded-For and
+	// X-Real-IP headers are trusted to say who the request came from
+	TrustedProxies []netip.Prefix
+}
+
+// LoadSecurityConfig reads the security configuration from the environment
+func LoadSecurityConfig(production bool) (SecurityConfig, error) {
+	config := SecurityConfig{
+		PreflightMaxAge: 10 * time.Minute,
+	}
+
+	if !production {
+		// The Vite development server
+		config.AllowedOrigins = []string{"http://localhost:5173"}
+	}
+
+	if origins, exists := os.LookupEnv("ALLOWED_ORIGINS"); exists {
+		config.AllowedOrigins = nil
+
+		for _, origin := range strings.Split(origins, ",") {
+			origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+			if len(origin) == 0 {
+				continue
+			}
+
+			if origin != "*" {
+				parsed, err := url.Parse(origin)
+				if err != nil || parsed.Scheme == "" || parsed.Host == "" || parsed.Path != "" {
+					return config, errors.New("ALLOWED_ORIGINS must be a comma separated list of origins, such as https://rota.example.com")
+				}
+			}
+
+			config.AllowedOrigins = append(config.AllowedOrigins, origin)
+		}
+	}
+
+	if proxies, exists := os.LookupEnv("TRUSTED_PROXIES"); exists {
+		for _, proxy := range strings.Split(proxies, ",") {
+			proxy = strings.TrimSpace(proxy)
+			if len(proxy) == 0 {
+				continue
+			}
+
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				address, addressErr := netip.ParseAddr(proxy)
+				if addressErr != nil {
+					return config, errors.New("TRUSTED_PROXIES must be a comma separated list of IP addresses or CIDR ranges, such as 10.0.0.0/8")
+				}
+
+				prefix = netip.PrefixFrom(address, address.BitLen())
+			}
+
+			config.TrustedProxies = append(config.TrustedProxies, prefix.Masked())
+		}
+	}
+
+	return config, nil
+}
+
+func (config SecurityConfig) isTrustedProxy(address netip.Addr) bool {
+	address = address.Unmap()
+	for _, proxy := range config.TrustedProxies {
+		if proxy.Contains(address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the IP address the request was made from. Requests from a trusted proxy are from the address it
+// says it forwarded them for, which is the last one in X-Forwarded-For that isn't another trusted proxy, since
+// anything before that was sent by the client and can't be trusted
+func (config SecurityConfig) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !config.isTrustedProxy(remote) {
+		return host
+	}
+
+	var forwardedFor []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwardedFor = append(forwardedFor, strings.Split(header, ",")...)
+	}
+
+	if len(forwardedFor) == 0 {
+		if realIp, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIp.Unmap().String()
+		}
+
+		return host
+	}
+
+	client := remote
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		address, err := netip.ParseAddr(strings.TrimSpace(forwardedFor[i]))
+		if err != nil {
+			break
+		}
+
+		client = address.Unmap()
+		if !config.isTrustedProxy(client) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// ClientIP returns the IP address the request was made from, as worked out by the request's security config
+func ClientIP(r *http.Request) string {
+	return GetSecurityFromContext(r.Context()).ClientIP(r)
+}
+
+// IsOriginAllowed returns whether a request with the given Origin header may use the server. Requests without an
+// Origin header do not come from a browser page, and requests from the server's own origin are always allowed
+func (config SecurityConfig) IsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func WithCORSMiddleware(config SecurityConfig) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			isPreflight := r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0
+
+			w.Header().Add("Vary", "Origin")
+
+			if !config.IsOriginAllowed(r) {
+				// Browsers would refuse to read the response anyway, but the request must not be allowed to change anything
+				if isPreflight || !isSafeMethod(r.Method) {
+					WriteError(w, OriginNotAllowed, "Origin not allowed")
+					return
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if len(origin) > 0 {
+				// Credentials are allowed, so the origin is echoed back rather than using a wildcard
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				w.Header().Set("Access-Control-Expose-Headers", "ETag, Location, Retry-After, "+IdempotentReplayedHeader)
+			}
+
+			if isPreflight {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match, If-None-Match, "+IdempotencyKeyHeader+", "+CSRFHeaderName)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.PreflightMaxAge.Seconds())))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithCSRFMiddleware rejects requests that change state unless they include the session's CSRF token in the CSRF
+// header. Other sites can make the browser send the session cookie, but they can't read the CSRF cookie to copy it
+func WithCSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sessions := GetSessionsFromContext(r.Context())
+		session := GetSessionFromContext(r.Context())
+		logger := GetLoggerFromContext(r.Context())
+
+		if !sessions.VerifyCSRFToken(session.SessionId, r.Header.Get(CSRFHeaderName)) {
+			logger.Debug("Rejected request with a missing or invalid CSRF token")
+
+			// Sessions started before CSRF tokens were issued won't have the cookie, so give them one to retry with
+			sessions.SetCSRFCookie(w, *session)
+			WriteError(w, InvalidCSRFToken, "Missing or invalid CSRF token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRFToken returns the CSRF token for a session. It is derived from the session, so it doesn't need to be stored
+func (manager *SessionManager) CSRFToken(sessionId string) string {
+	return sign(manager.config.Secrets[0], "csrf:"+sessionId)
+}
+
+func (manager *SessionManager) VerifyCSRFToken(sessionId string, token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+
+	for _, secret := range manager.config.Secrets {
+		if hmac.Equal([]byte(token), []byte(sign(secret, "csrf:"+sessionId))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (manager *SessionManager) SetCSRFCookie(w http.ResponseWriter, session Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    manager.CSRFToken(session.SessionId),
+		Domain:   manager.config.CookieDomain,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		Secure:   manager.config.CookieSecure,
+		SameSite: manager.config.CookieSameSite,
+	})
+}
+
+func WithSecurityMiddleware(config SecurityConfig) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "security", config))
+			next.ServeHTTP(w, modifiedRequest)
+		})
+	}
+}
+
+func GetSecurityFromContext(ctx context.Context) SecurityConfig {
+	config, ok := ctx.Value("security").(SecurityConfig)
+	if !ok {
+		panic("Security config in context is not present. Something has gone wrong!")
+	}
+
+	return config
+}
@@ -0,0 +1,845 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSessionToken = errors.New("invalid session token")
+	ErrSessionExpired      = errors.New("session has expired")
+	ErrSessionRevoked      = errors.New("session has been revoked")
+)
+
+// IsSessionError returns whether the error was caused by the session itself, rather than by a failure to look it up
+func IsSessionError(err error) bool {
+	return errors.Is(err, ErrInvalidSessionToken) || errors.Is(err, ErrSessionExpired) || errors.Is(err, ErrSessionRevoked)
+}
+
+type SessionConfig struct {
+	// Tokens are signed with the first secret and verified against all of them, so a new secret can be
+	// added in front of the old one to rotate it without logging everyone out
+	Secrets [][]byte
+	// How long a session lasts without being used
+	Lifetime time.Duration
+	// How old a token can get before it is replaced with a new one
+	RotateAfter time.Duration
+
+	CookieName     string
+	CookieDomain   string
+	CookiePath     string
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+}
+
+// LoadSessionConfig reads the session configuration from the environment
+func LoadSessionConfig(production bool) (SessionConfig, error) {
+	config := SessionConfig{
+		Lifetime:       30 * 24 * time.Hour,
+		RotateAfter:    24 * time.Hour,
+		CookieName:     "session",
+		CookiePath:     "/",
+		CookieSecure:   production,
+		CookieSameSite: http.SameSiteLaxMode,
+	}
+
+	if secrets, exists := os.LookupEnv("SESSION_SECRETS"); exists {
+		for _, secret := range strings.Split(secrets, ",") {
+			if len(strings.TrimSpace(secret)) < 32 {
+				return config, errors.New("every session secret must be at least 32 characters long")
+			}
+
+			config.Secrets = append(config.Secrets, []byte(strings.TrimSpace(secret)))
+		}
+	} else if production {
+		return config, errors.New("SESSION_SECRETS must be set in production")
+	} else {
+		// Sessions will not survive a restart of the development server
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		config.Secrets = [][]byte{secret}
+	}
+
+	if lifetime, exists := os.LookupEnv("SESSION_LIFETIME"); exists {
+		parsed, err := time.ParseDuration(lifetime)
+		if err != nil || parsed <= 0 {
+			return config, errors.New("SESSION_LIFETIME must be a positive duration, such as 720h")
+		}
+
+		config.Lifetime = parsed
+	}
+
+	if rotateAfter, exists := os.LookupEnv("SESSION_ROTATE_AFTER"); exists {
+		parsed, err := time.ParseDuration(rotateAfter)
+		if err != nil || parsed <= 0 {
+			return config, errors.New("SESSION_ROTATE_AFTER must be a positive duration, such as 24h")
+		}
+
+		config.RotateAfter = parsed
+	}
+
+	if name, exists := os.LookupEnv("SESSION_COOKIE_NAME"); exists {
+		config.CookieName = name
+	}
+
+	if domain, exists := os.LookupEnv("SESSION_COOKIE_DOMAIN"); exists {
+		config.CookieDomain = domain
+	}
+
+	if path, exists := os.LookupEnv("SESSION_COOKIE_PATH"); exists {
+		config.CookiePath = path
+	}
+
+	if secure, exists := os.LookupEnv("SESSION_COOKIE_SECURE"); exists {
+		config.CookieSecure = strings.ToLower(secure) == "true"
+	}
+
+	if sameSite, exists := os.LookupEnv("SESSION_COOKIE_SAMESITE"); exists {
+		switch strings.ToLower(sameSite) {
+		case "strict":
+			config.CookieSameSite = http.SameSiteStrictMode
+		case "lax":
+			config.CookieSameSite = http.SameSiteLaxMode
+		case "none":
+			config.CookieSameSite = http.SameSiteNoneMode
+		default:
+			return config, errors.New("SESSION_COOKIE_SAMESITE must be one of 'strict', 'lax' or 'none'")
+		}
+	}
+
+	if config.CookieSameSite == http.SameSiteNoneMode && !config.CookieSecure {
+		return config, errors.New("SESSION_COOKIE_SAMESITE=none requires SESSION_COOKIE_SECURE=true")
+	}
+
+	return config, nil
+}
+
+// How often the last seen time of a session is updated, so that not every request writes to the session
+const lastSeenInterval = time.Minute
+
+// Published to a session's channel when it is revoked, so that its WebSockets are closed
+const sessionRevokedMessage = "REVOKED"
+
+type Session struct {
+	SessionId string
+	PlayerId  string
+	// Incremented every time the token is rotated, so that older tokens stop working
+	Generation int
+	CreatedAt  time.Time
+	IssuedAt   time.Time
+	ExpiresAt  time.Time
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	// The number of WebSockets currently connected with the session
+	Sockets int
+}
+
+type sessionClaims struct {
+	Sid string
+	Pid string
+	Gen int
+	Exp int64
+}
+
+// SessionStore keeps players' sessions, each of which expires at its ExpiresAt
+type SessionStore interface {
+	// CreateSession saves the new session and lists it against its player
+	CreateSession(ctx context.Context, session Session) error
+	// GetSession returns the session with the given ID, or nil if it has expired or been revoked
+	GetSession(ctx context.Context, sessionId string) (*Session, error)
+	// RotateSession saves the session's new generation, issue time and expiry
+	RotateSession(ctx context.Context, session Session) error
+	// TouchSession saves when the session was last seen and on which device, unless it has been revoked in the meantime
+	TouchSession(ctx context.Context, session Session) error
+	// DeleteSession revokes one of the player's sessions, telling everyone watching it
+	DeleteSession(ctx context.Context, playerId string, sessionId string) error
+	// ListSessions returns the player's sessions that have neither expired nor been revoked, in no particular order
+	ListSessions(ctx context.Context, playerId string) ([]Session, error)
+	// AddSessionSockets changes the number of WebSockets connected with the session by the given amount
+	AddSessionSockets(ctx context.Context, sessionId string, change int) error
+	// WatchSession returns a channel that is closed if the session is revoked, until stop is called
+	WatchSession(ctx context.Context, sessionId string) (revoked <-chan struct{}, stop func())
+}
+
+type SessionManager struct {
+	config SessionConfig
+	store  SessionStore
+}
+
+func NewSessionManager(config SessionConfig, store SessionStore) *SessionManager {
+	return &SessionManager{
+		config: config,
+		store:  store,
+	}
+}
+
+func sessionKey(sessionId string) string {
+	return "session:" + sessionId
+}
+
+func playerSessionsKey(playerId string) string {
+	return "player:" + playerId + ":sessions"
+}
+
+func (store *RedisStore) CreateSession(ctx context.Context, session Session) error {
+	// The session is listed against the player before it exists, since under Cluster the two keys can't be written in
+	// one transaction. Listed sessions that don't exist are dropped from the list once it is next read
+	err := store.rdb.SAdd(ctx, playerSessionsKey(session.PlayerId), session.SessionId).Err()
+	if err != nil {
+		return err
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		err := pipe.JSONSet(ctx, sessionKey(session.SessionId), "$", session).Err()
+		if err != nil {
+			return err
+		}
+
+		return pipe.ExpireAt(ctx, sessionKey(session.SessionId), session.ExpiresAt).Err()
+	})
+
+	return err
+}
+
+func (store *RedisStore) GetSession(ctx context.Context, sessionId string) (*Session, error) {
+	return getRedisJson[Session](ctx, store.rdb, sessionKey(sessionId))
+}
+
+func (store *RedisStore) RotateSession(ctx context.Context, session Session) error {
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		err := pipe.JSONSet(ctx, sessionKey(session.SessionId), "$.Generation", session.Generation).Err()
+		if err != nil {
+			return err
+		}
+
+		err = pipe.JSONSet(ctx, sessionKey(session.SessionId), "$.IssuedAt", StrAsJson(session.IssuedAt.Format(time.RFC3339Nano))).Err()
+		if err != nil {
+			return err
+		}
+
+		err = pipe.JSONSet(ctx, sessionKey(session.SessionId), "$.ExpiresAt", StrAsJson(session.ExpiresAt.Format(time.RFC3339Nano))).Err()
+		if err != nil {
+			return err
+		}
+
+		return pipe.ExpireAt(ctx, sessionKey(session.SessionId), session.ExpiresAt).Err()
+	})
+
+	return err
+}
+
+func (store *RedisStore) TouchSession(ctx context.Context, session Session) error {
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		// XX stops a session that was revoked in the meantime from being recreated
+		err := pipe.JSONSetMode(ctx, sessionKey(session.SessionId), "$.LastSeenAt", StrAsJson(session.LastSeenAt.Format(time.RFC3339Nano)), "XX").Err()
+		if err != nil {
+			return err
+		}
+
+		err = pipe.JSONSetMode(ctx, sessionKey(session.SessionId), "$.UserAgent", StrAsJson(session.UserAgent), "XX").Err()
+		if err != nil {
+			return err
+		}
+
+		return pipe.JSONSetMode(ctx, sessionKey(session.SessionId), "$.IP", StrAsJson(session.IP), "XX").Err()
+	})
+
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+
+	return err
+}
+
+func (store *RedisStore) DeleteSession(ctx context.Context, playerId string, sessionId string) error {
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		err := pipe.Del(ctx, sessionKey(sessionId)).Err()
+		if err != nil {
+			return err
+		}
+
+		return pipe.Publish(ctx, sessionKey(sessionId), sessionRevokedMessage).Err()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Under Cluster the player's list of sessions can be in a different slot to the session. If this fails, the
+	// revoked session is dropped from the list once it is next read
+	return store.rdb.SRem(ctx, playerSessionsKey(playerId), sessionId).Err()
+}
+
+func (store *RedisStore) ListSessions(ctx context.Context, playerId string) ([]Session, error) {
+	sessionIds, err := store.rdb.SMembers(ctx, playerSessionsKey(playerId)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, 0, len(sessionIds))
+	if len(sessionIds) == 0 {
+		return sessions, nil
+	}
+
+	keys := make([]string, len(sessionIds))
+	for i, sessionId := range sessionIds {
+		keys[i] = sessionKey(sessionId)
+	}
+
+	results, err := jsonMGet(ctx, store.rdb, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []any
+	for i, result := range results {
+		sessionJson, ok := result.(string)
+		if !ok {
+			// The session has expired, so it no longer needs to be tracked against the player
+			expired = append(expired, sessionIds[i])
+			continue
+		}
+
+		var session []Session
+		if err := json.Unmarshal([]byte(sessionJson), &session); err != nil || len(session) == 0 {
+			continue
+		}
+
+		sessions = append(sessions, session[0])
+	}
+
+	if len(expired) > 0 {
+		store.rdb.SRem(ctx, playerSessionsKey(playerId), expired...)
+	}
+
+	return sessions, nil
+}
+
+func (store *RedisStore) AddSessionSockets(ctx context.Context, sessionId string, change int) error {
+	return store.rdb.JSONNumIncrBy(ctx, sessionKey(sessionId), "$.Sockets", float64(change)).Err()
+}
+
+func (store *RedisStore) WatchSession(ctx context.Context, sessionId string) (<-chan struct{}, func()) {
+	pubsub := store.rdb.Subscribe(ctx, sessionKey(sessionId))
+	messages := pubsub.Channel()
+
+	revoked := make(chan struct{})
+	go func() {
+		// Closing the subscription closes its channel without a message
+		if _, ok := <-messages; ok {
+			close(revoked)
+		}
+	}()
+
+	return revoked, func() {
+		pubsub.Close()
+	}
+}
+
+// getSession expects the store to already be locked
+func (store *MemoryStore) getSession(sessionId string) (*Session, error) {
+	session, err := getMemoryJson[Session](store.sessions, sessionId)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	if !time.Now().Before(session.ExpiresAt) {
+		delete(store.sessions, sessionId)
+		return nil, nil
+	}
+
+	return session, nil
+}
+
+// setSession expects the store to already be locked
+func (store *MemoryStore) setSession(session Session) error {
+	sessionJson, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	store.sessions[session.SessionId] = sessionJson
+	return nil
+}
+
+func (store *MemoryStore) CreateSession(ctx context.Context, session Session) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.playerSessions[session.PlayerId] == nil {
+		store.playerSessions[session.PlayerId] = map[string]struct{}{}
+	}
+	store.playerSessions[session.PlayerId][session.SessionId] = struct{}{}
+
+	return store.setSession(session)
+}
+
+func (store *MemoryStore) GetSession(ctx context.Context, sessionId string) (*Session, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.getSession(sessionId)
+}
+
+// modifySession runs the function on the session and saves it, unless it has expired or been revoked
+func (store *MemoryStore) modifySession(sessionId string, modify func(session *Session)) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stored, err := store.getSession(sessionId)
+	if err != nil || stored == nil {
+		return err
+	}
+
+	modify(stored)
+	return store.setSession(*stored)
+}
+
+func (store *MemoryStore) RotateSession(ctx context.Context, session Session) error {
+	return store.modifySession(session.SessionId, func(stored *Session) {
+		stored.Generation = session.Generation
+		stored.IssuedAt = session.IssuedAt
+		stored.ExpiresAt = session.ExpiresAt
+	})
+}
+
+func (store *MemoryStore) TouchSession(ctx context.Context, session Session) error {
+	return store.modifySession(session.SessionId, func(stored *Session) {
+		stored.LastSeenAt = session.LastSeenAt
+		stored.UserAgent = session.UserAgent
+		stored.IP = session.IP
+	})
+}
+
+func (store *MemoryStore) DeleteSession(ctx context.Context, playerId string, sessionId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.sessions, sessionId)
+	delete(store.playerSessions[playerId], sessionId)
+
+	for revoked := range store.sessionWatchers[sessionId] {
+		close(revoked)
+	}
+	delete(store.sessionWatchers, sessionId)
+
+	return nil
+}
+
+func (store *MemoryStore) ListSessions(ctx context.Context, playerId string) ([]Session, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	sessions := []Session{}
+	for sessionId := range store.playerSessions[playerId] {
+		session, err := store.getSession(sessionId)
+		if err != nil {
+			return nil, err
+		}
+
+		if session == nil {
+			delete(store.playerSessions[playerId], sessionId)
+			continue
+		}
+
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, nil
+}
+
+func (store *MemoryStore) AddSessionSockets(ctx context.Context, sessionId string, change int) error {
+	return store.modifySession(sessionId, func(session *Session) {
+		session.Sockets += change
+	})
+}
+
+func (store *MemoryStore) WatchSession(ctx context.Context, sessionId string) (<-chan struct{}, func()) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	revoked := make(chan struct{})
+	if store.sessionWatchers[sessionId] == nil {
+		store.sessionWatchers[sessionId] = map[chan struct{}]struct{}{}
+	}
+	store.sessionWatchers[sessionId][revoked] = struct{}{}
+
+	return revoked, func() {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+
+		// Once the session has been revoked, the channel has already been closed and forgotten
+		delete(store.sessionWatchers[sessionId], revoked)
+	}
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (manager *SessionManager) token(session Session) string {
+	claims, _ := json.Marshal(sessionClaims{
+		Sid: session.SessionId,
+		Pid: session.PlayerId,
+		Gen: session.Generation,
+		Exp: session.ExpiresAt.Unix(),
+	})
+
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + sign(manager.config.Secrets[0], payload)
+}
+
+// parseToken checks the token's signature and expiry without looking up the session
+func (manager *SessionManager) parseToken(token string) (sessionClaims, error) {
+	var claims sessionClaims
+
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return claims, ErrInvalidSessionToken
+	}
+
+	isSignatureValid := false
+	for _, secret := range manager.config.Secrets {
+		if hmac.Equal([]byte(signature), []byte(sign(secret, payload))) {
+			isSignatureValid = true
+		}
+	}
+
+	if !isSignatureValid {
+		return claims, ErrInvalidSessionToken
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, ErrInvalidSessionToken
+	}
+
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return claims, ErrInvalidSessionToken
+	}
+
+	if time.Now().Unix() >= claims.Exp {
+		return claims, ErrSessionExpired
+	}
+
+	return claims, nil
+}
+
+// Create starts a new session for the player on the given device and returns its token
+func (manager *SessionManager) Create(ctx context.Context, playerId string, userAgent string, ip string) (Session, string, error) {
+	now := time.Now()
+	session := Session{
+		SessionId:  uuid.NewString(),
+		PlayerId:   playerId,
+		CreatedAt:  now,
+		IssuedAt:   now,
+		ExpiresAt:  now.Add(manager.config.Lifetime),
+		UserAgent:  userAgent,
+		IP:         ip,
+		LastSeenAt: now,
+	}
+
+	if err := manager.store.CreateSession(ctx, session); err != nil {
+		return session, "", err
+	}
+
+	return session, manager.token(session), nil
+}
+
+// Validate returns the session for a token, as long as it is correctly signed, has not expired and has not been revoked
+func (manager *SessionManager) Validate(ctx context.Context, token string) (*Session, error) {
+	claims, err := manager.parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := manager.store.GetSession(ctx, claims.Sid)
+	if err != nil {
+		return nil, err
+	}
+
+	if session == nil {
+		return nil, ErrSessionRevoked
+	}
+
+	// Requests that were already in flight when the token was rotated may still use the previous token
+	if session.PlayerId != claims.Pid || claims.Gen < session.Generation-1 {
+		return nil, ErrSessionRevoked
+	}
+
+	return session, nil
+}
+
+// Rotate issues a new token for the session, extending its expiry and invalidating tokens older than the current one
+func (manager *SessionManager) Rotate(ctx context.Context, session Session) (Session, string, error) {
+	now := time.Now()
+	session.Generation++
+	session.IssuedAt = now
+	session.ExpiresAt = now.Add(manager.config.Lifetime)
+
+	if err := manager.store.RotateSession(ctx, session); err != nil {
+		return session, "", err
+	}
+
+	return session, manager.token(session), nil
+}
+
+// Touch records that the session has just been used from the given device
+func (manager *SessionManager) Touch(ctx context.Context, session *Session, userAgent string, ip string) error {
+	session.LastSeenAt = time.Now()
+	session.UserAgent = userAgent
+	session.IP = ip
+
+	return manager.store.TouchSession(ctx, *session)
+}
+
+// Revoke ends one of the player's sessions immediately, no matter how many valid tokens for it exist, and closes its
+// WebSockets
+func (manager *SessionManager) Revoke(ctx context.Context, playerId string, sessionId string) error {
+	return manager.store.DeleteSession(ctx, playerId, sessionId)
+}
+
+// RevokeAll ends every one of the player's sessions
+func (manager *SessionManager) RevokeAll(ctx context.Context, playerId string) error {
+	sessions, err := manager.store.ListSessions(ctx, playerId)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		err := manager.Revoke(ctx, playerId, session.SessionId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns the player's active sessions, most recently used first
+func (manager *SessionManager) List(ctx context.Context, playerId string) ([]Session, error) {
+	sessions, err := manager.store.ListSessions(ctx, playerId)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return b.LastSeenAt.Compare(a.LastSeenAt)
+	})
+
+	return sessions, nil
+}
+
+// Connect records that a WebSocket has connected with the session. disconnect must be called once the WebSocket closes
+func (manager *SessionManager) Connect(ctx context.Context, sessionId string) (disconnect func()) {
+	manager.store.AddSessionSockets(ctx, sessionId, 1)
+
+	return func() {
+		// The request's context has already been cancelled by the time the WebSocket closes
+		manager.store.AddSessionSockets(context.Background(), sessionId, -1)
+	}
+}
+
+// Revocations returns the channel that is closed if the session is revoked. stop must be called once it is no longer
+// being listened to
+func (manager *SessionManager) Revocations(ctx context.Context, sessionId string) (revoked <-chan struct{}, stop func()) {
+	return manager.store.WatchSession(ctx, sessionId)
+}
+
+// IsActive returns whether the session still exists, which it doesn't once it has expired or been revoked
+func (manager *SessionManager) IsActive(ctx context.Context, sessionId string) (bool, error) {
+	session, err := manager.store.GetSession(ctx, sessionId)
+	return session != nil, err
+}
+
+// SetCookie sets the session cookie to the token, along with the session's CSRF cookie
+func (manager *SessionManager) SetCookie(w http.ResponseWriter, session Session, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     manager.config.CookieName,
+		Value:    token,
+		Domain:   manager.config.CookieDomain,
+		Path:     manager.config.CookiePath,
+		Expires:  session.ExpiresAt,
+		Secure:   manager.config.CookieSecure,
+		SameSite: manager.config.CookieSameSite,
+		HttpOnly: true,
+	})
+
+	manager.SetCSRFCookie(w, session)
+}
+
+func (manager *SessionManager) ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     manager.config.CookieName,
+		Value:    "",
+		Domain:   manager.config.CookieDomain,
+		Path:     manager.config.CookiePath,
+		MaxAge:   -1,
+		Secure:   manager.config.CookieSecure,
+		SameSite: manager.config.CookieSameSite,
+		HttpOnly: true,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    "",
+		Domain:   manager.config.CookieDomain,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   manager.config.CookieSecure,
+		SameSite: manager.config.CookieSameSite,
+	})
+}
+
+// Authenticate validates the session cookie on the request, rotating the token when it is due.
+// Both the HTTP API and the WebSocket server authenticate players this way
+func (manager *SessionManager) Authenticate(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(manager.config.CookieName)
+	if err != nil {
+		return nil, ErrInvalidSessionToken
+	}
+
+	session, err := manager.Validate(r.Context(), cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(session.IssuedAt) >= manager.config.RotateAfter {
+		rotated, token, err := manager.Rotate(r.Context(), *session)
+		if err != nil {
+			return nil, err
+		}
+
+		manager.SetCookie(w, rotated, token)
+		session = &rotated
+	}
+
+	if time.Since(session.LastSeenAt) >= lastSeenInterval || session.IP != ClientIP(r) {
+		err := manager.Touch(r.Context(), session, r.UserAgent(), ClientIP(r))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+// StartSession creates a new session for the player and sets the session cookie
+func (manager *SessionManager) StartSession(w http.ResponseWriter, r *http.Request, playerId string) (*Session, error) {
+	session, token, err := manager.Create(r.Context(), playerId, r.UserAgent(), ClientIP(r))
+	if err != nil {
+		return nil, err
+	}
+
+	manager.SetCookie(w, session, token)
+	return &session, nil
+}
+
+// SessionSummary describes one of a player's sessions, without anything that could be used to take it over
+type SessionSummary struct {
+	SessionId  string
+	Device     string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Sockets    int
+	// Whether this is the session the request was made with
+	Current bool
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	sessions := GetSessionsFromContext(r.Context())
+	currentSession := GetSessionFromContext(r.Context())
+
+	playerSessions, err := sessions.List(r.Context(), id)
+	if err != nil {
+		logger.Warn("There was an error fetching sessions: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching sessions")
+		return
+	}
+
+	summaries := make([]SessionSummary, len(playerSessions))
+	for i, session := range playerSessions {
+		summaries[i] = SessionSummary{
+			SessionId:  session.SessionId,
+			Device:     session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			Sockets:    session.Sockets,
+			Current:    session.SessionId == currentSession.SessionId,
+		}
+	}
+
+	WriteJson(w, summaries)
+}
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+	sessions := GetSessionsFromContext(r.Context())
+	currentSession := GetSessionFromContext(r.Context())
+
+	sessionId := r.PathValue("sessionId")
+
+	session, err := store.GetSession(r.Context(), sessionId)
+	if err != nil {
+		logger.Warn("There was an error fetching sessions: " + err.Error())
+		WriteError(w, InternalError, "There was an error revoking the session")
+		return
+	}
+
+	if session == nil || session.PlayerId != id {
+		WriteError(w, SessionNotFound, "Session not found")
+		return
+	}
+
+	err = sessions.Revoke(r.Context(), id, sessionId)
+	if err != nil {
+		logger.Warn("There was an error revoking session: " + err.Error())
+		WriteError(w, InternalError, "There was an error revoking the session")
+		return
+	}
+
+	if sessionId == currentSession.SessionId {
+		sessions.ClearCookie(w)
+	}
+
+	logger.Info("Revoked session " + sessionId)
+	w.WriteHeader(http.StatusOK)
+}
+
+func revokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	sessions := GetSessionsFromContext(r.Context())
+
+	err := sessions.RevokeAll(r.Context(), id)
+	if err != nil {
+		logger.Warn("There was an error revoking sessions: " + err.Error())
+		WriteError(w, InternalError, "There was an error logging out everywhere")
+		return
+	}
+
+	logger.Info("Logged out everywhere")
+	sessions.ClearCookie(w)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long in-flight requests, WebSockets and background tasks get to finish once the server starts shutting down.
+// Kept under the 30 seconds most orchestrators wait after SIGTERM before killing the process
+const shutdownTimeout = 25 * time.Second
+
+// How long clients are told to wait before retrying requests that were turned away because the server is restarting.
+// Other servers can take them straight away, so this is only how long to wait if there aren't any
+const restartRetryAfter = 2 * time.Second
+
+// How long a resume token can be used for after the server that issued it shut down
+const resumeTokenLifetime = 5 * time.Minute
+
+// Drain tracks the WebSockets held by the server, so that it can tell them to reconnect elsewhere and wait for them to
+// close when shutting down. Once the server starts draining, it takes no new lobbies or WebSockets
+type Drain struct {
+	mutex       sync.Mutex
+	draining    chan struct{}
+	started     bool
+	connections int
+	// Closed once the server is draining and every WebSocket has closed
+	drained chan struct{}
+}
+
+func NewDrain() *Drain {
+	return &Drain{
+		draining: make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+}
+
+// Start starts draining the server, closing the channel returned by Draining
+func (drain *Drain) Start() {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
+
+	if drain.started {
+		return
+	}
+
+	drain.started = true
+	close(drain.draining)
+
+	if drain.connections == 0 {
+		close(drain.drained)
+	}
+}
+
+// Draining returns a channel that is closed once the server starts draining
+func (drain *Drain) Draining() <-chan struct{} {
+	return drain.draining
+}
+
+func (drain *Drain) IsDraining() bool {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
+
+	return drain.started
+}
+
+// Track counts a WebSocket until done is called once it closes. WebSockets aren't taken once the server is draining,
+// in which case ok is false
+func (drain *Drain) Track() (done func(), ok bool) {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
+
+	if drain.started {
+		return nil, false
+	}
+
+	drain.connections++
+
+	return func() {
+		drain.mutex.Lock()
+		defer drain.mutex.Unlock()
+
+		drain.connections--
+		if drain.started && drain.connections == 0 {
+			close(drain.drained)
+		}
+	}, true
+}
+
+// Wait waits for every WebSocket to close once the server is draining, or for the context to be done
+func (drain *Drain) Wait(ctx context.Context) error {
+	select {
+	case <-drain.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func WithDrainMiddleware(drain *Drain) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "drain", drain))
+			next.ServeHTTP(w, modifiedRequest)
+		})
+	}
+}
+
+func GetDrainFromContext(ctx context.Context) *Drain {
+	drain, ok := ctx.Value("drain").(*Drain)
+	if !ok {
+		panic("Drain in context is not present. Something has gone wrong!")
+	}
+
+	return drain
+}
+
+// writeServerRestarting turns away something the server no longer takes because it is shutting down
+func writeServerRestarting(w http.ResponseWriter) {
+	retryAfterSeconds := int(math.Ceil(restartRetryAfter.Seconds()))
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	WriteErrorDetails(w, ServerRestarting, "The server is restarting, try again shortly", map[string]any{
+		"RetryAfter": retryAfterSeconds,
+	})
+}
+
+// ResumeToken is given to WebSocket clients when the server shuts down, so that they carry on from the same place on
+// whichever server they reconnect to. It isn't a credential, since it only holds what clients can already send, and
+// clients are still authenticated by their session
+type ResumeToken struct {
+	PlayerId    string
+	ClientId    string
+	LastEventId string `json:",omitempty"`
+	ExpiresAt   time.Time
+}
+
+func EncodeResumeToken(token ResumeToken) string {
+	tokenJson, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(tokenJson)
+}
+
+// DecodeResumeToken reads the token, returning false if it can't be read, has expired or has values that wouldn't
+// be accepted if sent on their own
+func DecodeResumeToken(encoded string) (ResumeToken, bool) {
+	var token ResumeToken
+
+	tokenJson, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(tokenJson, &token) != nil {
+		return token, false
+	}
+
+	if time.Now().After(token.ExpiresAt) || !IsValidClientId(token.ClientId) {
+		return token, false
+	}
+
+	if len(token.LastEventId) > 0 && !IsValidStreamId(token.LastEventId) {
+		return token, false
+	}
+
+	return token, true
+}
+
+// BackgroundTasks runs the work the server does outside of requests, such as its schedulers, until it shuts down
+type BackgroundTasks struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	tasks  sync.WaitGroup
+}
+
+func NewBackgroundTasks(ctx context.Context) *BackgroundTasks {
+	ctx, cancel := context.WithCancel(ctx)
+	return &BackgroundTasks{ctx: ctx, cancel: cancel}
+}
+
+// Go runs the task until its context is done, which is when the server shuts down
+func (background *BackgroundTasks) Go(task func(ctx context.Context)) {
+	background.tasks.Add(1)
+	go func() {
+		defer background.tasks.Done()
+		task(background.ctx)
+	}()
+}
+
+// Stop cancels every task, and waits for them to return or for the context to be done
+func (background *BackgroundTasks) Stop(ctx context.Context) error {
+	background.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		background.tasks.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShutDown stops the server taking new lobbies and WebSockets, tells connected players to reconnect elsewhere and
+// waits for requests, WebSockets and then background tasks to finish, giving up once shutdownTimeout runs out
+func ShutDown(server *http.Server, drain *Drain, background *BackgroundTasks, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	logger.Info("Shutting down, draining requests and connections")
+	drain.Start()
+
+	// Stops listening straight away, then waits for requests that are already being handled. WebSockets are hijacked
+	// from the server, so aren't waited for
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("Gave up waiting for requests to finish: " + err.Error())
+	}
+
+	if err := drain.Wait(ctx); err != nil {
+		logger.Warn("Gave up waiting for WebSockets to close: " + err.Error())
+	}
+
+	// Background tasks close their subscriptions as they stop
+	if err := background.Stop(ctx); err != nil {
+		logger.Warn("Gave up waiting for background tasks to stop: " + err.Error())
+	}
+
+	logger.Info("Shut down")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StoreReader reads players and lobbies straight from a Store
+type StoreReader interface {
+	// GetPlayer returns the player with the given ID, or nil if they have never connected
+	GetPlayer(ctx context.Context, playerId string) (*Player, error)
+	// GetLobby returns the lobby with the given ID, or nil if it doesn't exist
+	GetLobby(ctx context.Context, lobbyId string) (*Lobby, error)
+	// GetIdempotentMove returns the move the player made in the lobby with the idempotency key, or nil if they haven't
+	// used it there
+	GetIdempotentMove(ctx context.Context, lobbyId string, playerId string, key string) (*idempotentMove, error)
+	// GetLobbyEvents returns the entries in the lobby's log after the one with the given ID, or all of them if the ID
+	// is empty
+	GetLobbyEvents(ctx context.Context, lobbyId string, afterId string) ([]LobbyLogEntry, error)
+	// GetLobbyExpiry returns when the lobby will expire unless something happens in it, or the zero time if it
+	// already has
+	GetLobbyExpiry(ctx context.Context, lobbyId string) (time.Time, error)
+}
+
+// PlayerTx is a transaction against one player. Writes are only saved once the transaction's function returns without
+// an error, and then all at once
+type PlayerTx interface {
+	// GetPlayer returns the player, or nil if they have never connected
+	GetPlayer(ctx context.Context) (*Player, error)
+	// SetPlayer saves the player, who expires once they haven't been active for a while if they are a guest
+	SetPlayer(player Player)
+}
+
+// LobbyTx is a transaction against one lobby, its log and the moves made in it. Writes are only saved once the
+// transaction's function returns without an error, and then all at once
+type LobbyTx interface {
+	// GetLobby returns the lobby, or nil if it doesn't exist
+	GetLobby(ctx context.Context) (*Lobby, error)
+	// GetIdempotentMove returns the move the player made in the lobby with the idempotency key, or nil if they haven't
+	// used it there
+	GetIdempotentMove(ctx context.Context, playerId string, key string) (*idempotentMove, error)
+	// GetLobbyEvents returns the entries in the lobby's log after the one with the given ID, or all of them if the ID
+	// is empty
+	GetLobbyEvents(ctx context.Context, afterId string) ([]LobbyLogEntry, error)
+	// GetLobbyExpiry returns when the lobby will expire unless something happens in it, or the zero time if it
+	// already has
+	GetLobbyExpiry(ctx context.Context) (time.Time, error)
+	// SetLobby saves the lobby and puts off it expiring
+	SetLobby(lobby Lobby)
+	// DeleteLobby deletes the lobby along with its log
+	DeleteLobby()
+	// AppendLobbyEvent adds the entry to the end of the lobby's log, setting its ID once the transaction is saved, and
+	// puts off the lobby expiring
+	AppendLobbyEvent(entry *LobbyLogEntry)
+	SetIdempotentMove(playerId string, key string, move idempotentMove, lifetime time.Duration)
+	// SetGameOver saves the job that records the result of the lobby's game along with the end of the game, so that it
+	// is recorded even if the server dies straight after. It stays with the lobby until HandOffGameOver schedules it
+	SetGameOver(timer Timer)
+}
+
+// Store holds everything the server keeps: players, lobbies and finished games, each player's inbox of messages from
+// the server, and what the rest of the server keeps alongside them, such as sessions, ratings and tournaments. Guests
+// and lobbies expire once they haven't been active for a while
+type Store interface {
+	StoreReader
+	GameArchive
+	AccountStore
+	SessionStore
+	RateLimitStore
+	RatingStore
+	LeaderboardStore
+	TournamentStore
+	ArenaStore
+	TimerStore
+	NodeStore
+
+	// GetPlayers returns the players with the given IDs in the same order, with nil for those that don't exist
+	GetPlayers(ctx context.Context, playerIds ...string) ([]*Player, error)
+	// UpdatePlayer runs the function in a transaction against the player. If anything it read changes before its
+	// writes are saved, the function is run again, up to a few times before giving up with ErrTxConflict
+	UpdatePlayer(ctx context.Context, playerId string, update func(tx PlayerTx) error) error
+	// UpdateLobby runs the function in a transaction against the lobby, the same way as UpdatePlayer. A player and a
+	// lobby are never saved in one transaction, since under Redis Cluster they are in different slots, so lobbies are
+	// what say who is in them, and are saved before their players
+	UpdateLobby(ctx context.Context, lobbyId string, update func(tx LobbyTx) error) error
+	// HandOffGameOver schedules the job saved with the lobby that records the result of the game, and removes it from
+	// the lobby. It does nothing if the job has already been handed off
+	HandOffGameOver(ctx context.Context, lobbyId string, gameId string) error
+	// Notify adds the message to the end of the player's inbox
+	Notify(ctx context.Context, playerId string, payload []byte) error
+	// OpenInbox starts delivering the player's messages to the client, starting after the last one it acknowledged.
+	// New clients are only sent messages added from now on
+	OpenInbox(ctx context.Context, playerId string, clientId string) (Inbox, error)
+	// KeepAlive puts off the player and the lobby they are in expiring, as long as neither has already
+	KeepAlive(ctx context.Context, playerId string) error
+	// ExpiredLobbies sends the ID of each lobby as it expires, until the context is done. Every caller is sent every
+	// lobby, even across servers
+	ExpiredLobbies(ctx context.Context) (<-chan string, error)
+	// TryLock takes the named lock for the given time, returning false if someone else already holds it. Locks are let
+	// go of once their time runs out, so that one held by a server that died doesn't stay held
+	TryLock(ctx context.Context, name string, lifetime time.Duration) (bool, error)
+	// Unlock lets go of the named lock before its time runs out
+	Unlock(ctx context.Context, name string) error
+}
+
+// ErrTxConflict is returned when a transaction kept conflicting with other changes
+var ErrTxConflict = errors.New("transaction conflicted with other changes too many times")
+
+// How many times a transaction is run before giving up
+const storeTxAttempts = 5
+
+type StorageBackend string
+
+const (
+	RedisStorage StorageBackend = "redis"
+	// Everything is kept in the server's memory, so that it can run in one process with no Redis, such as for
+	// development. Only one server can run against it, and everything is lost when it stops
+	MemoryStorage StorageBackend = "memory"
+)
+
+// LoadStorageBackend reads where the server keeps everything from the environment
+func LoadStorageBackend() (StorageBackend, error) {
+	value, exists := os.LookupEnv("STORAGE")
+	if !exists {
+		return RedisStorage, nil
+	}
+
+	backend := StorageBackend(strings.ToLower(strings.TrimSpace(value)))
+	if backend != RedisStorage && backend != MemoryStorage {
+		return RedisStorage, errors.New("STORAGE must be either " + string(RedisStorage) + " or " + string(MemoryStorage))
+	}
+
+	return backend, nil
+}
+
+var streamIdPattern = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
+
+// IsValidStreamId returns whether the ID could be the ID of an entry in a stream, such as a lobby's log or a player's
+// inbox
+func IsValidStreamId(id string) bool {
+	return streamIdPattern.MatchString(id)
+}
+
+// parseStreamId splits a stream entry's ID into the millisecond it was added in and its sequence within that
+// millisecond
+func parseStreamId(id string) (int64, int64, bool) {
+	millis, sequence, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	parsedMillis, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	parsedSequence, err := strconv.ParseInt(sequence, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return parsedMillis, parsedSequence, true
+}
+
+// compareStreamIds returns a negative number if a was added before b, a positive one if after, and 0 if they are the
+// same. IDs that can't be parsed come before every other ID
+func compareStreamIds(a string, b string) int {
+	aMillis, aSequence, _ := parseStreamId(a)
+	bMillis, bSequence, _ := parseStreamId(b)
+
+	if aMillis != bMillis {
+		return cmp.Compare(aMillis, bMillis)
+	}
+
+	return cmp.Compare(aSequence, bSequence)
+}
+
+func WithStoreMiddleware(store Store) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modifiedRequest := r.WithContext(context.WithValue(r.Context(), "store", store))
+			next.ServeHTTP(w, modifiedRequest)
+		})
+	}
+}
+
+func GetStoreFromContext(ctx context.Context) Store {
+	store, ok := ctx.Value("store").(Store)
+	if !ok {
+		panic("Store in context is not present. Something has gone wrong!")
+	}
+
+	return store
+}
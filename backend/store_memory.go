@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryGameRef struct {
+	gameId  string
+	endedAt time.Time
+}
+
+type memoryLobbyEvent struct {
+	id        string
+	entryJson []byte
+}
+
+type memoryInboxMessage struct {
+	InboxMessage
+	addedAt time.Time
+}
+
+type memoryIdempotentMove struct {
+	move      []byte
+	expiresAt time.Time
+}
+
+// MemoryStore keeps everything in memory, so that the whole server can run in one process without Redis, and code
+// which needs a Store can be tested without it. Everything is lost when the process stops. Documents are stored as
+// JSON, the same as in Redis, so that callers can never share or modify what is stored
+type MemoryStore struct {
+	mutex           sync.Mutex
+	players         map[string][]byte
+	lobbies         map[string][]byte
+	lobbyEvents     map[string][]memoryLobbyEvent
+	idempotentMoves map[string]memoryIdempotentMove
+	// The jobs that record the results of finished games, until they are handed off to the timers
+	gameOvers map[string][]byte
+	games     map[string][]byte
+	// The IDs of each player's archived games, with the most recently finished first
+	playerGames map[string][]memoryGameRef
+	inboxes     map[string][]memoryInboxMessage
+	// The ID of the last message each of a player's clients acknowledged
+	inboxAcks map[string]map[string]string
+	// The inboxes being delivered to clients right now
+	openInboxes map[string]map[*memoryInbox]struct{}
+	// The ID of the last log entry or message, so that new ones always get a greater ID, the same as in a Redis stream
+	lastStreamMillis   int64
+	lastStreamSequence int64
+	// When each guest expires
+	playerExpiries map[string]time.Time
+	// When each lobby expires, and when it and its log are deleted, the same as the keys in Redis
+	lobbyExpiries         map[string]time.Time
+	lobbyDocumentExpiries map[string]time.Time
+
+	accounts       map[string][]byte
+	sessions       map[string][]byte
+	playerSessions map[string]map[string]struct{}
+	// The channels closed when each session is revoked
+	sessionWatchers   map[string]map[chan struct{}]struct{}
+	rateLimitBuckets  map[string]memoryTokenBucket
+	playerConnections map[string]map[string]time.Time
+	ratings           map[string][]byte
+	// Keyed by "<playerId>:<pool>", with the most recent change first
+	ratingHistories map[string][]RatingHistoryEntry
+	// Keyed the same as the leaderboards and current streaks in Redis
+	leaderboards    map[string]map[string]float64
+	currentStreaks  map[string]map[string]int
+	recordedGames   map[string]map[string]struct{}
+	seasonStandings map[string][]byte
+	currentSeason   string
+	tournaments     map[string][]byte
+	// Every tournament in the order they were created
+	tournamentIds []string
+	arenas        map[string][]byte
+	activeArenas  map[string]struct{}
+	arenaPools    map[string]map[string]time.Time
+	timers        map[string][]byte
+	// When each timer is next due, or when its lease runs out once it has been claimed
+	timersDueAt     map[string]time.Time
+	nodes           map[string]time.Time
+	nodeConnections map[string]map[string][]byte
+	playerSockets   map[string]map[string]string
+	// When each lock is let go of
+	locks map[string]time.Time
+}
+
+// How often the memory store checks for guests and lobbies that have expired
+const memoryExpiryInterval = time.Second
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		players:         map[string][]byte{},
+		lobbies:         map[string][]byte{},
+		lobbyEvents:     map[string][]memoryLobbyEvent{},
+		idempotentMoves: map[string]memoryIdempotentMove{},
+		gameOvers:       map[string][]byte{},
+		games:           map[string][]byte{},
+		playerGames:     map[string][]memoryGameRef{},
+		inboxes:         map[string][]memoryInboxMessage{},
+		inboxAcks:       map[string]map[string]string{},
+		openInboxes:     map[string]map[*memoryInbox]struct{}{},
+		playerExpiries:  map[string]time.Time{},
+		lobbyExpiries:   map[string]time.Time{},
+
+		lobbyDocumentExpiries: map[string]time.Time{},
+
+		accounts:          map[string][]byte{},
+		sessions:          map[string][]byte{},
+		playerSessions:    map[string]map[string]struct{}{},
+		sessionWatchers:   map[string]map[chan struct{}]struct{}{},
+		rateLimitBuckets:  map[string]memoryTokenBucket{},
+		playerConnections: map[string]map[string]time.Time{},
+		ratings:           map[string][]byte{},
+		ratingHistories:   map[string][]RatingHistoryEntry{},
+		leaderboards:      map[string]map[string]float64{},
+		currentStreaks:    map[string]map[string]int{},
+		recordedGames:     map[string]map[string]struct{}{},
+		seasonStandings:   map[string][]byte{},
+		tournaments:       map[string][]byte{},
+		arenas:            map[string][]byte{},
+		activeArenas:      map[string]struct{}{},
+		arenaPools:        map[string]map[string]time.Time{},
+		timers:            map[string][]byte{},
+		timersDueAt:       map[string]time.Time{},
+		nodes:             map[string]time.Time{},
+		nodeConnections:   map[string]map[string][]byte{},
+		playerSockets:     map[string]map[string]string{},
+		locks:             map[string]time.Time{},
+	}
+}
+
+// getMemoryJson returns the document decoded from its JSON, or nil if there isn't one
+func getMemoryJson[T any](documents map[string][]byte, id string) (*T, error) {
+	valueJson, exists := documents[id]
+	if !exists {
+		return nil, nil
+	}
+
+	valueJson, err := upgradeDocument[T](valueJson)
+	if err != nil {
+		return nil, err
+	}
+
+	var value T
+	if err := json.Unmarshal(valueJson, &value); err != nil {
+		return nil, err
+	}
+
+	return &value, nil
+}
+
+// modifyMemoryJson runs the function on the document and saves it, returning nil if there is no document. The function
+// is run without the store locked, so that it can read from the store itself, and is run again if the document
+// changes before it can be saved, the same as a transaction in Redis. save, if given, is run with the store locked
+// once the document has been saved
+func modifyMemoryJson[T any](store *MemoryStore, documents map[string][]byte, id string, modify func(value *T) error, save func(value *T)) (*T, error) {
+	for range storeTxAttempts {
+		store.mutex.Lock()
+		read := documents[id]
+		value, err := getMemoryJson[T](documents, id)
+		store.mutex.Unlock()
+
+		if err != nil || value == nil {
+			return nil, err
+		}
+
+		if err := modify(value); err != nil {
+			return nil, err
+		}
+
+		valueJson, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		store.mutex.Lock()
+		if !bytes.Equal(documents[id], read) {
+			store.mutex.Unlock()
+			continue
+		}
+
+		documents[id] = valueJson
+		if save != nil {
+			save(value)
+		}
+		store.mutex.Unlock()
+
+		return value, nil
+	}
+
+	return nil, ErrTxConflict
+}
+
+// The unexported get methods expect the store to already be locked
+
+func (store *MemoryStore) getIdempotentMove(lobbyId string, playerId string, key string) (*idempotentMove, error) {
+	stored, exists := store.idempotentMoves[idempotencyKey(lobbyId, playerId, key)]
+	if !exists {
+		return nil, nil
+	}
+
+	if time.Now().After(stored.expiresAt) {
+		delete(store.idempotentMoves, idempotencyKey(lobbyId, playerId, key))
+		return nil, nil
+	}
+
+	var move idempotentMove
+	if err := json.Unmarshal(stored.move, &move); err != nil {
+		return nil, err
+	}
+
+	return &move, nil
+}
+
+func (store *MemoryStore) getLobbyEvents(lobbyId string, afterId string) ([]LobbyLogEntry, error) {
+	if len(afterId) > 0 && !IsValidStreamId(afterId) {
+		return nil, errors.New("invalid lobby event ID " + afterId)
+	}
+
+	entries := []LobbyLogEntry{}
+	for _, event := range store.lobbyEvents[lobbyId] {
+		if len(afterId) > 0 && compareStreamIds(event.id, afterId) <= 0 {
+			continue
+		}
+
+		var entry LobbyLogEntry
+		if err := json.Unmarshal(event.entryJson, &entry); err != nil {
+			return entries, err
+		}
+
+		entry.Id = event.id
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// getLobbyExpiry returns the zero time once the lobby has expired, even if it hasn't been swept yet
+func (store *MemoryStore) getLobbyExpiry(lobbyId string) time.Time {
+	expiresAt := store.lobbyExpiries[lobbyId]
+	if time.Now().After(expiresAt) {
+		return time.Time{}
+	}
+
+	return expiresAt
+}
+
+func (store *MemoryStore) refreshLobbyExpiry(lobbyId string) {
+	store.lobbyExpiries[lobbyId] = time.Now().Add(lobbyLifetime)
+	store.lobbyDocumentExpiries[lobbyId] = time.Now().Add(lobbyLifetime + lobbyExpiryGrace)
+}
+
+func (store *MemoryStore) deleteLobby(lobbyId string) {
+	delete(store.lobbies, lobbyId)
+	delete(store.lobbyEvents, lobbyId)
+	delete(store.lobbyExpiries, lobbyId)
+	delete(store.lobbyDocumentExpiries, lobbyId)
+}
+
+// nextStreamId returns an ID greater than every one before it, made the same way as Redis makes stream IDs
+func (store *MemoryStore) nextStreamId() string {
+	millis := time.Now().UnixMilli()
+	if millis > store.lastStreamMillis {
+		store.lastStreamMillis = millis
+		store.lastStreamSequence = 0
+	} else {
+		store.lastStreamSequence++
+	}
+
+	return strconv.FormatInt(store.lastStreamMillis, 10) + "-" + strconv.FormatInt(store.lastStreamSequence, 10)
+}
+
+func (store *MemoryStore) GetPlayer(ctx context.Context, playerId string) (*Player, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return getMemoryJson[Player](store.players, playerId)
+}
+
+func (store *MemoryStore) GetLobby(ctx context.Context, lobbyId string) (*Lobby, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return getMemoryJson[Lobby](store.lobbies, lobbyId)
+}
+
+func (store *MemoryStore) GetIdempotentMove(ctx context.Context, lobbyId string, playerId string, key string) (*idempotentMove, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.getIdempotentMove(lobbyId, playerId, key)
+}
+
+func (store *MemoryStore) GetLobbyEvents(ctx context.Context, lobbyId string, afterId string) ([]LobbyLogEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.getLobbyEvents(lobbyId, afterId)
+}
+
+func (store *MemoryStore) GetLobbyExpiry(ctx context.Context, lobbyId string) (time.Time, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.getLobbyExpiry(lobbyId), nil
+}
+
+func (store *MemoryStore) GetPlayers(ctx context.Context, playerIds ...string) ([]*Player, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	players := make([]*Player, len(playerIds))
+	for i, playerId := range playerIds {
+		player, err := getMemoryJson[Player](store.players, playerId)
+		if err != nil {
+			return players, err
+		}
+
+		players[i] = player
+	}
+
+	return players, nil
+}
+
+// memoryTx reads straight from the store, which stays locked for the whole transaction, and queues its writes so
+// that none of them are saved if the transaction fails
+type memoryTx struct {
+	store  *MemoryStore
+	writes []func()
+	// Set if a write couldn't be encoded, in which case none of them are saved
+	err error
+}
+
+func (tx *memoryTx) queue(value any, write func(valueJson []byte)) {
+	valueJson, err := json.Marshal(value)
+	if err != nil {
+		tx.err = err
+		return
+	}
+
+	tx.writes = append(tx.writes, func() {
+		write(valueJson)
+	})
+}
+
+type memoryPlayerTx struct {
+	memoryTx
+	playerId string
+}
+
+func (tx *memoryPlayerTx) GetPlayer(ctx context.Context) (*Player, error) {
+	return getMemoryJson[Player](tx.store.players, tx.playerId)
+}
+
+func (tx *memoryPlayerTx) SetPlayer(player Player) {
+	player = playerAtSchemaVersion(player)
+	tx.queue(player, func(playerJson []byte) {
+		tx.store.players[tx.playerId] = playerJson
+
+		if isGuest(player) {
+			tx.store.playerExpiries[tx.playerId] = time.Now().Add(guestLifetime)
+		} else {
+			delete(tx.store.playerExpiries, tx.playerId)
+		}
+	})
+}
+
+type memoryLobbyTx struct {
+	memoryTx
+	lobbyId string
+}
+
+func (tx *memoryLobbyTx) GetLobby(ctx context.Context) (*Lobby, error) {
+	return getMemoryJson[Lobby](tx.store.lobbies, tx.lobbyId)
+}
+
+func (tx *memoryLobbyTx) GetIdempotentMove(ctx context.Context, playerId string, key string) (*idempotentMove, error) {
+	return tx.store.getIdempotentMove(tx.lobbyId, playerId, key)
+}
+
+func (tx *memoryLobbyTx) GetLobbyEvents(ctx context.Context, afterId string) ([]LobbyLogEntry, error) {
+	return tx.store.getLobbyEvents(tx.lobbyId, afterId)
+}
+
+func (tx *memoryLobbyTx) GetLobbyExpiry(ctx context.Context) (time.Time, error) {
+	return tx.store.getLobbyExpiry(tx.lobbyId), nil
+}
+
+func (tx *memoryLobbyTx) SetLobby(lobby Lobby) {
+	lobby = lobbyAtSchemaVersion(lobby)
+	tx.queue(lobby, func(lobbyJson []byte) {
+		tx.store.lobbies[tx.lobbyId] = lobbyJson
+		tx.store.refreshLobbyExpiry(tx.lobbyId)
+	})
+}
+
+func (tx *memoryLobbyTx) DeleteLobby() {
+	tx.writes = append(tx.writes, func() {
+		tx.store.deleteLobby(tx.lobbyId)
+	})
+}
+
+func (tx *memoryLobbyTx) AppendLobbyEvent(entry *LobbyLogEntry) {
+	tx.queue(entry, func(entryJson []byte) {
+		entry.Id = tx.store.nextStreamId()
+		tx.store.lobbyEvents[tx.lobbyId] = append(tx.store.lobbyEvents[tx.lobbyId], memoryLobbyEvent{id: entry.Id, entryJson: entryJson})
+		tx.store.refreshLobbyExpiry(tx.lobbyId)
+	})
+}
+
+func (tx *memoryLobbyTx) SetIdempotentMove(playerId string, key string, move idempotentMove, lifetime time.Duration) {
+	tx.queue(move, func(moveJson []byte) {
+		tx.store.idempotentMoves[idempotencyKey(tx.lobbyId, playerId, key)] = memoryIdempotentMove{
+			move:      moveJson,
+			expiresAt: time.Now().Add(lifetime),
+		}
+	})
+}
+
+func (tx *memoryLobbyTx) SetGameOver(timer Timer) {
+	tx.queue(timer, func(timerJson []byte) {
+		tx.store.gameOvers[gameOverKey(tx.lobbyId, timer.Lobby.Game.Id)] = timerJson
+	})
+}
+
+// update holds the store's lock while the transaction runs, so it never conflicts with anything
+func (store *MemoryStore) update(ctx context.Context, run func() (*memoryTx, error)) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx, err := run()
+	if err != nil {
+		return err
+	}
+
+	if tx.err != nil {
+		return tx.err
+	}
+
+	for _, write := range tx.writes {
+		write()
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) UpdatePlayer(ctx context.Context, playerId string, update func(tx PlayerTx) error) error {
+	return store.update(ctx, func() (*memoryTx, error) {
+		playerTx := &memoryPlayerTx{memoryTx: memoryTx{store: store}, playerId: playerId}
+		return &playerTx.memoryTx, update(playerTx)
+	})
+}
+
+func (store *MemoryStore) UpdateLobby(ctx context.Context, lobbyId string, update func(tx LobbyTx) error) error {
+	return store.update(ctx, func() (*memoryTx, error) {
+		lobbyTx := &memoryLobbyTx{memoryTx: memoryTx{store: store}, lobbyId: lobbyId}
+		return &lobbyTx.memoryTx, update(lobbyTx)
+	})
+}
+
+func (store *MemoryStore) SaveGame(ctx context.Context, game ArchivedGame) error {
+	gameJson, err := json.Marshal(game)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	_, alreadySaved := store.games[game.GameId]
+	store.games[game.GameId] = gameJson
+	if alreadySaved {
+		return nil
+	}
+
+	for _, playerId := range []string{game.Player1, game.Player2} {
+		games := append(store.playerGames[playerId], memoryGameRef{gameId: game.GameId, endedAt: game.EndedAt})
+
+		// Kept in the same order as the Redis archive, which sorts by when the game ended
+		slices.SortStableFunc(games, func(a memoryGameRef, b memoryGameRef) int {
+			return b.endedAt.Compare(a.endedAt)
+		})
+
+		store.playerGames[playerId] = games
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) GetGame(ctx context.Context, gameId string) (*ArchivedGame, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return getMemoryJson[ArchivedGame](store.games, gameId)
+}
+
+func (store *MemoryStore) ListPlayerGames(ctx context.Context, playerId string, offset int, limit int) (ArchivedGamePage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	games := store.playerGames[playerId]
+	page := ArchivedGamePage{
+		Games:  []ArchivedGame{},
+		Offset: offset,
+		Limit:  limit,
+		Total:  len(games),
+	}
+
+	for i := offset; i < len(games) && i < offset+limit; i++ {
+		game, err := getMemoryJson[ArchivedGame](store.games, games[i].gameId)
+		if err != nil {
+			return page, err
+		}
+
+		page.Games = append(page.Games, *game)
+	}
+
+	return page, nil
+}
+
+func (store *MemoryStore) KeepAlive(ctx context.Context, playerId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	player, err := getMemoryJson[Player](store.players, playerId)
+	if err != nil || player == nil {
+		return err
+	}
+
+	if isGuest(*player) {
+		store.playerExpiries[playerId] = time.Now().Add(guestLifetime)
+	}
+
+	// Unlike saving the lobby, this never brings back a lobby that has already expired
+	if player.CurrentLobby != nil && !store.getLobbyExpiry(*player.CurrentLobby).IsZero() {
+		store.refreshLobbyExpiry(*player.CurrentLobby)
+	}
+
+	return nil
+}
+
+// ExpiredLobbies checks for expired guests and lobbies every so often, deleting guests and sending the IDs of lobbies
+// as they expire. Lobbies that haven't been swept are deleted along with their logs once their grace period is over.
+// Memory storage only works with a single server, so there should only be one caller
+func (store *MemoryStore) ExpiredLobbies(ctx context.Context) (<-chan string, error) {
+	expired := make(chan string)
+
+	go func() {
+		defer close(expired)
+
+		ticker := time.NewTicker(memoryExpiryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, lobbyId := range store.expire(now) {
+					select {
+					case expired <- lobbyId:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return expired, nil
+}
+
+// expire deletes everything that has expired, and returns the IDs of the lobbies that expired since it last ran
+func (store *MemoryStore) expire(now time.Time) []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for playerId, expiresAt := range store.playerExpiries {
+		if now.After(expiresAt) {
+			delete(store.players, playerId)
+			delete(store.playerExpiries, playerId)
+		}
+	}
+
+	var expiredLobbyIds []string
+	for lobbyId, expiresAt := range store.lobbyExpiries {
+		if now.After(expiresAt) {
+			delete(store.lobbyExpiries, lobbyId)
+			expiredLobbyIds = append(expiredLobbyIds, lobbyId)
+		}
+	}
+
+	for lobbyId, expiresAt := range store.lobbyDocumentExpiries {
+		if now.After(expiresAt) {
+			store.deleteLobby(lobbyId)
+		}
+	}
+
+	// Buckets that have filled up again are no different to those that were never taken from
+	for name, bucket := range store.rateLimitBuckets {
+		if now.After(bucket.expiresAt) {
+			delete(store.rateLimitBuckets, name)
+		}
+	}
+
+	return expiredLobbyIds
+}
+
+func (store *MemoryStore) TryLock(ctx context.Context, name string, lifetime time.Duration) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if releasedAt, exists := store.locks[name]; exists && time.Now().Before(releasedAt) {
+		return false, nil
+	}
+
+	store.locks[name] = time.Now().Add(lifetime)
+	return true, nil
+}
+
+func (store *MemoryStore) Unlock(ctx context.Context, name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.locks, name)
+	return nil
+}
+
+type memoryInbox struct {
+	store    *MemoryStore
+	playerId string
+	clientId string
+	messages chan InboxMessage
+	closed   bool
+}
+
+// Notify adds the message to the player's inbox and delivers it to each of their clients that are connected. Clients
+// that can't keep up are disconnected, and are sent it again once they reconnect
+func (store *MemoryStore) Notify(ctx context.Context, playerId string, payload []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	message := InboxMessage{Id: store.nextStreamId(), Payload: string(payload)}
+
+	// Trimmed the same way as in Redis, so that only recent messages are kept
+	oldest := time.Now().Add(-inboxRetention)
+	inbox := slices.DeleteFunc(store.inboxes[playerId], func(stored memoryInboxMessage) bool {
+		return stored.addedAt.Before(oldest)
+	})
+	store.inboxes[playerId] = append(inbox, memoryInboxMessage{InboxMessage: message, addedAt: time.Now()})
+
+	for inbox := range store.openInboxes[playerId] {
+		select {
+		case inbox.messages <- message:
+		default:
+			inbox.close()
+		}
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) OpenInbox(ctx context.Context, playerId string, clientId string) (Inbox, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	messages := store.inboxes[playerId]
+
+	// New clients start from the latest message
+	cursor, acknowledged := store.inboxAcks[playerId][clientId]
+	if !acknowledged && len(messages) > 0 {
+		cursor = messages[len(messages)-1].Id
+	}
+
+	var backlog []InboxMessage
+	for _, message := range messages {
+		if len(cursor) == 0 || compareStreamIds(message.Id, cursor) > 0 {
+			backlog = append(backlog, message.InboxMessage)
+		}
+	}
+
+	inbox := &memoryInbox{
+		store:    store,
+		playerId: playerId,
+		clientId: clientId,
+		messages: make(chan InboxMessage, len(backlog)+inboxBuffer),
+	}
+
+	for _, message := range backlog {
+		inbox.messages <- message
+	}
+
+	if store.openInboxes[playerId] == nil {
+		store.openInboxes[playerId] = map[*memoryInbox]struct{}{}
+	}
+
+	store.openInboxes[playerId][inbox] = struct{}{}
+
+	return inbox, nil
+}
+
+func (inbox *memoryInbox) Messages() <-chan InboxMessage {
+	return inbox.messages
+}
+
+func (inbox *memoryInbox) Ack(id string) error {
+	store := inbox.store
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.inboxAcks[inbox.playerId] == nil {
+		store.inboxAcks[inbox.playerId] = map[string]string{}
+	}
+
+	if compareStreamIds(id, store.inboxAcks[inbox.playerId][inbox.clientId]) > 0 {
+		store.inboxAcks[inbox.playerId][inbox.clientId] = id
+	}
+
+	return nil
+}
+
+func (inbox *memoryInbox) Close() error {
+	inbox.store.mutex.Lock()
+	defer inbox.store.mutex.Unlock()
+
+	inbox.close()
+	return nil
+}
+
+// close stops delivering to the inbox, and expects the store to already be locked
+func (inbox *memoryInbox) close() {
+	if inbox.closed {
+		return
+	}
+
+	inbox.closed = true
+	close(inbox.messages)
+
+	delete(inbox.store.openInboxes[inbox.playerId], inbox)
+	if len(inbox.store.openInboxes[inbox.playerId]) == 0 {
+		delete(inbox.store.openInboxes, inbox.playerId)
+	}
+}
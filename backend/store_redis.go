@@ -0,0 +1,718 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisStore keeps players, lobbies and games as RedisJSON documents, and each player's inbox as a stream
+type RedisStore struct {
+	*RedisGameArchive
+	rdb     redis.UniversalClient
+	inboxes *redisInboxReader
+}
+
+func NewRedisStore(rdb redis.UniversalClient) *RedisStore {
+	return &RedisStore{
+		RedisGameArchive: NewRedisGameArchive(rdb),
+		rdb:              rdb,
+		inboxes: &redisInboxReader{
+			rdb:     rdb,
+			open:    map[string]map[*redisInbox]struct{}{},
+			reading: map[int]bool{},
+		},
+	}
+}
+
+// playerHashTag puts the player and everything saved in the same transactions as them in their own slot
+func playerHashTag(playerId string) string {
+	return "player:" + playerId
+}
+
+// lobbyHashTag puts the lobby, its log and the moves made in it in their own slot
+func lobbyHashTag(lobbyId string) string {
+	return "lobby:" + lobbyId
+}
+
+func playerKey(playerId string) string {
+	return withHashTag(playerHashTag(playerId), "player:"+playerId)
+}
+
+func lobbyKey(lobbyId string) string {
+	return withHashTag(lobbyHashTag(lobbyId), "lobby:"+lobbyId)
+}
+
+func lobbyEventsKey(lobbyId string) string {
+	return withHashTag(lobbyHashTag(lobbyId), "lobby:"+lobbyId+":events")
+}
+
+// getRedisJson returns the document stored at the key, or nil if there isn't one
+func getRedisJson[T any](ctx context.Context, rdb redis.Cmdable, key string) (*T, error) {
+	valueJson, err := rdb.JSONGet(ctx, key).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	if len(valueJson) == 0 {
+		return nil, nil
+	}
+
+	migratedJson, err := upgradeDocument[T]([]byte(valueJson))
+	if err != nil {
+		return nil, err
+	}
+
+	var value T
+	if err := json.Unmarshal(migratedJson, &value); err != nil {
+		return nil, err
+	}
+
+	return &value, nil
+}
+
+func (store *RedisStore) GetPlayer(ctx context.Context, playerId string) (*Player, error) {
+	return getRedisJson[Player](ctx, store.rdb, playerKey(playerId))
+}
+
+func (store *RedisStore) GetLobby(ctx context.Context, lobbyId string) (*Lobby, error) {
+	return getRedisJson[Lobby](ctx, store.rdb, lobbyKey(lobbyId))
+}
+
+func (store *RedisStore) GetIdempotentMove(ctx context.Context, lobbyId string, playerId string, key string) (*idempotentMove, error) {
+	return getRedisJson[idempotentMove](ctx, store.rdb, idempotencyKey(lobbyId, playerId, key))
+}
+
+func (store *RedisStore) GetLobbyEvents(ctx context.Context, lobbyId string, afterId string) ([]LobbyLogEntry, error) {
+	return getRedisLobbyEvents(ctx, store.rdb, lobbyId, afterId)
+}
+
+func (store *RedisStore) GetLobbyExpiry(ctx context.Context, lobbyId string) (time.Time, error) {
+	return getRedisLobbyExpiry(ctx, store.rdb, lobbyId)
+}
+
+// getRedisLobbyExpiry reads when the lobby expires from the TTL of its expiry key, which is gone once it has
+func getRedisLobbyExpiry(ctx context.Context, rdb redis.Cmdable, lobbyId string) (time.Time, error) {
+	ttl, err := rdb.PTTL(ctx, lobbyExpiryKey(lobbyId)).Result()
+	if err != nil || ttl < 0 {
+		return time.Time{}, err
+	}
+
+	return time.Now().Add(ttl), nil
+}
+
+// getRedisLobbyEvents reads the lobby's log from its stream, where each entry is kept as JSON
+func getRedisLobbyEvents(ctx context.Context, rdb redis.Cmdable, lobbyId string, afterId string) ([]LobbyLogEntry, error) {
+	start := "-"
+	if len(afterId) > 0 {
+		start = "(" + afterId
+	}
+
+	messages, err := rdb.XRange(ctx, lobbyEventsKey(lobbyId), start, "+").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]LobbyLogEntry, 0, len(messages))
+	for _, message := range messages {
+		entryJson, _ := message.Values["entry"].(string)
+
+		var entry LobbyLogEntry
+		if err := json.Unmarshal([]byte(entryJson), &entry); err != nil {
+			return entries, err
+		}
+
+		entry.Id = message.ID
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (store *RedisStore) GetPlayers(ctx context.Context, playerIds ...string) ([]*Player, error) {
+	players := make([]*Player, len(playerIds))
+	if len(playerIds) == 0 {
+		return players, nil
+	}
+
+	keys := make([]string, len(playerIds))
+	for i, playerId := range playerIds {
+		keys[i] = playerKey(playerId)
+	}
+
+	// Every player is in their own slot under Cluster, so they can't be read with JSON.MGET
+	playersJson, err := jsonMGet(ctx, store.rdb, keys...)
+	if err != nil {
+		return players, err
+	}
+
+	for i, playerJson := range playersJson {
+		rawPlayer, ok := playerJson.(string)
+		if !ok || i >= len(players) {
+			continue
+		}
+
+		// JSON.MGET with a JSONPath wraps every document in an array
+		var matches []json.RawMessage
+		if err := json.Unmarshal([]byte(rawPlayer), &matches); err != nil || len(matches) == 0 {
+			continue
+		}
+
+		migratedJson, err := upgradeDocument[Player](matches[0])
+		if err != nil {
+			return players, err
+		}
+
+		var player Player
+		if err := json.Unmarshal(migratedJson, &player); err == nil {
+			players[i] = &player
+		}
+	}
+
+	return players, nil
+}
+
+// redisTx watches every key it reads, and queues its writes to be sent in a single MULTI
+type redisTx struct {
+	tx     *redis.Tx
+	writes []func(ctx context.Context, pipe redis.Pipeliner)
+	// Run once the writes have been saved
+	saved []func()
+	// Set if a write couldn't be encoded, in which case none of them are saved
+	err error
+}
+
+func (tx *redisTx) watch(ctx context.Context, key string) error {
+	return tx.tx.Watch(ctx, key).Err()
+}
+
+// redisPlayerTx only touches keys in the player's slot
+type redisPlayerTx struct {
+	redisTx
+	playerId string
+}
+
+func (tx *redisPlayerTx) GetPlayer(ctx context.Context) (*Player, error) {
+	if err := tx.watch(ctx, playerKey(tx.playerId)); err != nil {
+		return nil, err
+	}
+
+	return getRedisJson[Player](ctx, tx.tx, playerKey(tx.playerId))
+}
+
+func (tx *redisPlayerTx) SetPlayer(player Player) {
+	player = playerAtSchemaVersion(player)
+	tx.writes = append(tx.writes, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.JSONSet(ctx, playerKey(player.Id), "$", player)
+
+		if isGuest(player) {
+			pipe.PExpire(ctx, playerKey(player.Id), guestLifetime)
+		} else {
+			pipe.Persist(ctx, playerKey(player.Id))
+		}
+	})
+}
+
+// redisLobbyTx only touches keys in the lobby's slot
+type redisLobbyTx struct {
+	redisTx
+	lobbyId string
+}
+
+func (tx *redisLobbyTx) GetLobby(ctx context.Context) (*Lobby, error) {
+	if err := tx.watch(ctx, lobbyKey(tx.lobbyId)); err != nil {
+		return nil, err
+	}
+
+	return getRedisJson[Lobby](ctx, tx.tx, lobbyKey(tx.lobbyId))
+}
+
+func (tx *redisLobbyTx) GetIdempotentMove(ctx context.Context, playerId string, key string) (*idempotentMove, error) {
+	if err := tx.watch(ctx, idempotencyKey(tx.lobbyId, playerId, key)); err != nil {
+		return nil, err
+	}
+
+	return getRedisJson[idempotentMove](ctx, tx.tx, idempotencyKey(tx.lobbyId, playerId, key))
+}
+
+func (tx *redisLobbyTx) GetLobbyEvents(ctx context.Context, afterId string) ([]LobbyLogEntry, error) {
+	if err := tx.watch(ctx, lobbyEventsKey(tx.lobbyId)); err != nil {
+		return nil, err
+	}
+
+	return getRedisLobbyEvents(ctx, tx.tx, tx.lobbyId, afterId)
+}
+
+func (tx *redisLobbyTx) GetLobbyExpiry(ctx context.Context) (time.Time, error) {
+	if err := tx.watch(ctx, lobbyExpiryKey(tx.lobbyId)); err != nil {
+		return time.Time{}, err
+	}
+
+	return getRedisLobbyExpiry(ctx, tx.tx, tx.lobbyId)
+}
+
+// refreshLobbyExpiry puts off the lobby expiring. The lobby and its log are kept for a while after its expiry key is
+// gone, so that the sweeper can still read them
+func refreshLobbyExpiry(ctx context.Context, pipe redis.Pipeliner, lobbyId string) {
+	pipe.Set(ctx, lobbyExpiryKey(lobbyId), "1", lobbyLifetime)
+	pipe.PExpire(ctx, lobbyKey(lobbyId), lobbyLifetime+lobbyExpiryGrace)
+	pipe.PExpire(ctx, lobbyEventsKey(lobbyId), lobbyLifetime+lobbyExpiryGrace)
+}
+
+func (tx *redisLobbyTx) SetLobby(lobby Lobby) {
+	lobby = lobbyAtSchemaVersion(lobby)
+	tx.writes = append(tx.writes, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.JSONSet(ctx, lobbyKey(tx.lobbyId), "$", lobby)
+		refreshLobbyExpiry(ctx, pipe, tx.lobbyId)
+	})
+}
+
+func (tx *redisLobbyTx) DeleteLobby() {
+	tx.writes = append(tx.writes, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.Del(ctx, lobbyKey(tx.lobbyId), lobbyEventsKey(tx.lobbyId), lobbyExpiryKey(tx.lobbyId))
+	})
+}
+
+func (tx *redisLobbyTx) AppendLobbyEvent(entry *LobbyLogEntry) {
+	entryJson, err := json.Marshal(entry)
+	if err != nil {
+		tx.err = err
+		return
+	}
+
+	var added *redis.StringCmd
+	tx.writes = append(tx.writes, func(ctx context.Context, pipe redis.Pipeliner) {
+		added = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: lobbyEventsKey(tx.lobbyId),
+			Values: []any{"entry", string(entryJson)},
+		})
+		refreshLobbyExpiry(ctx, pipe, tx.lobbyId)
+	})
+
+	tx.saved = append(tx.saved, func() {
+		entry.Id = added.Val()
+	})
+}
+
+func (tx *redisLobbyTx) SetIdempotentMove(playerId string, key string, move idempotentMove, lifetime time.Duration) {
+	tx.writes = append(tx.writes, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.JSONSet(ctx, idempotencyKey(tx.lobbyId, playerId, key), "$", move)
+		pipe.PExpire(ctx, idempotencyKey(tx.lobbyId, playerId, key), lifetime)
+	})
+}
+
+func (tx *redisLobbyTx) SetGameOver(timer Timer) {
+	timerJson, err := json.Marshal(timer)
+	if err != nil {
+		tx.err = err
+		return
+	}
+
+	tx.writes = append(tx.writes, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.Set(ctx, gameOverKey(tx.lobbyId, timer.Lobby.Game.Id), string(timerJson), 0)
+	})
+}
+
+// update runs the transaction on the primary that holds the key, which every key the transaction touches shares a
+// slot with. Cluster clients find that primary by the watched key
+func (store *RedisStore) update(ctx context.Context, key string, run func(tx *redis.Tx) (*redisTx, error)) error {
+	err := WatchWithRetries(ctx, func() error {
+		return store.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			storeTx, err := run(tx)
+			if err != nil {
+				return err
+			}
+
+			if storeTx.err != nil {
+				return storeTx.err
+			}
+
+			if len(storeTx.writes) == 0 {
+				return nil
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, write := range storeTx.writes {
+					write(ctx, pipe)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			for _, saved := range storeTx.saved {
+				saved()
+			}
+
+			return nil
+		}, key)
+	}, storeTxAttempts)
+
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrTxConflict
+	}
+
+	return err
+}
+
+func (store *RedisStore) UpdatePlayer(ctx context.Context, playerId string, update func(tx PlayerTx) error) error {
+	return store.update(ctx, playerKey(playerId), func(tx *redis.Tx) (*redisTx, error) {
+		playerTx := &redisPlayerTx{redisTx: redisTx{tx: tx}, playerId: playerId}
+		return &playerTx.redisTx, update(playerTx)
+	})
+}
+
+func (store *RedisStore) UpdateLobby(ctx context.Context, lobbyId string, update func(tx LobbyTx) error) error {
+	return store.update(ctx, lobbyKey(lobbyId), func(tx *redis.Tx) (*redisTx, error) {
+		lobbyTx := &redisLobbyTx{redisTx: redisTx{tx: tx}, lobbyId: lobbyId}
+		return &lobbyTx.redisTx, update(lobbyTx)
+	})
+}
+
+func (store *RedisStore) KeepAlive(ctx context.Context, playerId string) error {
+	player, err := store.GetPlayer(ctx, playerId)
+	if err != nil || player == nil {
+		return err
+	}
+
+	_, err = store.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if isGuest(*player) {
+			pipe.PExpire(ctx, playerKey(playerId), guestLifetime)
+		}
+
+		// Unlike saving the lobby, this never brings back a lobby that has already expired
+		if player.CurrentLobby != nil {
+			pipe.PExpire(ctx, lobbyExpiryKey(*player.CurrentLobby), lobbyLifetime)
+			pipe.PExpire(ctx, lobbyKey(*player.CurrentLobby), lobbyLifetime+lobbyExpiryGrace)
+			pipe.PExpire(ctx, lobbyEventsKey(*player.CurrentLobby), lobbyLifetime+lobbyExpiryGrace)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// ExpiredLobbies listens for the keyspace notifications sent when lobbies' expiry keys expire. They have to be turned
+// on with EnableExpiryNotifications
+func (store *RedisStore) ExpiredLobbies(ctx context.Context) (<-chan string, error) {
+	// Notifications are only sent by the primary that holds the key, and under Cluster lobbies are spread across every
+	// primary, so each of them is listened to
+	var mutex sync.Mutex
+	var subscriptions []*redis.PubSub
+	err := forEachPrimary(ctx, store.rdb, func(ctx context.Context, client *redis.Client) error {
+		pubsub := client.Subscribe(ctx, "__keyevent@"+strconv.Itoa(client.Options().DB)+"__:expired")
+		if _, err := pubsub.Receive(ctx); err != nil {
+			pubsub.Close()
+			return err
+		}
+
+		mutex.Lock()
+		subscriptions = append(subscriptions, pubsub)
+		mutex.Unlock()
+		return nil
+	})
+
+	if err != nil {
+		for _, pubsub := range subscriptions {
+			pubsub.Close()
+		}
+
+		return nil, err
+	}
+
+	expired := make(chan string)
+	var listening sync.WaitGroup
+	for _, pubsub := range subscriptions {
+		listening.Add(1)
+		go func() {
+			defer listening.Done()
+			defer pubsub.Close()
+
+			notifications := pubsub.Channel()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case notification := <-notifications:
+					lobbyId, ok := lobbyIdFromExpiryKey(notification.Payload)
+					if !ok {
+						continue
+					}
+
+					select {
+					case expired <- lobbyId:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		listening.Wait()
+		close(expired)
+	}()
+
+	return expired, nil
+}
+
+// How long a read of the open inboxes waits for new messages. Inboxes opened while a read is waiting are only
+// included in the next one, but are sent everything they missed as soon as they are opened
+const inboxReadBlock = time.Second
+
+// How long to wait before reading inboxes again after a read failed
+const inboxReadRetryDelay = time.Second
+
+func lockKey(name string) string {
+	return "lock:" + name
+}
+
+func (store *RedisStore) TryLock(ctx context.Context, name string, lifetime time.Duration) (bool, error) {
+	return store.rdb.SetNX(ctx, lockKey(name), "1", lifetime).Result()
+}
+
+func (store *RedisStore) Unlock(ctx context.Context, name string) error {
+	return store.rdb.Del(ctx, lockKey(name)).Err()
+}
+
+// addToInbox adds the message to the player's inbox, trimming messages older than the retention period
+func addToInbox(ctx context.Context, pipe redis.Pipeliner, playerId string, payload []byte) {
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: inboxKey(playerId),
+		MinID:  inboxMinId(),
+		Approx: true,
+		Values: []any{"message", string(payload)},
+	})
+	pipe.PExpire(ctx, inboxKey(playerId), inboxRetention)
+}
+
+func (store *RedisStore) Notify(ctx context.Context, playerId string, payload []byte) error {
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		addToInbox(ctx, pipe, playerId, payload)
+		return nil
+	})
+
+	return err
+}
+
+func (store *RedisStore) OpenInbox(ctx context.Context, playerId string, clientId string) (Inbox, error) {
+	cursor, err := store.rdb.HGet(ctx, inboxAcksKey(playerId), clientId).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	// New clients start from the latest message
+	if errors.Is(err, redis.Nil) {
+		latest, err := store.rdb.XRevRangeN(ctx, inboxKey(playerId), "+", "-", 1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		cursor = "0-0"
+		if len(latest) > 0 {
+			cursor = latest[0].ID
+		}
+	}
+
+	backlog, err := store.rdb.XRange(ctx, inboxKey(playerId), "("+cursor, "+").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	inbox := &redisInbox{
+		reader:   store.inboxes,
+		playerId: playerId,
+		clientId: clientId,
+		cursor:   cursor,
+		messages: make(chan InboxMessage, len(backlog)+inboxBuffer),
+	}
+
+	for _, message := range backlog {
+		inbox.messages <- redisInboxMessage(message)
+		inbox.cursor = message.ID
+	}
+
+	store.inboxes.add(inbox)
+
+	return inbox, nil
+}
+
+func redisInboxMessage(message redis.XMessage) InboxMessage {
+	payload, _ := message.Values["message"].(string)
+	return InboxMessage{Id: message.ID, Payload: payload}
+}
+
+// redisInboxReader reads every inbox open on this server with a single blocking read for each shard, rather than one
+// for each client, so that connected clients don't each hold a Redis connection
+type redisInboxReader struct {
+	rdb   redis.UniversalClient
+	mutex sync.Mutex
+	open  map[string]map[*redisInbox]struct{}
+	// The shards being read right now
+	reading map[int]bool
+}
+
+type redisInbox struct {
+	reader   *redisInboxReader
+	playerId string
+	clientId string
+	// The ID of the last message delivered to the client
+	cursor   string
+	messages chan InboxMessage
+	closed   bool
+}
+
+func (reader *redisInboxReader) add(inbox *redisInbox) {
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+
+	if reader.open[inbox.playerId] == nil {
+		reader.open[inbox.playerId] = map[*redisInbox]struct{}{}
+	}
+
+	reader.open[inbox.playerId][inbox] = struct{}{}
+
+	shard := shardOf(inbox.playerId)
+	if !reader.reading[shard] {
+		reader.reading[shard] = true
+		go reader.read(shard)
+	}
+}
+
+// read delivers new messages to the open inboxes in the shard until none are left open in it
+func (reader *redisInboxReader) read(shard int) {
+	ctx := context.Background()
+
+	for {
+		// Each inbox is read from the earliest message any of the player's clients still needs
+		var keys []string
+		var cursors []string
+		playerIds := map[string]string{}
+
+		reader.mutex.Lock()
+		for playerId, inboxes := range reader.open {
+			if shardOf(playerId) != shard {
+				continue
+			}
+
+			var earliest string
+			for inbox := range inboxes {
+				if len(earliest) == 0 || compareStreamIds(inbox.cursor, earliest) < 0 {
+					earliest = inbox.cursor
+				}
+			}
+
+			keys = append(keys, inboxKey(playerId))
+			cursors = append(cursors, earliest)
+			playerIds[inboxKey(playerId)] = playerId
+		}
+
+		if len(keys) == 0 {
+			reader.reading[shard] = false
+			reader.mutex.Unlock()
+			return
+		}
+		reader.mutex.Unlock()
+
+		streams, err := reader.rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: append(keys, cursors...),
+			Block:   inboxReadBlock,
+		}).Result()
+
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+
+		if err != nil {
+			time.Sleep(inboxReadRetryDelay)
+			continue
+		}
+
+		reader.mutex.Lock()
+		for _, stream := range streams {
+			for inbox := range reader.open[playerIds[stream.Stream]] {
+				inbox.deliver(stream.Messages)
+			}
+		}
+		reader.mutex.Unlock()
+	}
+}
+
+// deliver sends the client the messages it hasn't been sent yet. A client that can't keep up is disconnected, and
+// is sent them again once it reconnects. Expects the reader to already be locked
+func (inbox *redisInbox) deliver(messages []redis.XMessage) {
+	for _, message := range messages {
+		if compareStreamIds(message.ID, inbox.cursor) <= 0 {
+			continue
+		}
+
+		select {
+		case inbox.messages <- redisInboxMessage(message):
+			inbox.cursor = message.ID
+		default:
+			inbox.close()
+			return
+		}
+	}
+}
+
+func (inbox *redisInbox) Messages() <-chan InboxMessage {
+	return inbox.messages
+}
+
+// Moves a client's cursor forward to the acknowledged message, leaving it where it is if it is already at or past it,
+// so that acknowledgements arriving out of order never redeliver messages. KEYS[1] is the player's acks, and ARGV holds
+// the client ID, the message ID and how long to keep the acks for in milliseconds
+var ackInboxScript = redis.NewScript(`
+local function parse(id)
+	local millis, sequence = string.match(id or '', '^(%d+)-(%d+)$')
+	return tonumber(millis) or 0, tonumber(sequence) or 0
+end
+
+local currentMillis, currentSequence = parse(redis.call('HGET', KEYS[1], ARGV[1]) or '')
+local millis, sequence = parse(ARGV[2])
+
+if millis > currentMillis or (millis == currentMillis and sequence > currentSequence) then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+end
+
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+func (inbox *redisInbox) Ack(id string) error {
+	ctx := context.Background()
+	return ackInboxScript.Run(ctx, inbox.reader.rdb, []string{inboxAcksKey(inbox.playerId)}, inbox.clientId, id, inboxRetention.Milliseconds()).Err()
+}
+
+func (inbox *redisInbox) Close() error {
+	inbox.reader.mutex.Lock()
+	defer inbox.reader.mutex.Unlock()
+
+	inbox.close()
+	return nil
+}
+
+// close stops delivering to the inbox, and expects the reader to already be locked
+func (inbox *redisInbox) close() {
+	if inbox.closed {
+		return
+	}
+
+	inbox.closed = true
+	close(inbox.messages)
+
+	delete(inbox.reader.open[inbox.playerId], inbox)
+	if len(inbox.reader.open[inbox.playerId]) == 0 {
+		delete(inbox.reader.open, inbox.playerId)
+	}
+}
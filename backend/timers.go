@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+type TimerKind string
+
+const (
+	// Forfeits the game of a player who has been disconnected for too long
+	DisconnectForfeit TimerKind = "DISCONNECT_FORFEIT"
+	// Writes a finished game through to the database, for when writing it straight away failed
+	DatabaseWriteThrough TimerKind = "DATABASE_WRITE_THROUGH"
+	// Writes a tournament through to the database, for when writing it straight away failed
+	TournamentWriteThrough TimerKind = "TOURNAMENT_WRITE_THROUGH"
+	// Creates the lobby of a tournament game, for when creating it straight away failed
+	TournamentLobby TimerKind = "TOURNAMENT_LOBBY"
+	// Records the result of a finished game, for when recording it straight away failed or the node died first
+	RecordGameOver TimerKind = "RECORD_GAME_OVER"
+)
+
+// How long a player in a game can be disconnected from every node before they forfeit it
+const disconnectForfeitDelay = time.Minute
+
+// How often each node checks for timers that are due
+const timerPollInterval = time.Second
+
+// How long a node has to fire a timer it has claimed before another node may claim it again
+const timerLease = 30 * time.Second
+
+// How many due timers a node claims at a time
+const timerClaimBatch = 50
+
+// Timer is something the server has to do at a given time, whichever node is running then. Timers are kept in the
+// store and claimed by one node at a time, so each timer is only fired by one node
+type Timer struct {
+	// Scheduling a timer with the same ID as another replaces it
+	Id       string
+	Kind     TimerKind
+	PlayerId string `json:",omitempty"`
+	LobbyId  string `json:",omitempty"`
+	// The tournament to write through to the database, or whose game's lobby to create. It is read again when the
+	// timer fires, so that whatever it has changed to since is used
+	TournamentId string `json:",omitempty"`
+	// The finished game, for timers that write it through to the database
+	Game *ArchivedGame `json:",omitempty"`
+	// The lobby as it was when its game ended, for timers that record the game's result
+	Lobby *Lobby `json:",omitempty"`
+	DueAt time.Time
+}
+
+// TimerHandler fires a timer. If the node firing a timer dies or runs out of lease, the timer is fired again by
+// another node, so handlers check whether what they do still needs doing in the same transaction that does it
+type TimerHandler func(ctx context.Context, timer Timer) error
+
+// TimerStore keeps timers until they have been fired
+type TimerStore interface {
+	// ScheduleTimer sets the timer to fire once it is due, replacing any timer with the same ID
+	ScheduleTimer(ctx context.Context, timer Timer) error
+	// CancelTimer stops the timer from firing, unless a node is already firing it
+	CancelTimer(ctx context.Context, timerId string) error
+	// ClaimDueTimers claims up to limit timers that are due, so that no other node fires them until the lease runs out,
+	// and returns them along with when it does. Timers that can't be read are returned with only their ID
+	ClaimDueTimers(ctx context.Context, lease time.Duration, limit int) ([]Timer, time.Time, error)
+	// CompleteTimer deletes a timer that has been fired, unless it has been rescheduled or claimed again since
+	CompleteTimer(ctx context.Context, timerId string, leaseUntil time.Time) error
+}
+
+// timerHashTag puts the timer in a shard with other timers, so that due timers can be claimed a shard at a time
+func timerHashTag(shard int) string {
+	return "timers:" + strconv.Itoa(shard)
+}
+
+// timersKey holds the ID of every timer in the shard, scored by when it is next due in milliseconds. Claimed timers
+// are scored by when their lease runs out instead
+func timersKey(shard int) string {
+	return withHashTag(timerHashTag(shard), "timers")
+}
+
+func timerKey(timerId string) string {
+	return withHashTag(timerHashTag(shardOf(timerId)), "timer:"+timerId)
+}
+
+// Claims the timers that are due by pushing them back until their lease runs out. KEYS is the shard's timers, and
+// ARGV holds the lease in milliseconds, how many timers to claim, and optionally when the lease runs out in
+// milliseconds, so that timers claimed from every shard at once share one lease. Returns when the lease runs out
+// followed by the IDs of the claimed timers
+var claimTimersScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local leaseUntil = tonumber(ARGV[3]) or now + tonumber(ARGV[1])
+
+local claimed = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, tonumber(ARGV[2]))
+for _, id in ipairs(claimed) do
+	redis.call('ZADD', KEYS[1], leaseUntil, id)
+end
+
+table.insert(claimed, 1, tostring(leaseUntil))
+return claimed
+`)
+
+// Deletes a fired timer, unless it was rescheduled or claimed by another node since. KEYS are the timers and the
+// timer, and ARGV holds the timer's ID and when its lease runs out
+var completeTimerScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) ~= tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('DEL', KEYS[2])
+return 1
+`)
+
+func (store *RedisStore) ScheduleTimer(ctx context.Context, timer Timer) error {
+	timerJson, err := json.Marshal(timer)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, timerKey(timer.Id), string(timerJson), 0)
+		pipe.ZAdd(ctx, timersKey(shardOf(timer.Id)), redis.Z{Score: float64(timer.DueAt.UnixMilli()), Member: timer.Id})
+		return nil
+	})
+
+	return err
+}
+
+func (store *RedisStore) CancelTimer(ctx context.Context, timerId string) error {
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, timersKey(shardOf(timerId)), timerId)
+		pipe.Del(ctx, timerKey(timerId))
+		return nil
+	})
+
+	return err
+}
+
+func (store *RedisStore) ClaimDueTimers(ctx context.Context, lease time.Duration, limit int) ([]Timer, time.Time, error) {
+	var timers []Timer
+	var leaseUntil time.Time
+
+	// Starting from a different shard each time stops the first shards from always being claimed from first
+	shards := shardCount()
+	first := rand.IntN(shards)
+	for i := 0; i < shards && len(timers) < limit; i++ {
+		shard := (first + i) % shards
+
+		args := []any{lease.Milliseconds(), limit - len(timers)}
+		if !leaseUntil.IsZero() {
+			args = append(args, leaseUntil.UnixMilli())
+		}
+
+		claimed, err := claimTimersScript.Run(ctx, store.rdb, []string{timersKey(shard)}, args...).StringSlice()
+		if err != nil || len(claimed) == 0 {
+			return timers, leaseUntil, err
+		}
+
+		leaseMillis, err := strconv.ParseInt(claimed[0], 10, 64)
+		if err != nil {
+			return timers, leaseUntil, err
+		}
+		leaseUntil = time.UnixMilli(leaseMillis)
+
+		for _, timerId := range claimed[1:] {
+			timerJson, err := store.rdb.Get(ctx, timerKey(timerId)).Result()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return timers, leaseUntil, err
+			}
+
+			// Timers that were cancelled while being claimed have nothing to fire
+			if len(timerJson) == 0 {
+				if err := store.CompleteTimer(ctx, timerId, leaseUntil); err != nil {
+					return timers, leaseUntil, err
+				}
+
+				continue
+			}
+
+			timer := Timer{Id: timerId}
+			if err := json.Unmarshal([]byte(timerJson), &timer); err != nil {
+				timer = Timer{Id: timerId}
+			}
+
+			timers = append(timers, timer)
+		}
+	}
+
+	return timers, leaseUntil, nil
+}
+
+func (store *RedisStore) CompleteTimer(ctx context.Context, timerId string, leaseUntil time.Time) error {
+	return completeTimerScript.Run(ctx, store.rdb, []string{timersKey(shardOf(timerId)), timerKey(timerId)}, timerId, leaseUntil.UnixMilli()).Err()
+}
+
+func (store *MemoryStore) ScheduleTimer(ctx context.Context, timer Timer) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	timerJson, err := json.Marshal(timer)
+	if err != nil {
+		return err
+	}
+
+	store.timers[timer.Id] = timerJson
+	store.timersDueAt[timer.Id] = timer.DueAt.Truncate(time.Millisecond)
+	return nil
+}
+
+func (store *MemoryStore) CancelTimer(ctx context.Context, timerId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.timers, timerId)
+	delete(store.timersDueAt, timerId)
+	return nil
+}
+
+func (store *MemoryStore) ClaimDueTimers(ctx context.Context, lease time.Duration, limit int) ([]Timer, time.Time, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	leaseUntil := now.Add(lease).Truncate(time.Millisecond)
+
+	var timers []Timer
+	for timerId, dueAt := range store.timersDueAt {
+		if len(timers) >= limit {
+			break
+		}
+
+		if dueAt.After(now) {
+			continue
+		}
+
+		// Claimed timers are pushed back until their lease runs out, the same as in Redis
+		store.timersDueAt[timerId] = leaseUntil
+
+		timer, err := getMemoryJson[Timer](store.timers, timerId)
+		if err != nil || timer == nil {
+			timer = &Timer{Id: timerId}
+		}
+
+		timers = append(timers, *timer)
+	}
+
+	return timers, leaseUntil, nil
+}
+
+func (store *MemoryStore) CompleteTimer(ctx context.Context, timerId string, leaseUntil time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if dueAt, exists := store.timersDueAt[timerId]; exists && dueAt.Equal(leaseUntil) {
+		delete(store.timers, timerId)
+		delete(store.timersDueAt, timerId)
+	}
+
+	return nil
+}
+
+// RunTimers fires timers as they become due, until the context is done
+func RunTimers(ctx context.Context, store Store, logger *slog.Logger, handlers map[TimerKind]TimerHandler) {
+	ticker := time.NewTicker(timerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fireDueTimers(ctx, store, logger, handlers); err != nil {
+				logger.Warn("There was an error firing timers: " + err.Error())
+			}
+		}
+	}
+}
+
+func fireDueTimers(ctx context.Context, store Store, logger *slog.Logger, handlers map[TimerKind]TimerHandler) error {
+	timers, leaseUntil, err := store.ClaimDueTimers(ctx, timerLease, timerClaimBatch)
+	if err != nil {
+		return err
+	}
+
+	for _, timer := range timers {
+		timerLogger := logger.With(slog.String("timerId", timer.Id))
+
+		if handler, exists := handlers[timer.Kind]; len(timer.Kind) == 0 {
+			timerLogger.Warn("Dropping timer that couldn't be read")
+		} else if !exists {
+			timerLogger.Warn("Dropping timer of unknown kind " + string(timer.Kind))
+		} else if err := handler(ctx, timer); err != nil {
+			// Fired again once the lease runs out
+			timerLogger.Warn("There was an error firing timer: " + err.Error())
+			continue
+		}
+
+		err = store.CompleteTimer(ctx, timer.Id, leaseUntil)
+		if err != nil {
+			timerLogger.Warn("There was an error completing timer: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func disconnectForfeitTimerId(playerId string) string {
+	return "disconnect-forfeit:" + playerId
+}
+
+// ScheduleDisconnectForfeit gives a player who has disconnected from every node a while to reconnect before they
+// forfeit the game they are playing, if they are playing one
+func ScheduleDisconnectForfeit(ctx context.Context, store Store, playerId string) error {
+	lobby, err := GetPlayerLobby(ctx, store, playerId)
+	if err != nil || lobby == nil || lobby.Player2 == nil || lobby.Game == nil || lobby.Game.State == GameOver {
+		return err
+	}
+
+	return store.ScheduleTimer(ctx, Timer{
+		Id:       disconnectForfeitTimerId(playerId),
+		Kind:     DisconnectForfeit,
+		PlayerId: playerId,
+		LobbyId:  lobby.LobbyId,
+		DueAt:    time.Now().Add(disconnectForfeitDelay),
+	})
+}
+
+// ForfeitDisconnectedPlayer resigns the timer's player from their game, unless they have reconnected, left the lobby
+// or the game has ended since the timer was set
+func ForfeitDisconnectedPlayer(ctx context.Context, store Store, logger *slog.Logger, timer Timer) error {
+	connected, err := IsPlayerConnected(ctx, store, timer.PlayerId)
+	if err != nil || connected {
+		return err
+	}
+
+	logger = logger.With(slog.String("playerId", timer.PlayerId))
+	logger.Info("Player was disconnected for too long, forfeiting their game")
+
+	_, err = Resign(ctx, store, logger, timer.PlayerId, timer.LobbyId)
+
+	var validationError LobbyValidationError
+	var invalidMoveError *InvalidMoveError
+	if errors.As(err, &validationError) || errors.As(err, &invalidMoveError) {
+		logger.Debug("Game no longer needed forfeiting")
+		return nil
+	}
+
+	return err
+}
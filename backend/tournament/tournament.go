@@ -0,0 +1,462 @@
+package tournament
+
+import (
+	"math"
+	"sort"
+)
+
+type Format string
+
+const (
+	RoundRobin Format = "ROUND_ROBIN"
+	Swiss             = "SWISS"
+	Knockout          = "KNOCKOUT"
+)
+
+func IsValidFormat(format Format) bool {
+	return format == RoundRobin || format == Swiss || format == Knockout
+}
+
+// Pairing is a single game within a round. A pairing without a second player is a bye, which
+// counts as a win for the first player
+type Pairing struct {
+	Player1 string
+	Player2 *string
+	LobbyId *string
+	Winner  *string
+	// Both players forfeited, such as when their game was abandoned, so it counts as a loss for each of them
+	Forfeited bool `json:",omitempty"`
+}
+
+func (p Pairing) IsBye() bool {
+	return p.Player2 == nil
+}
+
+func (p Pairing) IsFinished() bool {
+	return p.IsBye() || p.Winner != nil || p.Forfeited
+}
+
+func (p Pairing) Opponent(playerId string) *string {
+	if p.Player1 == playerId {
+		return p.Player2
+	}
+
+	if p.Player2 != nil && *p.Player2 == playerId {
+		return &p.Player1
+	}
+
+	return nil
+}
+
+func (p Pairing) Includes(playerId string) bool {
+	return p.Player1 == playerId || (p.Player2 != nil && *p.Player2 == playerId)
+}
+
+// WinnerId returns the player who won the pairing, treating a bye as a win
+func (p Pairing) WinnerId() *string {
+	if p.IsBye() {
+		return &p.Player1
+	}
+
+	return p.Winner
+}
+
+type Round struct {
+	Number   int
+	Pairings []Pairing
+}
+
+func (r Round) IsFinished() bool {
+	for _, pairing := range r.Pairings {
+		if !pairing.IsFinished() {
+			return false
+		}
+	}
+
+	return true
+}
+
+type Standing struct {
+	PlayerId        string
+	Points          float64
+	Wins            int
+	Losses          int
+	Byes            int
+	Buchholz        float64
+	SonnebornBerger float64
+}
+
+// TotalRounds returns the number of rounds a tournament with the given number of players will
+// last. swissRounds is only used for Swiss tournaments, and defaults to enough rounds to find a
+// single undefeated player
+func TotalRounds(format Format, playerCount int, swissRounds int) int {
+	if playerCount < 2 {
+		return 0
+	}
+
+	switch format {
+	case RoundRobin:
+		if playerCount%2 == 0 {
+			return playerCount - 1
+		}
+
+		return playerCount
+	case Swiss:
+		if swissRounds > 0 {
+			return swissRounds
+		}
+
+		return int(math.Ceil(math.Log2(float64(playerCount))))
+	case Knockout:
+		return int(math.Ceil(math.Log2(float64(playerCount))))
+	}
+
+	return 0
+}
+
+// NextRound generates the pairings for the round after the given rounds. Players are expected to
+// be ordered by seed, strongest first
+func NextRound(format Format, players []string, rounds []Round) Round {
+	number := len(rounds) + 1
+
+	switch format {
+	case RoundRobin:
+		return Round{Number: number, Pairings: roundRobinPairings(players, len(rounds))}
+	case Swiss:
+		return Round{Number: number, Pairings: swissPairings(players, rounds)}
+	case Knockout:
+		return Round{Number: number, Pairings: knockoutPairings(players, rounds)}
+	}
+
+	return Round{Number: number}
+}
+
+// IsComplete returns whether no further rounds should be played
+func IsComplete(format Format, players []string, rounds []Round, swissRounds int) bool {
+	if len(rounds) > 0 && !rounds[len(rounds)-1].IsFinished() {
+		return false
+	}
+
+	if format == Knockout {
+		return len(remainingPlayers(players, rounds)) <= 1
+	}
+
+	return len(rounds) >= TotalRounds(format, len(players), swissRounds)
+}
+
+// roundRobinPairings uses the circle method, where the first player stays in place and everyone
+// else rotates by one position each round
+func roundRobinPairings(players []string, roundIndex int) []Pairing {
+	seats := make([]*string, len(players))
+	for i := range players {
+		player := players[i]
+		seats[i] = &player
+	}
+
+	if len(seats)%2 != 0 {
+		seats = append(seats, nil)
+	}
+
+	n := len(seats)
+	rotated := make([]*string, n)
+	rotated[0] = seats[0]
+	for i := 1; i < n; i++ {
+		rotated[1+(i-1+roundIndex)%(n-1)] = seats[i]
+	}
+
+	var pairings []Pairing
+	for i := 0; i < n/2; i++ {
+		first, second := rotated[i], rotated[n-1-i]
+
+		if first == nil && second == nil {
+			continue
+		}
+
+		if first == nil {
+			pairings = append(pairings, Pairing{Player1: *second})
+		} else if second == nil {
+			pairings = append(pairings, Pairing{Player1: *first})
+		} else {
+			pairings = append(pairings, Pairing{Player1: *first, Player2: second})
+		}
+	}
+
+	return pairings
+}
+
+// How many partial pairings pairWithoutRematches tries before giving up. Late rounds of large Swiss tournaments can
+// have so many used pairings that searching every ordering would never finish
+const maxPairingSteps = 10000
+
+// swissPairings pairs players with similar scores against each other while avoiding rematches.
+// The lowest ranked player who has not had a bye yet receives one if there is an odd number of players
+func swissPairings(players []string, rounds []Round) []Pairing {
+	standings := Standings(players, rounds)
+
+	ranked := make([]string, len(standings))
+	for i, standing := range standings {
+		ranked[i] = standing.PlayerId
+	}
+
+	var pairings []Pairing
+	if len(ranked)%2 != 0 {
+		byeIndex := len(ranked) - 1
+		for i := len(ranked) - 1; i >= 0; i-- {
+			if !hadBye(ranked[i], rounds) {
+				byeIndex = i
+				break
+			}
+		}
+
+		pairings = append(pairings, Pairing{Player1: ranked[byeIndex]})
+		ranked = append(ranked[:byeIndex:byeIndex], ranked[byeIndex+1:]...)
+	}
+
+	played := playedPairs(rounds)
+	steps := maxPairingSteps
+
+	matched, ok := pairWithoutRematches(ranked, played, &steps)
+	if !ok {
+		// Either every possible pairing includes a rematch, or one without couldn't be found in time, so allow as
+		// few rematches as pairing greedily by rank gives
+		matched = pairAvoidingRematches(ranked, played)
+	}
+
+	return append(matched, pairings...)
+}
+
+// pairWithoutRematches pairs each player with the highest ranked player below them that they haven't played yet,
+// backtracking when that leaves players who can't be paired. It gives up once it has used up the steps
+func pairWithoutRematches(ranked []string, played map[[2]string]bool, steps *int) ([]Pairing, bool) {
+	if len(ranked) == 0 {
+		return nil, true
+	}
+
+	first := ranked[0]
+	for i := 1; i < len(ranked); i++ {
+		if played[pairKey(first, ranked[i])] {
+			continue
+		}
+
+		if *steps <= 0 {
+			return nil, false
+		}
+		*steps--
+
+		rest := make([]string, 0, len(ranked)-2)
+		rest = append(rest, ranked[1:i]...)
+		rest = append(rest, ranked[i+1:]...)
+
+		if pairings, ok := pairWithoutRematches(rest, played, steps); ok {
+			opponent := ranked[i]
+			return append([]Pairing{{Player1: first, Player2: &opponent}}, pairings...), true
+		}
+	}
+
+	return nil, false
+}
+
+// pairAvoidingRematches pairs each player with the highest ranked unpaired player below them that they haven't
+// played yet, or the highest ranked one if they have played all of them
+func pairAvoidingRematches(ranked []string, played map[[2]string]bool) []Pairing {
+	paired := make([]bool, len(ranked))
+
+	var pairings []Pairing
+	for i := range ranked {
+		if paired[i] {
+			continue
+		}
+
+		opponentIndex := -1
+		for j := i + 1; j < len(ranked); j++ {
+			if paired[j] {
+				continue
+			}
+
+			if opponentIndex == -1 {
+				opponentIndex = j
+			}
+
+			if !played[pairKey(ranked[i], ranked[j])] {
+				opponentIndex = j
+				break
+			}
+		}
+
+		if opponentIndex == -1 {
+			break
+		}
+
+		paired[i], paired[opponentIndex] = true, true
+		opponent := ranked[opponentIndex]
+		pairings = append(pairings, Pairing{Player1: ranked[i], Player2: &opponent})
+	}
+
+	return pairings
+}
+
+// playedPairs returns every pair of players who have already played each other
+func playedPairs(rounds []Round) map[[2]string]bool {
+	played := map[[2]string]bool{}
+	for _, round := range rounds {
+		for _, pairing := range round.Pairings {
+			if !pairing.IsBye() {
+				played[pairKey(pairing.Player1, *pairing.Player2)] = true
+			}
+		}
+	}
+
+	return played
+}
+
+func pairKey(a string, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return [2]string{a, b}
+}
+
+// knockoutPairings pairs the strongest remaining seed against the weakest. With an odd number of
+// remaining players the middle seed receives a bye
+func knockoutPairings(players []string, rounds []Round) []Pairing {
+	remaining := remainingPlayers(players, rounds)
+
+	var pairings []Pairing
+	for i, j := 0, len(remaining)-1; i <= j; i, j = i+1, j-1 {
+		if i == j {
+			pairings = append(pairings, Pairing{Player1: remaining[i]})
+		} else {
+			opponent := remaining[j]
+			pairings = append(pairings, Pairing{Player1: remaining[i], Player2: &opponent})
+		}
+	}
+
+	return pairings
+}
+
+// remainingPlayers returns the players still in a knockout tournament, in seed order
+func remainingPlayers(players []string, rounds []Round) []string {
+	if len(rounds) == 0 {
+		return players
+	}
+
+	winners := map[string]bool{}
+	for _, pairing := range rounds[len(rounds)-1].Pairings {
+		if winner := pairing.WinnerId(); winner != nil {
+			winners[*winner] = true
+		}
+	}
+
+	var remaining []string
+	for _, player := range players {
+		if winners[player] {
+			remaining = append(remaining, player)
+		}
+	}
+
+	return remaining
+}
+
+func hadBye(player string, rounds []Round) bool {
+	for _, round := range rounds {
+		for _, pairing := range round.Pairings {
+			if pairing.IsBye() && pairing.Player1 == player {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Standings ranks players by points, breaking ties with Buchholz (the sum of the opponents' points),
+// then Sonneborn-Berger (the sum of the points of defeated opponents), then seed
+func Standings(players []string, rounds []Round) []Standing {
+	byPlayer := map[string]*Standing{}
+	standings := make([]Standing, len(players))
+	for i, player := range players {
+		standings[i] = Standing{PlayerId: player}
+		byPlayer[player] = &standings[i]
+	}
+
+	for _, round := range rounds {
+		for _, pairing := range round.Pairings {
+			if pairing.Forfeited {
+				for _, player := range []string{pairing.Player1, *pairing.Player2} {
+					if standing, exists := byPlayer[player]; exists {
+						standing.Losses++
+					}
+				}
+
+				continue
+			}
+
+			winner := pairing.WinnerId()
+			if winner == nil {
+				continue
+			}
+
+			if standing, exists := byPlayer[*winner]; exists {
+				standing.Points++
+				standing.Wins++
+				if pairing.IsBye() {
+					standing.Byes++
+				}
+			}
+
+			if loser := pairing.Opponent(*winner); loser != nil {
+				if standing, exists := byPlayer[*loser]; exists {
+					standing.Losses++
+				}
+			}
+		}
+	}
+
+	for _, round := range rounds {
+		for _, pairing := range round.Pairings {
+			if pairing.IsBye() || pairing.Winner == nil {
+				continue
+			}
+
+			player1, player1Exists := byPlayer[pairing.Player1]
+			player2, player2Exists := byPlayer[*pairing.Player2]
+			if !player1Exists || !player2Exists {
+				continue
+			}
+
+			player1.Buchholz += player2.Points
+			player2.Buchholz += player1.Points
+
+			if *pairing.Winner == pairing.Player1 {
+				player1.SonnebornBerger += player2.Points
+			} else {
+				player2.SonnebornBerger += player1.Points
+			}
+		}
+	}
+
+	seeds := map[string]int{}
+	for i, player := range players {
+		seeds[player] = i
+	}
+
+	sort.SliceStable(standings, func(i, j int) bool {
+		a, b := standings[i], standings[j]
+		if a.Points != b.Points {
+			return a.Points > b.Points
+		}
+
+		if a.Buchholz != b.Buchholz {
+			return a.Buchholz > b.Buchholz
+		}
+
+		if a.SonnebornBerger != b.SonnebornBerger {
+			return a.SonnebornBerger > b.SonnebornBerger
+		}
+
+		return seeds[a.PlayerId] < seeds[b.PlayerId]
+	})
+
+	return standings
+}
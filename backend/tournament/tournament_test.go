@@ -0,0 +1,438 @@
+package tournament
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testPlayers(count int) []string {
+	players := make([]string, count)
+	for i := range players {
+		players[i] = fmt.Sprintf("p%02d", i+1)
+	}
+
+	return players
+}
+
+// finishRound has the first player of every pairing win it
+func finishRound(round Round) Round {
+	for i, pairing := range round.Pairings {
+		if !pairing.IsBye() {
+			winner := pairing.Player1
+			round.Pairings[i].Winner = &winner
+		}
+	}
+
+	return round
+}
+
+// playTournament plays every round of the tournament, with the first player of every pairing winning
+func playTournament(t *testing.T, format Format, players []string, swissRounds int) []Round {
+	t.Helper()
+
+	var rounds []Round
+	for !IsComplete(format, players, rounds, swissRounds) {
+		if len(rounds) > len(players) {
+			t.Fatalf("Tournament of %d players didn't finish", len(players))
+		}
+
+		rounds = append(rounds, finishRound(NextRound(format, players, rounds)))
+	}
+
+	return rounds
+}
+
+// checkRound fails the test unless every player is in exactly one pairing of the round
+func checkRound(t *testing.T, players []string, round Round) {
+	t.Helper()
+
+	seen := map[string]int{}
+	for _, pairing := range round.Pairings {
+		seen[pairing.Player1]++
+		if pairing.Player2 != nil {
+			seen[*pairing.Player2]++
+		}
+	}
+
+	for _, player := range players {
+		if seen[player] != 1 {
+			t.Fatalf("Expected %s to be paired once in round %d, got %d: %+v", player, round.Number, seen[player], round.Pairings)
+		}
+	}
+}
+
+func byes(round Round) []string {
+	var players []string
+	for _, pairing := range round.Pairings {
+		if pairing.IsBye() {
+			players = append(players, pairing.Player1)
+		}
+	}
+
+	return players
+}
+
+func pairs(round Round) [][2]string {
+	var players [][2]string
+	for _, pairing := range round.Pairings {
+		if !pairing.IsBye() {
+			players = append(players, [2]string{pairing.Player1, *pairing.Player2})
+		}
+	}
+
+	return players
+}
+
+func TestRoundRobin(t *testing.T) {
+	for count := 2; count <= 9; count++ {
+		t.Run(fmt.Sprintf("%d players", count), func(t *testing.T) {
+			players := testPlayers(count)
+			rounds := playTournament(t, RoundRobin, players, 0)
+
+			if len(rounds) != TotalRounds(RoundRobin, count, 0) {
+				t.Fatalf("Expected %d rounds, got %d", TotalRounds(RoundRobin, count, 0), len(rounds))
+			}
+
+			played := map[[2]string]int{}
+			byeCounts := map[string]int{}
+			for _, round := range rounds {
+				checkRound(t, players, round)
+
+				roundByes := byes(round)
+				if len(roundByes) != count%2 {
+					t.Fatalf("Expected %d byes in round %d, got %v", count%2, round.Number, roundByes)
+				}
+
+				for _, player := range roundByes {
+					byeCounts[player]++
+				}
+
+				for _, pair := range pairs(round) {
+					played[pairKey(pair[0], pair[1])]++
+				}
+			}
+
+			// The circle method has everyone play everyone else exactly once
+			for i, a := range players {
+				for _, b := range players[i+1:] {
+					if played[pairKey(a, b)] != 1 {
+						t.Fatalf("Expected %s and %s to play once, got %d", a, b, played[pairKey(a, b)])
+					}
+				}
+			}
+
+			// With an odd number of players, the empty seat rotates so everyone sits out exactly once
+			for _, player := range players {
+				if count%2 != 0 && byeCounts[player] != 1 {
+					t.Fatalf("Expected %s to have one bye, got %d", player, byeCounts[player])
+				}
+			}
+		})
+	}
+}
+
+func TestSwissPairings(t *testing.T) {
+	tests := []struct {
+		name          string
+		players       int
+		rounds        int
+		expectedByes  []string
+		expectedPairs [][2]string
+	}{
+		{
+			name:          "first round pairs by seed",
+			players:       4,
+			expectedPairs: [][2]string{{"p01", "p02"}, {"p03", "p04"}},
+		},
+		{
+			name:          "odd players gives the lowest seed a bye",
+			players:       5,
+			expectedByes:  []string{"p05"},
+			expectedPairs: [][2]string{{"p01", "p02"}, {"p03", "p04"}},
+		},
+		{
+			// p05 is ranked with the winners of the first round, but the bye still goes to the lowest ranked player who
+			// hasn't had one, p04
+			name:          "bye isn't given twice",
+			players:       5,
+			rounds:        1,
+			expectedByes:  []string{"p04"},
+			expectedPairs: [][2]string{{"p01", "p03"}, {"p05", "p02"}},
+		},
+		{
+			// p01 has beaten p02 and p03 has beaten p04, so the leaders meet and p02 plays p04
+			name:          "winners meet",
+			players:       4,
+			rounds:        1,
+			expectedPairs: [][2]string{{"p01", "p03"}, {"p02", "p04"}},
+		},
+		{
+			// p01 has already played p02 and p03, leaving only p04
+			name:          "rematches are avoided",
+			players:       4,
+			rounds:        2,
+			expectedPairs: [][2]string{{"p01", "p04"}, {"p02", "p03"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			players := testPlayers(test.players)
+
+			var rounds []Round
+			for range test.rounds {
+				rounds = append(rounds, finishRound(NextRound(Swiss, players, rounds)))
+			}
+
+			round := NextRound(Swiss, players, rounds)
+			checkRound(t, players, round)
+
+			if actual := byes(round); !reflect.DeepEqual(actual, test.expectedByes) {
+				t.Fatalf("Expected byes %v, got %v", test.expectedByes, actual)
+			}
+
+			if actual := pairs(round); !reflect.DeepEqual(actual, test.expectedPairs) {
+				t.Fatalf("Expected pairs %v, got %v", test.expectedPairs, actual)
+			}
+		})
+	}
+}
+
+func TestSwissTournament(t *testing.T) {
+	tests := []struct {
+		name    string
+		players int
+		rounds  int
+	}{
+		{name: "even players", players: 8},
+		{name: "odd players", players: 7},
+		{name: "one round per player with an odd number", players: 5, rounds: 5},
+		{name: "large tournament", players: 64},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			players := testPlayers(test.players)
+			rounds := playTournament(t, Swiss, players, test.rounds)
+
+			played := map[[2]string]bool{}
+			byeCounts := map[string]int{}
+			for _, round := range rounds {
+				checkRound(t, players, round)
+
+				for _, player := range byes(round) {
+					byeCounts[player]++
+					if byeCounts[player] > 1 {
+						t.Fatalf("%s had a second bye in round %d", player, round.Number)
+					}
+				}
+
+				for _, pair := range pairs(round) {
+					if played[pairKey(pair[0], pair[1])] {
+						t.Fatalf("%s and %s were paired again in round %d", pair[0], pair[1], round.Number)
+					}
+
+					played[pairKey(pair[0], pair[1])] = true
+				}
+			}
+		})
+	}
+}
+
+func TestSwissPairingsAllowRematchesWhenUnavoidable(t *testing.T) {
+	players := testPlayers(4)
+	rounds := playTournament(t, RoundRobin, players, 0)
+
+	// Everyone has played everyone, so every pairing is a rematch
+	round := NextRound(Swiss, players, rounds)
+	checkRound(t, players, round)
+
+	if len(pairs(round)) != 2 {
+		t.Fatalf("Expected two pairings, got %+v", round.Pairings)
+	}
+}
+
+func TestPairWithoutRematches(t *testing.T) {
+	tests := []struct {
+		name     string
+		ranked   []string
+		played   [][2]string
+		expected [][2]string
+		ok       bool
+	}{
+		{
+			name:     "no one has played",
+			ranked:   []string{"a", "b", "c", "d"},
+			expected: [][2]string{{"a", "b"}, {"c", "d"}},
+			ok:       true,
+		},
+		{
+			// Pairing a with b would leave c and d, who have played, so a plays c instead
+			name:     "backtracks",
+			ranked:   []string{"a", "b", "c", "d"},
+			played:   [][2]string{{"c", "d"}},
+			expected: [][2]string{{"a", "c"}, {"b", "d"}},
+			ok:       true,
+		},
+		{
+			name:   "impossible",
+			ranked: []string{"a", "b", "c", "d"},
+			played: [][2]string{{"a", "b"}, {"a", "c"}, {"a", "d"}},
+			ok:     false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			played := map[[2]string]bool{}
+			for _, pair := range test.played {
+				played[pairKey(pair[0], pair[1])] = true
+			}
+
+			steps := maxPairingSteps
+			pairings, ok := pairWithoutRematches(test.ranked, played, &steps)
+			if ok != test.ok {
+				t.Fatalf("Expected ok to be %v, got %v", test.ok, ok)
+			}
+
+			if actual := pairs(Round{Pairings: pairings}); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("Expected pairs %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPairWithoutRematchesGivesUp(t *testing.T) {
+	// The lowest ranked player has played everyone, so no pairing exists, but finding that out means trying every way
+	// of pairing the others
+	ranked := testPlayers(40)
+	last := ranked[len(ranked)-1]
+
+	played := map[[2]string]bool{}
+	for _, player := range ranked[:len(ranked)-1] {
+		played[pairKey(player, last)] = true
+	}
+
+	steps := maxPairingSteps
+	if _, ok := pairWithoutRematches(ranked, played, &steps); ok {
+		t.Fatal("Expected no pairing to be found")
+	}
+
+	if steps != 0 {
+		t.Fatalf("Expected the search to use up its steps, %d are left", steps)
+	}
+
+	// swissPairings falls back to pairing greedily, which only leaves the last player with a rematch
+	pairings := pairAvoidingRematches(ranked, played)
+	checkRound(t, ranked, Round{Pairings: pairings})
+
+	rematches := 0
+	for _, pair := range pairs(Round{Pairings: pairings}) {
+		if played[pairKey(pair[0], pair[1])] {
+			rematches++
+		}
+	}
+
+	if rematches != 1 {
+		t.Fatalf("Expected one rematch, got %d", rematches)
+	}
+}
+
+func TestKnockout(t *testing.T) {
+	tests := []struct {
+		name     string
+		players  int
+		expected []Round
+	}{
+		{
+			name:    "two players",
+			players: 2,
+			expected: []Round{
+				{Number: 1, Pairings: []Pairing{{Player1: "p01", Player2: ptr("p02")}}},
+			},
+		},
+		{
+			name:    "power of two",
+			players: 4,
+			expected: []Round{
+				{Number: 1, Pairings: []Pairing{{Player1: "p01", Player2: ptr("p04")}, {Player1: "p02", Player2: ptr("p03")}}},
+				{Number: 2, Pairings: []Pairing{{Player1: "p01", Player2: ptr("p02")}}},
+			},
+		},
+		{
+			// The middle seed gets a bye whenever an odd number of players remain
+			name:    "odd players",
+			players: 5,
+			expected: []Round{
+				{Number: 1, Pairings: []Pairing{{Player1: "p01", Player2: ptr("p05")}, {Player1: "p02", Player2: ptr("p04")}, {Player1: "p03"}}},
+				{Number: 2, Pairings: []Pairing{{Player1: "p01", Player2: ptr("p03")}, {Player1: "p02"}}},
+				{Number: 3, Pairings: []Pairing{{Player1: "p01", Player2: ptr("p02")}}},
+			},
+		},
+		{
+			name:    "three players",
+			players: 3,
+			expected: []Round{
+				{Number: 1, Pairings: []Pairing{{Player1: "p01", Player2: ptr("p03")}, {Player1: "p02"}}},
+				{Number: 2, Pairings: []Pairing{{Player1: "p01", Player2: ptr("p02")}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			players := testPlayers(test.players)
+			rounds := playTournament(t, Knockout, players, 0)
+
+			if len(rounds) != len(test.expected) {
+				t.Fatalf("Expected %d rounds, got %d", len(test.expected), len(rounds))
+			}
+
+			for i, round := range rounds {
+				expected := finishRound(test.expected[i])
+				if !reflect.DeepEqual(round, expected) {
+					t.Fatalf("Expected round %d to be %+v, got %+v", i+1, expected, round)
+				}
+			}
+
+			if len(rounds) != TotalRounds(Knockout, test.players, 0) {
+				t.Fatalf("Expected TotalRounds to be %d, got %d", len(rounds), TotalRounds(Knockout, test.players, 0))
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+// A pairing both players forfeited is a loss for each of them, and neither goes through to the next round
+func TestForfeitedPairing(t *testing.T) {
+	players := testPlayers(4)
+
+	round := NextRound(Knockout, players, nil)
+	round.Pairings[0].Winner = &round.Pairings[0].Player1
+	round.Pairings[1].Forfeited = true
+	rounds := []Round{round}
+
+	if !round.IsFinished() {
+		t.Fatal("Expected the round to be finished")
+	}
+
+	// Only the winner of the other pairing is left
+	if !IsComplete(Knockout, players, rounds, 0) {
+		t.Fatalf("Expected the tournament to be complete, %v are left", remainingPlayers(players, rounds))
+	}
+
+	for _, standing := range Standings(players, rounds) {
+		expectedLosses := 1
+		if standing.PlayerId == "p01" {
+			expectedLosses = 0
+		}
+
+		if standing.Losses != expectedLosses || (standing.PlayerId != "p01" && standing.Points != 0) {
+			t.Fatalf("Expected %s to have %d losses, got %+v", standing.PlayerId, expectedLosses, standing)
+		}
+	}
+}
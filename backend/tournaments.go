@@ -0,0 +1,703 @@
+package main
+
+import (
+	"backend/tournament"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type TournamentState string
+
+const (
+	TournamentRegistering TournamentState = "REGISTERING"
+	TournamentInProgress                  = "IN_PROGRESS"
+	TournamentFinished                    = "FINISHED"
+)
+
+type Tournament struct {
+	TournamentId string
+	Name         string
+	Format       tournament.Format
+	OrganizerId  string
+	State        TournamentState
+	// Ordered by seed once the tournament has started
+	Players     []string
+	SwissRounds int
+	Rounds      []tournament.Round
+	Standings   []tournament.Standing
+	CreatedAt   time.Time
+	StartedAt   *time.Time
+	FinishedAt  *time.Time
+}
+
+type TournamentPage struct {
+	Tournaments []Tournament
+	Offset      int
+	Limit       int
+	Total       int
+}
+
+type TournamentValidationError struct {
+	cause   ErrorCode
+	message string
+}
+
+func (e TournamentValidationError) Error() string {
+	return string(e.cause)
+}
+
+func tournamentKey(tournamentId string) string {
+	return "tournament:" + tournamentId
+}
+
+// TournamentStore keeps tournaments while they are being played, along with a list of every tournament
+type TournamentStore interface {
+	// GetTournament returns the tournament with the given ID, or nil if it doesn't exist
+	GetTournament(ctx context.Context, tournamentId string) (*Tournament, error)
+	// CreateTournament saves a new tournament and adds it to the list
+	CreateTournament(ctx context.Context, tourney Tournament) error
+	// ModifyTournament runs the function on the tournament in a transaction, returning it as it was saved, or nil if it
+	// doesn't exist. If the tournament changes before it is saved, the function is run again, up to a few times before
+	// giving up with ErrTxConflict
+	ModifyTournament(ctx context.Context, tournamentId string, modify func(tourney *Tournament) error) (*Tournament, error)
+	// ListTournaments returns a page of the list of tournaments, most recently created first
+	ListTournaments(ctx context.Context, offset int, limit int) (TournamentPage, error)
+}
+
+func (store *RedisStore) GetTournament(ctx context.Context, tournamentId string) (*Tournament, error) {
+	return getRedisJson[Tournament](ctx, store.rdb, tournamentKey(tournamentId))
+}
+
+func (store *RedisStore) CreateTournament(ctx context.Context, tourney Tournament) error {
+	// Under Cluster the tournament and the list of tournaments can be in different slots. The tournament is saved
+	// first, so that the list never holds a tournament that doesn't exist
+	err := store.rdb.JSONSet(ctx, tournamentKey(tourney.TournamentId), "$", tourney).Err()
+	if err != nil {
+		return err
+	}
+
+	return store.rdb.ZAdd(ctx, "tournaments", redis.Z{Score: float64(tourney.CreatedAt.UnixMilli()), Member: tourney.TournamentId}).Err()
+}
+
+func (store *RedisStore) ModifyTournament(ctx context.Context, tournamentId string, modify func(tourney *Tournament) error) (*Tournament, error) {
+	var modified *Tournament
+
+	tx := func(tx *redis.Tx) error {
+		modified = nil
+
+		tourney, err := getRedisJson[Tournament](ctx, tx, tournamentKey(tournamentId))
+		if err != nil || tourney == nil {
+			return err
+		}
+
+		if err := modify(tourney); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.JSONSet(ctx, tournamentKey(tournamentId), "$", tourney).Err()
+		})
+
+		if err == nil {
+			modified = tourney
+		}
+
+		return err
+	}
+
+	err := WatchWithRetries(ctx, func() error {
+		return store.rdb.Watch(ctx, tx, tournamentKey(tournamentId))
+	}, storeTxAttempts)
+
+	if errors.Is(err, redis.TxFailedErr) {
+		return nil, ErrTxConflict
+	}
+
+	return modified, err
+}
+
+func (store *RedisStore) ListTournaments(ctx context.Context, offset int, limit int) (TournamentPage, error) {
+	page := TournamentPage{
+		Tournaments: []Tournament{},
+		Offset:      offset,
+		Limit:       limit,
+	}
+
+	total, err := store.rdb.ZCard(ctx, "tournaments").Result()
+	if err != nil {
+		return page, err
+	}
+	page.Total = int(total)
+
+	tournamentIds, err := store.rdb.ZRevRange(ctx, "tournaments", int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return page, err
+	}
+
+	for _, tournamentId := range tournamentIds {
+		tourney, err := store.GetTournament(ctx, tournamentId)
+		if err != nil {
+			return page, err
+		}
+
+		if tourney != nil {
+			page.Tournaments = append(page.Tournaments, *tourney)
+		}
+	}
+
+	return page, nil
+}
+
+func (store *MemoryStore) GetTournament(ctx context.Context, tournamentId string) (*Tournament, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return getMemoryJson[Tournament](store.tournaments, tournamentId)
+}
+
+func (store *MemoryStore) CreateTournament(ctx context.Context, tourney Tournament) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tournamentJson, err := json.Marshal(tourney)
+	if err != nil {
+		return err
+	}
+
+	store.tournaments[tourney.TournamentId] = tournamentJson
+	store.tournamentIds = append(store.tournamentIds, tourney.TournamentId)
+	return nil
+}
+
+func (store *MemoryStore) ModifyTournament(ctx context.Context, tournamentId string, modify func(tourney *Tournament) error) (*Tournament, error) {
+	return modifyMemoryJson(store, store.tournaments, tournamentId, modify, nil)
+}
+
+func (store *MemoryStore) ListTournaments(ctx context.Context, offset int, limit int) (TournamentPage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	page := TournamentPage{
+		Tournaments: []Tournament{},
+		Offset:      offset,
+		Limit:       limit,
+		Total:       len(store.tournamentIds),
+	}
+
+	// Tournaments are listed in the order they were created, so the latest are at the end
+	for i := len(store.tournamentIds) - 1 - offset; i >= 0 && len(page.Tournaments) < limit; i-- {
+		tourney, err := getMemoryJson[Tournament](store.tournaments, store.tournamentIds[i])
+		if err != nil {
+			return page, err
+		}
+
+		page.Tournaments = append(page.Tournaments, *tourney)
+	}
+
+	return page, nil
+}
+
+// UpdateTournament applies update to the stored tournament inside a transaction. The lobbies of any round started by
+// the update are created once the transaction has succeeded, and participants are sent the updated tournament
+func UpdateTournament(ctx context.Context, store Store, logger *slog.Logger, tournamentId string, update func(tourney *Tournament) error) (*Tournament, error) {
+	var startedRound *tournament.Round
+	var finishedRound *tournament.Round
+
+	updated, err := store.ModifyTournament(ctx, tournamentId, func(tourney *Tournament) error {
+		roundCount := len(tourney.Rounds)
+
+		err := update(tourney)
+		if err != nil {
+			return err
+		}
+
+		startedRound, finishedRound = nil, nil
+		if tourney.State == TournamentInProgress && len(tourney.Rounds) > 0 && tourney.Rounds[len(tourney.Rounds)-1].IsFinished() {
+			round := tourney.Rounds[len(tourney.Rounds)-1]
+			finishedRound = &round
+			startedRound = advanceTournament(tourney)
+		} else if len(tourney.Rounds) > roundCount {
+			startedRound = &tourney.Rounds[len(tourney.Rounds)-1]
+		}
+
+		tourney.Standings = tournament.Standings(tourney.Players, tourney.Rounds)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if updated == nil {
+		return nil, TournamentValidationError{cause: TournamentNotFound, message: "No tournament with ID " + tournamentId + " found"}
+	}
+
+	logger = logger.With(slog.String("tournamentId", tournamentId))
+
+	if finishedRound != nil {
+		deleteRoundLobbies(ctx, store, logger, *finishedRound)
+	}
+
+	if startedRound != nil {
+		logger.Info("Starting round " + strconv.Itoa(startedRound.Number))
+		for _, pairing := range startedRound.Pairings {
+			if pairing.IsBye() {
+				continue
+			}
+
+			err := createTournamentLobby(ctx, store, logger, updated.TournamentId, pairing)
+			if err != nil {
+				logger.Warn("There was an error creating tournament lobby, it will be tried again: " + err.Error())
+			}
+		}
+	}
+
+	if database := GetDatabaseFromContext(ctx); database != nil {
+		err = writeTournamentThroughToDatabase(ctx, store, database, logger, *updated)
+		if err != nil {
+			logger.Warn("There was an error writing the tournament to the database: " + err.Error())
+		}
+	}
+
+	PublishLobbyEvent(ctx, store, logger, LobbyEventMessage{
+		Event:      TournamentUpdate,
+		Tournament: updated,
+	}, updated.Players...)
+
+	return updated, nil
+}
+
+func tournamentWriteThroughTimerId(tournamentId string) string {
+	return "tournament-write-through:" + tournamentId
+}
+
+// writeTournamentThroughToDatabase saves the tournament to the database. Like games, a timer is scheduled before
+// trying and only cancelled once the tournament has been saved
+func writeTournamentThroughToDatabase(ctx context.Context, store Store, database *Database, logger *slog.Logger, tourney Tournament) error {
+	timerId := tournamentWriteThroughTimerId(tourney.TournamentId)
+
+	err := store.ScheduleTimer(ctx, Timer{
+		Id:           timerId,
+		Kind:         TournamentWriteThrough,
+		TournamentId: tourney.TournamentId,
+		DueAt:        time.Now().Add(databaseWriteThroughRetryDelay),
+	})
+	if err != nil {
+		logger.Warn("There was an error scheduling the database write to be retried: " + err.Error())
+	}
+
+	err = database.SaveTournament(ctx, tourney)
+	if err != nil {
+		return err
+	}
+
+	return store.CancelTimer(ctx, timerId)
+}
+
+// RetryTournamentWriteThrough saves the timer's tournament to the database as it is now
+func RetryTournamentWriteThrough(ctx context.Context, store Store, database *Database, logger *slog.Logger, timer Timer) error {
+	tourney, err := store.GetTournament(ctx, timer.TournamentId)
+	if err != nil || tourney == nil {
+		return err
+	}
+
+	logger.With(slog.String("tournamentId", tourney.TournamentId)).Info("Retrying writing tournament through to the database")
+
+	return database.SaveTournament(ctx, *tourney)
+}
+
+// How long after failing to create a tournament game's lobby it is tried again
+const tournamentLobbyRetryDelay = 10 * time.Second
+
+func tournamentLobbyTimerId(lobbyId string) string {
+	return "tournament-lobby:" + lobbyId
+}
+
+func newTournamentLobby(tournamentId string, pairing tournament.Pairing) Lobby {
+	return Lobby{
+		LobbyId:      *pairing.LobbyId,
+		Player1:      pairing.Player1,
+		Player2:      pairing.Player2,
+		TournamentId: &tournamentId,
+	}
+}
+
+// createTournamentLobby creates the lobby for one of a round's games. A timer is scheduled before trying and only
+// cancelled once the lobby has been created, so that the game isn't left without a lobby, which would stop the round
+// from ever finishing
+func createTournamentLobby(ctx context.Context, store Store, logger *slog.Logger, tournamentId string, pairing tournament.Pairing) error {
+	timerId := tournamentLobbyTimerId(*pairing.LobbyId)
+
+	err := store.ScheduleTimer(ctx, Timer{
+		Id:           timerId,
+		Kind:         TournamentLobby,
+		TournamentId: tournamentId,
+		LobbyId:      *pairing.LobbyId,
+		DueAt:        time.Now().Add(tournamentLobbyRetryDelay),
+	})
+	if err != nil {
+		logger.Warn("There was an error scheduling the tournament lobby to be created again: " + err.Error())
+	}
+
+	err = CreateMatchLobby(ctx, store, logger, newTournamentLobby(tournamentId, pairing))
+	if err != nil {
+		return err
+	}
+
+	return store.CancelTimer(ctx, timerId)
+}
+
+// RetryTournamentLobby creates the lobby for the timer's tournament game, unless the game has finished since
+func RetryTournamentLobby(ctx context.Context, store Store, logger *slog.Logger, timer Timer) error {
+	tourney, err := store.GetTournament(ctx, timer.TournamentId)
+	if err != nil || tourney == nil || tourney.State != TournamentInProgress || len(tourney.Rounds) == 0 {
+		return err
+	}
+
+	for _, pairing := range tourney.Rounds[len(tourney.Rounds)-1].Pairings {
+		if pairing.LobbyId == nil || *pairing.LobbyId != timer.LobbyId || pairing.IsFinished() {
+			continue
+		}
+
+		logger.With(slog.String("tournamentId", tourney.TournamentId)).Info("Retrying creating tournament lobby")
+		return CreateMatchLobby(ctx, store, logger, newTournamentLobby(tourney.TournamentId, pairing))
+	}
+
+	return nil
+}
+
+// advanceTournament starts the next round of a tournament whose current round has finished, or finishes the
+// tournament if there are no rounds left to play
+func advanceTournament(tourney *Tournament) *tournament.Round {
+	if tournament.IsComplete(tourney.Format, tourney.Players, tourney.Rounds, tourney.SwissRounds) {
+		now := time.Now()
+		tourney.State = TournamentFinished
+		tourney.FinishedAt = &now
+
+		return nil
+	}
+
+	round := tournament.NextRound(tourney.Format, tourney.Players, tourney.Rounds)
+	for i := range round.Pairings {
+		if !round.Pairings[i].IsBye() {
+			lobbyId := NewLobbyId()
+			round.Pairings[i].LobbyId = &lobbyId
+		}
+	}
+
+	tourney.Rounds = append(tourney.Rounds, round)
+
+	return &tourney.Rounds[len(tourney.Rounds)-1]
+}
+
+// deleteRoundLobbies removes the lobbies of a finished round, taking out the players still in them. Their games have
+// already been archived
+func deleteRoundLobbies(ctx context.Context, store Store, logger *slog.Logger, round tournament.Round) {
+	for _, pairing := range round.Pairings {
+		if pairing.LobbyId == nil {
+			continue
+		}
+
+		lobbyId := *pairing.LobbyId
+		err := store.UpdateLobby(ctx, lobbyId, func(tx LobbyTx) error {
+			tx.DeleteLobby()
+			return nil
+		})
+		if err != nil {
+			logger.Warn("There was an error deleting tournament lobby " + lobbyId + ": " + err.Error())
+			continue
+		}
+
+		for _, playerId := range []string{pairing.Player1, *pairing.Player2} {
+			if _, err := clearCurrentLobby(ctx, store, playerId, lobbyId); err != nil {
+				logger.Warn("There was an error taking player " + playerId + " out of tournament lobby " + lobbyId + ": " + err.Error())
+			}
+		}
+	}
+}
+
+// RecordTournamentResult records the winner of a tournament game, starting the next round once every game in
+// the current round has finished
+func RecordTournamentResult(ctx context.Context, store Store, logger *slog.Logger, tournamentId string, lobbyId string, winnerId string) error {
+	_, err := UpdateTournament(ctx, store, logger, tournamentId, func(tourney *Tournament) error {
+		if tourney.State != TournamentInProgress || len(tourney.Rounds) == 0 {
+			return nil
+		}
+
+		round := &tourney.Rounds[len(tourney.Rounds)-1]
+		for i, pairing := range round.Pairings {
+			if pairing.LobbyId != nil && *pairing.LobbyId == lobbyId && pairing.Winner == nil && pairing.Includes(winnerId) {
+				round.Pairings[i].Winner = &winnerId
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// RecordTournamentForfeit records that both players forfeited a tournament game that was abandoned before it finished,
+// starting the next round once every game in the current round has finished
+func RecordTournamentForfeit(ctx context.Context, store Store, logger *slog.Logger, tournamentId string, lobbyId string) error {
+	_, err := UpdateTournament(ctx, store, logger, tournamentId, func(tourney *Tournament) error {
+		if tourney.State != TournamentInProgress || len(tourney.Rounds) == 0 {
+			return nil
+		}
+
+		round := &tourney.Rounds[len(tourney.Rounds)-1]
+		for i, pairing := range round.Pairings {
+			if pairing.LobbyId != nil && *pairing.LobbyId == lobbyId && !pairing.IsFinished() {
+				round.Pairings[i].Forfeited = true
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// seedPlayers orders players by their classic rating, strongest first
+func seedPlayers(ctx context.Context, store Store, players []string) ([]string, error) {
+	pool := RatingPool(Classic, Unlimited)
+	ratings := map[string]float64{}
+	for _, playerId := range players {
+		playerRatings, err := store.GetPlayerRatings(ctx, playerId)
+		if err != nil {
+			return nil, err
+		}
+
+		ratings[playerId] = playerRatings.Get(pool).Glicko.Rating
+	}
+
+	seeded := make([]string, len(players))
+	copy(seeded, players)
+	sort.SliceStable(seeded, func(i, j int) bool {
+		return ratings[seeded[i]] > ratings[seeded[j]]
+	})
+
+	return seeded, nil
+}
+
+func writeTournamentError(w http.ResponseWriter, logger *slog.Logger, err error) {
+	var validationError TournamentValidationError
+	if errors.As(err, &validationError) {
+		WriteError(w, validationError.cause, validationError.message)
+		return
+	}
+
+	logger.Warn("There was an error updating tournament: " + err.Error())
+	WriteError(w, InternalError, "There was an error updating tournament")
+}
+
+func createTournamentHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 || len(name) > 64 {
+		WriteError(w, InvalidRequest, "Missing or invalid 'name' parameter, must be between 1 and 64 characters")
+		return
+	}
+
+	format := tournament.Format(r.URL.Query().Get("format"))
+	if !tournament.IsValidFormat(format) {
+		WriteError(w, InvalidRequest, "Invalid 'format' parameter, must be one of 'ROUND_ROBIN', 'SWISS' or 'KNOCKOUT'")
+		return
+	}
+
+	swissRounds := 0
+	rawRounds := r.URL.Query().Get("rounds")
+	if len(rawRounds) > 0 {
+		if rounds, err := strconv.Atoi(rawRounds); err == nil && rounds > 0 {
+			swissRounds = rounds
+		} else {
+			WriteError(w, InvalidRequest, "Invalid 'rounds' parameter, must be a positive integer")
+			return
+		}
+	}
+
+	tourney := Tournament{
+		TournamentId: NewLobbyId(),
+		Name:         name,
+		Format:       format,
+		OrganizerId:  id,
+		State:        TournamentRegistering,
+		Players:      []string{},
+		SwissRounds:  swissRounds,
+		Rounds:       []tournament.Round{},
+		Standings:    []tournament.Standing{},
+		CreatedAt:    time.Now(),
+	}
+
+	logger = logger.With(slog.String("tournamentId", tourney.TournamentId))
+
+	err := store.CreateTournament(r.Context(), tourney)
+	if err != nil {
+		logger.Warn("There was an error creating the tournament: " + err.Error())
+		WriteError(w, InternalError, "There was an error creating the tournament")
+		return
+	}
+
+	if database := GetDatabaseFromContext(r.Context()); database != nil {
+		err = writeTournamentThroughToDatabase(r.Context(), store, database, logger, tourney)
+		if err != nil {
+			logger.Warn("There was an error writing the tournament to the database: " + err.Error())
+		}
+	}
+
+	logger.Info("Created tournament")
+	WriteJson(w, tourney)
+}
+
+func listTournamentsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	offset, limit, err := ParsePagination(r)
+	if err != nil {
+		WriteError(w, InvalidRequest, err.Error())
+		return
+	}
+
+	page, err := store.ListTournaments(r.Context(), offset, limit)
+	if err != nil {
+		logger.Warn("There was an error fetching tournaments: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching tournaments")
+		return
+	}
+
+	WriteJson(w, page)
+}
+
+func getTournamentHandler(w http.ResponseWriter, r *http.Request) {
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	tournamentId := r.PathValue("tournamentId")
+	tourney, err := store.GetTournament(r.Context(), tournamentId)
+
+	// Finished tournaments are still in the database once the store no longer has them
+	if database := GetDatabaseFromContext(r.Context()); err == nil && tourney == nil && database != nil {
+		tourney, err = database.GetTournament(r.Context(), tournamentId)
+	}
+
+	if err != nil {
+		logger.Warn("There was an error fetching tournament: " + err.Error())
+		WriteError(w, InternalError, "There was an error fetching tournament")
+		return
+	}
+
+	if tourney == nil {
+		WriteError(w, TournamentNotFound, "No tournament with ID "+tournamentId+" found")
+		return
+	}
+
+	WriteJson(w, tourney)
+}
+
+func registerTournamentHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	tourney, err := UpdateTournament(r.Context(), store, logger, r.PathValue("tournamentId"), func(tourney *Tournament) error {
+		if tourney.State != TournamentRegistering {
+			return TournamentValidationError{cause: RegistrationClosed, message: "Registration for the tournament has closed"}
+		}
+
+		for _, playerId := range tourney.Players {
+			if playerId == id {
+				return nil
+			}
+		}
+
+		tourney.Players = append(tourney.Players, id)
+		return nil
+	})
+
+	if err != nil {
+		writeTournamentError(w, logger, err)
+		return
+	}
+
+	WriteJson(w, tourney)
+}
+
+func withdrawTournamentHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	tourney, err := UpdateTournament(r.Context(), store, logger, r.PathValue("tournamentId"), func(tourney *Tournament) error {
+		if tourney.State != TournamentRegistering {
+			return TournamentValidationError{cause: RegistrationClosed, message: "Registration for the tournament has closed"}
+		}
+
+		players := []string{}
+		for _, playerId := range tourney.Players {
+			if playerId != id {
+				players = append(players, playerId)
+			}
+		}
+
+		tourney.Players = players
+		return nil
+	})
+
+	if err != nil {
+		writeTournamentError(w, logger, err)
+		return
+	}
+
+	WriteJson(w, tourney)
+}
+
+func startTournamentHandler(w http.ResponseWriter, r *http.Request) {
+	id := GetIdFromContext(r.Context())
+	logger := GetLoggerFromContext(r.Context())
+	store := GetStoreFromContext(r.Context())
+
+	tourney, err := UpdateTournament(r.Context(), store, logger, r.PathValue("tournamentId"), func(tourney *Tournament) error {
+		if tourney.OrganizerId != id {
+			return TournamentValidationError{cause: NotOrganizer, message: "Only the organizer can start the tournament"}
+		}
+
+		if tourney.State != TournamentRegistering {
+			return TournamentValidationError{cause: AlreadyStarted, message: "The tournament has already started"}
+		}
+
+		if len(tourney.Players) < 2 {
+			return TournamentValidationError{cause: NotEnoughPlayers, message: "At least 2 players must register before the tournament can start"}
+		}
+
+		seeded, err := seedPlayers(r.Context(), store, tourney.Players)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		tourney.Players = seeded
+		tourney.State = TournamentInProgress
+		tourney.StartedAt = &now
+		advanceTournament(tourney)
+
+		return nil
+	})
+
+	if err != nil {
+		writeTournamentError(w, logger, err)
+		return
+	}
+
+	WriteJson(w, tourney)
+}
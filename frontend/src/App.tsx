@@ -3,7 +3,7 @@ import {Button} from '@/components/ui/button.tsx';
 import {Label} from '@/components/ui/label.tsx';
 import {Input} from '@/components/ui/input.tsx';
 import {useMutation} from '@tanstack/react-query';
-import {throwIfNotOk} from '@/utils.ts';
+import {apiFetch, throwIfNotOk} from '@/utils.ts';
 import {Board} from '@/Board.tsx';
 import type {Game} from '@/types.ts';
 import {useWS} from '@/hooks/useWS.ts';
@@ -13,11 +13,19 @@ type AppProps = {
 }
 export function App(props: AppProps) {
 	const [game, setGame] = useState<Game | null>(null);
+	const [maintenance, setMaintenance] = useState(false);
 	const wsStatus = useWS(message => {
-		if (message.Event === 'GAME_UPDATE') {
+		if (message.Event === 'GAME_UPDATE' || message.Event === 'CATCH_UP') {
 			setGame(message.Game);
 		} else if (message.Event === 'OPPONENT_LEFT') {
 			setGame(null);
+		} else if (message.Event === 'LOBBY_EXPIRED') {
+			setGame(null);
+			setPlayerState('MAIN_MENU');
+		} else if (message.Event === 'MAINTENANCE_STARTED') {
+			setMaintenance(true);
+		} else if (message.Event === 'MAINTENANCE_ENDED') {
+			setMaintenance(false);
 		}
 	});
 
@@ -26,7 +34,7 @@ export function App(props: AppProps) {
 
 	const createLobbyMutation = useMutation({
 		mutationFn: () => {
-			return throwIfNotOk(fetch('/api/create-lobby', {
+			return throwIfNotOk(apiFetch('/api/create-lobby', {
 				method: 'POST',
 			}));
 		}
@@ -34,7 +42,7 @@ export function App(props: AppProps) {
 
 	const joinLobbyMutation = useMutation({
 		mutationFn: () => {
-			return throwIfNotOk(fetch(`/api/join-lobby?lobbyId=${lobbyId}`, {
+			return throwIfNotOk(apiFetch(`/api/join-lobby?lobbyId=${lobbyId}`, {
 				method: 'POST',
 			}));
 		}
@@ -52,8 +60,12 @@ export function App(props: AppProps) {
 
 	const makeMoveMutation = useMutation({
 		mutationFn: (opts: { from?: number, to: number }) => {
-			return throwIfNotOk(fetch(`/api/make-move?from=${opts.from ?? -1}&to=${opts.to}`, {
-				method: 'POST'
+			const expectedVersion = game ? `&expectedVersion=${game.Version}` : '';
+
+			return throwIfNotOk(apiFetch(`/api/make-move?from=${opts.from ?? -1}&to=${opts.to}${expectedVersion}`, {
+				method: 'POST',
+				// Lets the request be retried without making the move twice
+				headers: { 'Idempotency-Key': crypto.randomUUID() }
 			}));
 		},
 		onError: () => {
@@ -99,7 +111,7 @@ export function App(props: AppProps) {
 
 	const leaveLobbyMutation = useMutation({
 		mutationFn: () => {
-			return throwIfNotOk(fetch('/api/leave-lobby', {
+			return throwIfNotOk(apiFetch('/api/leave-lobby', {
 				method: 'POST'
 			}))
 		},
@@ -114,6 +126,14 @@ export function App(props: AppProps) {
 		leaveLobbyMutation.mutate();
 	}
 
+	const resignMutation = useMutation({
+		mutationFn: () => {
+			return throwIfNotOk(apiFetch('/api/resign', {
+				method: 'POST'
+			}));
+		}
+	});
+
 	const joinLobbyUrl = () => `${window.location.origin}/join/${lobbyId}`;
 
 	if (wsStatus.state === 'LOADING') {
@@ -128,10 +148,15 @@ export function App(props: AppProps) {
 		return <p>There was an error connecting to the WebSocket server: {JSON.stringify(wsStatus.error)}</p>;
 	}
 
+	const maintenanceBanner = maintenance && (
+		<p className="text-amber-700">The server is under maintenance. Your game will carry on once it is back.</p>
+	);
+
 	if (playerState === 'MAIN_MENU') {
 		return (
 			<div className="flex flex-col items-center justify-center w-full h-full">
 				<div className="flex flex-col gap-8 w-[900px]">
+					{maintenanceBanner}
 					<span className="text-center text-4xl">Rota</span>
 					{createLobbyMutation.isError && <p>{'' + createLobbyMutation.error}</p>}
 					<Button
@@ -159,12 +184,22 @@ export function App(props: AppProps) {
 	} else if (playerState === 'IN_LOBBY') {
 		return (
 			<>
+				{maintenanceBanner}
 				<Button
 					disabled={leaveLobbyMutation.isPending}
 					onClick={handleLeaveLobbyClicked}
 				>
 					Leave game
 				</Button>
+				{game && game.State !== 'GAME_OVER' && (
+					<Button
+						variant="outline"
+						disabled={resignMutation.isPending}
+						onClick={() => resignMutation.mutate()}
+					>
+						Resign
+					</Button>
+				)}
 				{!game && (<p>Waiting for opponent to join. Share this link to have your opponent join: <a href={joinLobbyUrl()}>{joinLobbyUrl()}</a></p>)}
 				{game && (<>
 					<p>This is the {game.State} phase.</p>
@@ -1,32 +1,93 @@
-import {useEffect, useState} from 'react';
-import type {Game} from '@/types.ts';
+import {useEffect, useRef, useState} from 'react';
+import type {Game, PublicProfile} from '@/types.ts';
 
 type LobbyEventMessage = {
-	Event: 'GAME_UPDATE' | 'OPPONENT_LEFT';
-	Game: Game
+	Event: 'GAME_UPDATE' | 'OPPONENT_LEFT' | 'TOURNAMENT_UPDATE' | 'ARENA_UPDATE' | 'CHAT_MESSAGE' | 'CATCH_UP' | 'LOBBY_EXPIRED' | 'MAINTENANCE_STARTED' | 'MAINTENANCE_ENDED' | 'SERVER_RESTARTING';
+	// The ID of the lobby event the message is about, sent back when reconnecting to catch up on anything missed
+	EventId?: string,
+	// Sent back once the message has been handled, so that it isn't sent again after reconnecting
+	DeliveryId: string,
+	Game: Game,
+	Tournament?: unknown,
+	Arena?: unknown,
+	Players?: Array<PublicProfile>,
+	Chat?: { PlayerId: string, Message: string, At: string },
+	Events?: Array<unknown>,
+	// Sent when the server is shutting down, and sent back when reconnecting to carry on from the same place
+	ResumeToken?: string
 }
 
+// How long to wait before reconnecting after the connection drops
+const reconnectDelay = 1000;
+
+// Identifies this tab to the server, which keeps track of the messages each tab has acknowledged
+const getClientId = () => {
+	let clientId = sessionStorage.getItem('clientId');
+	if (!clientId) {
+		clientId = crypto.randomUUID();
+		sessionStorage.setItem('clientId', clientId);
+	}
+
+	return clientId;
+};
+
 export const useWS = (onMessage: (message: LobbyEventMessage) => void) => {
 	const [wsStatus, setWsStatus] = useState<{ state: 'LOADING' | 'CONNECTED' | 'CLOSED' } | {
 		state: 'ERROR',
 		error: any
 	}>({state: 'LOADING'});
+	const lastEventId = useRef<string | null>(null);
+	const resumeToken = useRef<string | null>(null);
 
 	useEffect(() => {
-		const connection = new WebSocket('/ws');
-
-		connection.addEventListener('open', () => setWsStatus({state: 'CONNECTED'}));
-		connection.addEventListener('error', e => setWsStatus({state: 'ERROR', error: e}));
-		connection.addEventListener('message', e => {
-			console.log('Received WS message', e.data, JSON.parse(e.data));
-
-			// setGame(JSON.parse(e.data));
-			onMessage(JSON.parse(e.data));
-		});
-		connection.addEventListener('close', () => {
-			setWsStatus({ state: 'CLOSED' });
-		})
+		let closed = false;
+		let reconnectTimeout: ReturnType<typeof setTimeout> | undefined;
+		let connection: WebSocket;
+
+		const connect = () => {
+			const lastEventIdParam = lastEventId.current ? `&lastEventId=${lastEventId.current}` : '';
+			const resumeTokenParam = resumeToken.current ? `&resumeToken=${resumeToken.current}` : '';
+			const url = `/ws?clientId=${getClientId()}${lastEventIdParam}${resumeTokenParam}`;
+			resumeToken.current = null;
+			connection = new WebSocket(url);
+
+			connection.addEventListener('open', () => setWsStatus({state: 'CONNECTED'}));
+			connection.addEventListener('error', e => setWsStatus({state: 'ERROR', error: e}));
+			connection.addEventListener('message', e => {
+				console.log('Received WS message', e.data, JSON.parse(e.data));
+
+				const message: LobbyEventMessage = JSON.parse(e.data);
+				if (message.EventId) {
+					lastEventId.current = message.EventId;
+				}
+
+				// The server closes the connection straight after, and it is reconnected as usual
+				if (message.ResumeToken) {
+					resumeToken.current = message.ResumeToken;
+				}
+
+				onMessage(message);
+
+				if (message.DeliveryId) {
+					connection.send(JSON.stringify({ Ack: message.DeliveryId }));
+				}
+			});
+			connection.addEventListener('close', () => {
+				if (closed) return;
+
+				// Anything missed while reconnecting is sent as soon as the new connection opens
+				reconnectTimeout = setTimeout(connect, reconnectDelay);
+			});
+		};
+
+		connect();
+
+		return () => {
+			closed = true;
+			clearTimeout(reconnectTimeout);
+			connection.close();
+		};
 	}, []);
 
 	return wsStatus;
-}
\ No newline at end of file
+}
@@ -1,5 +1,20 @@
 export type Game = {
 	State: 'SETUP' | 'PLAYING' | 'GAME_OVER',
 	Turn: 'PLAYER_1' | 'PLAYER_2',
-	Board: Array<'PLAYER_1' | 'PLAYER_2' | 'EMPTY'>
+	Board: Array<'PLAYER_1' | 'PLAYER_2' | 'EMPTY'>,
+	Variant: 'CLASSIC',
+	TimeControl: 'UNLIMITED',
+	Id: string,
+	Version: number,
+	Moves: Array<{ Player: 'PLAYER_1' | 'PLAYER_2', From: number | null, To: number, At: string }>,
+	StartedAt: string,
+	EndedAt: string | null
+}
+
+export type PublicProfile = {
+	PlayerId: string,
+	DisplayName: string,
+	Avatar: string,
+	Country: string,
+	Bio: string
 }
\ No newline at end of file
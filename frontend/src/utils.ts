@@ -1,10 +1,38 @@
+// The body of every unsuccessful response from the server
+export type ApiErrorBody = {
+	Code: string,
+	Message: string,
+	Status: number,
+	Details?: Record<string, unknown>
+}
+
+export class ApiError extends Error {
+	readonly code: string;
+	readonly status: number;
+	readonly details?: Record<string, unknown>;
+
+	constructor(body: ApiErrorBody) {
+		super(body.Message);
+		this.code = body.Code;
+		this.status = body.Status;
+		this.details = body.Details;
+	}
+}
+
 export function throwIfNotOk(fetchCall: Promise<Response>) {
 	return fetchCall
 		.then((response) => {
 			return response.text()
 				.then(text => {
 					if (!response.ok) {
-						throw new Error(text);
+						let body: ApiErrorBody;
+						try {
+							body = JSON.parse(text);
+						} catch {
+							body = {Code: 'INTERNAL_ERROR', Message: text, Status: response.status};
+						}
+
+						throw new ApiError(body);
 					}
 
 					return text;
@@ -12,4 +40,22 @@ export function throwIfNotOk(fetchCall: Promise<Response>) {
 		});
 }
 
+function getCookie(name: string) {
+	return document.cookie
+		.split('; ')
+		.find(cookie => cookie.startsWith(`${name}=`))
+		?.substring(name.length + 1);
+}
+
+// Sends the CSRF token issued by the server along with the request, which is required for anything other than GET
+export function apiFetch(input: string, init: RequestInit = {}) {
+	const headers = new Headers(init.headers);
+	const csrfToken = getCookie('csrf_token');
+	if (csrfToken) {
+		headers.set('X-CSRF-Token', csrfToken);
+	}
+
+	return fetch(input, {...init, headers});
+}
+
 export const api = (str: string) => import.meta.env.VITE_SERVER_URL ?? `http://localhost:8080${str}`;
\ No newline at end of file